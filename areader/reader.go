@@ -18,12 +18,14 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/handlers"
@@ -31,21 +33,82 @@ import (
 )
 
 type SignatureVerifyFn func(message, sig []byte) error
+type SignatureChainVerifyFn func(message, sig, chain []byte) error
+type TimestampVerifyFn func(sig, token []byte) (time.Time, error)
 type DevicesCompatibleFn func([]string) error
+type SecurityVersionFn func(version uint64) error
 type ScriptsReadFn func(io.Reader, os.FileInfo) error
 
+// UpdateSelectFn decides if the update targeted at the given device types
+// is installed; the device types are nil for the updates installed on all
+// the devices compatible with the artifact.
+type UpdateSelectFn func(updateType string, deviceTypes []string) bool
+
+// SelectDeviceType selects the updates targeted at the given device type
+// and the ones installed on all the compatible devices.
+func SelectDeviceType(deviceType string) UpdateSelectFn {
+	return func(updateType string, deviceTypes []string) bool {
+		if deviceTypes == nil {
+			return true
+		}
+		for _, d := range deviceTypes {
+			if d == deviceType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 type Reader struct {
 	CompatibleDevicesCallback DevicesCompatibleFn
 	ScriptsReadCallback       ScriptsReadFn
 	VerifySignatureCallback   SignatureVerifyFn
-	IsSigned                  bool
+	// SecurityVersionCallback receives the security version of the
+	// artifact, allowing the device to refuse downgrades. The version is
+	// protected by the signature, but as the header checksum is verified
+	// only after the whole header is read the stored minimum version must
+	// not be updated before the artifact is successfully read.
+	SecurityVersionCallback SecurityVersionFn
+	// VerifyChainCallback is used for verifying the signature of the
+	// artifacts containing the certificate chain of the signer.
+	VerifyChainCallback SignatureChainVerifyFn
+	// VerifyTimestampCallback is used for verifying the timestamp token
+	// of the signature; it returns the time the signature was created at.
+	VerifyTimestampCallback TimestampVerifyFn
+	// Decrypter is used for decrypting the data files of the encrypted
+	// artifacts. Reading the encrypted artifact fails if not set, unless
+	// VerifyOnly is set.
+	Decrypter artifact.Decrypter
+	// VerifyOnly allows reading the encrypted artifacts with no Decrypter
+	// set; the checksums of the encrypted data files are verified, but the
+	// files are not passed to the installers. It must be set only if the
+	// artifact is inspected or validated, but not installed.
+	VerifyOnly bool
+	// ModuleHandler creates the installer of the update types with no
+	// registered handler; e.g. handlers.ModuleInstallers running the
+	// external update modules. If not set or nil is returned, the updates
+	// of such types are only read.
+	ModuleHandler func(updateType string) handlers.Installer
+	// UpdateSelectCallback selects the updates of multi-target artifacts
+	// to install; the updates not selected are read and verified, but not
+	// passed to their installers.
+	UpdateSelectCallback UpdateSelectFn
+	// Now returns the time the validity of the artifact is checked at;
+	// if not set the current time is used.
+	Now      func() time.Time
+	IsSigned bool
 
 	shouldBeSigned bool
+	signedAt       time.Time
+	dataKey        []byte
 	hInfo          *artifact.HeaderInfo
 	info           *artifact.Info
 	r              io.Reader
 	handlers       map[string]handlers.Installer
 	installers     map[int]handlers.Installer
+	typeInfo       map[int]*artifact.TypeInfo
+	skipped        map[int]bool
 }
 
 func NewReader(r io.Reader) *Reader {
@@ -53,6 +116,8 @@ func NewReader(r io.Reader) *Reader {
 		r:          r,
 		handlers:   make(map[string]handlers.Installer, 1),
 		installers: make(map[int]handlers.Installer, 1),
+		typeInfo:   make(map[int]*artifact.TypeInfo, 1),
+		skipped:    make(map[int]bool),
 	}
 }
 
@@ -62,6 +127,8 @@ func NewReaderSigned(r io.Reader) *Reader {
 		shouldBeSigned: true,
 		handlers:       make(map[string]handlers.Installer, 1),
 		installers:     make(map[int]handlers.Installer, 1),
+		typeInfo:       make(map[int]*artifact.TypeInfo, 1),
+		skipped:        make(map[int]bool),
 	}
 }
 
@@ -144,6 +211,7 @@ func (ar *Reader) readHeader(tReader io.Reader, headerSum []byte) error {
 	if err = ar.readHeaderUpdate(tr, &hdr); err != nil {
 		return err
 	}
+	ar.selectUpdates()
 
 	// Check if header checksum is correct.
 	if cr, ok := r.(*artifact.Checksum); ok {
@@ -152,6 +220,23 @@ func (ar *Reader) readHeader(tReader io.Reader, headerSum []byte) error {
 		}
 	}
 
+	// refuse installing stale artifacts or the ones not released yet; the
+	// validity window and the security version can be trusted only after
+	// the checksum is verified
+	now := time.Now()
+	if ar.Now != nil {
+		now = ar.Now()
+	}
+	if err = hInfo.Validity.Check(now); err != nil {
+		return errors.Wrap(err, "reader")
+	}
+
+	if ar.SecurityVersionCallback != nil {
+		if err = ar.SecurityVersionCallback(hInfo.SecurityVersion); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -215,22 +300,41 @@ func readManifest(tReader *tar.Reader) (*artifact.ChecksumStore, error) {
 	return manifest, nil
 }
 
-func signatureReadAndVerify(tReader *tar.Reader, message []byte,
-	verify SignatureVerifyFn, signed bool) error {
-	// verify signature
-	if verify == nil && signed {
+func readSignature(tReader *tar.Reader, name string) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, tReader); err != nil {
+		return nil, errors.Wrapf(err, "reader: can not read %s file", name)
+	}
+	return buf.Bytes(), nil
+}
+
+func (ar *Reader) verifySignature(message, sig, chain []byte) error {
+	var err error
+	switch {
+	case chain != nil && ar.VerifyChainCallback != nil:
+		err = ar.VerifyChainCallback(message, sig, chain)
+	case ar.VerifySignatureCallback != nil:
+		err = ar.VerifySignatureCallback(message, sig)
+	case ar.shouldBeSigned:
 		return errors.New("reader: verify signature callback not registered")
-	} else if verify != nil {
-		// first read signature...
-		sig := bytes.NewBuffer(nil)
-		if _, err := io.Copy(sig, tReader); err != nil {
-			return errors.Wrapf(err, "reader: can not read signature file")
-		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reader: invalid signature")
+	}
+	return nil
+}
 
-		if err := verify(message, sig.Bytes()); err != nil {
-			return errors.Wrap(err, "reader: invalid signature")
-		}
+func (ar *Reader) verifyTimestamp(sig, token []byte) error {
+	if ar.VerifyTimestampCallback == nil {
+		return nil
+	}
+	t, err := ar.VerifyTimestampCallback(sig, token)
+	if err != nil {
+		return errors.Wrap(err, "reader: invalid timestamp")
 	}
+	ar.signedAt = t
 	return nil
 }
 
@@ -270,9 +374,43 @@ func (ar *Reader) readHeaderV2(tReader *tar.Reader,
 	switch hdr.FileInfo().Name() {
 	case "manifest.sig":
 		ar.IsSigned = true
-		// firs read and verify signature
-		if err = signatureReadAndVerify(tReader, manifest.GetRaw(),
-			ar.VerifySignatureCallback, ar.shouldBeSigned); err != nil {
+		// firs read signature...
+		sig, err := readSignature(tReader, "signature")
+		if err != nil {
+			return nil, err
+		}
+		hdr, err = getNext(tReader)
+		if err != nil {
+			return nil, errors.New("reader: error reading header")
+		}
+
+		// ...and the optional certificate chain of the signer
+		var chain []byte
+		if hdr.FileInfo().Name() == "manifest.crt" {
+			if chain, err = readSignature(tReader, "certificates"); err != nil {
+				return nil, err
+			}
+			if hdr, err = getNext(tReader); err != nil {
+				return nil, errors.New("reader: error reading header")
+			}
+		}
+
+		// ...and the optional timestamp of the signature, which is verified
+		// first so that the signing time is known while verifying signature
+		if hdr.FileInfo().Name() == "manifest.tsr" {
+			token, err := readSignature(tReader, "timestamp")
+			if err != nil {
+				return nil, err
+			}
+			if err = ar.verifyTimestamp(sig, token); err != nil {
+				return nil, err
+			}
+			if hdr, err = getNext(tReader); err != nil {
+				return nil, errors.New("reader: error reading header")
+			}
+		}
+
+		if err = ar.verifySignature(manifest.GetRaw(), sig, chain); err != nil {
 			return nil, err
 		}
 		// verify checksums of version
@@ -281,10 +419,6 @@ func (ar *Reader) readHeaderV2(tReader *tar.Reader,
 		}
 
 		// ...and then header
-		hdr, err = getNext(tReader)
-		if err != nil {
-			return nil, errors.New("reader: error reading header")
-		}
 		if !strings.HasPrefix(hdr.Name, "header.tar.gz") {
 			return nil, errors.Errorf("reader: invalid header element: %v", hdr.Name)
 		}
@@ -337,9 +471,50 @@ func (ar *Reader) ReadArtifact() error {
 	default:
 		return errors.Errorf("reader: unsupported version: %d", ver.Version)
 	}
+	if err = ar.verifyProvenance(s); err != nil {
+		return err
+	}
+	if err = ar.unwrapDataKey(); err != nil {
+		return err
+	}
 	return ar.readData(tReader, s)
 }
 
+// verifyProvenance checks if the provenance is issued for the data files
+// of the artifact.
+func (ar *Reader) verifyProvenance(manifest *artifact.ChecksumStore) error {
+	prov := ar.hInfo.Provenance
+	if prov == nil {
+		return nil
+	}
+	if manifest == nil {
+		return errors.New("reader: provenance is not supported by version 1 artifacts")
+	}
+	return errors.Wrap(prov.Verify(manifest), "reader")
+}
+
+func (ar *Reader) unwrapDataKey() error {
+	enc := ar.hInfo.Encryption
+	if enc == nil {
+		return nil
+	}
+	if ar.Decrypter == nil {
+		if ar.VerifyOnly {
+			return nil
+		}
+		return errors.New("reader: artifact is encrypted, but no decryption key is set")
+	}
+	if ar.info.Version < 2 {
+		return errors.New("reader: encryption is not supported by version 1 artifacts")
+	}
+	key, err := ar.Decrypter.UnwrapKey(enc.Keys)
+	if err != nil {
+		return errors.Wrap(err, "reader: can not decrypt artifact")
+	}
+	ar.dataKey = key
+	return nil
+}
+
 func (ar *Reader) GetCompatibleDevices() []string {
 	return ar.hInfo.CompatibleDevices
 }
@@ -352,6 +527,37 @@ func (ar *Reader) GetInfo() artifact.Info {
 	return *ar.info
 }
 
+// GetEncryption returns the encryption parameters of the artifact or nil
+// if the data files are not encrypted.
+func (ar *Reader) GetEncryption() *artifact.Encryption {
+	return ar.hInfo.Encryption
+}
+
+// GetValidity returns the time window the artifact can be installed in or
+// nil if the artifact has no validity set.
+func (ar *Reader) GetValidity() *artifact.Validity {
+	return ar.hInfo.Validity
+}
+
+// GetProvenance returns the build provenance of the artifact or nil if
+// there is none. The provenance is verified against the manifest.
+func (ar *Reader) GetProvenance() *artifact.Provenance {
+	return ar.hInfo.Provenance
+}
+
+// GetSecurityVersion returns the anti-rollback security version of the
+// artifact; zero if not set.
+func (ar *Reader) GetSecurityVersion() uint64 {
+	return ar.hInfo.SecurityVersion
+}
+
+// GetSigningTime returns the time the artifact was signed at as proven by
+// the verified timestamp; zero if there is no timestamp or it was not
+// verified.
+func (ar *Reader) GetSigningTime() time.Time {
+	return ar.signedAt
+}
+
 func (ar *Reader) setInstallers(upd []artifact.UpdateType) error {
 	for i, update := range upd {
 		// set installer for given update type
@@ -359,6 +565,12 @@ func (ar *Reader) setInstallers(upd []artifact.UpdateType) error {
 			ar.installers[i] = w.Copy()
 			continue
 		}
+		if ar.ModuleHandler != nil {
+			if m := ar.ModuleHandler(update.Type); m != nil {
+				ar.installers[i] = m
+				continue
+			}
+		}
 		// if nothing else worked set generic installer for given update
 		ar.installers[i] = handlers.NewGeneric(update.Type)
 	}
@@ -391,7 +603,25 @@ func (ar *Reader) readHeaderUpdate(tr *tar.Reader, hdr *tar.Header) error {
 		if !ok {
 			return errors.Errorf("reader: can not find parser for update: %v", hdr.Name)
 		}
-		if hErr := inst.ReadHeader(tr, hdr.Name); hErr != nil {
+		var r io.Reader = tr
+		if filepath.Base(hdr.Name) == "type-info" {
+			// the device types the update is targeted at are needed
+			// for selecting the updates
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return errors.Wrap(err, "reader: can not read type-info")
+			}
+			tInfo := new(artifact.TypeInfo)
+			if err = json.Unmarshal(data, tInfo); err != nil {
+				return errors.Wrap(err, "reader: can not parse type-info")
+			}
+			if err = tInfo.Validate(); err != nil {
+				return errors.Wrap(err, "reader: invalid type-info")
+			}
+			ar.typeInfo[updNo] = tInfo
+			r = bytes.NewReader(data)
+		}
+		if hErr := inst.ReadHeader(r, hdr.Name); hErr != nil {
 			return errors.Wrap(hErr, "reader: can not read header")
 		}
 
@@ -405,6 +635,45 @@ func (ar *Reader) readHeaderUpdate(tr *tar.Reader, hdr *tar.Header) error {
 	}
 }
 
+// skippedUpdate consumes the data of the update not selected for installing;
+// the data is still verified by the reader.
+type skippedUpdate struct {
+	handlers.Installer
+}
+
+func (s skippedUpdate) Install(r io.Reader, info *os.FileInfo) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (ar *Reader) selectUpdates() {
+	if ar.UpdateSelectCallback == nil {
+		return
+	}
+	for no, inst := range ar.installers {
+		if !ar.UpdateSelectCallback(inst.GetType(), ar.GetUpdateDeviceTypes(no)) {
+			ar.installers[no] = skippedUpdate{inst}
+			ar.skipped[no] = true
+		}
+	}
+}
+
+// GetUpdateDeviceTypes returns the types of the devices the update is
+// targeted at; nil if it is installed on all the devices compatible with
+// the artifact.
+func (ar *Reader) GetUpdateDeviceTypes(no int) []string {
+	if tInfo, ok := ar.typeInfo[no]; ok {
+		return tInfo.DeviceTypes()
+	}
+	return nil
+}
+
+// IsSkipped reports if the update was not selected for installing by
+// UpdateSelectCallback.
+func (ar *Reader) IsSkipped(no int) bool {
+	return ar.skipped[no]
+}
+
 func (ar *Reader) readNextDataFile(tr *tar.Reader,
 	manifest *artifact.ChecksumStore) error {
 	hdr, err := getNext(tr)
@@ -425,9 +694,43 @@ func (ar *Reader) readNextDataFile(tr *tar.Reader,
 		return errors.Wrapf(err,
 			"reader: can not find parser for parsing data file [%v]", hdr.Name)
 	}
+	if ar.hInfo.Encryption != nil {
+		return ar.readEncrypted(tr, hdr.Name, inst, manifest, updNo)
+	}
 	return readAndInstall(tr, inst, manifest, updNo)
 }
 
+// readEncrypted verifies the checksum of the encrypted data file and, if the
+// data key is known, installs the decrypted content. The data key is not
+// known only if the artifact is read with VerifyOnly set.
+func (ar *Reader) readEncrypted(r io.Reader, name string, inst handlers.Installer,
+	manifest *artifact.ChecksumStore, no int) error {
+	sum, err := manifest.Get(name)
+	if err != nil {
+		return errors.Wrap(err, "reader: checksum missing")
+	}
+	ch := artifact.NewReaderChecksum(r, sum)
+
+	if ar.dataKey != nil {
+		dr, err := artifact.NewDecryptReader(ch, ar.dataKey, name,
+			ar.hInfo.Encryption.ChunkSize)
+		if err != nil {
+			return errors.Wrap(err, "reader: can not decrypt data")
+		}
+		if err = readAndInstall(dr, inst, manifest, no); err != nil {
+			return err
+		}
+		// make sure all the chunks are authenticated
+		if _, err = io.Copy(ioutil.Discard, dr); err != nil {
+			return errors.Wrap(err, "reader: error reading data")
+		}
+	}
+	if _, err = io.Copy(ioutil.Discard, ch); err != nil {
+		return errors.Wrap(err, "reader: error reading data")
+	}
+	return nil
+}
+
 func (ar *Reader) readData(tr *tar.Reader, manifest *artifact.ChecksumStore) error {
 	for {
 		err := ar.readNextDataFile(tr, manifest)
@@ -488,17 +791,32 @@ func readAndInstall(r io.Reader, i handlers.Installer,
 
 	tar := tar.NewReader(gz)
 
+	// once installing a data file has started, the installer is aborted on
+	// any failure, as it may hold resources or a partial installation
+	var started *handlers.DataFile
+	abort := func(err error) error {
+		if started == nil {
+			return err
+		}
+		if a, ok := i.(handlers.Aborter); ok {
+			if aerr := a.Abort(started, err); aerr != nil {
+				return &abortError{cause: err, abort: aerr}
+			}
+		}
+		return err
+	}
+
 	for {
 		hdr, err := tar.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return errors.Wrap(err, "update: error reading update file header")
+			return abort(errors.Wrap(err, "update: error reading update file header"))
 		}
 
 		df := getDataFile(i, hdr.Name)
 		if df == nil {
-			return errors.Errorf("update: can not find data file: %s", hdr.Name)
+			return abort(errors.Errorf("update: can not find data file: %s", hdr.Name))
 		}
 
 		// fill in needed data
@@ -514,22 +832,59 @@ func readAndInstall(r io.Reader, i handlers.Installer,
 			df.Checksum, err = manifest.Get(filepath.Join(artifact.UpdatePath(no),
 				hdr.FileInfo().Name()))
 			if err != nil {
-				return errors.Wrapf(err, "update: checksum missing")
+				return abort(errors.Wrapf(err, "update: checksum missing"))
 			}
 		}
 		if df.Checksum == nil {
-			return errors.Errorf("update: checksum missing for file: %s", hdr.Name)
+			return abort(errors.Errorf("update: checksum missing for file: %s", hdr.Name))
 		}
 
-		// check checksum
-		ch := artifact.NewReaderChecksum(tar, df.Checksum)
-
-		if err = i.Install(ch, &info); err != nil {
-			return errors.Wrapf(err, "update: can not install update: %v", hdr)
+		started = df
+		if p, ok := i.(handlers.Preparer); ok {
+			if err = p.Prepare(df); err != nil {
+				return abort(errors.Wrapf(err, "update: can not prepare update: %v", hdr))
+			}
+		}
+		if err = installDataFile(tar, i, df, &info); err != nil {
+			return abort(err)
 		}
+	}
+	return nil
+}
 
-		if err = ch.Verify(); err != nil {
-			return errors.Wrap(err, "reader: error reading data")
+// abortError is returned if aborting the installation fails; the error
+// which caused the abort stays the primary one.
+type abortError struct {
+	cause error
+	abort error
+}
+
+func (e *abortError) Error() string {
+	return e.cause.Error() + "; update: can not abort update: " + e.abort.Error()
+}
+
+func (e *abortError) Cause() error {
+	return e.cause
+}
+
+// installDataFile installs the data file and finalizes the installation
+// once the checksum of the data is verified.
+func installDataFile(r io.Reader, i handlers.Installer, df *handlers.DataFile,
+	info *os.FileInfo) error {
+	// check checksum
+	ch := artifact.NewReaderChecksum(r, df.Checksum)
+
+	if err := i.Install(ch, info); err != nil {
+		return errors.Wrapf(err, "update: can not install update: %s", df.Name)
+	}
+
+	if err := ch.Verify(); err != nil {
+		return errors.Wrap(err, "reader: error reading data")
+	}
+
+	if f, ok := i.(handlers.Finalizer); ok {
+		if err := f.Finalize(df); err != nil {
+			return errors.Wrapf(err, "update: can not finalize update: %s", df.Name)
 		}
 	}
 	return nil
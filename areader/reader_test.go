@@ -18,16 +18,22 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -122,6 +128,9 @@ func TestReadArtifact(t *testing.T) {
 	rfh := handlers.NewRootfsInstaller()
 	rfh.InstallHandler = copy
 
+	kr, err := artifact.NewKeyRing([]byte(PublicKey))
+	assert.NoError(t, err)
+
 	tc := []struct {
 		version   int
 		signed    bool
@@ -136,6 +145,10 @@ func TestReadArtifact(t *testing.T) {
 			errors.New("reader: invalid signature: crypto/rsa: verification error")},
 		// // test that we do not need a verifier for signed artifact
 		{2, true, rfh, nil, nil},
+		{2, true, rfh, artifact.NewThresholdVerifier(kr, 1), nil},
+		{2, true, rfh, artifact.NewThresholdVerifier(kr, 2),
+			errors.New("reader: invalid signature: signer: not enough valid " +
+				"signatures; required: 2; valid: 1")},
 	}
 
 	// first create archive, that we will be able to read
@@ -175,6 +188,620 @@ func TestReadArtifact(t *testing.T) {
 	}
 }
 
+func TestReadSignedWithCertificates(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	s := artifact.NewCertificateSigner([]byte(PrivateKey), []byte("certificates"))
+	aw := awriter.NewWriterSigned(art, s)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+	raw := art.Bytes()
+
+	// certificates are passed to the chain verification callback
+	var chain []byte
+	aReader := NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifyChainCallback = func(message, sig, c []byte) error {
+		chain = c
+		return artifact.NewVerifier([]byte(PublicKey)).Verify(message, sig)
+	}
+	assert.NoError(t, aReader.ReadArtifact())
+	assert.Equal(t, []byte("certificates"), chain)
+
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifyChainCallback = func(message, sig, c []byte) error {
+		return errors.New("untrusted chain")
+	}
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "reader: invalid signature: untrusted chain")
+
+	// the signature can still be verified using the key only
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	assert.NoError(t, aReader.ReadArtifact())
+}
+
+func TestReadLifecycle(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+
+	var events []string
+	read := func(raw []byte, prepareErr, installErr, abortErr error) error {
+		events = nil
+		rootfs := handlers.NewRootfsInstaller()
+		rootfs.PrepareHandler = func(df *handlers.DataFile) error {
+			events = append(events, "prepare")
+			assert.Equal(t, int64(len(TestUpdateFileContent)), df.Size)
+			return prepareErr
+		}
+		rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+			events = append(events, "install")
+			_, err := io.Copy(ioutil.Discard, r)
+			if installErr != nil {
+				return installErr
+			}
+			return err
+		}
+		rootfs.FinalizeHandler = func(df *handlers.DataFile) error {
+			events = append(events, "finalize")
+			return nil
+		}
+		rootfs.AbortHandler = func(df *handlers.DataFile, cause error) error {
+			events = append(events, "abort")
+			assert.Error(t, cause)
+			return abortErr
+		}
+		aReader := NewReader(bytes.NewReader(raw))
+		require.NoError(t, aReader.RegisterHandler(rootfs))
+		return aReader.ReadArtifact()
+	}
+
+	assert.NoError(t, read(art.Bytes(), nil, nil, nil))
+	assert.Equal(t, []string{"prepare", "install", "finalize"}, events)
+
+	assert.Error(t, read(art.Bytes(), errors.New("no space"), nil, nil))
+	assert.Equal(t, []string{"prepare", "abort"}, events)
+
+	assert.Error(t, read(art.Bytes(), nil, errors.New("write error"), nil))
+	assert.Equal(t, []string{"prepare", "install", "abort"}, events)
+
+	// the error which caused the abort stays the primary one
+	installErr := errors.New("write error")
+	err = read(art.Bytes(), nil, installErr, errors.New("rollback error"))
+	assert.Equal(t, installErr, errors.Cause(err))
+	assert.Contains(t, err.Error(), "write error; update: can not abort update: "+
+		"rollback error")
+	assert.Equal(t, []string{"prepare", "install", "abort"}, events)
+
+	// the checksum fails after all the data is installed
+	sum := sha256.Sum256([]byte(TestUpdateFileContent))
+	hexSum := hex.EncodeToString(sum[:])
+	raw := bytes.Replace(art.Bytes(), []byte(hexSum),
+		bytes.Repeat([]byte("0"), len(hexSum)), 1)
+	require.NotEqual(t, art.Bytes(), raw)
+	assert.Error(t, read(raw, nil, nil, nil))
+	assert.Equal(t, []string{"prepare", "install", "abort"}, events)
+}
+
+func TestReadAndInstallAbort(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	require.NoError(t, err)
+	defer os.Remove(upd)
+
+	// the data file is followed by a corrupted tar header
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: upd, Mode: 0600,
+		Size: int64(len(TestUpdateFileContent))}))
+	_, err = tw.Write([]byte(TestUpdateFileContent))
+	require.NoError(t, err)
+	require.NoError(t, tw.Flush())
+	_, err = gz.Write(bytes.Repeat([]byte("corrupted"), 128))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	var events []string
+	rootfs := handlers.NewRootfsV2(upd)
+	sum := sha256.Sum256([]byte(TestUpdateFileContent))
+	rootfs.GetUpdateFiles()[0].Checksum = []byte(hex.EncodeToString(sum[:]))
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	rootfs.FinalizeHandler = func(df *handlers.DataFile) error {
+		events = append(events, "finalize")
+		return nil
+	}
+	rootfs.AbortHandler = func(df *handlers.DataFile, cause error) error {
+		events = append(events, "abort")
+		assert.Equal(t, upd, df.Name)
+		return nil
+	}
+	err = readAndInstall(buf, rootfs, nil, 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "update: error reading update file header")
+	assert.Equal(t, []string{"finalize", "abort"}, events)
+}
+
+func TestReadMultiTarget(t *testing.T) {
+	var updates []handlers.Composer
+	for _, data := range []string{"gateway", "sensor-a", "sensor-b"} {
+		upd, err := MakeFakeUpdate(data)
+		require.NoError(t, err)
+		defer os.Remove(upd)
+		updates = append(updates, handlers.NewRootfsV2(upd))
+	}
+	updates[1] = handlers.NewTargeted(updates[1], []string{"sensor-a"})
+	updates[2] = handlers.NewTargeted(updates[2], []string{"sensor-b", "sensor-c"})
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	err := aw.WriteArtifact("mender", 2, []string{"gateway"},
+		"mender-1.1", &awriter.Updates{U: updates}, nil)
+	require.NoError(t, err)
+
+	read := func(selectFn UpdateSelectFn) (*Reader, []string) {
+		var installed []string
+		rootfs := handlers.NewRootfsInstaller()
+		rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+			data, err := ioutil.ReadAll(r)
+			installed = append(installed, string(data))
+			return err
+		}
+		aReader := NewReader(bytes.NewReader(art.Bytes()))
+		aReader.UpdateSelectCallback = selectFn
+		require.NoError(t, aReader.RegisterHandler(rootfs))
+		require.NoError(t, aReader.ReadArtifact())
+		return aReader, installed
+	}
+
+	aReader, installed := read(nil)
+	assert.Equal(t, []string{"gateway", "sensor-a", "sensor-b"}, installed)
+	assert.Nil(t, aReader.GetUpdateDeviceTypes(0))
+	assert.Equal(t, []string{"sensor-a"}, aReader.GetUpdateDeviceTypes(1))
+	assert.Equal(t, []string{"sensor-b", "sensor-c"}, aReader.GetUpdateDeviceTypes(2))
+
+	aReader, installed = read(SelectDeviceType("sensor-c"))
+	assert.Equal(t, []string{"gateway", "sensor-b"}, installed)
+	assert.False(t, aReader.IsSkipped(0))
+	assert.True(t, aReader.IsSkipped(1))
+	assert.False(t, aReader.IsSkipped(2))
+
+	// only the updates targeted at the sensors
+	_, installed = read(func(updateType string, deviceTypes []string) bool {
+		assert.Equal(t, "rootfs-image", updateType)
+		return deviceTypes != nil
+	})
+	assert.Equal(t, []string{"sensor-a", "sensor-b"}, installed)
+
+	// the malformed device types are not ignored
+	for _, typeInfo := range []string{
+		`{"type":"rootfs-image","artifact_depends":{"device_type":"sensor-a"}}`,
+		`{"type":"rootfs-image","artifact_depends":{"device_type":[]}}`,
+		`{"type":"rootfs-image"`,
+	} {
+		upd, err := MakeFakeUpdate("sensor")
+		require.NoError(t, err)
+		defer os.Remove(upd)
+		art := bytes.NewBuffer(nil)
+		err = awriter.NewWriter(art).WriteArtifact("mender", 2, []string{"gateway"},
+			"mender-1.1", &awriter.Updates{U: []handlers.Composer{
+				typeInfoComposer{handlers.NewRootfsV2(upd), typeInfo}}}, nil)
+		require.NoError(t, err)
+
+		aReader := NewReader(art)
+		aReader.UpdateSelectCallback = SelectDeviceType("sensor-b")
+		require.NoError(t, aReader.RegisterHandler(handlers.NewRootfsInstaller()))
+		assert.Error(t, aReader.ReadArtifact(), typeInfo)
+	}
+}
+
+// typeInfoComposer replaces the type-info of the composed update.
+type typeInfoComposer struct {
+	handlers.Composer
+	typeInfo string
+}
+
+func (c typeInfoComposer) ComposeHeader(tw *tar.Writer, no int) error {
+	buf := bytes.NewBuffer(nil)
+	htw := tar.NewWriter(buf)
+	if err := c.Composer.ComposeHeader(htw, no); err != nil {
+		return err
+	}
+	if err := htw.Close(); err != nil {
+		return err
+	}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if filepath.Base(hdr.Name) == "type-info" {
+			data = []byte(c.typeInfo)
+			hdr.Size = int64(len(data))
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = tw.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func TestReadEncrypted(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	enc, err := artifact.NewEncrypter([]byte(PublicKey))
+	assert.NoError(t, err)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriterSigned(art, artifact.NewSigner([]byte(PrivateKey)))
+	aw.SetEncrypter(enc)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+	raw := art.Bytes()
+	assert.NotContains(t, string(raw), TestUpdateFileContent)
+
+	installed := bytes.NewBuffer(nil)
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		_, err := io.Copy(installed, r)
+		return err
+	}
+
+	// the artifact can not be installed without the data key
+	aReader := NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	assert.NoError(t, aReader.RegisterHandler(rootfs))
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no decryption key")
+	assert.Equal(t, 0, installed.Len())
+
+	// the signature is verified without decrypting the data
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	aReader.VerifyOnly = true
+	assert.NoError(t, aReader.RegisterHandler(rootfs))
+	assert.NoError(t, aReader.ReadArtifact())
+	assert.Equal(t, 0, installed.Len())
+	assert.NotNil(t, aReader.GetEncryption())
+
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	aReader.Decrypter = artifact.NewDecrypter([]byte(PrivateKey))
+	assert.NoError(t, aReader.RegisterHandler(rootfs))
+	assert.NoError(t, aReader.ReadArtifact())
+	assert.Equal(t, TestUpdateFileContent, installed.String())
+
+	// modified encrypted data is detected even without the data key
+	mod := bytes.NewBuffer(nil)
+	tr := tar.NewReader(bytes.NewReader(raw))
+	tw := tar.NewWriter(mod)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		if hdr.Name == "data/0000.tar.gz" {
+			data[len(data)-1] ^= 0xff
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	aReader = NewReader(mod)
+	aReader.VerifyOnly = true
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid checksum")
+
+	// not encrypted for the key
+	aReader = NewReader(bytes.NewReader(raw))
+	aReader.Decrypter = artifact.NewDecrypter([]byte(PublicKeyError))
+	assert.Error(t, aReader.ReadArtifact())
+}
+
+func TestReadValidity(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	start := time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(30 * 24 * time.Hour)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriterSigned(art, artifact.NewSigner([]byte(PrivateKey)))
+	aw.SetValidity(&artifact.Validity{NotBefore: &start, NotAfter: &end})
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+	raw := art.Bytes()
+
+	for _, tc := range []struct {
+		now     time.Time
+		expired bool
+		valid   bool
+	}{
+		{start.Add(time.Hour), false, true},
+		{start.Add(-time.Hour), false, false},
+		{end.Add(time.Hour), true, false},
+	} {
+		aReader := NewReaderSigned(bytes.NewReader(raw))
+		aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+		aReader.Now = func() time.Time { return tc.now }
+		err = aReader.ReadArtifact()
+		if tc.valid {
+			assert.NoError(t, err)
+			assert.Equal(t, end, *aReader.GetValidity().NotAfter)
+			continue
+		}
+		verr, ok := errors.Cause(err).(*artifact.ValidityError)
+		if assert.True(t, ok, "unexpected error: %v", err) {
+			assert.Equal(t, tc.expired, verr.Expired())
+		}
+	}
+
+	// the window is checked only once the header is known to be authentic
+	dir, err := ioutil.TempDir("", "scripts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	expired := bytes.NewBuffer(nil)
+	aw = awriter.NewWriter(expired)
+	aw.SetValidity(&artifact.Validity{NotBefore: &start, NotAfter: &start})
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, largeScripts(t, dir))
+	assert.NoError(t, err)
+	aReader := NewReaderSigned(bytes.NewReader(replaceHeader(t, raw, expired.Bytes())))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	aReader.Now = func() time.Time { return start.Add(time.Hour) }
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid checksum")
+
+	// the window can not be empty
+	aw = awriter.NewWriter(ioutil.Discard)
+	aw.SetValidity(&artifact.Validity{NotBefore: &end, NotAfter: &start})
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.Error(t, err)
+}
+
+// largeScripts creates the state script in the directory; the script makes
+// the header large enough not to be read at once while opening it, so that
+// the header is processed before its checksum is known.
+func largeScripts(t *testing.T, dir string) *artifact.Scripts {
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	script := filepath.Join(dir, "ArtifactInstall_Enter_10")
+	require.NoError(t, ioutil.WriteFile(script, content, 0755))
+	scr := new(artifact.Scripts)
+	require.NoError(t, scr.Add(script))
+	return scr
+}
+
+// replaceHeader returns the artifact with the header replaced by the header
+// of the other artifact, keeping the manifest and its signature.
+func replaceHeader(t *testing.T, raw, other []byte) []byte {
+	var header []byte
+	tr := tar.NewReader(bytes.NewReader(other))
+	for {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		if hdr.Name == "header.tar.gz" {
+			header, err = ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			break
+		}
+	}
+
+	mod := bytes.NewBuffer(nil)
+	tr = tar.NewReader(bytes.NewReader(raw))
+	tw := tar.NewWriter(mod)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		if hdr.Name == "header.tar.gz" {
+			data = header
+			hdr.Size = int64(len(data))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return mod.Bytes()
+}
+
+func TestReadSecurityVersion(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriterSigned(art, artifact.NewSigner([]byte(PrivateKey)))
+	aw.SetSecurityVersion(7)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+	raw := art.Bytes()
+
+	var version uint64
+	aReader := NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	aReader.SecurityVersionCallback = func(v uint64) error {
+		version = v
+		return nil
+	}
+	assert.NoError(t, aReader.ReadArtifact())
+	assert.Equal(t, uint64(7), version)
+	assert.Equal(t, uint64(7), aReader.GetSecurityVersion())
+
+	// the device refuses the downgrade
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	aReader.SecurityVersionCallback = func(v uint64) error {
+		if v < 8 {
+			return errors.New("downgrade")
+		}
+		return nil
+	}
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Equal(t, "downgrade", errors.Cause(err).Error())
+
+	// the version is passed to the device only once the header is known
+	// to be authentic
+	dir, err := ioutil.TempDir("", "scripts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	older := bytes.NewBuffer(nil)
+	aw = awriter.NewWriter(older)
+	aw.SetSecurityVersion(3)
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, largeScripts(t, dir))
+	assert.NoError(t, err)
+	version = 0
+	aReader = NewReaderSigned(bytes.NewReader(replaceHeader(t, raw, older.Bytes())))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	aReader.SecurityVersionCallback = func(v uint64) error {
+		version = v
+		return nil
+	}
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid checksum")
+	assert.Equal(t, uint64(0), version)
+}
+
+func TestReadProvenance(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriterSigned(art, artifact.NewSigner([]byte(PrivateKey)))
+	aw.SetProvenance(artifact.NewProvenance("builder", time.Now()))
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+
+	aReader := NewReaderSigned(bytes.NewReader(art.Bytes()))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	assert.NoError(t, aReader.ReadArtifact())
+	p := aReader.GetProvenance()
+	require.NotNil(t, p)
+	assert.Equal(t, "builder", p.Predicate.Builder.ID)
+	require.Len(t, p.Subject, 1)
+	assert.Equal(t, filepath.Join(artifact.UpdatePath(0), filepath.Base(upd)),
+		p.Subject[0].Name)
+	assert.Equal(t, string(aReader.GetHandlers()[0].GetUpdateFiles()[0].Checksum),
+		p.Subject[0].Digest["sha256"])
+
+	// provenance is not supported by version 1 artifacts
+	aw = awriter.NewWriter(bytes.NewBuffer(nil))
+	aw.SetProvenance(artifact.NewProvenance("builder", time.Now()))
+	err = aw.WriteArtifact("mender", 1, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.Error(t, err)
+}
+
+type testTimestamper struct {
+	sig []byte
+}
+
+func (ts *testTimestamper) Timestamp(sig []byte) ([]byte, error) {
+	ts.sig = sig
+	return []byte("token"), nil
+}
+
+func TestReadTimestamped(t *testing.T) {
+	upd, err := MakeFakeUpdate(TestUpdateFileContent)
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	s := artifact.NewCertificateSigner([]byte(PrivateKey), []byte("certificates"))
+	ts := new(testTimestamper)
+	s.SetTimestamper(ts)
+	aw := awriter.NewWriterSigned(art, s)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+	raw := art.Bytes()
+
+	signedAt := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	var chainSignedAt time.Time
+	aReader := NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifyTimestampCallback = func(sig, token []byte) (time.Time, error) {
+		assert.Equal(t, ts.sig, sig)
+		assert.Equal(t, []byte("token"), token)
+		return signedAt, nil
+	}
+	aReader.VerifyChainCallback = func(message, sig, c []byte) error {
+		// the timestamp is verified before the signature
+		chainSignedAt = aReader.GetSigningTime()
+		return artifact.NewVerifier([]byte(PublicKey)).Verify(message, sig)
+	}
+	assert.NoError(t, aReader.ReadArtifact())
+	assert.Equal(t, signedAt, aReader.GetSigningTime())
+	assert.Equal(t, signedAt, chainSignedAt)
+
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifyTimestampCallback = func(sig, token []byte) (time.Time, error) {
+		return time.Time{}, errors.New("untrusted TSA")
+	}
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	err = aReader.ReadArtifact()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "reader: invalid timestamp: untrusted TSA")
+
+	// the timestamp is ignored if there is no callback
+	aReader = NewReaderSigned(bytes.NewReader(raw))
+	aReader.VerifySignatureCallback = artifact.NewVerifier([]byte(PublicKey)).Verify
+	assert.NoError(t, aReader.ReadArtifact())
+	assert.True(t, aReader.GetSigningTime().IsZero())
+}
+
 func TestReadSigned(t *testing.T) {
 	art, err := MakeRootfsImageArtifact(2, true, false)
 	assert.NoError(t, err)
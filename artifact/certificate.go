@@ -0,0 +1,223 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertificateSigner is a Signer providing the certificate chain of the
+// signing key. The chain is stored in the artifact next to the signature.
+type CertificateSigner interface {
+	Signer
+	Certificates() []byte
+}
+
+// ChainVerifier is verifying the signature using the certificate chain
+// stored in the artifact.
+type ChainVerifier interface {
+	VerifyChain(message, sig, chain []byte) error
+}
+
+// PKICertSigner is the PKISigner storing the PEM encoded certificate chain
+// issued for the signing key; the leaf certificate must be the first one.
+type PKICertSigner struct {
+	*PKISigner
+	chain []byte
+}
+
+func NewCertificateSigner(privateKey, chain []byte) *PKICertSigner {
+	return &PKICertSigner{
+		PKISigner: NewSigner(privateKey),
+		chain:     chain,
+	}
+}
+
+func (s *PKICertSigner) Certificates() []byte {
+	return s.chain
+}
+
+// ParseCertificates parses all the PEM encoded certificates.
+func ParseCertificates(certsPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := certsPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: failed to parse certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("signer: no certificates found")
+	}
+	return certs, nil
+}
+
+// X509Verifier is verifying the certificate chain against the trusted root
+// certificates and then the signature using the leaf certificate key.
+type X509Verifier struct {
+	roots         *x509.CertPool
+	intermediates []*x509.Certificate
+	revoked       *RevocationList
+	signedAt      time.Time
+
+	// Now returns the time the validity of the certificates is checked
+	// against; if not set the current time is used.
+	Now func() time.Time
+}
+
+// NewX509Verifier creates the verifier trusting the PEM encoded root
+// certificates.
+func NewX509Verifier(rootsPEM []byte) (*X509Verifier, error) {
+	roots, err := ParseCertificates(rootsPEM)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, r := range roots {
+		pool.AddCert(r)
+	}
+	return &X509Verifier{roots: pool}, nil
+}
+
+// RequireIntermediates restricts the trusted chains to the ones issued
+// by any of the provided intermediate certificates.
+func (v *X509Verifier) RequireIntermediates(intermediatesPEM []byte) error {
+	certs, err := ParseCertificates(intermediatesPEM)
+	if err != nil {
+		return err
+	}
+	v.intermediates = append(v.intermediates, certs...)
+	return nil
+}
+
+// SetRevocationList sets the list of the revoked keys; the signer
+// certificate is rejected if its key is revoked.
+func (v *X509Verifier) SetRevocationList(rl *RevocationList) {
+	v.revoked = rl
+}
+
+// SetSigningTime sets the trusted time the signature was created at; the
+// certificates are checked against this time instead of the current one
+// and keys revoked after it are still accepted.
+func (v *X509Verifier) SetSigningTime(t time.Time) {
+	v.signedAt = t
+}
+
+func (v *X509Verifier) VerifyChain(message, sig, chain []byte) error {
+	_, err := v.VerifyCertificate(message, sig, chain)
+	return err
+}
+
+// VerifyCertificate verifies the chain and the signature returning the
+// leaf certificate of the signer.
+func (v *X509Verifier) VerifyCertificate(message, sig,
+	chain []byte) (*x509.Certificate, error) {
+	leaf, err := v.verifyChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(leaf.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: can not extract certificate key")
+	}
+	sm, err := getVerifyMethod(pub)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := ParseSignatures(sig)
+	if err != nil {
+		return nil, err
+	}
+	fp := Fingerprint(pub)
+	if r := v.revoked.Revoked(fp, v.signedAt); r != nil {
+		return nil, &RevokedKeyError{Keys: []RevokedKey{*r}}
+	}
+	for _, s := range sigs {
+		if s.KeyID != "" && s.KeyID != fp {
+			continue
+		}
+		dec := make([]byte, base64.StdEncoding.DecodedLen(len(s.Signature)))
+		decLen, err := base64.StdEncoding.Decode(dec, s.Signature)
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: error decoding signature")
+		}
+		if err = sm.method.Verify(message, dec[:decLen], sm.key); err == nil {
+			return leaf, nil
+		}
+	}
+	return nil, errors.New("signer: signature not matching signer certificate")
+}
+
+func (v *X509Verifier) verifyChain(chain []byte) (*x509.Certificate, error) {
+	certs, err := ParseCertificates(chain)
+	if err != nil {
+		return nil, err
+	}
+	leaf := certs[0]
+
+	if leaf.KeyUsage != 0 && leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, errors.New("signer: certificate can not be used for signing")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	if !v.signedAt.IsZero() {
+		opts.CurrentTime = v.signedAt
+	} else if v.Now != nil {
+		opts.CurrentTime = v.Now()
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: invalid certificate chain")
+	}
+
+	if len(v.intermediates) == 0 {
+		return leaf, nil
+	}
+	for _, ch := range chains {
+		// the first certificate is the leaf and the last one is the root
+		for _, c := range ch[1 : len(ch)-1] {
+			for _, i := range v.intermediates {
+				if bytes.Equal(c.Raw, i.Raw) {
+					return leaf, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("signer: certificate not issued by required intermediate")
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var testCertSerial int64
+
+func makeTestCert(t *testing.T, name string, ca bool, usage x509.KeyUsage,
+	notAfter time.Time, parent *testCert, extUsage ...x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	testCertSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(testCertSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              usage,
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	if len(extUsage) != 0 {
+		tmpl.ExtKeyUsage = extUsage
+	} else if !ca {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	}
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert,
+		key.Public(), parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestX509Verifier(t *testing.T) {
+	validity := time.Now().Add(24 * time.Hour)
+	caUsage := x509.KeyUsageCertSign
+
+	root := makeTestCert(t, "root", true, caUsage, validity, nil)
+	intermediate := makeTestCert(t, "intermediate", true, caUsage, validity, root)
+	otherIntermediate := makeTestCert(t, "other", true, caUsage, validity, root)
+	leaf := makeTestCert(t, "signer", false, x509.KeyUsageDigitalSignature,
+		validity, intermediate)
+
+	msg := []byte("this is secret message")
+	chain := append(append([]byte{}, leaf.certPEM...), intermediate.certPEM...)
+	signer := NewCertificateSigner(leaf.keyPEM, chain)
+	assert.Equal(t, chain, signer.Certificates())
+	sig, err := signer.Sign(msg)
+	require.NoError(t, err)
+
+	v, err := NewX509Verifier(root.certPEM)
+	require.NoError(t, err)
+
+	cert, err := v.VerifyCertificate(msg, sig, chain)
+	assert.NoError(t, err)
+	assert.Equal(t, "signer", cert.Subject.CommonName)
+
+	// invalid signature
+	err = v.VerifyChain([]byte("other message"), sig, chain)
+	assert.Error(t, err)
+
+	// missing intermediate certificate
+	err = v.VerifyChain(msg, sig, leaf.certPEM)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid certificate chain")
+
+	// untrusted root
+	otherRoot := makeTestCert(t, "other root", true, caUsage, validity, nil)
+	ov, err := NewX509Verifier(otherRoot.certPEM)
+	require.NoError(t, err)
+	assert.Error(t, ov.VerifyChain(msg, sig, chain))
+
+	// expired certificate
+	v.Now = func() time.Time { return validity.Add(time.Hour) }
+	err = v.VerifyChain(msg, sig, chain)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid certificate chain")
+	v.Now = nil
+
+	// required intermediate
+	require.NoError(t, v.RequireIntermediates(intermediate.certPEM))
+	assert.NoError(t, v.VerifyChain(msg, sig, chain))
+
+	v, err = NewX509Verifier(root.certPEM)
+	require.NoError(t, err)
+	require.NoError(t, v.RequireIntermediates(otherIntermediate.certPEM))
+	err = v.VerifyChain(msg, sig, chain)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not issued by required intermediate")
+
+	// certificate which can not be used for signing
+	noSign := makeTestCert(t, "no-sign", false, x509.KeyUsageKeyEncipherment,
+		validity, root)
+	sig, err = NewSigner(noSign.keyPEM).Sign(msg)
+	require.NoError(t, err)
+	v, err = NewX509Verifier(root.certPEM)
+	require.NoError(t, err)
+	err = v.VerifyChain(msg, sig, noSign.certPEM)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can not be used for signing")
+
+	_, err = NewX509Verifier([]byte("invalid"))
+	assert.Error(t, err)
+}
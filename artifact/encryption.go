@@ -0,0 +1,433 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CipherAES256GCM is the cipher used for encrypting the data files;
+	// each file is encrypted in chunks, each of them authenticated separately.
+	CipherAES256GCM = "aes-256-gcm"
+	// DefaultChunkSize is the size of the plain text of a single chunk.
+	DefaultChunkSize = 64 * 1024
+	// maxChunkSize limits the memory used while decrypting.
+	maxChunkSize = 16 * 1024 * 1024
+
+	// WrapRSAOAEP is the data key encrypted with RSA-OAEP using SHA256.
+	WrapRSAOAEP = "rsa-oaep-sha256"
+	// WrapECDHP256 is the data key encrypted with AES-256-GCM using the key
+	// derived from ECDH agreement of the ephemeral and the recipient key.
+	WrapECDHP256 = "ecdh-p256-aes-256-gcm"
+
+	dataKeySize     = 32
+	noncePrefixSize = 7
+	wrapLabel       = "mender-artifact data key"
+)
+
+// ErrNoRecipientKey is returned if the data key is not wrapped for the key
+// used for decrypting the artifact.
+var ErrNoRecipientKey = errors.New("encryption: artifact is not encrypted for the key")
+
+// Encryption describes how the data files of the artifact are encrypted.
+// It is stored in the header-info of the encrypted artifacts.
+type Encryption struct {
+	Cipher    string       `json:"cipher"`
+	ChunkSize int          `json:"chunk_size"`
+	Keys      []WrappedKey `json:"keys"`
+}
+
+// Validate checks if the encryption parameters are supported.
+func (e Encryption) Validate() error {
+	if e.Cipher != CipherAES256GCM || len(e.Keys) == 0 ||
+		e.ChunkSize <= 0 || e.ChunkSize > maxChunkSize {
+		return ErrValidatingData
+	}
+	return nil
+}
+
+// WrappedKey is the data key of the artifact encrypted for a single
+// recipient, identified by the fingerprint of its public key.
+type WrappedKey struct {
+	Fingerprint string `json:"fingerprint"`
+	Algorithm   string `json:"algorithm"`
+	Key         []byte `json:"key"`
+	// Ephemeral is the public key used for the key agreement; used only
+	// by ECDH.
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+}
+
+// Encrypter wraps the data key of the artifact for each of the recipients.
+type Encrypter interface {
+	WrapKey(key []byte) ([]WrappedKey, error)
+}
+
+// Decrypter recovers the data key of the artifact from one of the keys
+// wrapped for the recipients.
+type Decrypter interface {
+	UnwrapKey(keys []WrappedKey) ([]byte, error)
+}
+
+// PKIEncrypter wraps the data key using the public RSA or ECDSA P-256 keys
+// of the recipients.
+type PKIEncrypter struct {
+	keys []*SigningMethod
+}
+
+// NewEncrypter creates the encrypter from the PEM encoded public keys of the
+// recipients. The slice can contain more than one key.
+func NewEncrypter(publicKeys []byte) (*PKIEncrypter, error) {
+	e := new(PKIEncrypter)
+	for rest := publicKeys; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if strings.HasPrefix(block.Type, "PGP ") {
+			return nil, errors.New("encryption: OpenPGP keys are not supported")
+		}
+		sm, err := getVerifyMethod(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		e.keys = append(e.keys, sm)
+	}
+	if len(e.keys) == 0 {
+		return nil, errors.New("encryption: failed to parse public key")
+	}
+	return e, nil
+}
+
+// Fingerprints returns the fingerprints of the recipient keys.
+func (e *PKIEncrypter) Fingerprints() []string {
+	fps := make([]string, 0, len(e.keys))
+	for _, k := range e.keys {
+		fps = append(fps, Fingerprint(k.public))
+	}
+	return fps
+}
+
+func (e *PKIEncrypter) WrapKey(key []byte) ([]WrappedKey, error) {
+	var wrapped []WrappedKey
+	for _, k := range e.keys {
+		wk := WrappedKey{Fingerprint: Fingerprint(k.public)}
+		var err error
+		switch pub := k.key.(type) {
+		case *rsa.PublicKey:
+			wk.Algorithm = WrapRSAOAEP
+			wk.Key, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key,
+				[]byte(wrapLabel))
+		case *ecdsa.PublicKey:
+			wk.Algorithm = WrapECDHP256
+			wk.Ephemeral, wk.Key, err = wrapECDH(pub, key)
+		default:
+			err = errors.Errorf("unsupported public key type: %T", pub)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "encryption: can not wrap data key")
+		}
+		wrapped = append(wrapped, wk)
+	}
+	return wrapped, nil
+}
+
+// PKIDecrypter unwraps the data key using the private key of the recipient.
+type PKIDecrypter struct {
+	privateKey []byte
+}
+
+func NewDecrypter(privateKey []byte) *PKIDecrypter {
+	return &PKIDecrypter{privateKey: privateKey}
+}
+
+func (d *PKIDecrypter) UnwrapKey(keys []WrappedKey) ([]byte, error) {
+	sm, err := getKeyAndSignMethod(d.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	fp := Fingerprint(sm.public)
+	for _, wk := range keys {
+		if wk.Fingerprint != fp {
+			continue
+		}
+		var key []byte
+		switch priv := sm.key.(type) {
+		case *rsa.PrivateKey:
+			if wk.Algorithm != WrapRSAOAEP {
+				return nil, errors.Errorf("encryption: unsupported key wrapping: %s",
+					wk.Algorithm)
+			}
+			key, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wk.Key,
+				[]byte(wrapLabel))
+		case *ecdsa.PrivateKey:
+			if wk.Algorithm != WrapECDHP256 {
+				return nil, errors.Errorf("encryption: unsupported key wrapping: %s",
+					wk.Algorithm)
+			}
+			key, err = unwrapECDH(priv, wk.Ephemeral, wk.Key)
+		default:
+			return nil, errors.Errorf("encryption: unsupported private key type: %T", priv)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "encryption: can not unwrap data key")
+		}
+		if len(key) != dataKeySize {
+			return nil, errors.New("encryption: invalid data key")
+		}
+		return key, nil
+	}
+	return nil, ErrNoRecipientKey
+}
+
+// wrapECDH encrypts the key with the key agreed using the ephemeral key and
+// returns the ephemeral public key and the encrypted key.
+func wrapECDH(pub *ecdsa.PublicKey, key []byte) ([]byte, []byte, error) {
+	eph, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephPub := elliptic.Marshal(eph.Curve, eph.X, eph.Y)
+	x, _ := pub.Curve.ScalarMult(pub.X, pub.Y, eph.D.Bytes())
+	aead, err := newAEAD(deriveKEK(pub.Curve, x, ephPub))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the key encrypting key is used only once so the nonce can be constant
+	nonce := make([]byte, aead.NonceSize())
+	return ephPub, aead.Seal(nil, nonce, key, []byte(wrapLabel)), nil
+}
+
+func unwrapECDH(priv *ecdsa.PrivateKey, ephPub, wrapped []byte) ([]byte, error) {
+	ex, ey := elliptic.Unmarshal(priv.Curve, ephPub)
+	if ex == nil || !priv.Curve.IsOnCurve(ex, ey) {
+		return nil, errors.New("invalid ephemeral key")
+	}
+	x, _ := priv.Curve.ScalarMult(ex, ey, priv.D.Bytes())
+	aead, err := newAEAD(deriveKEK(priv.Curve, x, ephPub))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Open(nil, nonce, wrapped, []byte(wrapLabel))
+}
+
+func deriveKEK(curve elliptic.Curve, shared *big.Int, ephPub []byte) []byte {
+	// the shared secret is padded to the size of the curve
+	secret := make([]byte, (curve.Params().BitSize+7)/8)
+	b := shared.Bytes()
+	copy(secret[len(secret)-len(b):], b)
+
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(ephPub)
+	h.Write([]byte(wrapLabel))
+	return h.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewDataKey generates the random key used for encrypting the data files.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "encryption: can not generate data key")
+	}
+	return key, nil
+}
+
+// chunkNonce returns the nonce of the chunk, which is the random prefix of
+// the file, the chunk number and the flag marking the last chunk. This makes
+// reordering, removing or truncating chunks detectable.
+func chunkNonce(prefix []byte, no uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], no)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// EncryptWriter encrypts the data written to it in chunks. The name of the
+// file is authenticated with each chunk so that the encrypted files can not
+// be swapped. Close must be called to write the last chunk.
+type EncryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	name   []byte
+	prefix []byte
+	buf    []byte
+	size   int
+	no     uint32
+}
+
+// NewEncryptWriter creates the writer encrypting the file with the given
+// name using the data key.
+func NewEncryptWriter(w io.Writer, key []byte, name string,
+	chunkSize int) (*EncryptWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryption: invalid data key")
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err = io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, errors.Wrap(err, "encryption: can not generate nonce")
+	}
+	if _, err = w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{
+		w:      w,
+		aead:   aead,
+		name:   []byte(name),
+		prefix: prefix,
+		buf:    make([]byte, 0, chunkSize),
+		size:   chunkSize,
+	}, nil
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// the full chunk is written only once it is known it is not the
+		// last one
+		if len(e.buf) == e.size {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		l := e.size - len(e.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		e.buf = append(e.buf, p[:l]...)
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+// Close writes the last chunk; it does not close the underlying writer.
+func (e *EncryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *EncryptWriter) seal(last bool) error {
+	if e.no == ^uint32(0) {
+		return errors.New("encryption: file too big")
+	}
+	out := e.aead.Seal(nil, chunkNonce(e.prefix, e.no, last), e.buf, e.name)
+	e.no++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+// DecryptReader decrypts the data encrypted by EncryptWriter. Only the
+// authenticated data is returned; an error is returned if any of the chunks
+// is modified or if the file is truncated.
+type DecryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	name   []byte
+	prefix []byte
+	chunk  []byte
+	buf    *bytes.Reader
+	no     uint32
+	done   bool
+}
+
+// NewDecryptReader creates the reader decrypting the file with the given
+// name using the data key.
+func NewDecryptReader(r io.Reader, key []byte, name string,
+	chunkSize int) (*DecryptReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryption: invalid data key")
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err = io.ReadFull(r, prefix); err != nil {
+		return nil, errors.Wrap(err, "encryption: can not read nonce")
+	}
+	return &DecryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		name:   []byte(name),
+		prefix: prefix,
+		chunk:  make([]byte, chunkSize+aead.Overhead()),
+		buf:    bytes.NewReader(nil),
+	}, nil
+}
+
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for d.buf.Len() == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	return d.buf.Read(p)
+}
+
+func (d *DecryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// the full chunk is the last one if nothing follows it
+		if _, err = d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.no, d.done),
+		d.chunk[:n], d.name)
+	if err != nil {
+		return errors.New("encryption: can not decrypt data; " +
+			"data modified or truncated")
+	}
+	d.no++
+	d.buf.Reset(plain)
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapKey(t *testing.T) {
+	e, err := NewEncrypter([]byte(PublicRSAKey + "\n" + PublicECDSAKey))
+	require.NoError(t, err)
+	assert.Len(t, e.Fingerprints(), 2)
+
+	key, err := NewDataKey()
+	require.NoError(t, err)
+	keys, err := e.WrapKey(key)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, WrapRSAOAEP, keys[0].Algorithm)
+	assert.Equal(t, WrapECDHP256, keys[1].Algorithm)
+
+	for _, priv := range []string{PrivateRSAKey, PrivateECDSAKey} {
+		dec, err := NewDecrypter([]byte(priv)).UnwrapKey(keys)
+		assert.NoError(t, err)
+		assert.Equal(t, key, dec)
+	}
+
+	// not a recipient
+	_, err = NewDecrypter([]byte(PrivateECDSA384)).UnwrapKey(keys)
+	assert.Equal(t, ErrNoRecipientKey, err)
+
+	// modified wrapped key
+	keys[1].Key[0] ^= 0xff
+	_, err = NewDecrypter([]byte(PrivateECDSAKey)).UnwrapKey(keys)
+	assert.Error(t, err)
+
+	_, err = NewEncrypter([]byte("invalid"))
+	assert.Error(t, err)
+}
+
+func encrypt(t *testing.T, key, data []byte, name string, chunk int) []byte {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewEncryptWriter(buf, key, name, chunk)
+	require.NoError(t, err)
+	// write in small pieces to cross the chunk boundaries
+	for len(data) > 0 {
+		l := 3
+		if l > len(data) {
+			l = len(data)
+		}
+		_, err = w.Write(data[:l])
+		require.NoError(t, err)
+		data = data[l:]
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decrypt(key, data []byte, name string, chunk int) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(data), key, name, chunk)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptData(t *testing.T) {
+	key, err := NewDataKey()
+	require.NoError(t, err)
+
+	const chunk = 16
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3 * chunk} {
+		data := bytes.Repeat([]byte{'a'}, size)
+		enc := encrypt(t, key, data, "data/0000.tar.gz", chunk)
+		dec, err := decrypt(key, enc, "data/0000.tar.gz", chunk)
+		assert.NoError(t, err, "size: %d", size)
+		assert.Equal(t, data, dec, "size: %d", size)
+	}
+
+	data := bytes.Repeat([]byte("data"), 10)
+	enc := encrypt(t, key, data, "data/0000.tar.gz", chunk)
+
+	// modified content
+	mod := append([]byte{}, enc...)
+	mod[len(mod)/2] ^= 0xff
+	_, err = decrypt(key, mod, "data/0000.tar.gz", chunk)
+	assert.Error(t, err)
+
+	// truncated at the chunk boundary
+	_, err = decrypt(key, enc[:noncePrefixSize+2*(chunk+16)],
+		"data/0000.tar.gz", chunk)
+	assert.Error(t, err)
+
+	// swapped data files
+	_, err = decrypt(key, enc, "data/0001.tar.gz", chunk)
+	assert.Error(t, err)
+
+	// invalid key
+	other, err := NewDataKey()
+	require.NoError(t, err)
+	_, err = decrypt(other, enc, "data/0000.tar.gz", chunk)
+	assert.Error(t, err)
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Supported types of the generated keys.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeOpenPGP = "openpgp"
+
+	// DefaultPGPUserID is the user ID of the generated OpenPGP keys.
+	DefaultPGPUserID = "mender-artifact"
+)
+
+// DefaultKeySize returns the default size in bits of the keys of given type.
+func DefaultKeySize(keyType string) int {
+	if keyType == KeyTypeECDSA {
+		return 256
+	}
+	return 3072
+}
+
+// GenerateKey generates a new key pair of the given type and size. The
+// private key is returned in the format accepted by NewSigner and the public
+// key in the format accepted by NewVerifier; PEM encoded for RSA and ECDSA
+// keys and ASCII armored for OpenPGP keys.
+func GenerateKey(keyType string, bits int) ([]byte, []byte, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		if bits < 2048 {
+			return nil, nil, errors.Errorf("signer: RSA key size must be "+
+				"at least 2048 bits: %d", bits)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "signer: can not generate key")
+		}
+		return encodeKeyPair(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+	case KeyTypeECDSA:
+		// only P-256 keys can be used for signing; see ECDSA256
+		if bits != 256 {
+			return nil, nil, errors.Errorf("signer: unsupported ECDSA key size: %d", bits)
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "signer: can not generate key")
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "signer: can not encode key")
+		}
+		return encodeKeyPair(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case KeyTypeOpenPGP:
+		if bits < 2048 {
+			return nil, nil, errors.Errorf("signer: RSA key size must be "+
+				"at least 2048 bits: %d", bits)
+		}
+		return GeneratePGPKey(bits, DefaultPGPUserID)
+	default:
+		return nil, nil, errors.Errorf("signer: unsupported key type: %s", keyType)
+	}
+}
+
+func encodeKeyPair(block *pem.Block) ([]byte, []byte, error) {
+	private := pem.EncodeToMemory(block)
+	public, err := GetPublic(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), nil
+}
+
+// KeyInfo describes a single key.
+type KeyInfo struct {
+	// Type is either RSA, ECDSA or OpenPGP followed by the algorithm
+	// of the primary key; e.g. OpenPGP RSA.
+	Type    string
+	Size    int
+	Private bool
+	// Fingerprint is the fingerprint used for identifying the key the
+	// artifact is signed with; see Fingerprint.
+	Fingerprint string
+	// OpenPGPFingerprint is the fingerprint of the OpenPGP key as shown
+	// by GnuPG; empty for other keys.
+	OpenPGPFingerprint string
+}
+
+// GetKeyInfo returns the information about all the keys stored in the PEM
+// encoded or ASCII armored data. Both private and public keys are supported.
+func GetKeyInfo(keys []byte) ([]KeyInfo, error) {
+	var methods []*SigningMethod
+	if IsPGPKey(keys) {
+		blocks, err := pgpArmoredBlocks(keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blocks {
+			switch b.blockType {
+			case openpgp.PublicKeyType:
+				m, err := getPGPVerifyMethods(b.raw)
+				if err != nil {
+					return nil, err
+				}
+				methods = append(methods, m...)
+			case openpgp.PrivateKeyType:
+				m, err := getPGPSignMethod(b.raw)
+				if err != nil {
+					return nil, err
+				}
+				methods = append(methods, m)
+			}
+		}
+	}
+	for rest := keys; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		var sm *SigningMethod
+		var err error
+		switch {
+		case strings.HasPrefix(block.Type, "PGP "):
+			continue
+		case block.Type == "PUBLIC KEY":
+			sm, err = getVerifyMethod(block.Bytes)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			sm, err = getKeyAndSignMethod(pem.EncodeToMemory(block))
+		default:
+			return nil, errors.Errorf("signer: unsupported PEM block: %s", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, sm)
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("signer: no key found")
+	}
+
+	infos := make([]KeyInfo, 0, len(methods))
+	for _, sm := range methods {
+		info := KeyInfo{Fingerprint: Fingerprint(sm.public)}
+		switch key := sm.key.(type) {
+		case *rsa.PublicKey:
+			info.Type, info.Size = "RSA", key.N.BitLen()
+		case *rsa.PrivateKey:
+			info.Type, info.Size, info.Private = "RSA", key.N.BitLen(), true
+		case *ecdsa.PublicKey:
+			info.Type, info.Size = "ECDSA", key.Curve.Params().BitSize
+		case *ecdsa.PrivateKey:
+			info.Type, info.Size, info.Private = "ECDSA", key.Curve.Params().BitSize, true
+		case *openpgp.Entity:
+			info.Type = "OpenPGP " + pgpAlgorithm(key.PrimaryKey.PubKeyAlgo)
+			bits, err := key.PrimaryKey.BitLength()
+			if err != nil {
+				return nil, errors.Wrap(err, "signer: invalid OpenPGP key")
+			}
+			info.Size, info.Private = int(bits), key.PrivateKey != nil
+			info.OpenPGPFingerprint = strings.ToUpper(
+				hex.EncodeToString(key.PrimaryKey.Fingerprint[:]))
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, tc := range []struct {
+		keyType  string
+		infoType string
+	}{
+		{KeyTypeRSA, "RSA"},
+		{KeyTypeECDSA, "ECDSA"},
+		{KeyTypeOpenPGP, "OpenPGP RSA"},
+	} {
+		bits := DefaultKeySize(tc.keyType)
+		if tc.keyType != KeyTypeECDSA {
+			// keep the test fast
+			bits = 2048
+		}
+		priv, pub, err := GenerateKey(tc.keyType, bits)
+		require.NoError(t, err, tc.keyType)
+
+		sig, err := NewSigner(priv).Sign([]byte("message"))
+		assert.NoError(t, err, tc.keyType)
+		assert.NoError(t, NewVerifier(pub).Verify([]byte("message"), sig), tc.keyType)
+
+		privInfo, err := GetKeyInfo(priv)
+		require.NoError(t, err, tc.keyType)
+		pubInfo, err := GetKeyInfo(pub)
+		require.NoError(t, err, tc.keyType)
+		require.Len(t, privInfo, 1)
+		require.Len(t, pubInfo, 1)
+
+		assert.Equal(t, tc.infoType, privInfo[0].Type)
+		assert.Equal(t, bits, privInfo[0].Size)
+		assert.True(t, privInfo[0].Private)
+		assert.False(t, pubInfo[0].Private)
+		assert.Equal(t, privInfo[0].Fingerprint, pubInfo[0].Fingerprint)
+		assert.Equal(t, privInfo[0].OpenPGPFingerprint, pubInfo[0].OpenPGPFingerprint)
+
+		kr, err := NewKeyRing(pub)
+		require.NoError(t, err)
+		assert.Equal(t, []string{pubInfo[0].Fingerprint}, kr.Fingerprints())
+	}
+
+	_, _, err := GenerateKey(KeyTypeRSA, 1024)
+	assert.Error(t, err)
+	_, _, err = GenerateKey(KeyTypeECDSA, 384)
+	assert.Error(t, err)
+	_, _, err = GenerateKey("dsa", 1024)
+	assert.Error(t, err)
+}
+
+func TestGetKeyInfo(t *testing.T) {
+	info, err := GetKeyInfo([]byte(PublicRSAKey + "\n" + PrivateECDSAKey + "\n" +
+		PGPPublicKey))
+	require.NoError(t, err)
+	require.Len(t, info, 3)
+
+	assert.Equal(t, "OpenPGP RSA", info[0].Type)
+	assert.NotEmpty(t, info[0].OpenPGPFingerprint)
+	assert.Equal(t, "RSA", info[1].Type)
+	assert.Equal(t, 1024, info[1].Size)
+	assert.False(t, info[1].Private)
+	assert.Equal(t, "ECDSA", info[2].Type)
+	assert.Equal(t, 256, info[2].Size)
+	assert.True(t, info[2].Private)
+	assert.Empty(t, info[2].OpenPGPFingerprint)
+
+	_, err = GetKeyInfo([]byte("not a key"))
+	assert.Error(t, err)
+
+	_, err = GetKeyInfo([]byte(PublicRSAKeyInvalid))
+	assert.Error(t, err)
+}
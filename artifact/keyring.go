@@ -0,0 +1,213 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoMatchingKey is returned if the signature can not be verified with
+// any of the keys stored in the key ring.
+var ErrNoMatchingKey = errors.New("signer: no key matching the signature")
+
+// Fingerprint returns the fingerprint of the DER encoded public key, which
+// is the hex encoded sha256 checksum of the key.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyRing is a Verifier using a set of public keys. The signature is valid
+// if it can be verified using any of the keys being a part of the key ring,
+// which allows trusting both old and new keys while those are rotated.
+type KeyRing struct {
+	keys     []*SigningMethod
+	revoked  *RevocationList
+	signedAt time.Time
+}
+
+// NewKeyRing creates the key ring from the PEM encoded or ASCII armored
+// OpenPGP public keys. Each of the provided slices can contain more than one
+// key (a bundle of keys).
+func NewKeyRing(keysPEM ...[]byte) (*KeyRing, error) {
+	kr := new(KeyRing)
+	for _, rest := range keysPEM {
+		if IsPGPKey(rest) {
+			methods, err := getPGPVerifyMethods(rest)
+			if err != nil {
+				return nil, err
+			}
+			kr.keys = append(kr.keys, methods...)
+		}
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if strings.HasPrefix(block.Type, "PGP ") {
+				continue
+			}
+			sm, err := getVerifyMethod(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			kr.keys = append(kr.keys, sm)
+		}
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("signer: failed to parse public key")
+	}
+	return kr, nil
+}
+
+// ReadKeyRing creates the key ring using the keys stored in the file or in
+// all the files inside the directory provided by path.
+func ReadKeyRing(path string) (*KeyRing, error) {
+	keys, err := ReadKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyRing(keys)
+}
+
+// ReadKeys reads the content of the key file. If path is a directory
+// the content of all the regular files inside it is returned as a bundle.
+func ReadKeys(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return ioutil.ReadFile(path)
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		key, err := ioutil.ReadFile(filepath.Join(path, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Fingerprints returns the fingerprints of all the keys in the key ring.
+func (kr *KeyRing) Fingerprints() []string {
+	fps := make([]string, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		fps = append(fps, Fingerprint(k.public))
+	}
+	return fps
+}
+
+// SetRevocationList sets the list of the revoked keys; signatures created
+// with any of the revoked keys are not considered valid.
+func (kr *KeyRing) SetRevocationList(rl *RevocationList) {
+	kr.revoked = rl
+}
+
+// SetSigningTime sets the trusted time the signature was created at;
+// keys revoked after this time are still accepted.
+func (kr *KeyRing) SetSigningTime(t time.Time) {
+	kr.signedAt = t
+}
+
+func (kr *KeyRing) Verify(message, sig []byte) error {
+	_, err := kr.VerifyKey(message, sig)
+	return err
+}
+
+// VerifyKey verifies the signature and returns the fingerprint of the key
+// the signature was successfully verified with. If the manifest is signed
+// more than once it is enough that any of the signatures is valid.
+func (kr *KeyRing) VerifyKey(message, sig []byte) (string, error) {
+	keys, err := kr.VerifyAll(message, sig)
+	if err != nil {
+		return "", err
+	}
+	return keys[0], nil
+}
+
+// VerifyAll verifies all the signatures and returns the fingerprints of
+// the keys being used for creating valid signatures. Each key is
+// reported only once.
+func (kr *KeyRing) VerifyAll(message, sig []byte) ([]string, error) {
+	sigs, err := ParseSignatures(sig)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	var revoked []RevokedKey
+	for _, s := range sigs {
+		dec := make([]byte, base64.StdEncoding.DecodedLen(len(s.Signature)))
+		decLen, err := base64.StdEncoding.Decode(dec, s.Signature)
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: error decoding signature")
+		}
+		for _, k := range kr.keys {
+			fp := Fingerprint(k.public)
+			// signatures containing key identifier are verified only
+			// with the matching key
+			if s.KeyID != "" && s.KeyID != fp {
+				continue
+			}
+			if k.method.Verify(message, dec[:decLen], k.key) == nil {
+				if r := kr.revoked.Revoked(fp, kr.signedAt); r != nil {
+					revoked = append(revoked, *r)
+				} else if !contains(keys, fp) {
+					keys = append(keys, fp)
+				}
+				break
+			}
+		}
+	}
+	if len(keys) == 0 && len(revoked) != 0 {
+		return nil, &RevokedKeyError{Keys: revoked}
+	} else if len(keys) == 0 {
+		return nil, ErrNoMatchingKey
+	}
+	return keys, nil
+}
+
+func contains(list []string, elem string) bool {
+	for _, e := range list {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
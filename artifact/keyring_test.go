@@ -0,0 +1,101 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fingerprintPEM(t *testing.T, key string) string {
+	block, _ := pem.Decode([]byte(key))
+	require.NotNil(t, block)
+	return Fingerprint(block.Bytes)
+}
+
+func TestKeyRing(t *testing.T) {
+	msg := []byte("this is secret message")
+
+	rsaSig, err := NewSigner([]byte(PrivateRSAKey)).Sign(msg)
+	require.NoError(t, err)
+	ecdsaSig, err := NewSigner([]byte(PrivateECDSAKey)).Sign(msg)
+	require.NoError(t, err)
+
+	// bundle of keys in single file
+	kr, err := NewKeyRing([]byte(PublicRSAKey + "\n" + PublicECDSAKey))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		fingerprintPEM(t, PublicRSAKey),
+		fingerprintPEM(t, PublicECDSAKey),
+	}, kr.Fingerprints())
+
+	fp, err := kr.VerifyKey(msg, rsaSig)
+	assert.NoError(t, err)
+	assert.Equal(t, fingerprintPEM(t, PublicRSAKey), fp)
+
+	fp, err = kr.VerifyKey(msg, ecdsaSig)
+	assert.NoError(t, err)
+	assert.Equal(t, fingerprintPEM(t, PublicECDSAKey), fp)
+
+	assert.NoError(t, kr.Verify(msg, ecdsaSig))
+	assert.Equal(t, ErrNoMatchingKey,
+		kr.Verify([]byte("some other message"), ecdsaSig))
+
+	// key ring not containing signing key
+	kr, err = NewKeyRing([]byte(PublicECDSAKey))
+	require.NoError(t, err)
+	fp, err = kr.VerifyKey(msg, rsaSig)
+	assert.Equal(t, ErrNoMatchingKey, err)
+	assert.Empty(t, fp)
+
+	// invalid keys
+	_, err = NewKeyRing([]byte("invalid key"))
+	assert.Error(t, err)
+	_, err = NewKeyRing([]byte(PublicRSAKey), []byte(PublicDSAKey))
+	assert.Error(t, err)
+	_, err = NewKeyRing()
+	assert.Error(t, err)
+}
+
+func TestReadKeyRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "old.pem"),
+		[]byte(PublicRSAKey), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new.pem"),
+		[]byte(PublicECDSAKey), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0755))
+
+	// directory of keys
+	kr, err := ReadKeyRing(dir)
+	require.NoError(t, err)
+	assert.Len(t, kr.Fingerprints(), 2)
+
+	// single key file
+	kr, err = ReadKeyRing(filepath.Join(dir, "old.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{fingerprintPEM(t, PublicRSAKey)}, kr.Fingerprints())
+
+	_, err = ReadKeyRing(filepath.Join(dir, "non-existing"))
+	assert.Error(t, err)
+}
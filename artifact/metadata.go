@@ -17,7 +17,9 @@ package artifact
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -83,6 +85,16 @@ type HeaderInfo struct {
 	Updates           []UpdateType `json:"updates"`
 	CompatibleDevices []string     `json:"device_types_compatible"`
 	ArtifactName      string       `json:"artifact_name"`
+	// Encryption is set only if the data files are encrypted.
+	Encryption *Encryption `json:"encryption,omitempty"`
+	// Validity is the optional time window the artifact can be installed in.
+	Validity *Validity `json:"validity,omitempty"`
+	// SecurityVersion is increased with each release fixing a vulnerability;
+	// devices refuse installing artifacts with lower version than the one
+	// already installed.
+	SecurityVersion uint64 `json:"security_version,omitempty"`
+	// Provenance is the optional build provenance of the data files.
+	Provenance *Provenance `json:"provenance,omitempty"`
 }
 
 // Validate checks if header-info structure is correct.
@@ -95,9 +107,71 @@ func (hi HeaderInfo) Validate() error {
 			return ErrValidatingData
 		}
 	}
+	if hi.Validity != nil {
+		if err := hi.Validity.Validate(); err != nil {
+			return err
+		}
+	}
+	if hi.Provenance != nil {
+		if err := hi.Provenance.Validate(); err != nil {
+			return err
+		}
+	}
+	if hi.Encryption != nil {
+		return hi.Encryption.Validate()
+	}
 	return nil
 }
 
+// Validity is the time window the artifact can be installed in. Either of
+// the bounds is optional.
+type Validity struct {
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+}
+
+// Validate checks if the validity window is not empty.
+func (v Validity) Validate() error {
+	if v.NotBefore != nil && v.NotAfter != nil && v.NotAfter.Before(*v.NotBefore) {
+		return ErrValidatingData
+	}
+	return nil
+}
+
+// Check returns *ValidityError if the artifact can not be installed at the
+// given time.
+func (v *Validity) Check(now time.Time) error {
+	if v == nil {
+		return nil
+	}
+	if (v.NotBefore != nil && now.Before(*v.NotBefore)) ||
+		(v.NotAfter != nil && now.After(*v.NotAfter)) {
+		return &ValidityError{Validity: *v, Now: now}
+	}
+	return nil
+}
+
+// ValidityError is returned if the artifact is installed outside of its
+// validity window.
+type ValidityError struct {
+	Validity Validity
+	Now      time.Time
+}
+
+// Expired returns true if the validity window has already passed.
+func (e *ValidityError) Expired() bool {
+	return e.Validity.NotAfter != nil && e.Now.After(*e.Validity.NotAfter)
+}
+
+func (e *ValidityError) Error() string {
+	if e.Expired() {
+		return fmt.Sprintf("artifact expired at: %s",
+			e.Validity.NotAfter.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("artifact not valid before: %s",
+		e.Validity.NotBefore.Format(time.RFC3339))
+}
+
 func (hi *HeaderInfo) Write(p []byte) (n int, err error) {
 	if err := decode(p, hi); err != nil {
 		return 0, err
@@ -109,6 +183,48 @@ func (hi *HeaderInfo) Write(p []byte) (n int, err error) {
 // archived in artifacts archive.
 type TypeInfo struct {
 	Type string `json:"type"`
+	// ArtifactDepends lists the requirements the device must fulfill to
+	// install the update; e.g. the checksum of the installed rootfs image.
+	ArtifactDepends map[string]interface{} `json:"artifact_depends,omitempty"`
+}
+
+// DeviceTypeDepends is the key of the artifact dependency listing the types
+// of the devices the update is targeted at; e.g. the sensors attached to the
+// gateway the artifact is deployed to.
+const DeviceTypeDepends = "device_type"
+
+// DeviceTypes returns the types of the devices the update is targeted at;
+// nil if the update is installed on all the devices compatible with the
+// artifact.
+func (ti TypeInfo) DeviceTypes() []string {
+	devices, _ := ti.deviceTypes()
+	return devices
+}
+
+func (ti TypeInfo) deviceTypes() ([]string, error) {
+	d, ok := ti.ArtifactDepends[DeviceTypeDepends]
+	if !ok {
+		return nil, nil
+	}
+	var devices []string
+	switch list := d.(type) {
+	case []string:
+		devices = list
+	case []interface{}:
+		for _, d := range list {
+			s, ok := d.(string)
+			if !ok {
+				return nil, errors.New("invalid target device type")
+			}
+			devices = append(devices, s)
+		}
+	default:
+		return nil, errors.New("invalid target device types")
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("empty target device types")
+	}
+	return devices, nil
 }
 
 // Validate validates corectness of TypeInfo.
@@ -116,6 +232,9 @@ func (ti TypeInfo) Validate() error {
 	if len(ti.Type) == 0 {
 		return ErrValidatingData
 	}
+	if _, err := ti.deviceTypes(); err != nil {
+		return errors.Wrap(ErrValidatingData, err.Error())
+	}
 	return nil
 }
 
@@ -16,7 +16,9 @@ package artifact
 
 import (
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,6 +62,45 @@ func TestValidateHeaderInfo(t *testing.T) {
 	}
 }
 
+func TestValidity(t *testing.T) {
+	start := time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(30 * 24 * time.Hour)
+
+	var validityTests = []struct {
+		in      *Validity
+		now     time.Time
+		err     string
+		expired bool
+	}{
+		{nil, start, "", false},
+		{&Validity{}, start, "", false},
+		{&Validity{NotBefore: &start, NotAfter: &end}, start, "", false},
+		{&Validity{NotBefore: &start, NotAfter: &end}, end, "", false},
+		{&Validity{NotBefore: &start, NotAfter: &end}, start.Add(-time.Second),
+			"artifact not valid before: 2018-05-01T00:00:00Z", false},
+		{&Validity{NotBefore: &start, NotAfter: &end}, end.Add(time.Second),
+			"artifact expired at: 2018-05-31T00:00:00Z", true},
+		{&Validity{NotAfter: &end}, start.Add(-time.Hour), "", false},
+		{&Validity{NotBefore: &start}, end.Add(time.Hour), "", false},
+	}
+	for idx, tt := range validityTests {
+		err := tt.in.Check(tt.now)
+		if tt.err == "" {
+			assert.NoError(t, err, "failing test: %v", idx)
+			continue
+		}
+		assert.EqualError(t, err, tt.err, "failing test: %v", idx)
+		if assert.IsType(t, &ValidityError{}, err) {
+			assert.Equal(t, tt.expired, err.(*ValidityError).Expired())
+		}
+	}
+
+	hi := HeaderInfo{Updates: []UpdateType{{Type: "update"}},
+		CompatibleDevices: []string{"vexpress"}, ArtifactName: "id",
+		Validity: &Validity{NotBefore: &end, NotAfter: &start}}
+	assert.Equal(t, ErrValidatingData, hi.Validate())
+}
+
 func TestValidateTypeInfo(t *testing.T) {
 	var validateTests = []struct {
 		in  TypeInfo
@@ -68,11 +109,19 @@ func TestValidateTypeInfo(t *testing.T) {
 		{TypeInfo{}, ErrValidatingData},
 		{TypeInfo{Type: ""}, ErrValidatingData},
 		{TypeInfo{Type: "rootfs-image"}, nil},
+		{TypeInfo{Type: "rootfs-image", ArtifactDepends: map[string]interface{}{
+			DeviceTypeDepends: []interface{}{"sensor"}}}, nil},
+		{TypeInfo{Type: "rootfs-image", ArtifactDepends: map[string]interface{}{
+			DeviceTypeDepends: "sensor"}}, ErrValidatingData},
+		{TypeInfo{Type: "rootfs-image", ArtifactDepends: map[string]interface{}{
+			DeviceTypeDepends: []interface{}{"sensor", 1}}}, ErrValidatingData},
+		{TypeInfo{Type: "rootfs-image", ArtifactDepends: map[string]interface{}{
+			DeviceTypeDepends: []interface{}{}}}, ErrValidatingData},
 	}
 
 	for _, tt := range validateTests {
 		e := tt.in.Validate()
-		assert.Equal(t, e, tt.err)
+		assert.Equal(t, errors.Cause(e), tt.err)
 	}
 }
 
@@ -0,0 +1,294 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	pgpArmorBegin = "-----BEGIN PGP "
+	pgpArmorEnd   = "-----END PGP "
+)
+
+var pgpConfig = &packet.Config{DefaultHash: crypto.SHA256}
+
+// IsPGPKey checks if the key is an ASCII armored OpenPGP key.
+func IsPGPKey(key []byte) bool {
+	return bytes.Contains(key, []byte(pgpArmorBegin))
+}
+
+// OpenPGP Crypto interface implementation. Signatures are binary
+// OpenPGP detached signature packets.
+type OpenPGP struct{}
+
+func (p *OpenPGP) Sign(message []byte, key interface{}) ([]byte, error) {
+	entity, ok := key.(*openpgp.Entity)
+	if !ok || entity.PrivateKey == nil {
+		return nil, errors.New("signer: invalid private key")
+	}
+	sig := bytes.NewBuffer(nil)
+	err := openpgp.DetachSign(sig, entity, bytes.NewReader(message), pgpConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: error signing message")
+	}
+	return sig.Bytes(), nil
+}
+
+// Verify accepts the signature created by the primary key or any of the
+// subkeys of the entity, as long as the key is bound to the entity, is
+// allowed to sign and was neither expired nor revoked when signing.
+func (p *OpenPGP) Verify(message, sig []byte, key interface{}) error {
+	entity, ok := key.(*openpgp.Entity)
+	if !ok {
+		return errors.New("signer: invalid public key")
+	}
+
+	pkt, err := packet.Read(bytes.NewReader(sig))
+	if err != nil {
+		return errors.Wrap(err, "signer: invalid OpenPGP signature")
+	}
+	s, ok := pkt.(*packet.Signature)
+	if !ok || s.IssuerKeyId == nil || s.SigType != packet.SigTypeBinary {
+		return errors.New("signer: not an OpenPGP signature of binary data")
+	}
+	switch s.Hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+	default:
+		return errors.Errorf("signer: unsupported OpenPGP signature hash: %v", s.Hash)
+	}
+
+	keys := openpgp.EntityList{entity}.KeysByIdUsage(*s.IssuerKeyId, packet.KeyFlagSign)
+	for _, k := range keys {
+		if !pgpKeyValid(k, s.CreationTime) {
+			continue
+		}
+		h := s.Hash.New()
+		h.Write(message)
+		if k.PublicKey.VerifySignature(h, s) == nil {
+			return nil
+		}
+	}
+	return errors.New("signer: verification failed")
+}
+
+// pgpKeyValid checks that the key was neither expired nor revoked at the
+// given time. The subkey bindings are verified when the keys are read and
+// the key flags by KeysByIdUsage.
+func pgpKeyValid(k openpgp.Key, at time.Time) bool {
+	if k.SelfSignature == nil ||
+		k.SelfSignature.SigType == packet.SigTypeSubkeyRevocation {
+		return false
+	}
+	if pgpKeyExpired(k.PublicKey, k.SelfSignature, at) {
+		return false
+	}
+	if k.PublicKey == k.Entity.PrimaryKey {
+		return true
+	}
+	// subkeys can not outlive the primary key
+	for _, id := range k.Entity.Identities {
+		if pgpKeyExpired(k.Entity.PrimaryKey, id.SelfSignature, at) {
+			return false
+		}
+	}
+	return true
+}
+
+// pgpKeyExpired checks the key expiration time, which is relative to the
+// creation time of the key, stored in the self-signature.
+func pgpKeyExpired(pub *packet.PublicKey, sig *packet.Signature, at time.Time) bool {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return false
+	}
+	expiry := pub.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+	return at.After(expiry)
+}
+
+func pgpAlgorithm(algo packet.PublicKeyAlgorithm) string {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		return "RSA"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	default:
+		return "unknown"
+	}
+}
+
+// pgpBlock is a single ASCII armored block.
+type pgpBlock struct {
+	blockType string
+	body      []byte
+	raw       []byte
+}
+
+// pgpArmoredBlocks returns all the ASCII armored blocks stored in data;
+// the checksums of the blocks are verified.
+func pgpArmoredBlocks(data []byte) ([]pgpBlock, error) {
+	var blocks []pgpBlock
+	for {
+		start := bytes.Index(data, []byte(pgpArmorBegin))
+		if start < 0 {
+			return blocks, nil
+		}
+		data = data[start:]
+		end := bytes.Index(data, []byte(pgpArmorEnd))
+		if end < 0 {
+			return nil, errors.New("signer: invalid OpenPGP armor")
+		}
+		if eol := bytes.IndexByte(data[end:], '\n'); eol < 0 {
+			end = len(data)
+		} else {
+			end += eol + 1
+		}
+
+		block, err := armor.Decode(bytes.NewReader(data[:end]))
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: invalid OpenPGP armor")
+		}
+		body, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: invalid OpenPGP armor")
+		}
+		blocks = append(blocks, pgpBlock{
+			blockType: block.Type,
+			body:      body,
+			raw:       data[:end],
+		})
+		data = data[end:]
+	}
+}
+
+func pgpPublic(entity *openpgp.Entity) ([]byte, error) {
+	public := bytes.NewBuffer(nil)
+	if err := entity.PrimaryKey.Serialize(public); err != nil {
+		return nil, errors.Wrap(err, "signer: can not serialize OpenPGP key")
+	}
+	return public.Bytes(), nil
+}
+
+// getPGPVerifyMethods returns the verification method for each of the
+// entities stored in the armored public key block(s).
+func getPGPVerifyMethods(armored []byte) ([]*SigningMethod, error) {
+	blocks, err := pgpArmoredBlocks(armored)
+	if err != nil {
+		return nil, err
+	}
+	var methods []*SigningMethod
+	for _, b := range blocks {
+		if b.blockType != openpgp.PublicKeyType {
+			continue
+		}
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(b.body))
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: failed to parse OpenPGP public key")
+		}
+		for _, e := range entities {
+			public, err := pgpPublic(e)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods,
+				&SigningMethod{key: e, public: public, method: new(OpenPGP)})
+		}
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("signer: failed to parse OpenPGP public key")
+	}
+	return methods, nil
+}
+
+// getPGPSignMethod returns the signing method using the entity stored in
+// the armored secret key block.
+func getPGPSignMethod(armored []byte) (*SigningMethod, error) {
+	blocks, err := pgpArmoredBlocks(armored)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 || blocks[0].blockType != openpgp.PrivateKeyType {
+		return nil, errors.New("signer: failed to parse OpenPGP private key")
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(blocks[0].body))
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to parse OpenPGP private key")
+	}
+	entity := entities[0]
+	if entity.PrivateKey == nil {
+		return nil, errors.New("signer: failed to parse OpenPGP private key")
+	}
+	if entity.PrivateKey.Encrypted {
+		return nil, errors.New("signer: passphrase protected OpenPGP keys " +
+			"are not supported; please export the key without protection")
+	}
+	public, err := pgpPublic(entity)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningMethod{key: entity, public: public, method: new(OpenPGP)}, nil
+}
+
+// GeneratePGPKey generates the unprotected OpenPGP RSA key with the given
+// user ID and returns the ASCII armored private and public key blocks.
+// The user ID can be either the name or the name followed by the email
+// address in angle brackets.
+func GeneratePGPKey(bits int, userID string) ([]byte, []byte, error) {
+	name, email := userID, ""
+	if i := strings.LastIndex(userID, "<"); i >= 0 && strings.HasSuffix(userID, ">") {
+		name = strings.TrimSpace(userID[:i])
+		email = userID[i+1 : len(userID)-1]
+	}
+	config := &packet.Config{DefaultHash: crypto.SHA256, RSABits: bits}
+	entity, err := openpgp.NewEntity(name, "", email, config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not generate key")
+	}
+
+	private := bytes.NewBuffer(nil)
+	w, err := armor.Encode(private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not encode key")
+	}
+	// the identities and subkeys are signed while serializing private key
+	if err = entity.SerializePrivate(w, config); err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not encode key")
+	}
+	if err = w.Close(); err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not encode key")
+	}
+
+	public := bytes.NewBuffer(nil)
+	if w, err = armor.Encode(public, openpgp.PublicKeyType, nil); err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not encode key")
+	}
+	if err = entity.Serialize(w); err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not encode key")
+	}
+	if err = w.Close(); err != nil {
+		return nil, nil, errors.Wrap(err, "signer: can not encode key")
+	}
+	return append(private.Bytes(), '\n'), append(public.Bytes(), '\n'), nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// StatementType is the type of the in-toto statement.
+	StatementType = "https://in-toto.io/Statement/v0.1"
+	// ProvenanceType is the type of the SLSA provenance predicate.
+	ProvenanceType = "https://slsa.dev/provenance/v0.2"
+	// BuildTypeWrite is the build type of the provenance generated while
+	// writing the artifact with mender-artifact.
+	BuildTypeWrite = "https://mender.io/mender-artifact/write@v1"
+)
+
+// DigestSet maps the name of the hash algorithm to the hex encoded digest.
+type DigestSet map[string]string
+
+// Subject is the file the provenance is issued for.
+type Subject struct {
+	Name   string    `json:"name"`
+	Digest DigestSet `json:"digest"`
+}
+
+// Provenance is the in-toto statement carrying the SLSA provenance of the
+// artifact. It describes how the data files of the artifact were produced;
+// those are the subjects of the statement.
+type Provenance struct {
+	Type          string              `json:"_type"`
+	Subject       []Subject           `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenancePredicate is the SLSA provenance predicate.
+type ProvenancePredicate struct {
+	Builder    Builder     `json:"builder"`
+	BuildType  string      `json:"buildType"`
+	Invocation *Invocation `json:"invocation,omitempty"`
+	Metadata   *BuildInfo  `json:"metadata,omitempty"`
+	Materials  []Material  `json:"materials,omitempty"`
+}
+
+// Builder identifies the build platform.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// Invocation describes the event starting the build.
+type Invocation struct {
+	ConfigSource *ConfigSource          `json:"configSource,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// ConfigSource is the source the build definition comes from.
+type ConfigSource struct {
+	URI        string    `json:"uri,omitempty"`
+	Digest     DigestSet `json:"digest,omitempty"`
+	EntryPoint string    `json:"entryPoint,omitempty"`
+}
+
+// BuildInfo holds the timestamps of the build.
+type BuildInfo struct {
+	BuildInvocationID string     `json:"buildInvocationId,omitempty"`
+	BuildStartedOn    *time.Time `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn   *time.Time `json:"buildFinishedOn,omitempty"`
+}
+
+// Material is the input of the build.
+type Material struct {
+	URI    string    `json:"uri"`
+	Digest DigestSet `json:"digest,omitempty"`
+}
+
+// NewProvenance creates the provenance of the artifact built by the given
+// builder starting at the given time.
+func NewProvenance(builderID string, started time.Time) *Provenance {
+	return &Provenance{
+		Type:          StatementType,
+		PredicateType: ProvenanceType,
+		Predicate: ProvenancePredicate{
+			Builder:   Builder{ID: builderID},
+			BuildType: BuildTypeWrite,
+			Metadata:  &BuildInfo{BuildStartedOn: &started},
+		},
+	}
+}
+
+// ParseProvenance parses and validates the JSON encoded provenance.
+func ParseProvenance(data []byte) (*Provenance, error) {
+	p := new(Provenance)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrap(err, "provenance: can not parse provenance")
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Validate checks if the provenance is the supported statement.
+func (p *Provenance) Validate() error {
+	if p.Type != StatementType {
+		return errors.Errorf("provenance: unsupported statement type: %s", p.Type)
+	}
+	if p.PredicateType != ProvenanceType {
+		return errors.Errorf("provenance: unsupported predicate type: %s",
+			p.PredicateType)
+	}
+	if p.Predicate.Builder.ID == "" {
+		return errors.New("provenance: missing builder id")
+	}
+	return nil
+}
+
+// AddMaterial adds the file used for building the artifact together with
+// its checksum.
+func (p *Provenance) AddMaterial(uri, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "provenance: can not open material: %s", path)
+	}
+	defer f.Close()
+	ch := NewWriterChecksum(ioutil.Discard)
+	if _, err = io.Copy(ch, f); err != nil {
+		return errors.Wrapf(err, "provenance: can not read material: %s", path)
+	}
+	p.Predicate.Materials = append(p.Predicate.Materials,
+		Material{URI: uri, Digest: DigestSet{"sha256": string(ch.Checksum())}})
+	return nil
+}
+
+// Verify checks if all the subjects match the checksums stored in the
+// manifest of the artifact.
+func (p *Provenance) Verify(manifest *ChecksumStore) error {
+	if len(p.Subject) == 0 {
+		return errors.New("provenance: no subjects")
+	}
+	for _, s := range p.Subject {
+		sum, err := manifest.Get(s.Name)
+		if err != nil {
+			return errors.Errorf("provenance: subject is not a part of "+
+				"the artifact: %s", s.Name)
+		}
+		if s.Digest["sha256"] != string(sum) {
+			return errors.Errorf("provenance: invalid checksum of subject: %s",
+				s.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenance(t *testing.T) {
+	f, err := ioutil.TempFile("", "material")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("update")
+	require.NoError(t, err)
+	f.Close()
+
+	p := NewProvenance("https://ci.example.com", time.Now())
+	require.NoError(t, p.AddMaterial("file:update", f.Name()))
+	assert.Error(t, p.AddMaterial("file:missing", f.Name()+"-missing"))
+	require.Len(t, p.Predicate.Materials, 1)
+	sum := sha256.Sum256([]byte("update"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), p.Predicate.Materials[0].Digest["sha256"])
+
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	parsed, err := ParseProvenance(data)
+	require.NoError(t, err)
+	assert.Equal(t, p.Predicate.Builder, parsed.Predicate.Builder)
+	assert.Equal(t, p.Predicate.Materials, parsed.Predicate.Materials)
+
+	_, err = ParseProvenance([]byte("invalid"))
+	assert.Error(t, err)
+	_, err = ParseProvenance([]byte(`{"_type": "https://in-toto.io/Statement/v0.1",
+		"predicateType": "https://example.com/other"}`))
+	assert.Error(t, err)
+	p.Predicate.Builder.ID = ""
+	assert.Error(t, p.Validate())
+}
+
+func TestVerifyProvenance(t *testing.T) {
+	s := NewChecksumStore()
+	require.NoError(t, s.Add("data/0000/update", []byte("1234")))
+
+	p := NewProvenance("builder", time.Now())
+	assert.Error(t, p.Verify(s))
+
+	p.Subject = []Subject{{Name: "data/0000/update", Digest: DigestSet{"sha256": "1234"}}}
+	assert.NoError(t, p.Verify(s))
+
+	p.Subject[0].Digest["sha256"] = "4321"
+	assert.Error(t, p.Verify(s))
+
+	p.Subject[0].Name = "data/0001/update"
+	assert.Error(t, p.Verify(s))
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RevokedKey is a single entry of the revocation list.
+type RevokedKey struct {
+	// fingerprint of the public key; see Fingerprint
+	Fingerprint string    `json:"fingerprint"`
+	RevokedAt   time.Time `json:"revoked_at"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// RevocationList is the list of the signing keys which should not be
+// trusted anymore. The signature does not prove the list is the latest
+// one; an older list signed with the same key is valid as well, so the
+// callers should store the issue time of the accepted list and reject the
+// older ones using CheckIssued.
+type RevocationList struct {
+	Issued time.Time    `json:"issued"`
+	Keys   []RevokedKey `json:"revoked_keys"`
+}
+
+// signedRevocationList is the format the revocation list is stored in;
+// the signature is calculated over the compact JSON encoding of the list
+// so that the file can be reformatted without breaking the signature.
+type signedRevocationList struct {
+	List      json.RawMessage `json:"list"`
+	Signature string          `json:"signature"`
+}
+
+// RevokedKeyError is returned if the signature is valid, but the key used
+// for signing is revoked.
+type RevokedKeyError struct {
+	Keys []RevokedKey
+}
+
+func (e *RevokedKeyError) Error() string {
+	keys := make([]string, 0, len(e.Keys))
+	for _, k := range e.Keys {
+		keys = append(keys, fmt.Sprintf("%s (revoked at: %s)",
+			k.Fingerprint, k.RevokedAt.Format(time.RFC3339)))
+	}
+	return "signer: signed with revoked key: " + strings.Join(keys, ", ")
+}
+
+// ParseRevocationList verifies the signature of the revocation list and
+// returns the list if the signature is valid.
+func ParseRevocationList(raw []byte, v Verifier) (*RevocationList, error) {
+	signed := new(signedRevocationList)
+	if err := json.Unmarshal(raw, signed); err != nil {
+		return nil, errors.Wrap(err, "revocation: can not parse revocation list")
+	}
+	list := bytes.NewBuffer(nil)
+	if err := json.Compact(list, signed.List); err != nil {
+		return nil, errors.Wrap(err, "revocation: can not parse revocation list")
+	}
+	if err := v.Verify(list.Bytes(), []byte(signed.Signature)); err != nil {
+		return nil, errors.Wrap(err, "revocation: invalid revocation list signature")
+	}
+	rl := new(RevocationList)
+	if err := json.Unmarshal(list.Bytes(), rl); err != nil {
+		return nil, errors.Wrap(err, "revocation: can not parse revocation list")
+	}
+	return rl, nil
+}
+
+// CheckIssued returns an error if the list was issued before the last
+// accepted list so that the keys revoked since can not be trusted again by
+// replaying the older list.
+func (rl *RevocationList) CheckIssued(lastIssued time.Time) error {
+	if rl.Issued.Before(lastIssued) {
+		return errors.Errorf("revocation: revocation list issued at %s is "+
+			"older than the last accepted list issued at %s",
+			rl.Issued.Format(time.RFC3339), lastIssued.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Revoke adds the key to the list; if the key is already revoked the
+// earlier revocation time is kept.
+func (rl *RevocationList) Revoke(key RevokedKey) {
+	for i, k := range rl.Keys {
+		if k.Fingerprint == key.Fingerprint {
+			if key.RevokedAt.Before(k.RevokedAt) {
+				rl.Keys[i] = key
+			}
+			return
+		}
+	}
+	rl.Keys = append(rl.Keys, key)
+}
+
+// Get returns the revocation entry of the key or nil if the key is not
+// revoked.
+func (rl *RevocationList) Get(fingerprint string) *RevokedKey {
+	if rl == nil {
+		return nil
+	}
+	for i := range rl.Keys {
+		if rl.Keys[i].Fingerprint == fingerprint {
+			return &rl.Keys[i]
+		}
+	}
+	return nil
+}
+
+// Revoked returns the revocation entry of the key if the key is revoked at
+// the time the signature was created. If the signing time is not known
+// (zero) the key is considered revoked regardless of the revocation time.
+func (rl *RevocationList) Revoked(fingerprint string, signedAt time.Time) *RevokedKey {
+	r := rl.Get(fingerprint)
+	if r == nil || (!signedAt.IsZero() && signedAt.Before(r.RevokedAt)) {
+		return nil
+	}
+	return r
+}
+
+// Sign serializes and signs the revocation list.
+func (rl *RevocationList) Sign(s Signer) ([]byte, error) {
+	list, err := json.Marshal(rl)
+	if err != nil {
+		return nil, errors.Wrap(err, "revocation: can not serialize revocation list")
+	}
+	sig, err := s.Sign(list)
+	if err != nil {
+		return nil, errors.Wrap(err, "revocation: can not sign revocation list")
+	}
+	return json.MarshalIndent(&signedRevocationList{
+		List:      list,
+		Signature: string(sig),
+	}, "", "  ")
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationList(t *testing.T) {
+	revoked := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := &RevocationList{Issued: revoked}
+	rl.Revoke(RevokedKey{
+		Fingerprint: fingerprintPEM(t, PublicRSAKey),
+		RevokedAt:   revoked,
+		Reason:      "key compromised",
+	})
+	// earlier revocation time is kept
+	rl.Revoke(RevokedKey{
+		Fingerprint: fingerprintPEM(t, PublicRSAKey),
+		RevokedAt:   revoked.Add(time.Hour),
+	})
+	assert.Len(t, rl.Keys, 1)
+	assert.Equal(t, revoked, rl.Get(fingerprintPEM(t, PublicRSAKey)).RevokedAt)
+	assert.Nil(t, rl.Get(fingerprintPEM(t, PublicECDSAKey)))
+
+	// the list is signed with ECDSA key
+	list, err := rl.Sign(NewSigner([]byte(PrivateECDSAKey)))
+	require.NoError(t, err)
+
+	listKeys, err := NewKeyRing([]byte(PublicECDSAKey))
+	require.NoError(t, err)
+	parsed, err := ParseRevocationList(list, listKeys)
+	require.NoError(t, err)
+	assert.Equal(t, rl.Keys[0].Fingerprint, parsed.Keys[0].Fingerprint)
+	assert.True(t, revoked.Equal(parsed.Keys[0].RevokedAt))
+	assert.Equal(t, "key compromised", parsed.Keys[0].Reason)
+
+	// older list can not be replayed
+	assert.NoError(t, parsed.CheckIssued(revoked))
+	assert.NoError(t, parsed.CheckIssued(revoked.Add(-time.Hour)))
+	err = parsed.CheckIssued(revoked.Add(time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "older than the last accepted list")
+
+	// list signed with other key
+	otherKeys, err := NewKeyRing([]byte(PublicRSAKey))
+	require.NoError(t, err)
+	_, err = ParseRevocationList(list, otherKeys)
+	assert.Error(t, err)
+
+	_, err = ParseRevocationList([]byte("invalid"), listKeys)
+	assert.Error(t, err)
+
+	// signatures created with revoked keys are not valid anymore
+	msg := []byte("this is secret message")
+	rsaSig, err := NewSigner([]byte(PrivateRSAKey)).Sign(msg)
+	require.NoError(t, err)
+	ecdsaSig, err := NewSigner([]byte(PrivateECDSAKey)).Sign(msg)
+	require.NoError(t, err)
+
+	kr, err := NewKeyRing([]byte(PublicRSAKey + "\n" + PublicECDSAKey))
+	require.NoError(t, err)
+	kr.SetRevocationList(parsed)
+
+	err = kr.Verify(msg, rsaSig)
+	require.Error(t, err)
+	revErr, ok := err.(*RevokedKeyError)
+	require.True(t, ok)
+	assert.Equal(t, fingerprintPEM(t, PublicRSAKey), revErr.Keys[0].Fingerprint)
+	assert.Contains(t, err.Error(), "signed with revoked key")
+
+	assert.NoError(t, kr.Verify(msg, ecdsaSig))
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Signature is a single signature of the manifest. KeyID is the fingerprint
+// of the key used for signing; it is empty for the signatures created
+// before multiple signatures were supported.
+type Signature struct {
+	// base64 encoded signature as returned by the Signer
+	Signature []byte
+	KeyID     string
+}
+
+// Signatures is the content of the manifest.sig file.
+//
+// A single signature without key identifier is stored as it is; this is
+// the only format understood by older clients. If there are more
+// signatures each of those is stored in a separate line followed by the
+// key identifier, formatted the same way as the manifest file:
+//
+//	<base64 signature>  <key fingerprint>
+type Signatures []Signature
+
+// ParseSignatures parses the content of the manifest.sig file.
+func ParseSignatures(raw []byte) (Signatures, error) {
+	var sigs Signatures
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		chunks := strings.Split(line, "  ")
+		switch len(chunks) {
+		case 1:
+			sigs = append(sigs, Signature{Signature: []byte(chunks[0])})
+		case 2:
+			sigs = append(sigs, Signature{Signature: []byte(chunks[0]), KeyID: chunks[1]})
+		default:
+			return nil, errors.Errorf("signer: malformed signature line: '%s'", line)
+		}
+	}
+	if len(sigs) == 0 {
+		return nil, errors.New("signer: missing signature")
+	}
+	return sigs, nil
+}
+
+// Raw returns the content of the manifest.sig file.
+func (s Signatures) Raw() []byte {
+	if len(s) == 1 && s[0].KeyID == "" {
+		return s[0].Signature
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, sig := range s {
+		if sig.KeyID == "" {
+			buf.WriteString(fmt.Sprintf("%s\n", sig.Signature))
+		} else {
+			buf.WriteString(fmt.Sprintf("%s  %s\n", sig.Signature, sig.KeyID))
+		}
+	}
+	return buf.Bytes()
+}
+
+// HasKey checks if there is a signature created with the given key. The
+// signatures without the key identifier can only be told by verifying
+// those with the key.
+func (s Signatures) HasKey(keyID string) bool {
+	for _, sig := range s {
+		if sig.KeyID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// ThresholdVerifier is a Verifier requiring the manifest to be signed
+// with at least the threshold number of different keys from the key ring.
+type ThresholdVerifier struct {
+	keys      *KeyRing
+	threshold int
+}
+
+func NewThresholdVerifier(keys *KeyRing, threshold int) *ThresholdVerifier {
+	return &ThresholdVerifier{
+		keys:      keys,
+		threshold: threshold,
+	}
+}
+
+func (tv *ThresholdVerifier) Verify(message, sig []byte) error {
+	_, err := tv.VerifyKeys(message, sig)
+	return err
+}
+
+// VerifyKeys verifies the signatures and returns the fingerprints of all
+// the keys which were used for creating valid signatures.
+func (tv *ThresholdVerifier) VerifyKeys(message, sig []byte) ([]string, error) {
+	keys, err := tv.keys.VerifyAll(message, sig)
+	if err != nil && err != ErrNoMatchingKey {
+		return nil, err
+	}
+	if len(keys) < tv.threshold {
+		return keys, errors.Errorf("signer: not enough valid signatures; "+
+			"required: %d; valid: %d", tv.threshold, len(keys))
+	}
+	return keys, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSignatures(t *testing.T) {
+	// single signature without key identifier
+	sigs, err := ParseSignatures([]byte("c2lnbmF0dXJl"))
+	assert.NoError(t, err)
+	assert.Equal(t, Signatures{{Signature: []byte("c2lnbmF0dXJl")}}, sigs)
+	assert.Equal(t, []byte("c2lnbmF0dXJl"), sigs.Raw())
+
+	// multiple signatures
+	raw := "c2lnbmF0dXJl\nb3RoZXI=  1234\n"
+	sigs, err = ParseSignatures([]byte(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, Signatures{
+		{Signature: []byte("c2lnbmF0dXJl")},
+		{Signature: []byte("b3RoZXI="), KeyID: "1234"},
+	}, sigs)
+	assert.Equal(t, raw, string(sigs.Raw()))
+	assert.True(t, sigs.HasKey("1234"))
+	assert.False(t, sigs.HasKey("5678"))
+
+	_, err = ParseSignatures([]byte("c2ln  1234  5678"))
+	assert.Error(t, err)
+	_, err = ParseSignatures([]byte("\n"))
+	assert.Error(t, err)
+}
+
+func TestThresholdVerifier(t *testing.T) {
+	msg := []byte("this is secret message")
+
+	rsaSig, err := NewSigner([]byte(PrivateRSAKey)).Sign(msg)
+	require.NoError(t, err)
+	ecdsaSig, err := NewSigner([]byte(PrivateECDSAKey)).Sign(msg)
+	require.NoError(t, err)
+
+	rsaFp := fingerprintPEM(t, PublicRSAKey)
+	ecdsaFp := fingerprintPEM(t, PublicECDSAKey)
+
+	kr, err := NewKeyRing([]byte(PublicRSAKey), []byte(PublicECDSAKey))
+	require.NoError(t, err)
+
+	sigs := Signatures{
+		{Signature: rsaSig},
+		{Signature: ecdsaSig, KeyID: ecdsaFp},
+	}
+
+	keys, err := NewThresholdVerifier(kr, 2).VerifyKeys(msg, sigs.Raw())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{rsaFp, ecdsaFp}, keys)
+
+	// the same key signing twice is counted once
+	sigs = Signatures{
+		{Signature: rsaSig},
+		{Signature: rsaSig, KeyID: rsaFp},
+	}
+	err = NewThresholdVerifier(kr, 2).Verify(msg, sigs.Raw())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "required: 2; valid: 1")
+	assert.NoError(t, NewThresholdVerifier(kr, 1).Verify(msg, sigs.Raw()))
+
+	// key identifier not matching the key used for signing
+	sigs = Signatures{{Signature: rsaSig, KeyID: ecdsaFp}}
+	err = NewThresholdVerifier(kr, 1).Verify(msg, sigs.Raw())
+	assert.Error(t, err)
+
+	// single key verifier is checking the signature matching its key
+	sigs = Signatures{
+		{Signature: rsaSig, KeyID: rsaFp},
+		{Signature: ecdsaSig, KeyID: ecdsaFp},
+	}
+	assert.NoError(t, NewVerifier([]byte(PublicECDSAKey)).Verify(msg, sigs.Raw()))
+	assert.NoError(t, NewVerifier([]byte(PublicRSAKey)).Verify(msg, sigs.Raw()))
+	assert.NoError(t, kr.Verify(msg, sigs.Raw()))
+}
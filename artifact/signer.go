@@ -172,10 +172,12 @@ type SigningMethod struct {
 }
 
 // PKISigner implements public-key encryption and supports X.509-encodded keys.
-// For now both RSA and 256 bits ECDSA are supported.
+// For now both RSA and 256 bits ECDSA are supported. ASCII armored OpenPGP
+// RSA keys can be used as well; see OpenPGP.
 type PKISigner struct {
-	privateKey []byte
-	publicKey  []byte
+	privateKey  []byte
+	publicKey   []byte
+	timestamper Timestamper
 }
 
 func NewSigner(privateKey []byte) *PKISigner {
@@ -186,6 +188,21 @@ func NewVerifier(publicKey []byte) *PKISigner {
 	return &PKISigner{publicKey: publicKey}
 }
 
+// SetTimestamper sets the time stamping authority used for obtaining
+// trusted timestamps of the created signatures.
+func (s *PKISigner) SetTimestamper(t Timestamper) {
+	s.timestamper = t
+}
+
+// Timestamp returns the timestamp token of the signature or nil if the
+// signer has no time stamping authority set.
+func (s *PKISigner) Timestamp(sig []byte) ([]byte, error) {
+	if s.timestamper == nil {
+		return nil, nil
+	}
+	return s.timestamper.Timestamp(sig)
+}
+
 func (s *PKISigner) Sign(message []byte) ([]byte, error) {
 	sm, err := getKeyAndSignMethod(s.privateKey)
 	if err != nil {
@@ -200,18 +217,52 @@ func (s *PKISigner) Sign(message []byte) ([]byte, error) {
 	return enc, nil
 }
 
+// Verify checks if the message is signed with the verifier public key or
+// with the public part of the signer private key. If there are more
+// signatures, the one matching the key is used.
 func (s *PKISigner) Verify(message, sig []byte) error {
-	sm, err := getKeyAndVerifyMethod(s.publicKey)
+	sm, err := s.verifyMethod()
 	if err != nil {
 		return err
 	}
-	dec := make([]byte, base64.StdEncoding.DecodedLen(len(sig)))
-	decLen, err := base64.StdEncoding.Decode(dec, sig)
+	sigs, err := ParseSignatures(sig)
 	if err != nil {
-		return errors.Wrap(err, "signer: error decoding signature")
+		return err
 	}
+	fp := Fingerprint(sm.public)
+	for _, sig := range sigs {
+		if sig.KeyID != "" && sig.KeyID != fp {
+			continue
+		}
+		dec := make([]byte, base64.StdEncoding.DecodedLen(len(sig.Signature)))
+		decLen, err := base64.StdEncoding.Decode(dec, sig.Signature)
+		if err != nil {
+			return errors.Wrap(err, "signer: error decoding signature")
+		}
+		if err = sm.method.Verify(message, dec[:decLen], sm.key); err == nil ||
+			len(sigs) == 1 {
+			return err
+		}
+	}
+	return ErrNoMatchingKey
+}
 
-	return sm.method.Verify(message, dec[:decLen], sm.key)
+func (s *PKISigner) verifyMethod() (*SigningMethod, error) {
+	if s.publicKey != nil || s.privateKey == nil {
+		return getKeyAndVerifyMethod(s.publicKey)
+	}
+	sm, err := getKeyAndSignMethod(s.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	switch key := sm.key.(type) {
+	case *rsa.PrivateKey:
+		return &SigningMethod{key: &key.PublicKey, public: sm.public, method: sm.method}, nil
+	case *ecdsa.PrivateKey:
+		return &SigningMethod{key: &key.PublicKey, public: sm.public, method: sm.method}, nil
+	}
+	// the OpenPGP entity holds the public key as well
+	return sm, nil
 }
 
 func GetPublic(private []byte) ([]byte, error) {
@@ -223,26 +274,39 @@ func GetPublic(private []byte) ([]byte, error) {
 }
 
 func getKeyAndVerifyMethod(keyPEM []byte) (*SigningMethod, error) {
+	if IsPGPKey(keyPEM) {
+		methods, err := getPGPVerifyMethods(keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		return methods[0], nil
+	}
 	block, _ := pem.Decode(keyPEM)
 	if block == nil {
 		return nil, errors.New("signer: failed to parse public key")
 	}
+	return getVerifyMethod(block.Bytes)
+}
 
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+func getVerifyMethod(keyDER []byte) (*SigningMethod, error) {
+	pub, err := x509.ParsePKIXPublicKey(keyDER)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse encoded public key")
 	}
 	switch pub := pub.(type) {
 	case *rsa.PublicKey:
-		return &SigningMethod{key: pub, method: new(RSA)}, nil
+		return &SigningMethod{key: pub, public: keyDER, method: new(RSA)}, nil
 	case *ecdsa.PublicKey:
-		return &SigningMethod{key: pub, method: new(ECDSA256)}, nil
+		return &SigningMethod{key: pub, public: keyDER, method: new(ECDSA256)}, nil
 	default:
 		return nil, errors.Errorf("unsupported public key type: %v", pub)
 	}
 }
 
 func getKeyAndSignMethod(keyPEM []byte) (*SigningMethod, error) {
+	if IsPGPKey(keyPEM) {
+		return getPGPSignMethod(keyPEM)
+	}
 	block, _ := pem.Decode(keyPEM)
 	if block == nil {
 		return nil, errors.New("signer: failed to parse private key")
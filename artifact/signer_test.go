@@ -171,6 +171,10 @@ func TestRSA(t *testing.T) {
 	err = v.Verify(msg, sig)
 	assert.NoError(t, err)
 
+	// the signer verifies using the public part of its private key
+	assert.NoError(t, s.Verify(msg, sig))
+	assert.Error(t, s.Verify([]byte("other message"), sig))
+
 	// use invalid key
 	v = NewVerifier([]byte(PublicRSAKeyError))
 	err = v.Verify(msg, sig)
@@ -200,6 +204,10 @@ func TestECDSA(t *testing.T) {
 	err = v.Verify(msg, sig)
 	assert.NoError(t, err)
 
+	// the signer verifies using the public part of its private key
+	assert.NoError(t, s.Verify(msg, sig))
+	assert.Error(t, s.Verify([]byte("other message"), sig))
+
 	// use invalid key
 	v = NewVerifier([]byte(PublicECDSAKeyError))
 	err = v.Verify(msg, sig)
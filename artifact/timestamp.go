@@ -0,0 +1,417 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Timestamper returns RFC 3161 timestamp token of the provided data.
+type Timestamper interface {
+	Timestamp(data []byte) ([]byte, error)
+}
+
+var (
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+// ASN.1 structures of RFC 3161 and RFC 5652 (CMS).
+type tsMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsRequest struct {
+	Version        int
+	MessageImprint tsMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     asn1.RawValue         `asn1:"optional,tag:0"`
+}
+
+type tsStatus struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type tsResponse struct {
+	Status         tsStatus
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tsAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsMessageImprint
+	SerialNumber   *big.Int
+	// parsed manually as fractional seconds are allowed
+	GenTime    asn1.RawValue
+	Accuracy   tsAccuracy    `asn1:"optional"`
+	Ordering   bool          `asn1:"optional"`
+	Nonce      *big.Int      `asn1:"optional"`
+	TSA        asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// TSAClient obtains the timestamp tokens from the time stamping
+// authority using the HTTP transport described in RFC 3161.
+type TSAClient struct {
+	url    string
+	client *http.Client
+}
+
+func NewTSAClient(url string) *TSAClient {
+	return &TSAClient{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Timestamp requests the timestamp token of the SHA256 checksum of the data.
+func (c *TSAClient) Timestamp(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, errors.Wrap(err, "timestamp: can not create nonce")
+	}
+	req, err := asn1.Marshal(tsRequest{
+		Version: 1,
+		MessageImprint: tsMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			HashedMessage: sum[:],
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "timestamp: can not create request")
+	}
+
+	rsp, err := c.client.Post(c.url, "application/timestamp-query",
+		bytes.NewReader(req))
+	if err != nil {
+		return nil, errors.Wrap(err, "timestamp: can not connect to TSA")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("timestamp: TSA responded with: %s", rsp.Status)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "timestamp: can not read TSA response")
+	}
+
+	resp := new(tsResponse)
+	if _, err = asn1.Unmarshal(body, resp); err != nil {
+		return nil, errors.Wrap(err, "timestamp: invalid TSA response")
+	}
+	// 0 is granted and 1 is granted with modifications
+	if resp.Status.Status > 1 || len(resp.TimeStampToken.FullBytes) == 0 {
+		return nil, errors.Errorf("timestamp: request rejected by TSA; status: %d",
+			resp.Status.Status)
+	}
+
+	info, _, err := parseTimestampToken(resp.TimeStampToken.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("timestamp: nonce of the response not matching")
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, sum[:]) {
+		return nil, errors.New("timestamp: token not matching request")
+	}
+	return resp.TimeStampToken.FullBytes, nil
+}
+
+// TimestampVerifier verifies the timestamp tokens issued by the time
+// stamping authorities trusted by the root certificates.
+type TimestampVerifier struct {
+	roots *x509.CertPool
+}
+
+// NewTimestampVerifier creates the verifier trusting the PEM encoded root
+// certificates of the time stamping authorities.
+func NewTimestampVerifier(rootsPEM []byte) (*TimestampVerifier, error) {
+	roots, err := ParseCertificates(rootsPEM)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, r := range roots {
+		pool.AddCert(r)
+	}
+	return &TimestampVerifier{roots: pool}, nil
+}
+
+// Verify verifies the timestamp token of the data and returns the time
+// the timestamp was issued at.
+func (v *TimestampVerifier) Verify(data, token []byte) (time.Time, error) {
+	info, signer, err := parseTimestampToken(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	h, err := hashFromOID(info.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return time.Time{}, err
+	}
+	d := h.New()
+	d.Write(data)
+	if !bytes.Equal(d.Sum(nil), info.MessageImprint.HashedMessage) {
+		return time.Time{}, errors.New("timestamp: token not matching signature")
+	}
+
+	genTime, err := time.Parse("20060102150405Z0700", string(info.GenTime.Bytes))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "timestamp: invalid time")
+	}
+
+	// the TSA certificate must be valid at the time the token was issued
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		CurrentTime:   genTime,
+	}
+	for _, c := range signer.chain {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err = signer.cert.Verify(opts); err != nil {
+		return time.Time{}, errors.Wrap(err, "timestamp: invalid TSA certificate")
+	}
+	return genTime, nil
+}
+
+type tsSigner struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+}
+
+// parseTimestampToken parses the token and verifies its signature
+// returning the certificate of the signer.
+func parseTimestampToken(token []byte) (*tstInfo, *tsSigner, error) {
+	ci := new(cmsContentInfo)
+	if _, err := asn1.Unmarshal(token, ci); err != nil {
+		return nil, nil, errors.Wrap(err, "timestamp: invalid token")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, errors.New("timestamp: token is not signed data")
+	}
+	sd := new(cmsSignedData)
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, sd); err != nil {
+		return nil, nil, errors.Wrap(err, "timestamp: invalid token")
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, nil, errors.New("timestamp: token does not contain timestamp")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, nil, errors.New("timestamp: token must have exactly one signer")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "timestamp: invalid token certificates")
+	}
+
+	si := sd.SignerInfos[0]
+	signer, err := findTimestampSigner(si.SID, certs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = verifyTimestampSignature(&si, signer.cert,
+		sd.EncapContentInfo.EContent); err != nil {
+		return nil, nil, err
+	}
+
+	info := new(tstInfo)
+	if _, err = asn1.Unmarshal(sd.EncapContentInfo.EContent, info); err != nil {
+		return nil, nil, errors.Wrap(err, "timestamp: invalid token info")
+	}
+	return info, signer, nil
+}
+
+func findTimestampSigner(sid asn1.RawValue,
+	certs []*x509.Certificate) (*tsSigner, error) {
+	ias := new(cmsIssuerAndSerial)
+	if _, err := asn1.Unmarshal(sid.FullBytes, ias); err != nil {
+		return nil, errors.Wrap(err, "timestamp: unsupported signer identifier")
+	}
+	for i, c := range certs {
+		if bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes) &&
+			c.SerialNumber.Cmp(ias.Serial) == 0 {
+			chain := append(append([]*x509.Certificate{}, certs[:i]...), certs[i+1:]...)
+			return &tsSigner{cert: c, chain: chain}, nil
+		}
+	}
+	return nil, errors.New("timestamp: no certificate of the token signer")
+}
+
+func verifyTimestampSignature(si *cmsSignerInfo, cert *x509.Certificate,
+	content []byte) error {
+	h, err := hashFromOID(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	algo, err := signatureAlgorithm(h, cert)
+	if err != nil {
+		return err
+	}
+
+	signed := content
+	if len(si.SignedAttrs.FullBytes) != 0 {
+		attrs, err := parseAttributes(si.SignedAttrs.Bytes)
+		if err != nil {
+			return err
+		}
+		var ct asn1.ObjectIdentifier
+		if _, err = asn1.Unmarshal(attrs[oidContentType.String()], &ct); err != nil ||
+			!ct.Equal(oidTSTInfo) {
+			return errors.New("timestamp: invalid content type attribute")
+		}
+		var digest []byte
+		if _, err = asn1.Unmarshal(attrs[oidMessageDigest.String()], &digest); err != nil {
+			return errors.New("timestamp: invalid message digest attribute")
+		}
+		d := h.New()
+		d.Write(content)
+		if !bytes.Equal(d.Sum(nil), digest) {
+			return errors.New("timestamp: message digest not matching")
+		}
+		// the signature is calculated over the DER encoded SET OF attributes
+		signed = append([]byte{}, si.SignedAttrs.FullBytes...)
+		signed[0] = 0x31
+	}
+	if err = cert.CheckSignature(algo, signed, si.Signature); err != nil {
+		return errors.Wrap(err, "timestamp: invalid token signature")
+	}
+	return nil
+}
+
+// parseAttributes returns the first value of each of the attributes.
+func parseAttributes(raw []byte) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	for len(raw) > 0 {
+		attr := new(cmsAttribute)
+		rest, err := asn1.Unmarshal(raw, attr)
+		if err != nil {
+			return nil, errors.Wrap(err, "timestamp: invalid signed attributes")
+		}
+		var value asn1.RawValue
+		if _, err = asn1.Unmarshal(attr.Values.Bytes, &value); err != nil {
+			return nil, errors.Wrap(err, "timestamp: invalid signed attributes")
+		}
+		attrs[attr.Type.String()] = value.FullBytes
+		raw = rest
+	}
+	return attrs, nil
+}
+
+func hashFromOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, errors.Errorf("timestamp: unsupported hash algorithm: %v", oid)
+}
+
+func signatureAlgorithm(h crypto.Hash,
+	cert *x509.Certificate) (x509.SignatureAlgorithm, error) {
+	algos := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA: {
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		},
+		x509.ECDSA: {
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		},
+	}
+	if algo, ok := algos[cert.PublicKeyAlgorithm][h]; ok {
+		return algo, nil
+	}
+	return x509.UnknownSignatureAlgorithm,
+		errors.New("timestamp: unsupported signature algorithm")
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package artifact
+
+import (
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/artifact/tsatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestamp(t *testing.T) {
+	validity := time.Now().Add(24 * time.Hour)
+	root := makeTestCert(t, "tsa root", true, x509.KeyUsageCertSign, validity, nil)
+	tsaCert := makeTestCert(t, "tsa", false, x509.KeyUsageDigitalSignature,
+		validity, root, x509.ExtKeyUsageTimeStamping)
+
+	tsa, err := tsatest.NewAuthority(tsaCert.certPEM, tsaCert.keyPEM)
+	require.NoError(t, err)
+	issued := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	tsa.Now = func() time.Time { return issued }
+	srv := httptest.NewServer(tsa)
+	defer srv.Close()
+
+	sig := []byte("signature")
+	token, err := NewTSAClient(srv.URL).Timestamp(sig)
+	require.NoError(t, err)
+
+	v, err := NewTimestampVerifier(root.certPEM)
+	require.NoError(t, err)
+	ts, err := v.Verify(sig, token)
+	assert.NoError(t, err)
+	assert.True(t, issued.Equal(ts))
+
+	// token of other data
+	_, err = v.Verify([]byte("other signature"), token)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "token not matching signature")
+
+	// tampered token
+	tampered := append([]byte{}, token...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = v.Verify(sig, tampered)
+	assert.Error(t, err)
+
+	// untrusted TSA
+	otherRoot := makeTestCert(t, "other root", true, x509.KeyUsageCertSign,
+		validity, nil)
+	ov, err := NewTimestampVerifier(otherRoot.certPEM)
+	require.NoError(t, err)
+	_, err = ov.Verify(sig, token)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid TSA certificate")
+
+	// certificate not allowed for time stamping
+	codeSigning := makeTestCert(t, "code signing", false,
+		x509.KeyUsageDigitalSignature, validity, root)
+	other, err := tsatest.NewAuthority(codeSigning.certPEM, codeSigning.keyPEM)
+	require.NoError(t, err)
+	otherSrv := httptest.NewServer(other)
+	defer otherSrv.Close()
+	token, err = NewTSAClient(otherSrv.URL).Timestamp(sig)
+	require.NoError(t, err)
+	_, err = v.Verify(sig, token)
+	assert.Error(t, err)
+
+	_, err = NewTSAClient("http://127.0.0.1:0").Timestamp(sig)
+	assert.Error(t, err)
+}
+
+func TestTimestampRevocation(t *testing.T) {
+	msg := []byte("this is secret message")
+	signer := NewSigner([]byte(PrivateECDSAKey))
+	sig, err := signer.Sign(msg)
+	require.NoError(t, err)
+
+	// no time stamping authority set
+	token, err := signer.Timestamp(sig)
+	assert.NoError(t, err)
+	assert.Nil(t, token)
+
+	revoked := time.Now()
+	rl := new(RevocationList)
+	rl.Revoke(RevokedKey{
+		Fingerprint: fingerprintPEM(t, PublicECDSAKey),
+		RevokedAt:   revoked,
+	})
+	kr, err := NewKeyRing([]byte(PublicECDSAKey))
+	require.NoError(t, err)
+	kr.SetRevocationList(rl)
+
+	// signing time not known
+	assert.Error(t, kr.Verify(msg, sig))
+
+	// signed before the key was revoked
+	kr.SetSigningTime(revoked.Add(-time.Hour))
+	assert.NoError(t, kr.Verify(msg, sig))
+
+	kr.SetSigningTime(revoked.Add(time.Hour))
+	assert.Error(t, kr.Verify(msg, sig))
+}
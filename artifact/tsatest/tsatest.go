@@ -0,0 +1,387 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package tsatest provides a minimal RFC 3161 time stamping authority
+// for testing the timestamped artifact signatures.
+package tsatest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAnyPolicy       = asn1.ObjectIdentifier{2, 5, 29, 32, 0}
+	// id-aa-signingCertificateV2 of RFC 5035
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+)
+
+// ASN.1 structures of RFC 3161 and RFC 5652 (CMS); these are kept apart
+// from the ones of the artifact package so that the tokens issued here
+// test its parsing.
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type request struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     asn1.RawValue         `asn1:"optional,tag:0"`
+}
+
+type status struct {
+	Status int
+}
+
+type response struct {
+	Status         status
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        asn1.RawValue
+	Nonce          *big.Int `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// essCertIDv2 identifies the certificate of the TSA; SHA256 is the default
+// hash algorithm so it is not encoded.
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type essSigningCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// Authority is a minimal RFC 3161 time stamping authority issuing SHA256
+// timestamp tokens. It serves the requests sent using HTTP, so it can be
+// used with httptest.NewServer.
+type Authority struct {
+	cert   *x509.Certificate
+	chain  []*x509.Certificate
+	key    crypto.Signer
+	serial int64
+	lock   sync.Mutex
+
+	// Now returns the time the tokens are issued at; if not set the
+	// current time is used.
+	Now func() time.Time
+}
+
+// NewAuthority creates the TSA using the PEM encoded private key and the
+// certificate chain starting with the TSA certificate.
+func NewAuthority(chainPEM, keyPEM []byte) (*Authority, error) {
+	var chain []*x509.Certificate
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "tsatest: invalid certificate")
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("tsatest: no certificates found")
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{cert: chain[0], chain: chain[1:], key: key}, nil
+}
+
+func parseKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("tsatest: failed to parse private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "tsatest: unsupported private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("tsatest: unsupported private key")
+	}
+	return signer, nil
+}
+
+// ServeHTTP handles the timestamp requests sent using HTTP.
+func (a *Authority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rsp, err := a.Respond(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(rsp)
+}
+
+// Respond returns the DER encoded response to the DER encoded request.
+func (a *Authority) Respond(req []byte) ([]byte, error) {
+	r := new(request)
+	if _, err := asn1.Unmarshal(req, r); err != nil {
+		return nil, errors.Wrap(err, "tsatest: invalid request")
+	}
+	if !r.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) {
+		// 2 is rejection
+		return asn1.Marshal(response{Status: status{Status: 2}})
+	}
+	token, err := a.issue(r)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(response{
+		Status:         status{Status: 0},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	})
+}
+
+func (a *Authority) issue(req *request) ([]byte, error) {
+	a.lock.Lock()
+	a.serial++
+	serial := a.serial
+	a.lock.Unlock()
+
+	now := time.Now()
+	if a.Now != nil {
+		now = a.Now()
+	}
+	policy := req.ReqPolicy
+	if policy == nil {
+		policy = oidAnyPolicy
+	}
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   big.NewInt(serial),
+		GenTime: asn1.RawValue{
+			Tag:   asn1.TagGeneralizedTime,
+			Bytes: []byte(now.UTC().Format("20060102150405Z")),
+		},
+		Nonce: req.Nonce,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "tsatest: can not create token")
+	}
+
+	attrs, err := signedAttributes(info, a.cert)
+	if err != nil {
+		return nil, err
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(attrs.FullBytes)
+	sig, err := a.key.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "tsatest: can not sign token")
+	}
+	sigAlgo := oidSHA256WithRSA
+	if a.cert.PublicKeyAlgorithm == x509.ECDSA {
+		sigAlgo = oidECDSAWithSHA256
+	}
+
+	sid, err := asn1.Marshal(issuerAndSerial{
+		Issuer: asn1.RawValue{FullBytes: a.cert.RawIssuer},
+		Serial: a.cert.SerialNumber,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "tsatest: can not create token")
+	}
+
+	var certs []byte
+	if req.CertReq {
+		certs = append(certs, a.cert.Raw...)
+		for _, c := range a.chain {
+			certs = append(certs, c.Raw...)
+		}
+	}
+	sd := signedData{
+		Version: 3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{
+			{Algorithm: oidSHA256},
+		},
+		EncapContentInfo: encapContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     info,
+		},
+		SignerInfos: []signerInfo{{
+			Version:         1,
+			SID:             asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      attrs.Bytes,
+			},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlgo},
+			Signature:          sig,
+		}},
+	}
+	if certs != nil {
+		sd.Certificates = asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      certs,
+		}
+	}
+	data, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, errors.Wrap(err, "tsatest: can not create token")
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      data,
+		},
+	})
+}
+
+// signedAttributes returns the DER encoded SET OF signed attributes
+// of the token.
+func signedAttributes(info []byte, cert *x509.Certificate) (*asn1.RawValue, error) {
+	digest := crypto.SHA256.New()
+	digest.Write(info)
+	certHash := sha256.Sum256(cert.Raw)
+
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidTSTInfo},
+		{oidMessageDigest, digest.Sum(nil)},
+		{oidSigningCertificateV2, essSigningCertificateV2{
+			Certs: []essCertIDv2{{CertHash: certHash[:]}},
+		}},
+	} {
+		value, err := asn1.Marshal(a.value)
+		if err != nil {
+			return nil, errors.Wrap(err, "tsatest: can not create token")
+		}
+		attr, err := asn1.Marshal(attribute{
+			Type: a.oid,
+			Values: asn1.RawValue{
+				Tag:        asn1.TagSet,
+				IsCompound: true,
+				Bytes:      value,
+			},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "tsatest: can not create token")
+		}
+		attrs = append(attrs, attr)
+	}
+	// DER requires the elements of SET OF to be sorted
+	sort.Slice(attrs, func(i, j int) bool {
+		return bytes.Compare(attrs[i], attrs[j]) < 0
+	})
+
+	raw := asn1.RawValue{
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      bytes.Join(attrs, nil),
+	}
+	full, err := asn1.Marshal(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "tsatest: can not create token")
+	}
+	raw.FullBytes = full
+	return &raw, nil
+}
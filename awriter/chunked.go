@@ -0,0 +1,45 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package awriter
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// WriteRootfsChunked writes an artifact with the chunked update built from
+// the ext4 image. The chunks of the base image are left out of the chunk
+// store; base can be empty to store all the chunks.
+func (aw *Writer) WriteRootfsChunked(format string, version int,
+	devices []string, name string, image, base string,
+	scr *artifact.Scripts) error {
+
+	dir, err := ioutil.TempDir("", "mender-chunked")
+	if err != nil {
+		return errors.Wrap(err, "writer: can not create chunk store")
+	}
+	defer os.RemoveAll(dir)
+
+	u, err := handlers.GenerateRootfsChunked(image, base, dir)
+	if err != nil {
+		return err
+	}
+	return aw.WriteArtifact(format, version, devices, name,
+		&Updates{U: []handlers.Composer{u}}, scr)
+}
@@ -30,8 +30,12 @@ import (
 // Writer provides on the fly writing of artifacts metadata file used by
 // the Mender client and the server.
 type Writer struct {
-	w      io.Writer // underlying writer
-	signer artifact.Signer
+	w         io.Writer // underlying writer
+	signer    artifact.Signer
+	encrypter artifact.Encrypter
+	validity  *artifact.Validity
+	secVer    uint64
+	prov      *artifact.Provenance
 }
 
 func NewWriter(w io.Writer) *Writer {
@@ -47,6 +51,31 @@ func NewWriterSigned(w io.Writer, s artifact.Signer) *Writer {
 	}
 }
 
+// SetEncrypter enables encrypting the data files of the artifact using
+// a random data key, which is wrapped for the recipients of the encrypter.
+func (aw *Writer) SetEncrypter(e artifact.Encrypter) {
+	aw.encrypter = e
+}
+
+// SetValidity sets the time window the artifact can be installed in. It is
+// stored in header-info so it is covered by the signature.
+func (aw *Writer) SetValidity(v *artifact.Validity) {
+	aw.validity = v
+}
+
+// SetSecurityVersion sets the anti-rollback security version of the
+// artifact. It is stored in header-info so it is covered by the signature.
+func (aw *Writer) SetSecurityVersion(v uint64) {
+	aw.secVer = v
+}
+
+// SetProvenance sets the build provenance of the artifact. The subjects of
+// the provenance are replaced with the data files of the artifact while
+// writing it. It is stored in header-info so it is covered by the signature.
+func (aw *Writer) SetProvenance(p *artifact.Provenance) {
+	aw.prov = p
+}
+
 type Updates struct {
 	U []handlers.Composer
 }
@@ -72,7 +101,121 @@ func calcDataHash(s *artifact.ChecksumStore, upd *Updates) error {
 	return nil
 }
 
-func writeTempHeader(s *artifact.ChecksumStore, devices []string, name string,
+// provenanceSubjects lists the data files of the artifact together with
+// their checksums calculated by calcDataHash.
+func provenanceSubjects(upd *Updates) []artifact.Subject {
+	var subjects []artifact.Subject
+	for i, u := range upd.U {
+		for _, f := range u.GetUpdateFiles() {
+			subjects = append(subjects, artifact.Subject{
+				Name:   filepath.Join(artifact.UpdatePath(i), filepath.Base(f.Name)),
+				Digest: artifact.DigestSet{"sha256": string(f.Checksum)},
+			})
+		}
+	}
+	return subjects
+}
+
+// encryptedFile is the encrypted data file stored in the artifact.
+type encryptedFile struct {
+	name string
+	f    *os.File
+}
+
+// encryptData encrypts all the data files into temporary files. The
+// checksums of the encrypted files are stored in the manifest so that
+// the signature can be verified without decrypting the artifact.
+func encryptData(s *artifact.ChecksumStore, e artifact.Encrypter,
+	upd *Updates) (*artifact.Encryption, []encryptedFile, error) {
+	key, err := artifact.NewDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := e.WrapKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "writer: can not encrypt artifact")
+	}
+
+	// first compose the data files the same way as for the plain artifacts
+	plain, err := ioutil.TempFile("", "data")
+	if err != nil {
+		return nil, nil, errors.New("writer: can not create temporary data file")
+	}
+	defer os.Remove(plain.Name())
+	defer plain.Close()
+
+	ptw := tar.NewWriter(plain)
+	if err = writeData(ptw, upd); err != nil {
+		return nil, nil, err
+	}
+	if err = ptw.Close(); err != nil {
+		return nil, nil, errors.Wrap(err, "writer: can not write data files")
+	}
+	if _, err = plain.Seek(0, 0); err != nil {
+		return nil, nil, errors.Wrap(err, "writer: can not read data files")
+	}
+
+	var files []encryptedFile
+	tr := tar.NewReader(plain)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			removeEncrypted(files)
+			return nil, nil, errors.Wrap(err, "writer: can not read data files")
+		}
+		f, err := encryptFile(s, tr, key, hdr.Name)
+		if f != nil {
+			files = append(files, encryptedFile{name: hdr.Name, f: f})
+		}
+		if err != nil {
+			removeEncrypted(files)
+			return nil, nil, err
+		}
+	}
+
+	return &artifact.Encryption{
+		Cipher:    artifact.CipherAES256GCM,
+		ChunkSize: artifact.DefaultChunkSize,
+		Keys:      keys,
+	}, files, nil
+}
+
+func encryptFile(s *artifact.ChecksumStore, r io.Reader, key []byte,
+	name string) (*os.File, error) {
+	f, err := ioutil.TempFile("", "data")
+	if err != nil {
+		return nil, errors.New("writer: can not create temporary data file")
+	}
+	ch := artifact.NewWriterChecksum(f)
+	ew, err := artifact.NewEncryptWriter(ch, key, name, artifact.DefaultChunkSize)
+	if err != nil {
+		return f, err
+	}
+	if _, err = io.Copy(ew, r); err != nil {
+		return f, errors.Wrapf(err, "writer: can not encrypt data file: %s", name)
+	}
+	if err = ew.Close(); err != nil {
+		return f, errors.Wrapf(err, "writer: can not encrypt data file: %s", name)
+	}
+	if err = s.Add(name, ch.Checksum()); err != nil {
+		return f, errors.Wrapf(err, "writer: can not add checksum: %s", name)
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return f, errors.Wrapf(err, "writer: can not read data file: %s", name)
+	}
+	return f, nil
+}
+
+func removeEncrypted(files []encryptedFile) {
+	for _, e := range files {
+		e.f.Close()
+		os.Remove(e.f.Name())
+	}
+}
+
+func writeTempHeader(s *artifact.ChecksumStore, hInfo *artifact.HeaderInfo,
 	upd *Updates, scr *artifact.Scripts) (*os.File, error) {
 	// create temporary header file
 	f, err := ioutil.TempFile("", "header")
@@ -90,7 +233,7 @@ func writeTempHeader(s *artifact.ChecksumStore, devices []string, name string,
 		htw := tar.NewWriter(gz)
 		defer htw.Close()
 
-		if err = writeHeader(htw, devices, name, upd, scr); err != nil {
+		if err = writeHeader(htw, hInfo, upd, scr); err != nil {
 			return errors.Wrapf(err, "writer: error writing header")
 		}
 		return nil
@@ -118,6 +261,34 @@ func WriteSignature(tw *tar.Writer, message []byte,
 	if err := sw.Write(sig, "manifest.sig"); err != nil {
 		return errors.Wrap(err, "writer: can not tar signature")
 	}
+
+	// store the certificate chain of the signer if there is one
+	if cs, ok := signer.(artifact.CertificateSigner); ok {
+		if err := sw.Write(cs.Certificates(), "manifest.crt"); err != nil {
+			return errors.Wrap(err, "writer: can not tar certificates")
+		}
+	}
+	return WriteTimestamp(tw, sig, signer)
+}
+
+// WriteTimestamp stores the timestamp token of the signature if the signer
+// is able to obtain one.
+func WriteTimestamp(tw *tar.Writer, sig []byte, signer artifact.Signer) error {
+	ts, ok := signer.(artifact.Timestamper)
+	if !ok {
+		return nil
+	}
+	token, err := ts.Timestamp(sig)
+	if err != nil {
+		return errors.Wrap(err, "writer: can not timestamp signature")
+	}
+	if token == nil {
+		return nil
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(token, "manifest.tsr"); err != nil {
+		return errors.Wrap(err, "writer: can not tar timestamp")
+	}
 	return nil
 }
 
@@ -127,6 +298,20 @@ func (aw *Writer) WriteArtifact(format string, version int,
 	if version == 1 && aw.signer != nil {
 		return errors.New("writer: can not create version 1 signed artifact")
 	}
+	if version == 1 && aw.encrypter != nil {
+		return errors.New("writer: can not create version 1 encrypted artifact")
+	}
+	if aw.validity != nil && aw.validity.Validate() != nil {
+		return errors.New("writer: artifact validity ends before it starts")
+	}
+	if version == 1 && aw.prov != nil {
+		return errors.New("writer: can not create version 1 artifact with provenance")
+	}
+	if aw.prov != nil {
+		if err := aw.prov.Validate(); err != nil {
+			return errors.Wrap(err, "writer: invalid provenance")
+		}
+	}
 
 	s := artifact.NewChecksumStore()
 	// calculate checksums of all data files
@@ -135,8 +320,32 @@ func (aw *Writer) WriteArtifact(format string, version int,
 		return err
 	}
 
+	// encrypt data files (we need to know the checksums before writing
+	// the manifest)
+	var enc *artifact.Encryption
+	var encrypted []encryptedFile
+	if aw.encrypter != nil {
+		var err error
+		enc, encrypted, err = encryptData(s, aw.encrypter, upd)
+		if err != nil {
+			return err
+		}
+		defer removeEncrypted(encrypted)
+	}
+	if aw.prov != nil {
+		aw.prov.Subject = provenanceSubjects(upd)
+	}
+
 	// write temporary header (we need to know the size before storing in tar)
-	tmpHdr, err := writeTempHeader(s, devices, name, upd, scr)
+	hInfo := &artifact.HeaderInfo{
+		CompatibleDevices: devices,
+		ArtifactName:      name,
+		Encryption:        enc,
+		Validity:          aw.validity,
+		SecurityVersion:   aw.secVer,
+		Provenance:        aw.prov,
+	}
+	tmpHdr, err := writeTempHeader(s, hInfo, upd, scr)
 	if err != nil {
 		return err
 	}
@@ -189,6 +398,9 @@ func (aw *Writer) WriteArtifact(format string, version int,
 	}
 
 	// write data files
+	if enc != nil {
+		return writeEncryptedData(tw, encrypted)
+	}
 	return writeData(tw, upd)
 }
 
@@ -209,17 +421,13 @@ func writeScripts(tw *tar.Writer, scr *artifact.Scripts) error {
 	return nil
 }
 
-func writeHeader(tw *tar.Writer, devices []string, name string,
+func writeHeader(tw *tar.Writer, hInfo *artifact.HeaderInfo,
 	updates *Updates, scr *artifact.Scripts) error {
 	// store header info
-	hInfo := new(artifact.HeaderInfo)
-
 	for _, upd := range updates.U {
 		hInfo.Updates =
 			append(hInfo.Updates, artifact.UpdateType{Type: upd.GetType()})
 	}
-	hInfo.CompatibleDevices = devices
-	hInfo.ArtifactName = name
 
 	sa := artifact.NewTarWriterStream(tw)
 	if err := sa.Write(artifact.ToStream(hInfo), "header-info"); err != nil {
@@ -249,3 +457,13 @@ func writeData(tw *tar.Writer, updates *Updates) error {
 	}
 	return nil
 }
+
+func writeEncryptedData(tw *tar.Writer, files []encryptedFile) error {
+	for _, e := range files {
+		fw := artifact.NewTarWriterFile(tw)
+		if err := fw.Write(e.f, e.name); err != nil {
+			return errors.Wrapf(err, "writer: error writing data files")
+		}
+	}
+	return nil
+}
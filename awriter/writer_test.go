@@ -186,6 +186,29 @@ func TestWithScripts(t *testing.T) {
 	assert.NoError(t, checkTarElemsnts(buf, 3))
 }
 
+func TestWriteRootfsChunked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunked")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := path.Join(dir, "rootfs.ext4")
+	data := bytes.Repeat([]byte("my test update"), 64*1024)
+	assert.NoError(t, ioutil.WriteFile(image, data, 0644))
+
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf)
+	err = w.WriteRootfsChunked("mender", 2, []string{"asd"}, "name",
+		image, "", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, checkTarElemsnts(buf, 4))
+	buf.Reset()
+
+	// error building the update from non-existing image
+	err = w.WriteRootfsChunked("mender", 2, []string{"asd"}, "name",
+		path.Join(dir, "non-existing"), "", nil)
+	assert.Error(t, err)
+}
+
 type TestDirEntry struct {
 	Path    string
 	Content []byte
@@ -0,0 +1,289 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package chunk implements the content-defined chunking of images. The image
+// is described by the index listing its chunks, while the data of the chunks
+// is kept in the store. Chunks already available on the device, e.g. in the
+// installed image, can be left out of the store.
+package chunk
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Params controls the size of the chunks.
+type Params struct {
+	MinSize int `json:"min_size"`
+	// AvgSize must be a power of two.
+	AvgSize int `json:"avg_size"`
+	MaxSize int `json:"max_size"`
+}
+
+// DefaultParams are the chunking parameters used by casync.
+var DefaultParams = Params{
+	MinSize: 16 * 1024,
+	AvgSize: 64 * 1024,
+	MaxSize: 256 * 1024,
+}
+
+// Validate checks if the chunk sizes are consistent.
+func (p Params) Validate() error {
+	if p.MinSize <= 0 || p.MinSize > p.AvgSize || p.AvgSize > p.MaxSize ||
+		p.AvgSize&(p.AvgSize-1) != 0 {
+		return errors.Errorf("chunk: invalid chunk sizes: %d/%d/%d",
+			p.MinSize, p.AvgSize, p.MaxSize)
+	}
+	return nil
+}
+
+// Chunk is the part of the image identified by its checksum.
+type Chunk struct {
+	Checksum string `json:"checksum"`
+	Size     int    `json:"size"`
+	// Stored is set if the data of the chunk is the next one in the store.
+	Stored bool `json:"stored,omitempty"`
+}
+
+// Index lists the chunks of the image in order.
+type Index struct {
+	Params
+	Size     int64   `json:"size"`
+	Checksum string  `json:"checksum"`
+	Chunks   []Chunk `json:"chunks"`
+}
+
+// Validate checks if the chunks add up to the image.
+func (idx *Index) Validate() error {
+	if err := idx.Params.Validate(); err != nil {
+		return err
+	}
+	var size int64
+	for _, c := range idx.Chunks {
+		if c.Size <= 0 || c.Size > idx.MaxSize || c.Checksum == "" {
+			return errors.Errorf("chunk: invalid chunk: %s", c.Checksum)
+		}
+		size += int64(c.Size)
+	}
+	if size != idx.Size || idx.Checksum == "" {
+		return errors.New("chunk: chunks do not match the image")
+	}
+	return nil
+}
+
+// gear maps the bytes to the random values of the rolling gear hash; the
+// values are derived from sha256 so the boundaries are stable.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:])
+	}
+}
+
+// Split cuts the data into chunks where the rolling hash of the preceding
+// bytes matches the mask. The chunk passed to fn is only valid until fn
+// returns.
+func Split(r io.Reader, p Params, fn func(chunk []byte) error) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	// the highest bits of the gear hash depend on the most bytes
+	bits := uint(math.Log2(float64(p.AvgSize)))
+	mask := ^uint64(0) << (64 - bits)
+
+	br := bufio.NewReader(r)
+	buf := make([]byte, 0, p.MaxSize)
+	var h uint64
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			if len(buf) > 0 {
+				return fn(buf)
+			}
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "chunk: can not read image")
+		}
+		buf = append(buf, c)
+		h = h<<1 + gear[c]
+		if (len(buf) >= p.MinSize && h&mask == 0) || len(buf) == p.MaxSize {
+			if err = fn(buf); err != nil {
+				return err
+			}
+			buf, h = buf[:0], 0
+		}
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Local holds the offsets of the chunks of the image available on the
+// device.
+type Local struct {
+	r      io.ReaderAt
+	chunks map[string]int64
+}
+
+// Scan splits the image into chunks using the same parameters as the index
+// so the unchanged parts of the image produce the same chunks.
+func Scan(r io.ReaderAt, p Params) (*Local, error) {
+	l := &Local{
+		r:      r,
+		chunks: make(map[string]int64),
+	}
+	var off int64
+	err := Split(io.NewSectionReader(r, 0, math.MaxInt64), p, func(data []byte) error {
+		sum := checksum(data)
+		if _, ok := l.chunks[sum]; !ok {
+			l.chunks[sum] = off
+		}
+		off += int64(len(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Has returns true if the chunk with the given checksum is available.
+func (l *Local) Has(sum string) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.chunks[sum]
+	return ok
+}
+
+func (l *Local) read(c Chunk) ([]byte, error) {
+	data := make([]byte, c.Size)
+	if _, err := l.r.ReadAt(data, l.chunks[c.Checksum]); err != nil {
+		return nil, errors.Wrap(err, "chunk: can not read local chunk")
+	}
+	if checksum(data) != c.Checksum {
+		return nil, errors.Errorf("chunk: local chunk has changed: %s", c.Checksum)
+	}
+	return data, nil
+}
+
+// Build splits the image into chunks and writes the index and the data of
+// the chunks to the store. Each chunk is stored once and only if it is not
+// available in the base image, which can be nil.
+func Build(image io.Reader, base *Local, store io.Writer,
+	p Params) (*Index, error) {
+	idx := &Index{Params: p}
+	stored := make(map[string]bool)
+	h := sha256.New()
+
+	err := Split(io.TeeReader(image, h), p, func(data []byte) error {
+		c := Chunk{Checksum: checksum(data), Size: len(data)}
+		if !stored[c.Checksum] && !base.Has(c.Checksum) {
+			if _, err := store.Write(data); err != nil {
+				return errors.Wrap(err, "chunk: can not write chunk store")
+			}
+			stored[c.Checksum] = true
+			c.Stored = true
+		}
+		idx.Chunks = append(idx.Chunks, c)
+		idx.Size += int64(c.Size)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx.Checksum = hex.EncodeToString(h.Sum(nil))
+	return idx, nil
+}
+
+// Missing returns the chunks which are neither in the store nor available
+// locally.
+func (idx *Index) Missing(local *Local) []string {
+	var missing []string
+	stored := make(map[string]bool)
+	for _, c := range idx.Chunks {
+		if c.Stored {
+			stored[c.Checksum] = true
+		} else if !stored[c.Checksum] && !local.Has(c.Checksum) {
+			missing = append(missing, c.Checksum)
+		}
+	}
+	return missing
+}
+
+// Assemble writes the image reading the chunks from the store and from the
+// local image, which can be nil if the store holds all the chunks.
+func Assemble(idx *Index, store io.Reader, local *Local, w io.Writer) error {
+	if missing := idx.Missing(local); len(missing) > 0 {
+		return errors.Errorf("chunk: %d chunks are not available; first: %s",
+			len(missing), missing[0])
+	}
+
+	// stored chunks used more than once and not available locally are kept
+	// in memory as the store is read only once
+	count := make(map[string]int)
+	for _, c := range idx.Chunks {
+		count[c.Checksum]++
+	}
+	cache := make(map[string][]byte)
+
+	h := sha256.New()
+	out := io.MultiWriter(w, h)
+	for _, c := range idx.Chunks {
+		data, err := idx.chunk(c, store, local, cache)
+		if err != nil {
+			return err
+		}
+		if c.Stored && count[c.Checksum] > 1 && !local.Has(c.Checksum) {
+			cache[c.Checksum] = data
+		}
+		if _, err = out.Write(data); err != nil {
+			return errors.Wrap(err, "chunk: can not write image")
+		}
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != idx.Checksum {
+		return errors.Errorf("chunk: invalid image checksum; expected: [%s]; "+
+			"actual: [%s]", idx.Checksum, sum)
+	}
+	return nil
+}
+
+func (idx *Index) chunk(c Chunk, store io.Reader, local *Local,
+	cache map[string][]byte) ([]byte, error) {
+	switch {
+	case c.Stored:
+		data := make([]byte, c.Size)
+		if _, err := io.ReadFull(store, data); err != nil {
+			return nil, errors.Wrap(err, "chunk: can not read chunk store")
+		}
+		if checksum(data) != c.Checksum {
+			return nil, errors.Errorf("chunk: invalid stored chunk: %s", c.Checksum)
+		}
+		return data, nil
+	case cache[c.Checksum] != nil:
+		return cache[c.Checksum], nil
+	default:
+		return local.read(c)
+	}
+}
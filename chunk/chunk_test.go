@@ -0,0 +1,101 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package chunk
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testParams = Params{MinSize: 256, AvgSize: 1024, MaxSize: 4096}
+
+func TestSplit(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var sizes []int
+	var joined []byte
+	require.NoError(t, Split(bytes.NewReader(data), testParams, func(c []byte) error {
+		sizes = append(sizes, len(c))
+		joined = append(joined, c...)
+		return nil
+	}))
+	assert.Equal(t, data, joined)
+	for _, s := range sizes[:len(sizes)-1] {
+		assert.True(t, s >= testParams.MinSize && s <= testParams.MaxSize)
+	}
+	assert.True(t, len(sizes) > 100)
+
+	// the boundaries follow the content, not the offsets
+	shifted := 0
+	require.NoError(t, Split(bytes.NewReader(append([]byte("prefix"), data...)),
+		testParams, func(c []byte) error {
+			if sizes[len(sizes)-1] == len(c) {
+				shifted++
+			}
+			return nil
+		}))
+	assert.NotZero(t, shifted)
+
+	assert.Error(t, Split(bytes.NewReader(data), Params{1, 1000, 2000},
+		func([]byte) error { return nil }))
+}
+
+func TestBuildAssemble(t *testing.T) {
+	base := make([]byte, 128*1024)
+	rand.New(rand.NewSource(2)).Read(base)
+	image := append([]byte(nil), base[:64*1024]...)
+	image = append(image, bytes.Repeat([]byte("new data"), 2048)...)
+	image = append(image, base[64*1024:]...)
+
+	local, err := Scan(bytes.NewReader(base), testParams)
+	require.NoError(t, err)
+
+	store := bytes.NewBuffer(nil)
+	idx, err := Build(bytes.NewReader(image), local, store, testParams)
+	require.NoError(t, err)
+	require.NoError(t, idx.Validate())
+	assert.Equal(t, int64(len(image)), idx.Size)
+	// only the new data is stored; the repeated chunks are stored once
+	assert.True(t, store.Len() < 16*1024, "store size: %d", store.Len())
+
+	out := bytes.NewBuffer(nil)
+	require.NoError(t, Assemble(idx, bytes.NewReader(store.Bytes()), local, out))
+	assert.Equal(t, image, out.Bytes())
+
+	// the chunks of the base image are not available without it
+	assert.NotEmpty(t, idx.Missing(nil))
+	assert.Error(t, Assemble(idx, bytes.NewReader(store.Bytes()), nil, out))
+
+	// the image built without base is self contained
+	store.Reset()
+	idx, err = Build(bytes.NewReader(image), nil, store, testParams)
+	require.NoError(t, err)
+	out.Reset()
+	require.NoError(t, Assemble(idx, store, nil, out))
+	assert.Equal(t, image, out.Bytes())
+
+	// the changed local image is detected
+	changed := append([]byte(nil), base...)
+	changed[100] ^= 0xff
+	local.r = bytes.NewReader(changed)
+	idx, err = Build(bytes.NewReader(image), local, store, testParams)
+	require.NoError(t, err)
+	assert.Error(t, Assemble(idx, store, local, out))
+}
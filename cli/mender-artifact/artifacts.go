@@ -86,13 +86,55 @@ func getKey(keyPath string) ([]byte, error) {
 		return nil, nil
 	}
 
-	key, err := ioutil.ReadFile(keyPath)
+	// the key path can also be a directory containing the bundle of
+	// public keys used for verifying the artifact
+	key, err := artifact.ReadKeys(keyPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error reading key file")
 	}
 	return key, nil
 }
 
+// getSigner returns the signer using the private key and optionally the
+// certificate chain issued for the key. If the URL of the time stamping
+// authority is provided the signatures are timestamped as well.
+func getSigner(keyPath, certPath, tsaURL string) (artifact.Signer, error) {
+	privateKey, err := getKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	var signer interface {
+		artifact.Signer
+		SetTimestamper(artifact.Timestamper)
+	}
+	if certPath == "" {
+		signer = artifact.NewSigner(privateKey)
+	} else {
+		chain, err := getKey(certPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "can not read certificate")
+		}
+		if _, err = artifact.ParseCertificates(chain); err != nil {
+			return nil, err
+		}
+		signer = artifact.NewCertificateSigner(privateKey, chain)
+	}
+	if tsaURL != "" {
+		signer.SetTimestamper(artifact.NewTSAClient(tsaURL))
+	}
+	return signer, nil
+}
+
+// getEncrypter returns the encrypter wrapping the data key for all the
+// public keys stored in the file or the directory provided by keyPath.
+func getEncrypter(keyPath string) (artifact.Encrypter, error) {
+	keys, err := getKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return artifact.NewEncrypter(keys)
+}
+
 func unpackArtifact(name string) (string, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -108,11 +150,17 @@ func unpackArtifact(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	defer tmp.Close()
+	tmp.Close()
 
+	// only the first image is the rootfs one being modified
+	var images int
 	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
-		_, err = io.Copy(tmp, r)
-		return err
+		images++
+		if images > 1 {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		}
+		return handlers.NewDeviceInstaller(tmp.Name()).Install(r, df)
 	}
 
 	if err = aReader.RegisterHandler(rootfs); err != nil {
@@ -123,6 +171,9 @@ func unpackArtifact(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if aReader.GetEncryption() != nil {
+		return "", errors.New("can not modify encrypted artifact")
+	}
 	return tmp.Name(), nil
 }
 
@@ -159,42 +210,74 @@ func repack(artifactName string, from io.Reader, to io.Writer, key []byte,
 	data := dataFile
 	ar := areader.NewReader(from)
 
-	if dataFile == "" {
-		tmpData, tmpErr := ioutil.TempFile("", "mender-repack")
-		if tmpErr != nil {
-			return nil, tmpErr
-		}
-		defer os.Remove(tmpData.Name())
-		defer tmpData.Close()
+	// the rootfs installer is needed even if the data file is replaced
+	// to find out if the dm-verity hash tree must be regenerated
+	tmpDir, err := ioutil.TempDir("", "mender-repack")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
 
-		rootfs := handlers.NewRootfsInstaller()
-		rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
-			_, err = io.Copy(tmpData, r)
+	// the first image is the rootfs one; the others are kept as they are
+	var images int
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		images++
+		if images == 1 && dataFile != "" {
+			_, err := io.Copy(ioutil.Discard, r)
 			return err
 		}
-
-		data = tmpData.Name()
-		ar.RegisterHandler(rootfs)
+		return handlers.NewDeviceInstaller(filepath.Join(tmpDir, df.Name)).Install(r, df)
 	}
+	ar.RegisterHandler(rootfs)
 
 	r, err := read(ar, verify, storeScripts)
 	if err != nil {
 		return nil, err
 	}
+	if r.GetEncryption() != nil {
+		return nil, errors.New("can not repack encrypted artifact")
+	}
 
 	info := r.GetInfo()
+	orig, ok := r.GetHandlers()[0].(*handlers.Rootfs)
+	if !ok {
+		return nil, errors.New("can not repack artifact not holding rootfs image")
+	}
+	var extra []string
+	for i, f := range orig.GetUpdateFiles() {
+		switch {
+		case i == 0 && data == "":
+			data = filepath.Join(tmpDir, f.Name)
+		case i == 0, orig.GetVerity() != nil && f.Name == orig.GetVerity().HashFile:
+		default:
+			extra = append(extra, filepath.Join(tmpDir, f.Name))
+		}
+	}
 
 	// now once arifact is read we need to
 	var h *handlers.Rootfs
 	switch info.Version {
 	case 1:
-		h = handlers.NewRootfsV1(data)
+		h = handlers.NewRootfsV1(data, extra...)
 	case 2:
-		h = handlers.NewRootfsV2(data)
+		h = handlers.NewRootfsV2(data, extra...)
 	default:
 		return nil, errors.Errorf("unsupported artifact version: %d", info.Version)
 	}
 
+	// the hash tree of the modified image must be regenerated
+	if orig.GetVerity() != nil {
+		vDir, err := ioutil.TempDir("", "mender-verity")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(vDir)
+		if err = addVerity(h, data, vDir); err != nil {
+			return nil, err
+		}
+	}
+
 	upd := &awriter.Updates{
 		U: []handlers.Composer{h},
 	}
@@ -207,6 +290,10 @@ func repack(artifactName string, from io.Reader, to io.Writer, key []byte,
 	if key != nil {
 		aWriter = awriter.NewWriterSigned(to, artifact.NewSigner(key))
 	}
+	aWriter.SetValidity(ar.GetValidity())
+	aWriter.SetSecurityVersion(ar.GetSecurityVersion())
+	// the provenance is dropped on purpose; the modified data files are
+	// no longer the output of the build it describes
 
 	name := ar.GetArtifactName()
 	if newName != "" {
@@ -318,7 +405,7 @@ func getCandidatesForModify(path string, key []byte) ([]partition, bool, error)
 	}
 	defer art.Close()
 
-	if err = validate(art, key); err == nil {
+	if _, err = validate(art, key); err == nil {
 		// we have VALID artifact, so we need to unpack it and store header
 		isArtifact = true
 		rawImage, err := unpackArtifact(path)
@@ -326,7 +413,7 @@ func getCandidatesForModify(path string, key []byte) ([]partition, bool, error)
 			return nil, isArtifact, errors.Wrap(err, "can not process artifact")
 		}
 		modifyCandidates = append(modifyCandidates, partition{path: rawImage})
-	} else if err == ErrInvalidSignature {
+	} else if errors.Cause(err) == ErrInvalidSignature {
 		return nil, isArtifact, err
 	} else {
 		parts, err := processSdimg(path)
@@ -0,0 +1,51 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/urfave/cli"
+)
+
+func writeRootfsChunked(c *cli.Context) error {
+	if err := validateInput(c); err != nil {
+		Log.Error(err.Error())
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "mender-chunked")
+	if err != nil {
+		return cli.NewExitError("can not create chunk store", errArtifactCreate)
+	}
+	defer os.RemoveAll(dir)
+
+	var base string
+	if c.String("base") != "" {
+		base, _, err = rootfsImage(c.String("base"), filepath.Join(dir, "base"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), errArtifactOpen)
+		}
+	}
+	h, err := handlers.GenerateRootfsChunked(c.String("update"), base, dir)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactCreate)
+	}
+	return writeUpdate(c, c.StringSlice("device-type"),
+		c.String("artifact-name"), h)
+}
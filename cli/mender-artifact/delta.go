@@ -0,0 +1,120 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/areader"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func writeRootfsDelta(c *cli.Context) error {
+	if c.String("source") == "" || c.String("target") == "" {
+		return cli.NewExitError("must provide `source` and `target`",
+			errArtifactInvalidParameters)
+	}
+
+	dir, err := ioutil.TempDir("", "mender-delta")
+	if err != nil {
+		return cli.NewExitError("can not create delta file", errArtifactCreate)
+	}
+	defer os.RemoveAll(dir)
+
+	source, _, err := rootfsImage(c.String("source"), filepath.Join(dir, "source"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactOpen)
+	}
+	target, ar, err := rootfsImage(c.String("target"), filepath.Join(dir, "target"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactOpen)
+	}
+
+	// name and devices default to the ones of the target artifact
+	name := c.String("artifact-name")
+	devices := c.StringSlice("device-type")
+	if ar != nil {
+		if name == "" {
+			name = ar.GetArtifactName()
+		}
+		if len(devices) == 0 {
+			devices = ar.GetCompatibleDevices()
+		}
+	}
+	if len(devices) == 0 || name == "" {
+		return cli.NewExitError("must provide `device-type` and `artifact-name`",
+			errArtifactInvalidParameters)
+	}
+	if len(strings.Fields(name)) > 1 {
+		return cli.NewExitError("whitespace is not allowed in the artifact-name",
+			errArtifactInvalidParameters)
+	}
+
+	deltaFile := filepath.Join(dir, filepath.Base(target)+handlers.DeltaSuffix)
+	h, err := handlers.GenerateRootfsDelta(source, target, deltaFile)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactCreate)
+	}
+
+	return writeUpdate(c, devices, name, h)
+}
+
+// rootfsImage returns the path of the rootfs image; if the given file is
+// a rootfs-image artifact the image is extracted to dir and the reader of
+// the artifact is returned as well.
+func rootfsImage(path, dir string) (string, *areader.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "can not open: %s", path)
+	}
+	defer f.Close()
+
+	// the version file is always the first one in the artifact
+	hdr, err := tar.NewReader(f).Next()
+	if err != nil || hdr.Name != "version" {
+		return path, nil, nil
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", nil, errors.Wrapf(err, "can not read: %s", path)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	var image string
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		image = filepath.Join(dir, filepath.Base(df.Name))
+		return handlers.NewDeviceInstaller(image).Install(r, df)
+	}
+	ar := areader.NewReader(f)
+	if err = ar.RegisterHandler(rootfs); err != nil {
+		return "", nil, errors.Wrap(err, "failed to register install handler")
+	}
+	if err = ar.ReadArtifact(); err != nil {
+		return "", nil, errors.Wrapf(err, "can not read artifact: %s", path)
+	}
+	if image == "" {
+		return "", nil, errors.Errorf("no rootfs image in artifact: %s", path)
+	}
+	return image, ar, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/urfave/cli"
+)
+
+func writeDirectory(c *cli.Context) error {
+	if err := validateInput(c); err != nil {
+		Log.Error(err.Error())
+		return err
+	}
+	if c.String("dest-dir") == "" {
+		return cli.NewExitError("must provide `dest-dir`",
+			errArtifactInvalidParameters)
+	}
+	if info, err := os.Stat(c.String("update")); err != nil || !info.IsDir() {
+		return cli.NewExitError("update must be a directory", errArtifactInvalidParameters)
+	}
+
+	dir, err := ioutil.TempDir("", "mender-directory")
+	if err != nil {
+		return cli.NewExitError("can not create archive", errArtifactCreate)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Clean(c.String("update"))
+	archive := filepath.Join(dir, filepath.Base(src)+".tar")
+	if err = handlers.ArchiveDirectory(src, archive); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactCreate)
+	}
+	h, err := handlers.NewDirectory(archive, handlers.DirectoryMetaData{
+		Path:  c.String("dest-dir"),
+		Clean: c.Bool("clean"),
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	return writeUpdate(c, c.StringSlice("device-type"),
+		c.String("artifact-name"), h)
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/urfave/cli"
+)
+
+func generateKey(c *cli.Context) error {
+	privPath := c.String("output-path")
+	pubPath := c.String("public-key")
+	if privPath == "" || pubPath == "" {
+		return cli.NewExitError("Missing key path; please use `-o` and `-p` "+
+			"parameters for providing those", errArtifactInvalidParameters)
+	}
+	if !c.Bool("force") {
+		for _, p := range []string{privPath, pubPath} {
+			if _, err := os.Stat(p); err == nil {
+				return cli.NewExitError("Key file already exists: "+p+
+					"; please use `-f` parameter for overwriting it",
+					errArtifactInvalidParameters)
+			}
+		}
+	}
+
+	keyType := c.String("type")
+	bits := c.Int("size")
+	if bits == 0 {
+		bits = artifact.DefaultKeySize(keyType)
+	}
+
+	var priv, pub []byte
+	var err error
+	if keyType == artifact.KeyTypeOpenPGP {
+		priv, pub, err = artifact.GeneratePGPKey(bits, c.String("user-id"))
+	} else {
+		priv, pub, err = artifact.GenerateKey(keyType, bits)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+
+	if err = ioutil.WriteFile(privPath, priv, 0600); err != nil {
+		return cli.NewExitError("Can not write private key: "+err.Error(), errArtifactCreate)
+	}
+	if err = ioutil.WriteFile(pubPath, pub, 0644); err != nil {
+		return cli.NewExitError("Can not write public key: "+err.Error(), errArtifactCreate)
+	}
+	return printKeyInfo(pubPath, pub)
+}
+
+func keyInfo(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("Nothing specified, nothing read. \nMaybe you wanted"+
+			" to say 'key info <key path>'?", errArtifactInvalidParameters)
+	}
+	for _, path := range c.Args() {
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cli.NewExitError("Can not read key: "+path, errArtifactOpen)
+		}
+		if err = printKeyInfo(path, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printKeyInfo(path string, key []byte) error {
+	infos, err := artifact.GetKeyInfo(key)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Invalid key %s: %s", path, err.Error()),
+			errArtifactInvalid)
+	}
+	fmt.Printf("Key file: %s\n", path)
+	for _, info := range infos {
+		kind := "public"
+		if info.Private {
+			kind = "private"
+		}
+		fmt.Printf("  Type: %s (%s)\n", info.Type, kind)
+		fmt.Printf("  Size: %d\n", info.Size)
+		fmt.Printf("  Fingerprint: %s\n", info.Fingerprint)
+		if info.OpenPGPFingerprint != "" {
+			fmt.Printf("  OpenPGP fingerprint: %s\n", info.OpenPGPFingerprint)
+		}
+	}
+	return nil
+}
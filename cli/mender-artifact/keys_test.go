@@ -0,0 +1,72 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeygen(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	priv := filepath.Join(updateTestDir, "private.key")
+	pub := filepath.Join(updateTestDir, "public.key")
+
+	os.Args = []string{"mender-artifact", "keygen", "-t", "ecdsa",
+		"-o", priv, "-p", pub}
+	assert.NoError(t, run())
+
+	info, err := os.Stat(priv)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the generated keys can be used for signing and verifying artifacts
+	err = WriteArtifact(updateTestDir, 2, "")
+	assert.NoError(t, err)
+	art := filepath.Join(updateTestDir, "artifact.mender")
+	os.Args = []string{"mender-artifact", "sign", "-k", priv, art}
+	assert.NoError(t, run())
+	os.Args = []string{"mender-artifact", "validate", "-k", pub, art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "key", "info", priv, pub}
+	assert.NoError(t, run())
+
+	// existing keys are not overwritten
+	os.Args = []string{"mender-artifact", "keygen", "-t", "ecdsa",
+		"-o", priv, "-p", pub}
+	assert.Error(t, run())
+	os.Args = []string{"mender-artifact", "keygen", "-t", "ecdsa", "-f",
+		"-o", priv, "-p", pub}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "keygen", "-t", "dsa", "-f",
+		"-o", priv, "-p", pub}
+	assert.Error(t, run())
+	os.Args = []string{"mender-artifact", "keygen", "-t", "rsa", "-b", "1024",
+		"-f", "-o", priv, "-p", pub}
+	assert.Error(t, run())
+
+	os.Args = []string{"mender-artifact", "key", "info", art}
+	assert.Error(t, run())
+	os.Args = []string{"mender-artifact", "key", "info"}
+	assert.Error(t, run())
+}
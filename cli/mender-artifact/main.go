@@ -17,6 +17,7 @@ package main
 import (
 	"os"
 
+	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/urfave/cli"
 )
 
@@ -52,9 +53,79 @@ func run() error {
 	app.Author = "mender.io"
 	app.Email = "contact@mender.io"
 
+	certificate := cli.StringFlag{
+		Name: "certificate, c",
+		Usage: "Full path to the certificate chain of the signing key; the " +
+			"certificate issued for the signing key must be the first one.",
+	}
+	tsaURL := cli.StringFlag{
+		Name: "tsa-url",
+		Usage: "URL of the RFC 3161 time stamping authority used for " +
+			"timestamping the signature.",
+	}
+
 	//
 	// write
 	//
+	deviceType := cli.StringSliceFlag{
+		Name: "device-type, t",
+		Usage: "Type of device(s) supported by the update. You can specify multiple " +
+			"compatible devices providing this parameter multiple times.",
+	}
+	artifactName := cli.StringFlag{
+		Name:  "artifact-name, n",
+		Usage: "Name of the artifact",
+	}
+	outputPath := cli.StringFlag{
+		Name:  "output-path, o",
+		Usage: "Full path to output artifact file.",
+	}
+	signingKey := cli.StringFlag{
+		Name: "key, k",
+		Usage: "Full path to the private key that will be used to sign the artifact. " +
+			"Both PEM encoded and ASCII armored OpenPGP keys are supported.",
+	}
+	securityVersion := cli.Uint64Flag{
+		Name: "security-version",
+		Usage: "Anti-rollback security version of the artifact; devices " +
+			"refuse installing artifacts with lower version than the installed one.",
+	}
+	notBefore := cli.StringFlag{
+		Name: "not-before",
+		Usage: "Time in RFC3339 format before which the artifact can not " +
+			"be installed.",
+	}
+	notAfter := cli.StringFlag{
+		Name: "not-after",
+		Usage: "Time in RFC3339 format after which the artifact can not " +
+			"be installed.",
+	}
+	encryptionKey := cli.StringFlag{
+		Name: "encryption-key",
+		Usage: "Full path to the public key of the recipient allowed to " +
+			"decrypt the update. It can also be a bundle of public keys " +
+			"or a directory containing the keys. The update is not " +
+			"encrypted if not provided.",
+	}
+	script := cli.StringSliceFlag{
+		Name: "script, s",
+		Usage: "Full path to the state script(s). You can specify multiple " +
+			"scripts providing this parameter multiple times.",
+	}
+	// updateFlags are shared by all the write subcommands creating version 2
+	// artifacts
+	updateFlags := []cli.Flag{
+		outputPath,
+		signingKey,
+		certificate,
+		tsaURL,
+		securityVersion,
+		notBefore,
+		notAfter,
+		encryptionKey,
+		script,
+	}
+
 	writeRootfsCommand := cli.Command{
 		Name:      "rootfs-image",
 		Action:    writeRootfs,
@@ -67,47 +138,348 @@ func run() error {
 			Name:  "update, u",
 			Usage: "Update `FILE`.",
 		},
+		cli.StringSliceFlag{
+			Name: "file, f",
+			Usage: "Additional image `FILE` installed together with the rootfs " +
+				"image; e.g. the kernel. You can specify multiple files providing " +
+				"this parameter multiple times.",
+		},
+		deviceType,
+		artifactName,
+		outputPath,
+		cli.IntFlag{
+			Name:  "version, v",
+			Usage: "Version of the artifact.",
+			Value: LatestFormatVersion,
+		},
+		signingKey,
+		certificate,
+		tsaURL,
+		securityVersion,
+		notBefore,
+		notAfter,
+		encryptionKey,
+		cli.BoolFlag{
+			Name: "dm-verity",
+			Usage: "Generate the dm-verity hash tree of the update and store " +
+				"it in the artifact together with its root hash.",
+		},
+		cli.StringFlag{
+			Name: "provenance",
+			Usage: "Full path to the in-toto statement with SLSA provenance " +
+				"of the update generated by the build pipeline.",
+		},
+		cli.StringFlag{
+			Name: "builder-id",
+			Usage: "Identifier of the build pipeline; the build provenance " +
+				"recording the input files is generated if provided.",
+		},
+		cli.StringFlag{
+			Name:  "source-uri",
+			Usage: "URI of the source repository the update is built from.",
+		},
+		cli.StringFlag{
+			Name:  "source-commit",
+			Usage: "Commit of the source repository the update is built from.",
+		},
+		script,
+	}
+
+	writeDeltaCommand := cli.Command{
+		Name:   "rootfs-image-delta",
+		Action: writeRootfsDelta,
+		Usage: "Writes Mender artifact containing the binary delta between " +
+			"two rootfs images",
+	}
+
+	writeDeltaCommand.Flags = append([]cli.Flag{
+		cli.StringFlag{
+			Name: "source",
+			Usage: "Rootfs image `FILE` or rootfs-image artifact installed " +
+				"on the devices the delta is applied to.",
+		},
+		cli.StringFlag{
+			Name:  "target",
+			Usage: "New rootfs image `FILE` or rootfs-image artifact.",
+		},
 		cli.StringSliceFlag{
 			Name: "device-type, t",
-			Usage: "Type of device(s) supported by the update. You can specify multiple " +
-				"compatible devices providing this parameter multiple times.",
+			Usage: "Type of device(s) supported by the update. Defaults to " +
+				"the devices of the target artifact.",
 		},
 		cli.StringFlag{
-			Name:  "artifact-name, n",
-			Usage: "Name of the artifact",
+			Name: "artifact-name, n",
+			Usage: "Name of the artifact. Defaults to the name of the target " +
+				"artifact.",
 		},
+	}, updateFlags...)
+
+	writeChunkedCommand := cli.Command{
+		Name:   "rootfs-image-chunked",
+		Action: writeRootfsChunked,
+		Usage: "Writes Mender artifact containing rootfs image split into " +
+			"content-defined chunks",
+	}
+
+	writeChunkedCommand.Flags = append([]cli.Flag{
 		cli.StringFlag{
-			Name:  "output-path, o",
-			Usage: "Full path to output artifact file.",
+			Name:  "update, u",
+			Usage: "Update `FILE`.",
 		},
-		cli.IntFlag{
-			Name:  "version, v",
-			Usage: "Version of the artifact.",
-			Value: LatestFormatVersion,
+		cli.StringFlag{
+			Name: "base",
+			Usage: "Rootfs image `FILE` or rootfs-image artifact installed on " +
+				"the devices; its chunks are left out of the artifact.",
 		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writeSingleFileCommand := cli.Command{
+		Name:   "single-file",
+		Action: writeSingleFile,
+		Usage:  "Writes Mender artifact replacing a single file on the device",
+	}
+
+	writeSingleFileCommand.Flags = append([]cli.Flag{
 		cli.StringFlag{
-			Name:  "key, k",
-			Usage: "Full path to the private key that will be used to sign the artifact.",
+			Name:  "update, u",
+			Usage: "Update `FILE`.",
 		},
+		cli.StringFlag{
+			Name:  "dest-path",
+			Usage: "Absolute path of the file on the device.",
+		},
+		cli.StringFlag{
+			Name: "mode",
+			Usage: "Octal permissions of the file on the device. Defaults to " +
+				"the permissions of the update file.",
+		},
+		cli.StringFlag{
+			Name: "owner",
+			Usage: "Owner of the file on the device; either name or uid. The " +
+				"owner is not changed if not provided.",
+		},
+		cli.StringFlag{
+			Name: "group",
+			Usage: "Group of the file on the device; either name or gid. The " +
+				"group is not changed if not provided.",
+		},
+		cli.StringFlag{
+			Name: "previous-checksum",
+			Usage: "Checksum of the file the update replaces; the update is " +
+				"refused if the file on the device does not match it.",
+		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writeDirectoryCommand := cli.Command{
+		Name:   "directory",
+		Action: writeDirectory,
+		Usage:  "Writes Mender artifact installing a directory tree on the device",
+	}
+
+	writeDirectoryCommand.Flags = append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "update, u",
+			Usage: "Update `DIRECTORY`.",
+		},
+		cli.StringFlag{
+			Name:  "dest-dir",
+			Usage: "Absolute path of the directory on the device.",
+		},
+		cli.BoolFlag{
+			Name: "clean",
+			Usage: "Remove the existing content of the directory on the device " +
+				"before installing the update.",
+		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writeDockerImageCommand := cli.Command{
+		Name:   "docker-image",
+		Action: writeDockerImage,
+		Usage:  "Writes Mender artifact containing container images",
+	}
+
+	writeDockerImageCommand.Flags = append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "update, u",
+			Usage: "OCI image layout `DIRECTORY` or docker-save archive.",
+		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writePackageCommand := cli.Command{
+		Name:   "package",
+		Action: writePackage,
+		Usage:  "Writes Mender artifact containing .deb or .ipk packages",
+	}
+
+	writePackageCommand.Flags = append([]cli.Flag{
 		cli.StringSliceFlag{
-			Name: "script, s",
-			Usage: "Full path to the state script(s). You can specify multiple " +
-				"scripts providing this parameter multiple times.",
+			Name: "update, u",
+			Usage: "Update package `FILE`. You can specify multiple packages " +
+				"providing this parameter multiple times; the packages are " +
+				"installed in the order of their dependencies.",
 		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writeRawImageCommand := cli.Command{
+		Name:   "raw-image",
+		Action: writeRawImage,
+		Usage:  "Writes Mender artifact containing images written to raw offsets",
 	}
 
+	writeRawImageCommand.Flags = append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name: "update, u",
+			Usage: "Update image `FILE`. You can specify multiple images providing " +
+				"this parameter multiple times; each image needs its own " +
+				"target, offset and max-size given in the same order.",
+		},
+		cli.StringSliceFlag{
+			Name:  "target",
+			Usage: "Name of the device or partition the image is written to.",
+		},
+		cli.StringSliceFlag{
+			Name:  "offset",
+			Usage: "Byte offset of the image in the target; e.g. 0x400.",
+		},
+		cli.StringSliceFlag{
+			Name:  "max-size",
+			Usage: "Size of the region of the target reserved for the image.",
+		},
+		cli.BoolFlag{
+			Name:  "erase",
+			Usage: "Erase the whole regions before writing the images.",
+		},
+		cli.StringFlag{
+			Name:  "erase-value",
+			Usage: "Byte the erased regions are filled with.",
+			Value: "0xff",
+		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writeModuleImageCommand := cli.Command{
+		Name:   "module-image",
+		Action: writeModuleImage,
+		Usage:  "Writes Mender artifact installed by an update module on the device",
+	}
+
+	writeModuleImageCommand.Flags = append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "type, T",
+			Usage: "Type of the update; the name of the update module installing it.",
+		},
+		cli.StringSliceFlag{
+			Name: "update, u",
+			Usage: "Payload `FILE` passed to the update module. You can specify " +
+				"multiple files providing this parameter multiple times.",
+		},
+		cli.StringFlag{
+			Name:  "meta-data, m",
+			Usage: "JSON `FILE` holding the meta-data passed to the update module.",
+		},
+		deviceType,
+		artifactName,
+	}, updateFlags...)
+
+	writeMultiTargetCommand := cli.Command{
+		Name:   "multi-target",
+		Action: writeMultiTarget,
+		Usage: "Writes Mender artifact holding updates for different device types; " +
+			"e.g. the devices attached to a gateway",
+	}
+
+	writeMultiTargetCommand.Flags = append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name: "update, u",
+			Usage: "Update `FILE`. You can specify multiple updates providing this " +
+				"parameter multiple times; each update needs its own " +
+				"target-device-type given in the same order.",
+		},
+		cli.StringSliceFlag{
+			Name: "update-type",
+			Usage: "Type of the update; rootfs-image if not provided, otherwise the " +
+				"update is installed by the update module of the same name.",
+		},
+		cli.StringSliceFlag{
+			Name: "target-device-type",
+			Usage: "Comma separated types of the devices the update is installed " +
+				"on; if empty, the update is installed on the devices compatible " +
+				"with the artifact.",
+		},
+		cli.StringSliceFlag{
+			Name: "device-type, t",
+			Usage: "Type of device(s) the artifact is deployed to; e.g. the gateway. " +
+				"You can specify multiple compatible devices providing this " +
+				"parameter multiple times.",
+		},
+		artifactName,
+	}, updateFlags...)
+
 	writeCommand := cli.Command{
 		Name:  "write",
 		Usage: "Writes artifact file.",
 		Subcommands: []cli.Command{
 			writeRootfsCommand,
+			writeDeltaCommand,
+			writeChunkedCommand,
+			writeSingleFileCommand,
+			writeDirectoryCommand,
+			writeDockerImageCommand,
+			writePackageCommand,
+			writeRawImageCommand,
+			writeModuleImageCommand,
+			writeMultiTargetCommand,
 		},
 	}
 
 	key := cli.StringFlag{
 		Name: "key, k",
 		Usage: "Full path to the public key that will be used to verify " +
-			"the artifact signature.",
+			"the artifact signature. It can also be a bundle of public keys " +
+			"or a directory containing the keys. Both PEM encoded and ASCII " +
+			"armored OpenPGP keys are supported.",
+	}
+
+	caCertificate := cli.StringFlag{
+		Name: "ca-certificate",
+		Usage: "Full path to the trusted root certificate(s) that will be used " +
+			"to verify the certificate chain of the artifact signer.",
+	}
+	intermediateCertificate := cli.StringFlag{
+		Name: "intermediate-certificate",
+		Usage: "Full path to the intermediate certificate(s); if provided " +
+			"the signer certificate must be issued by one of those.",
+	}
+
+	tsaCertificate := cli.StringFlag{
+		Name: "tsa-certificate",
+		Usage: "Full path to the trusted root certificate(s) of the time " +
+			"stamping authorities used to verify the signature timestamp.",
+	}
+	revocationList := cli.StringFlag{
+		Name: "revocation-list",
+		Usage: "Full path to the signed list of the revoked keys; artifacts " +
+			"signed with any of those are not considered valid.",
+	}
+	revocationKey := cli.StringFlag{
+		Name:  "revocation-key",
+		Usage: "Full path to the public key used to verify the revocation list.",
+	}
+	revocationIssued := cli.StringFlag{
+		Name: "revocation-list-issued",
+		Usage: "Issue time in RFC3339 format of the last accepted revocation " +
+			"list; older lists are rejected so that they can not be replayed.",
 	}
 
 	//
@@ -122,6 +494,23 @@ func run() error {
 	}
 	validate.Flags = []cli.Flag{
 		key,
+		cli.IntFlag{
+			Name: "threshold",
+			Usage: "Minimum number of valid signatures created with different " +
+				"keys provided using the `-k` parameter.",
+			Value: 1,
+		},
+		caCertificate,
+		intermediateCertificate,
+		revocationList,
+		revocationKey,
+		revocationIssued,
+		tsaCertificate,
+		cli.Uint64Flag{
+			Name: "min-security-version",
+			Usage: "Minimum security version of the artifact; artifacts with " +
+				"lower version are not considered valid.",
+		},
 	}
 
 	//
@@ -133,7 +522,14 @@ func run() error {
 		ArgsUsage:   "<artifact path>",
 		Action:      readArtifact,
 		Description: "This command validates artifact file provided by pathspec.",
-		Flags:       []cli.Flag{key},
+		Flags: []cli.Flag{key, caCertificate, intermediateCertificate,
+			revocationList, revocationKey, revocationIssued, tsaCertificate,
+			cli.StringFlag{
+				Name: "decryption-key",
+				Usage: "Full path to the private key used to decrypt the " +
+					"update of the encrypted artifact.",
+			},
+		},
 	}
 
 	//
@@ -158,6 +554,114 @@ func run() error {
 			Name:  "force, f",
 			Usage: "Force creating new signature if the artifact is already signed",
 		},
+		certificate,
+		tsaURL,
+		cli.BoolFlag{
+			Name: "append, a",
+			Usage: "Add the signature to the existing ones instead of replacing " +
+				"those; the signature is stored together with the key fingerprint. " +
+				"Can not be used together with the certificate.",
+		},
+	}
+
+	//
+	// revoke
+	//
+	revoke := cli.Command{
+		Name:      "revoke",
+		Usage:     "Creates or extends the signed list of the revoked keys.",
+		Action:    revokeKeys,
+		UsageText: "mender-artifact revoke [options]",
+		Description: "This command adds the keys to the revocation list and signs " +
+			"the list; if the list exists it must be signed with the same key.",
+	}
+	revoke.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "key, k",
+			Usage: "Full path to the private key that will be used to sign the list.",
+		},
+		cli.StringFlag{
+			Name:  "output-path, o",
+			Usage: "Full path to the revocation list; created if it does not exist.",
+		},
+		cli.StringSliceFlag{
+			Name: "fingerprint, f",
+			Usage: "Fingerprint of the key to revoke. You can specify multiple " +
+				"keys providing this parameter multiple times.",
+		},
+		cli.StringSliceFlag{
+			Name: "public-key, p",
+			Usage: "Full path to the public key to revoke. You can specify multiple " +
+				"keys providing this parameter multiple times.",
+		},
+		cli.StringFlag{
+			Name:  "time",
+			Usage: "Revocation time in RFC3339 format; the current time by default.",
+		},
+		cli.StringFlag{
+			Name:  "reason",
+			Usage: "Reason of the revocation stored in the list.",
+		},
+	}
+
+	//
+	// keygen
+	//
+	keygen := cli.Command{
+		Name:      "keygen",
+		Usage:     "Generates the key pair used for signing artifacts.",
+		Action:    generateKey,
+		UsageText: "mender-artifact keygen [options]",
+		Description: "This command generates the private key in the format " +
+			"accepted by the `-k` parameter of the signing commands and the " +
+			"matching public key used for verifying the artifacts.",
+	}
+	keygen.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "type, t",
+			Usage: "Type of the key; one of rsa, ecdsa or openpgp.",
+			Value: artifact.KeyTypeRSA,
+		},
+		cli.IntFlag{
+			Name: "size, b",
+			Usage: "Size of the key in bits; 3072 for RSA and OpenPGP keys " +
+				"and 256 for ECDSA keys by default.",
+		},
+		cli.StringFlag{
+			Name:  "output-path, o",
+			Usage: "Full path to the generated private key.",
+			Value: "private.key",
+		},
+		cli.StringFlag{
+			Name:  "public-key, p",
+			Usage: "Full path to the generated public key.",
+			Value: "public.key",
+		},
+		cli.StringFlag{
+			Name:  "user-id",
+			Usage: "User ID of the OpenPGP key.",
+			Value: artifact.DefaultPGPUserID,
+		},
+		cli.BoolFlag{
+			Name:  "force, f",
+			Usage: "Overwrite the existing key files.",
+		},
+	}
+
+	//
+	// key
+	//
+	keyCommand := cli.Command{
+		Name:  "key",
+		Usage: "Inspects key files.",
+		Subcommands: []cli.Command{
+			{
+				Name:      "info",
+				Usage:     "Prints the type, size and fingerprint of the keys.",
+				ArgsUsage: "<key path>...",
+				Action:    keyInfo,
+			},
+		},
 	}
 
 	//
@@ -234,6 +738,9 @@ func run() error {
 		readCommand,
 		validate,
 		sign,
+		revoke,
+		keygen,
+		keyCommand,
 		modify,
 		copy,
 		cat,
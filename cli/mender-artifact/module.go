@@ -0,0 +1,58 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/urfave/cli"
+)
+
+func writeModuleImage(c *cli.Context) error {
+	// the empty slice flag is not detected by validateInput
+	if len(c.StringSlice("update")) == 0 {
+		return cli.NewExitError("must provide `device-type`, `artifact-name` and `update`",
+			errArtifactInvalidParameters)
+	}
+	if err := validateInput(c); err != nil {
+		Log.Error(err.Error())
+		return err
+	}
+	if c.String("type") == "" {
+		return cli.NewExitError("must provide `type`", errArtifactInvalidParameters)
+	}
+
+	var meta map[string]interface{}
+	if c.String("meta-data") != "" {
+		data, err := ioutil.ReadFile(c.String("meta-data"))
+		if err != nil {
+			return cli.NewExitError("can not read meta-data: "+err.Error(),
+				errArtifactInvalidParameters)
+		}
+		if err = json.Unmarshal(data, &meta); err != nil {
+			return cli.NewExitError("meta-data must be a JSON object: "+err.Error(),
+				errArtifactInvalidParameters)
+		}
+	}
+
+	h, err := handlers.NewModuleImage(c.String("type"), c.StringSlice("update"), meta)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	return writeUpdate(c, c.StringSlice("device-type"),
+		c.String("artifact-name"), h)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// targetedUpdates pairs the update files with the update-type and
+// target-device-type flags given in the same order.
+func targetedUpdates(c *cli.Context) ([]handlers.Composer, error) {
+	files := c.StringSlice("update")
+	types := c.StringSlice("update-type")
+	targets := c.StringSlice("target-device-type")
+	if len(types) != 0 && len(types) != len(files) {
+		return nil, errors.New("`update-type` must be provided either for each " +
+			"update file or not at all")
+	}
+	if len(targets) != len(files) {
+		return nil, errors.New("`target-device-type` must be provided for each " +
+			"update file")
+	}
+
+	var updates []handlers.Composer
+	for i, file := range files {
+		updateType := "rootfs-image"
+		if len(types) != 0 {
+			updateType = types[i]
+		}
+		var h handlers.Composer
+		if updateType == "rootfs-image" {
+			h = handlers.NewRootfsV2(file)
+		} else {
+			m, err := handlers.NewModuleImage(updateType, []string{file}, nil)
+			if err != nil {
+				return nil, err
+			}
+			h = m
+		}
+
+		// the update with no target devices is installed on the devices
+		// compatible with the artifact
+		var devices []string
+		for _, d := range strings.Split(targets[i], ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				devices = append(devices, d)
+			}
+		}
+		if len(devices) != 0 {
+			h = handlers.NewTargeted(h, devices)
+		}
+		updates = append(updates, h)
+	}
+	return updates, nil
+}
+
+func writeMultiTarget(c *cli.Context) error {
+	// the empty slice flag is not detected by validateInput
+	if len(c.StringSlice("update")) == 0 {
+		return cli.NewExitError("must provide `device-type`, `artifact-name` and `update`",
+			errArtifactInvalidParameters)
+	}
+	if err := validateInput(c); err != nil {
+		Log.Error(err.Error())
+		return err
+	}
+
+	updates, err := targetedUpdates(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	return writeUpdate(c, c.StringSlice("device-type"),
+		c.String("artifact-name"), updates...)
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// rawPayloads pairs the update files with the target, offset and max-size
+// flags given in the same order.
+func rawPayloads(c *cli.Context) ([]handlers.RawPayload, error) {
+	files := c.StringSlice("update")
+	targets := c.StringSlice("target")
+	offsets := c.StringSlice("offset")
+	sizes := c.StringSlice("max-size")
+	if len(targets) != len(files) || len(offsets) != len(files) ||
+		len(sizes) != len(files) {
+		return nil, errors.New("`target`, `offset` and `max-size` must be " +
+			"provided for each update file")
+	}
+	eraseValue, err := strconv.ParseUint(c.String("erase-value"), 0, 8)
+	if err != nil {
+		return nil, errors.Errorf("invalid erase value: %s", c.String("erase-value"))
+	}
+
+	var payloads []handlers.RawPayload
+	for i, file := range files {
+		offset, err := strconv.ParseInt(offsets[i], 0, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid offset: %s", offsets[i])
+		}
+		size, err := strconv.ParseInt(sizes[i], 0, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid max size: %s", sizes[i])
+		}
+		payloads = append(payloads, handlers.RawPayload{
+			File:       file,
+			Target:     targets[i],
+			Offset:     offset,
+			MaxSize:    size,
+			Erase:      c.Bool("erase"),
+			EraseValue: uint8(eraseValue),
+		})
+	}
+	return payloads, nil
+}
+
+func writeRawImage(c *cli.Context) error {
+	// the empty slice flag is not detected by validateInput
+	if len(c.StringSlice("update")) == 0 {
+		return cli.NewExitError("must provide `device-type`, `artifact-name` and `update`",
+			errArtifactInvalidParameters)
+	}
+	if err := validateInput(c); err != nil {
+		Log.Error(err.Error())
+		return err
+	}
+
+	payloads, err := rawPayloads(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	h, err := handlers.NewRawImage(payloads)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	return writeUpdate(c, c.StringSlice("device-type"),
+		c.String("artifact-name"), h)
+}
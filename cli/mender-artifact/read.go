@@ -17,10 +17,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/mendersoftware/mender-artifact/areader"
 	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/urfave/cli"
 )
 
@@ -37,31 +40,10 @@ func readArtifact(c *cli.Context) error {
 	}
 	defer f.Close()
 
-	var verifyCallback areader.SignatureVerifyFn
-
-	key, err := getKey(c.String("key"))
+	v, err := getVerification(c)
 	if err != nil {
 		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
 	}
-	s := artifact.NewVerifier(key)
-	verifyCallback = s.Verify
-
-	// if key is not provided just continue reading artifact returning
-	// info that signature can not be verified
-	sigInfo := "no signature"
-	ver := func(message, sig []byte) error {
-		sigInfo = "signed but no key for verification provided; " +
-			"please use `-k` option for providing verification key"
-		if verifyCallback != nil {
-			err = verifyCallback(message, sig)
-			if err != nil {
-				sigInfo = "signed; verification using provided key failed"
-			} else {
-				sigInfo = "signed and verified correctly"
-			}
-		}
-		return nil
-	}
 
 	var scripts []string
 	readScripts := func(r io.Reader, info os.FileInfo) error {
@@ -70,11 +52,69 @@ func readArtifact(c *cli.Context) error {
 	}
 
 	ar := areader.NewReader(f)
-	r, err := read(ar, ver, readScripts)
+	// the encrypted artifact is only verified without the decryption key
+	ar.VerifyOnly = true
+	res := v.register(ar)
+	// rootfs installer exposes the dm-verity parameters of the update
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	if err = ar.RegisterHandler(rootfs); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	if err = ar.RegisterHandler(handlers.NewRootfsDeltaInstaller()); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	if err = ar.RegisterHandler(handlers.NewRootfsChunkedInstaller()); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	// without the root directory the file is not installed
+	if err = ar.RegisterHandler(handlers.NewSingleFileInstaller("")); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	if err = ar.RegisterHandler(handlers.NewDirectoryInstaller("", "")); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	if err = ar.RegisterHandler(handlers.NewDockerImageInstaller()); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	if err = ar.RegisterHandler(handlers.NewPackageInstaller()); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	// without the targets the images are not written
+	if err = ar.RegisterHandler(handlers.NewRawImageInstaller(nil)); err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalid)
+	}
+	if c.String("decryption-key") != "" {
+		key, err := getKey(c.String("decryption-key"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+		}
+		ar.Decrypter = artifact.NewDecrypter(key)
+	}
+	r, err := read(ar, nil, readScripts)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 0)
 	}
 
+	// if key is not provided just continue reading artifact returning
+	// info that signature can not be verified
+	sigInfo := "no signature"
+	switch {
+	case !res.signed:
+	case res.err == errNoVerificationKey:
+		sigInfo = "signed but no key for verification provided; " +
+			"please use `-k` option for providing verification key"
+	case revokedKeys(res.err) != nil:
+		sigInfo = "signed; signing key is revoked"
+	case res.err != nil:
+		sigInfo = "signed; verification using provided key failed"
+	default:
+		sigInfo = "signed and verified correctly"
+	}
+
 	inst := r.GetHandlers()
 	info := r.GetInfo()
 
@@ -83,6 +123,42 @@ func readArtifact(c *cli.Context) error {
 	fmt.Printf("  Format: %s\n", info.Format)
 	fmt.Printf("  Version: %d\n", info.Version)
 	fmt.Printf("  Signature: %s\n", sigInfo)
+	for _, k := range res.keys {
+		fmt.Printf("  Signature key: %s\n", k)
+	}
+	if res.signer != nil {
+		fmt.Printf("  Signer certificate: %s\n", res.signer.Subject)
+	}
+	switch {
+	case res.tsErr != nil:
+		fmt.Printf("  Signature timestamp: invalid; %s\n", res.tsErr.Error())
+	case !res.signedAt.IsZero():
+		fmt.Printf("  Signature timestamp: %s\n", res.signedAt.Format(time.RFC3339))
+	}
+	for _, k := range revokedKeys(res.err) {
+		fmt.Printf("  Revoked key: %s (revoked at: %s)\n", k.Fingerprint,
+			k.RevokedAt.Format(time.RFC3339))
+	}
+	if enc := r.GetEncryption(); enc != nil {
+		fmt.Printf("  Encryption: %s\n", enc.Cipher)
+		for _, k := range enc.Keys {
+			fmt.Printf("  Recipient key: %s\n", k.Fingerprint)
+		}
+	}
+	if v := r.GetSecurityVersion(); v != 0 {
+		fmt.Printf("  Security version: %d\n", v)
+	}
+	if v := r.GetValidity(); v != nil {
+		if v.NotBefore != nil {
+			fmt.Printf("  Not valid before: %s\n", v.NotBefore.Format(time.RFC3339))
+		}
+		if v.NotAfter != nil {
+			fmt.Printf("  Not valid after: %s\n", v.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if p := r.GetProvenance(); p != nil {
+		printProvenance(p, res.signed && res.err == nil)
+	}
 	fmt.Printf("  Compatible devices: '%s'\n", r.GetCompatibleDevices())
 	if len(scripts) > -1 {
 		fmt.Printf("  State scripts:\n")
@@ -95,6 +171,9 @@ func readArtifact(c *cli.Context) error {
 	for k, p := range inst {
 		fmt.Printf("  %3d:\n", k)
 		fmt.Printf("    Type:   %s\n", p.GetType())
+		if d := r.GetUpdateDeviceTypes(k); d != nil {
+			fmt.Printf("    Target devices: '%s'\n", d)
+		}
 		for _, f := range p.GetUpdateFiles() {
 			fmt.Printf("    Files:\n")
 			fmt.Printf("      name:     %s\n", f.Name)
@@ -102,6 +181,119 @@ func readArtifact(c *cli.Context) error {
 			fmt.Printf("      modified: %s\n", f.Date)
 			fmt.Printf("      checksum: %s\n", f.Checksum)
 		}
+		if r, ok := p.(*handlers.Rootfs); ok && r.GetVerity() != nil {
+			v := r.GetVerity()
+			fmt.Printf("    dm-verity:\n")
+			fmt.Printf("      hash file: %s\n", v.HashFile)
+			fmt.Printf("      root hash: %s\n", v.RootHash)
+			fmt.Printf("      salt:      %s\n", v.Salt)
+		}
+		if d, ok := p.(*handlers.RootfsDelta); ok {
+			fmt.Printf("    Depends:\n")
+			fmt.Printf("      %s: %s\n", handlers.RootfsImageChecksum,
+				d.GetSourceChecksum())
+			fmt.Printf("    Delta target:\n")
+			fmt.Printf("      size:     %d\n", d.GetTarget().TargetSize)
+			fmt.Printf("      checksum: %s\n", d.GetTarget().TargetChecksum)
+		}
+		if ch, ok := p.(*handlers.RootfsChunked); ok && ch.GetIndex() != nil {
+			idx := ch.GetIndex()
+			stored := 0
+			for _, c := range idx.Chunks {
+				if c.Stored {
+					stored++
+				}
+			}
+			fmt.Printf("    Chunked image:\n")
+			fmt.Printf("      size:     %d\n", idx.Size)
+			fmt.Printf("      checksum: %s\n", idx.Checksum)
+			fmt.Printf("      chunks:   %d (stored: %d)\n", len(idx.Chunks), stored)
+		}
+		if sf, ok := p.(*handlers.SingleFile); ok {
+			m := sf.GetMetaData()
+			fmt.Printf("    Destination:\n")
+			fmt.Printf("      path:     %s\n", m.Path)
+			fmt.Printf("      mode:     %s\n", m.Mode)
+			if m.Owner != "" || m.Group != "" {
+				fmt.Printf("      owner:    %s:%s\n", m.Owner, m.Group)
+			}
+			if m.PreviousChecksum != "" {
+				fmt.Printf("      replaces: %s\n", m.PreviousChecksum)
+			}
+		}
+		if d, ok := p.(*handlers.Directory); ok {
+			m := d.GetMetaData()
+			fmt.Printf("    Destination:\n")
+			fmt.Printf("      directory: %s\n", m.Path)
+			fmt.Printf("      clean:     %t\n", m.Clean)
+		}
+		if d, ok := p.(*handlers.DockerImage); ok {
+			fmt.Printf("    Images:\n")
+			for _, i := range d.GetMetaData().Images {
+				ref := i.Ref
+				if ref == "" {
+					ref = "<untagged>"
+				}
+				fmt.Printf("      %s: %s\n", ref, i.Digest)
+			}
+		}
+		if pkg, ok := p.(*handlers.Package); ok {
+			fmt.Printf("    Packages:\n")
+			for _, i := range pkg.GetMetaData().Packages {
+				fmt.Printf("      %s %s (%s)\n", i.Name, i.Version, i.Architecture)
+			}
+		}
+		if ri, ok := p.(*handlers.RawImage); ok {
+			fmt.Printf("    Payloads:\n")
+			for _, i := range ri.GetMetaData().Payloads {
+				fmt.Printf("      %s: %s at %#x (max size: %d", i.File, i.Target,
+					i.Offset, i.MaxSize)
+				if i.Erase {
+					fmt.Printf("; erase: %#x", i.EraseValue)
+				}
+				fmt.Printf(")\n")
+			}
+		}
 	}
 	return nil
 }
+
+// printProvenance shows the provenance, which has been already verified
+// against the data files by the reader.
+func printProvenance(p *artifact.Provenance, signed bool) {
+	verified := "matches the artifact data"
+	if !signed {
+		verified += "; not covered by a verified signature"
+	}
+	fmt.Printf("  Provenance: %s\n", verified)
+	fmt.Printf("    Builder: %s\n", p.Predicate.Builder.ID)
+	fmt.Printf("    Build type: %s\n", p.Predicate.BuildType)
+	if inv := p.Predicate.Invocation; inv != nil && inv.ConfigSource != nil {
+		fmt.Printf("    Source: %s\n", inv.ConfigSource.URI)
+		for alg, d := range inv.ConfigSource.Digest {
+			fmt.Printf("    Source revision: %s:%s\n", alg, d)
+		}
+	}
+	if m := p.Predicate.Metadata; m != nil {
+		if m.BuildStartedOn != nil {
+			fmt.Printf("    Build started: %s\n", m.BuildStartedOn.Format(time.RFC3339))
+		}
+		if m.BuildFinishedOn != nil {
+			fmt.Printf("    Build finished: %s\n", m.BuildFinishedOn.Format(time.RFC3339))
+		}
+	}
+	for _, m := range p.Predicate.Materials {
+		fmt.Printf("    Material: %s", m.URI)
+		if d, ok := m.Digest["sha256"]; ok {
+			fmt.Printf(" sha256:%s", d)
+		} else {
+			for alg, d := range m.Digest {
+				fmt.Printf(" %s:%s", alg, d)
+			}
+		}
+		fmt.Printf("\n")
+	}
+	for _, s := range p.Subject {
+		fmt.Printf("    Subject: %s sha256:%s\n", s.Name, s.Digest["sha256"])
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func revokeKeys(c *cli.Context) error {
+	if len(c.String("key")) == 0 {
+		return cli.NewExitError("Missing signing key; "+
+			"please use `-k` parameter for providing one", errArtifactInvalidParameters)
+	}
+	if len(c.String("output-path")) == 0 {
+		return cli.NewExitError("Missing revocation list path; "+
+			"please use `-o` parameter for providing one", errArtifactInvalidParameters)
+	}
+
+	fingerprints := c.StringSlice("fingerprint")
+	for _, p := range c.StringSlice("public-key") {
+		key, err := getKey(p)
+		if err != nil {
+			return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+		}
+		kr, err := artifact.NewKeyRing(key)
+		if err != nil {
+			return cli.NewExitError("Can not use public key provided: "+err.Error(),
+				errArtifactInvalidParameters)
+		}
+		fingerprints = append(fingerprints, kr.Fingerprints()...)
+	}
+	if len(fingerprints) == 0 {
+		return cli.NewExitError("Nothing to revoke; please use `--fingerprint` "+
+			"or `--public-key` parameter", errArtifactInvalidParameters)
+	}
+
+	revokedAt := time.Now().UTC()
+	if c.String("time") != "" {
+		t, err := time.Parse(time.RFC3339, c.String("time"))
+		if err != nil {
+			return cli.NewExitError("Invalid revocation time: "+err.Error(),
+				errArtifactInvalidParameters)
+		}
+		revokedAt = t
+	}
+
+	privateKey, err := getKey(c.String("key"))
+	if err != nil {
+		return cli.NewExitError("Can not use signing key provided: "+err.Error(), 1)
+	}
+
+	rl, err := readRevocationList(c.String("output-path"), privateKey)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, fp := range fingerprints {
+		rl.Revoke(artifact.RevokedKey{
+			Fingerprint: fp,
+			RevokedAt:   revokedAt,
+			Reason:      c.String("reason"),
+		})
+	}
+	rl.Issued = time.Now().UTC()
+
+	list, err := rl.Sign(artifact.NewSigner(privateKey))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = ioutil.WriteFile(c.String("output-path"), list, 0644); err != nil {
+		return cli.NewExitError("Can not write revocation list: "+err.Error(), 1)
+	}
+	return nil
+}
+
+// readRevocationList reads the existing revocation list so that it can be
+// extended; the list must be signed with the same key as the new one.
+func readRevocationList(path string, privateKey []byte) (*artifact.RevocationList, error) {
+	list, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return new(artifact.RevocationList), nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "can not read revocation list")
+	}
+
+	pub, err := artifact.GetPublic(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := artifact.NewKeyRing(pem.EncodeToMemory(
+		&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	if err != nil {
+		return nil, err
+	}
+	return artifact.ParseRevocationList(list, kr)
+}
@@ -15,13 +15,25 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
+var (
+	errSignV1            = errors.New("Can not sign v1 artifact")
+	errSignAlreadySigned = errors.New("Trying to sign already signed artifact; " +
+		"please use force option")
+)
+
 func signExisting(c *cli.Context) error {
 	if c.NArg() == 0 {
 		return cli.NewExitError("Nothing specified, nothing signed. \nMaybe you wanted"+
@@ -33,12 +45,31 @@ func signExisting(c *cli.Context) error {
 			"please use `-k` parameter for providing one", 1)
 	}
 
+	// the artifact holds a single certificate chain, which belongs to the
+	// first signer
+	if c.Bool("append") && len(c.String("certificate")) > 0 {
+		return cli.NewExitError("Can not append signature with certificate; "+
+			"the artifact holds the certificates of the first signer only", 1)
+	}
+
 	privateKey, err := getKey(c.String("key"))
 	if err != nil {
 		return cli.NewExitError("Can not use signing key provided: "+err.Error(), 1)
 	}
+	signer, err := getSigner(c.String("key"), c.String("certificate"),
+		c.String("tsa-url"))
+	if err != nil {
+		return cli.NewExitError("Can not use signing key provided: "+err.Error(), 1)
+	}
+
+	name := c.Args().First()
+	if len(c.String("output-path")) > 0 {
+		name = c.String("output-path")
+	}
 
-	tFile, err := ioutil.TempFile("", "mender-artifact")
+	// create temporary file next to the destination so that it can be
+	// renamed once the artifact is signed
+	tFile, err := ioutil.TempFile(filepath.Dir(name), "mender-artifact")
 	if err != nil {
 		return errors.Wrap(err,
 			"Can not create temporary file for storing artifact")
@@ -52,35 +83,224 @@ func signExisting(c *cli.Context) error {
 	}
 	defer f.Close()
 
-	reader, err := repack(c.Args().First(), f, tFile, privateKey, "", "")
+	// key identifier is needed only if the signature is appended
+	var keyID string
+	if c.Bool("append") {
+		pub, keyErr := artifact.GetPublic(privateKey)
+		if keyErr != nil {
+			return cli.NewExitError("Can not use signing key provided: "+keyErr.Error(), 1)
+		}
+		keyID = artifact.Fingerprint(pub)
+	}
+
+	err = signArtifact(f, tFile, signer, keyID,
+		c.Bool("force"))
 	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if err = tFile.Close(); err != nil {
 		return err
 	}
 
-	switch ver := reader.GetInfo().Version; ver {
+	err = os.Rename(tFile.Name(), name)
+	if err != nil {
+		return cli.NewExitError("Can not store signed artifact: "+err.Error(), 1)
+	}
+	return nil
+}
+
+// signArtifact copies the artifact read from `from` into `to` adding the
+// signature of the manifest. All the other files are copied as they are,
+// so the payloads, headers and scripts of all the updates are preserved.
+// If keyID is provided the signature is appended to the existing ones
+// instead of replacing those.
+func signArtifact(from io.Reader, to io.Writer, signer artifact.Signer,
+	keyID string, force bool) error {
+	tr := tar.NewReader(from)
+	tw := tar.NewWriter(to)
+
+	// first file inside the artifact MUST be version
+	hdr, raw, err := readArtifactFile(tr, "version")
+	if err != nil {
+		return err
+	}
+	info := new(artifact.Info)
+	if _, err = info.Write(raw); err != nil {
+		return errors.Wrap(err, "can not read version file")
+	}
+	switch info.Version {
 	case 1:
-		return cli.NewExitError("Can not sign v1 artifact", 1)
+		return errSignV1
 	case 2:
-		if reader.IsSigned && !c.Bool("force") {
-			return cli.NewExitError("Trying to sign already signed artifact; "+
-				"please use force option", 1)
-		}
 	default:
-		return cli.NewExitError("Unsupported version of artifact file: "+string(ver), 1)
+		return errors.Errorf("Unsupported version of artifact file: %d", info.Version)
+	}
+	if err = copyArtifactFile(tw, hdr, bytes.NewReader(raw)); err != nil {
+		return err
 	}
 
-	if err = tFile.Close(); err != nil {
+	// file after version MUST be manifest
+	hdr, manifest, err := readArtifactFile(tr, "manifest")
+	if err != nil {
+		return err
+	}
+	if err = copyArtifactFile(tw, hdr, bytes.NewReader(manifest)); err != nil {
 		return err
 	}
 
-	name := c.Args().First()
-	if len(c.String("output-path")) > 0 {
-		name = c.String("output-path")
+	hdr, err = tr.Next()
+	if err != nil {
+		return errors.Wrap(err, "can not read artifact file after manifest")
 	}
 
-	err = os.Rename(tFile.Name(), name)
+	var sigs artifact.Signatures
+	if hdr.Name == "manifest.sig" {
+		if keyID != "" {
+			buf := bytes.NewBuffer(nil)
+			if _, err = io.Copy(buf, tr); err != nil {
+				return errors.Wrap(err, "can not read signature")
+			}
+			if sigs, err = artifact.ParseSignatures(buf.Bytes()); err != nil {
+				return err
+			}
+			if sigs.HasKey(keyID) || signedWith(manifest, buf.Bytes(), signer) {
+				return errors.Errorf("Artifact is already signed with key: %s", keyID)
+			}
+		} else if !force {
+			return errSignAlreadySigned
+		}
+		// the existing signature is written again together with the new one
+		// or replaced with the new one
+		hdr, err = tr.Next()
+		if err != nil {
+			return errors.Wrap(err, "can not read artifact file after signature")
+		}
+	}
+
+	var appended []byte
+	if keyID == "" {
+		err = awriter.WriteSignature(tw, manifest, signer)
+	} else {
+		appended, err = appendSignature(tw, manifest, signer, keyID, sigs)
+	}
 	if err != nil {
-		return cli.NewExitError("Can not store signed artifact: "+err.Error(), 1)
+		return err
+	}
+
+	// certificates of the existing signer are kept only if the new
+	// signature is appended
+	if hdr.Name == "manifest.crt" {
+		if keyID != "" {
+			if err = copyArtifactFile(tw, hdr, tr); err != nil {
+				return err
+			}
+		}
+		if hdr, err = tr.Next(); err != nil {
+			return errors.Wrap(err, "can not read artifact file after certificates")
+		}
+	}
+	// the existing timestamp is not valid for the new signature
+	timestamped := hdr.Name == "manifest.tsr"
+	if timestamped {
+		if hdr, err = tr.Next(); err != nil {
+			return errors.Wrap(err, "can not read artifact file after timestamp")
+		}
+	}
+	if keyID != "" {
+		if err = appendTimestamp(tw, appended, signer, timestamped); err != nil {
+			return err
+		}
+	}
+
+	// copy the rest of the artifact without any modifications
+	for {
+		if err = copyArtifactFile(tw, hdr, tr); err != nil {
+			return err
+		}
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "can not read artifact file")
+		}
+	}
+	return tw.Close()
+}
+
+// signedWith checks if any of the signatures is created with the key of
+// the signer; the signatures without the key identifier can only be told
+// by verifying those.
+func signedWith(message, sig []byte, signer artifact.Signer) bool {
+	v, ok := signer.(artifact.Verifier)
+	return ok && v.Verify(message, sig) == nil
+}
+
+// appendTimestamp stores the timestamp token of the appended signatures.
+// The token of the existing signatures covers those only, so the signatures
+// must be timestamped again not to drop the trusted signing time silently.
+func appendTimestamp(tw *tar.Writer, sig []byte, signer artifact.Signer,
+	timestamped bool) error {
+	var token []byte
+	if ts, ok := signer.(artifact.Timestamper); ok {
+		var err error
+		if token, err = ts.Timestamp(sig); err != nil {
+			return errors.Wrap(err, "can not timestamp signature")
+		}
+	}
+	if token == nil {
+		if timestamped {
+			return errors.New("Artifact signature is timestamped; appending " +
+				"the signature would drop the timestamp unless `--tsa-url` is provided")
+		}
+		return nil
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(token, "manifest.tsr"); err != nil {
+		return errors.Wrap(err, "can not store timestamp")
+	}
+	return nil
+}
+
+// appendSignature writes the signatures of the artifact together with the
+// new one and returns the content of the written signature file.
+func appendSignature(tw *tar.Writer, message []byte, signer artifact.Signer,
+	keyID string, sigs artifact.Signatures) ([]byte, error) {
+	sig, err := signer.Sign(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not sign artifact")
+	}
+	sigs = append(sigs, artifact.Signature{Signature: sig, KeyID: keyID})
+	raw := sigs.Raw()
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(raw, "manifest.sig"); err != nil {
+		return nil, errors.Wrap(err, "can not tar signature")
+	}
+	return raw, nil
+}
+
+func readArtifactFile(tr *tar.Reader, name string) (*tar.Header, []byte, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "can not read artifact file: %s", name)
+	}
+	if hdr.Name != name {
+		return nil, nil, errors.Errorf("invalid artifact file; expecting: %s; got: %s",
+			name, hdr.Name)
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err = io.Copy(buf, tr); err != nil {
+		return nil, nil, errors.Wrapf(err, "can not read artifact file: %s", name)
+	}
+	return hdr, buf.Bytes(), nil
+}
+
+func copyArtifactFile(tw *tar.Writer, hdr *tar.Header, r io.Reader) error {
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "can not write header: %s", hdr.Name)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return errors.Wrapf(err, "can not copy artifact file: %s", hdr.Name)
 	}
 	return nil
 }
@@ -0,0 +1,57 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/urfave/cli"
+)
+
+func writeSingleFile(c *cli.Context) error {
+	if err := validateInput(c); err != nil {
+		Log.Error(err.Error())
+		return err
+	}
+	if c.String("dest-path") == "" {
+		return cli.NewExitError("must provide `dest-path`",
+			errArtifactInvalidParameters)
+	}
+
+	// the mode defaults to the one of the update file
+	mode := c.String("mode")
+	if mode == "" {
+		info, err := os.Stat(c.String("update"))
+		if err != nil {
+			return cli.NewExitError("can not open update file", errArtifactOpen)
+		}
+		mode = fmt.Sprintf("%04o", info.Mode().Perm())
+	}
+
+	h, err := handlers.NewSingleFile(c.String("update"), handlers.SingleFileMetaData{
+		Path:             c.String("dest-path"),
+		Mode:             mode,
+		Owner:            c.String("owner"),
+		Group:            c.String("group"),
+		PreviousChecksum: c.String("previous-checksum"),
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	return writeUpdate(c, c.StringSlice("device-type"),
+		c.String("artifact-name"), h)
+}
@@ -15,9 +15,12 @@
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -28,38 +31,230 @@ import (
 
 var ErrInvalidSignature = errors.New("error validating signature")
 
-func validate(art io.Reader, key []byte) error {
-	// do not return error immediately if we can not validate signature;
-	// just continue checking consistency and return info if
-	// signature verification failed
-	var validationError error
-	verify := func(message, sig []byte) error {
-		verifyCallback := func(message, sig []byte) error {
-			return errors.New("artifact is signed but no verification key was provided")
+var errNoVerificationKey = errors.New("artifact is signed but no verification key " +
+	"was provided")
+
+// verification holds everything needed for verifying the artifact signature.
+type verification struct {
+	key       []byte
+	threshold int
+	// the artifact must be signed if the threshold is requested explicitly
+	requireSigned bool
+	caCerts       []byte
+	intermediates []byte
+	revocations   *artifact.RevocationList
+	// trusted root certificates of the time stamping authorities
+	tsaCerts []byte
+	// artifacts with lower security version are rejected
+	minSecurityVersion uint64
+}
+
+// verificationResult is filled in while the artifact is read.
+type verificationResult struct {
+	signed bool
+	// fingerprints of the keys the artifact is signed with
+	keys []string
+	// certificate of the signer if the artifact is signed using certificate
+	signer *x509.Certificate
+	err    error
+	// signing time proven by the timestamp if there is one
+	signedAt time.Time
+	tsErr    error
+}
+
+func getVerification(c *cli.Context) (*verification, error) {
+	key, err := getKey(c.String("key"))
+	if err != nil {
+		return nil, err
+	}
+	v := &verification{
+		key:                key,
+		threshold:          c.Int("threshold"),
+		requireSigned:      c.IsSet("threshold") && c.Int("threshold") > 0,
+		minSecurityVersion: c.Uint64("min-security-version"),
+	}
+	if c.String("ca-certificate") != "" {
+		if v.caCerts, err = getKey(c.String("ca-certificate")); err != nil {
+			return nil, err
 		}
-		if key != nil {
-			s := artifact.NewVerifier(key)
-			verifyCallback = s.Verify
+	}
+	if c.String("intermediate-certificate") != "" {
+		if v.intermediates, err = getKey(c.String("intermediate-certificate")); err != nil {
+			return nil, err
 		}
-
-		if verifyCallback != nil {
-			if err := verifyCallback(message, sig); err != nil {
-				validationError = err
+	}
+	if c.String("tsa-certificate") != "" {
+		if v.tsaCerts, err = getKey(c.String("tsa-certificate")); err != nil {
+			return nil, err
+		}
+	}
+	if c.String("revocation-list") != "" {
+		if v.revocations, err = getRevocationList(c.String("revocation-list"),
+			c.String("revocation-key")); err != nil {
+			return nil, err
+		}
+		if c.String("revocation-list-issued") != "" {
+			issued, err := time.Parse(time.RFC3339, c.String("revocation-list-issued"))
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid revocation list issue time")
+			}
+			if err = v.revocations.CheckIssued(issued); err != nil {
+				return nil, err
 			}
 		}
+	}
+	return v, nil
+}
+
+// getRevocationList reads the revocation list and verifies its signature
+// using the provided public key.
+func getRevocationList(listPath, keyPath string) (*artifact.RevocationList, error) {
+	if keyPath == "" {
+		return nil, errors.New("revocation list provided but no key " +
+			"for verifying the list was provided")
+	}
+	key, err := getKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := artifact.NewKeyRing(key)
+	if err != nil {
+		return nil, err
+	}
+	list, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read revocation list")
+	}
+	return artifact.ParseRevocationList(list, kr)
+}
+
+// register sets the signature verification callbacks of the reader.
+// Do not return error immediately if we can not validate signature;
+// just continue checking consistency and return info if
+// signature verification failed.
+func (v *verification) register(ar *areader.Reader) *verificationResult {
+	res := new(verificationResult)
+	ar.VerifySignatureCallback = func(message, sig []byte) error {
+		res.signed = true
+		res.keys, res.err = v.verifyKeys(message, sig, res.signedAt)
 		return nil
 	}
+	if v.caCerts != nil {
+		ar.VerifyChainCallback = func(message, sig, chain []byte) error {
+			res.signed = true
+			res.signer, res.err = v.verifyChain(message, sig, chain, res.signedAt)
+			if res.err == nil {
+				pub, err := x509.MarshalPKIXPublicKey(res.signer.PublicKey)
+				if err != nil {
+					res.err = err
+					return nil
+				}
+				res.keys = []string{artifact.Fingerprint(pub)}
+			}
+			return nil
+		}
+	}
+	if v.minSecurityVersion > 0 {
+		ar.SecurityVersionCallback = func(version uint64) error {
+			if version < v.minSecurityVersion {
+				return errors.Errorf("artifact security version %d is lower "+
+					"than the minimum version %d", version, v.minSecurityVersion)
+			}
+			return nil
+		}
+	}
+	if v.tsaCerts != nil {
+		ar.VerifyTimestampCallback = func(sig, token []byte) (time.Time, error) {
+			res.signedAt, res.tsErr = v.verifyTimestamp(sig, token)
+			return res.signedAt, nil
+		}
+	}
+	return res
+}
+
+func (v *verification) verifyKeys(message, sig []byte,
+	signedAt time.Time) ([]string, error) {
+	if v.key == nil {
+		return nil, errNoVerificationKey
+	}
+	kr, err := artifact.NewKeyRing(v.key)
+	if err != nil {
+		return nil, err
+	}
+	kr.SetRevocationList(v.revocations)
+	kr.SetSigningTime(signedAt)
+	threshold := v.threshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	return artifact.NewThresholdVerifier(kr, threshold).VerifyKeys(message, sig)
+}
+
+func (v *verification) verifyChain(message, sig, chain []byte,
+	signedAt time.Time) (*x509.Certificate, error) {
+	xv, err := artifact.NewX509Verifier(v.caCerts)
+	if err != nil {
+		return nil, err
+	}
+	xv.SetRevocationList(v.revocations)
+	xv.SetSigningTime(signedAt)
+	if v.intermediates != nil {
+		if err = xv.RequireIntermediates(v.intermediates); err != nil {
+			return nil, err
+		}
+	}
+	return xv.VerifyCertificate(message, sig, chain)
+}
+
+// revokedKeys returns the revoked keys the artifact was signed with if the
+// verification failed because of the key revocation.
+func revokedKeys(err error) []artifact.RevokedKey {
+	if rev, ok := errors.Cause(err).(*artifact.RevokedKeyError); ok {
+		return rev.Keys
+	}
+	return nil
+}
+
+func (v *verification) verifyTimestamp(sig, token []byte) (time.Time, error) {
+	tv, err := artifact.NewTimestampVerifier(v.tsaCerts)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tv.Verify(sig, token)
+}
+
+// validate checks the consistency of the artifact and verifies its signature
+// returning the fingerprints of the keys the artifact was signed with.
+func validate(art io.Reader, key []byte) ([]string, error) {
+	res, err := validateSignatures(art, &verification{key: key})
+	if err != nil {
+		return nil, err
+	}
+	return res.keys, nil
+}
 
+func validateSignatures(art io.Reader, v *verification) (*verificationResult, error) {
 	ar := areader.NewReader(art)
-	ar.VerifySignatureCallback = verify
+	ar.VerifyOnly = true
+	res := v.register(ar)
 	if err := ar.ReadArtifact(); err != nil {
-		return err
+		return nil, err
 	}
-	if validationError != nil {
-		Log.Debugf("error validating signature: %s", validationError.Error())
-		return ErrInvalidSignature
+	if res.tsErr != nil {
+		return nil, errors.Wrap(res.tsErr, "error validating timestamp")
 	}
-	return nil
+	if v.requireSigned && !res.signed {
+		return nil, errors.Wrapf(ErrInvalidSignature,
+			"artifact is not signed, but %d signatures are required", v.threshold)
+	}
+	if res.err != nil {
+		Log.Debugf("error validating signature: %s", res.err.Error())
+		if revokedKeys(res.err) != nil {
+			return nil, errors.Wrap(ErrInvalidSignature, errors.Cause(res.err).Error())
+		}
+		return nil, ErrInvalidSignature
+	}
+	return res, nil
 }
 
 func validateArtifact(c *cli.Context) error {
@@ -68,7 +263,7 @@ func validateArtifact(c *cli.Context) error {
 			" to say 'artifacts validate <pathspec>'?", errArtifactInvalidParameters)
 	}
 
-	key, err := getKey(c.String("key"))
+	v, err := getVerification(c)
 	if err != nil {
 		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
 	}
@@ -79,10 +274,17 @@ func validateArtifact(c *cli.Context) error {
 	}
 	defer art.Close()
 
-	if err := validate(art, key); err != nil {
+	res, err := validateSignatures(art, v)
+	if err != nil {
 		return cli.NewExitError(err.Error(), errArtifactInvalid)
 	}
 
 	fmt.Printf("Artifact file '%s' validated successfully\n", c.Args().First())
+	for _, k := range res.keys {
+		fmt.Printf("Signature verified using key: %s\n", k)
+	}
+	if !res.signedAt.IsZero() {
+		fmt.Printf("Signature timestamp: %s\n", res.signedAt.Format(time.RFC3339))
+	}
 	return nil
 }
@@ -20,7 +20,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
@@ -79,7 +81,7 @@ func TestValidate(t *testing.T) {
 		fmt.Printf("---- Running test validate-%d ----\n", i)
 		art, err := WriteTestArtifact(test.version, "", test.writeKey)
 		assert.NoError(t, err)
-		err = validate(art, test.validateKey)
+		_, err = validate(art, test.validateKey)
 		if test.expectedError == nil {
 			assert.NoError(t, err)
 		} else {
@@ -117,3 +119,153 @@ func TestArtifactsValidateError(t *testing.T) {
 	assert.Equal(t, errArtifactOpen, lastExitCode)
 	assert.Contains(t, fakeErrWriter.String(), "no such file")
 }
+
+func TestValidateKeyDirectory(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	_, otherKey, err := generateKeys()
+	assert.NoError(t, err)
+
+	err = MakeFakeUpdateDir(keyDir,
+		[]TestDirEntry{
+			{
+				Path:    "old.key",
+				Content: otherKey,
+			},
+			{
+				Path:    "new.key",
+				Content: []byte(PublicValidateRSAKey),
+			},
+		})
+	assert.NoError(t, err)
+
+	art, err := WriteTestArtifact(2, "", []byte(PrivateValidateRSAKey))
+	assert.NoError(t, err)
+
+	keys, err := getKey(keyDir)
+	assert.NoError(t, err)
+	sigKeys, err := validate(art, keys)
+	assert.NoError(t, err)
+
+	kr, err := artifact.NewKeyRing([]byte(PublicValidateRSAKey))
+	assert.NoError(t, err)
+	assert.Equal(t, kr.Fingerprints(), sigKeys)
+}
+
+func TestValidateRevokedKey(t *testing.T) {
+	updateTestDir, err := ioutil.TempDir("", "update")
+	assert.NoError(t, err)
+	defer os.RemoveAll(updateTestDir)
+
+	listPriv, listPub, err := generateKeys()
+	assert.NoError(t, err)
+
+	err = MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{
+				Path:    "private.key",
+				Content: []byte(PrivateValidateRSAKey),
+			},
+			{
+				Path:    "public.key",
+				Content: []byte(PublicValidateRSAKey),
+			},
+			{
+				Path:    "list-private.key",
+				Content: listPriv,
+			},
+			{
+				Path:    "list-public.key",
+				Content: listPub,
+			},
+		})
+	assert.NoError(t, err)
+	err = WriteArtifact(updateTestDir, 2, "")
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "artifact.mender")
+	list := filepath.Join(updateTestDir, "revoked.json")
+
+	os.Args = []string{"mender-artifact", "sign",
+		"-k", filepath.Join(updateTestDir, "private.key"), art}
+	assert.NoError(t, run())
+
+	// nothing to revoke
+	os.Args = []string{"mender-artifact", "revoke",
+		"-k", filepath.Join(updateTestDir, "list-private.key"), "-o", list}
+	assert.Error(t, run())
+	assert.Equal(t, errArtifactInvalidParameters, lastExitCode)
+
+	// the list does not contain the signing key
+	os.Args = []string{"mender-artifact", "revoke",
+		"-k", filepath.Join(updateTestDir, "list-private.key"), "-o", list,
+		"-f", "0123456789abcdef"}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "validate",
+		"-k", filepath.Join(updateTestDir, "public.key"),
+		"--revocation-list", list,
+		"--revocation-key", filepath.Join(updateTestDir, "list-public.key"), art}
+	assert.NoError(t, run())
+
+	// missing key for verifying the list
+	os.Args = []string{"mender-artifact", "validate",
+		"-k", filepath.Join(updateTestDir, "public.key"),
+		"--revocation-list", list, art}
+	assert.Error(t, run())
+	assert.Equal(t, errArtifactInvalidParameters, lastExitCode)
+
+	// list signed with other key
+	os.Args = []string{"mender-artifact", "validate",
+		"-k", filepath.Join(updateTestDir, "public.key"),
+		"--revocation-list", list,
+		"--revocation-key", filepath.Join(updateTestDir, "public.key"), art}
+	assert.Error(t, run())
+	assert.Equal(t, errArtifactInvalidParameters, lastExitCode)
+
+	// extend the list with the signing key
+	os.Args = []string{"mender-artifact", "revoke",
+		"-k", filepath.Join(updateTestDir, "list-private.key"), "-o", list,
+		"-p", filepath.Join(updateTestDir, "public.key"),
+		"--time", "2018-01-01T00:00:00Z", "--reason", "compromised"}
+	assert.NoError(t, run())
+
+	// the list must be extended using the same key
+	os.Args = []string{"mender-artifact", "revoke",
+		"-k", filepath.Join(updateTestDir, "private.key"), "-o", list,
+		"-f", "0123456789abcdef"}
+	assert.Error(t, run())
+
+	assert.NoError(t, err)
+	rl, err := getRevocationList(list, filepath.Join(updateTestDir, "list-public.key"))
+	assert.NoError(t, err)
+	assert.Len(t, rl.Keys, 2)
+
+	kr, err := artifact.NewKeyRing([]byte(PublicValidateRSAKey))
+	assert.NoError(t, err)
+	assert.Equal(t, "compromised", rl.Get(kr.Fingerprints()[0]).Reason)
+
+	fakeErrWriter.Reset()
+	os.Args = []string{"mender-artifact", "validate",
+		"-k", filepath.Join(updateTestDir, "public.key"),
+		"--revocation-list", list,
+		"--revocation-key", filepath.Join(updateTestDir, "list-public.key"), art}
+	err = run()
+	assert.Error(t, err)
+	assert.Equal(t, errArtifactInvalid, lastExitCode)
+	assert.Contains(t, fakeErrWriter.String(), "signed with revoked key: "+
+		kr.Fingerprints()[0]+" (revoked at: 2018-01-01T00:00:00Z)")
+
+	// the list is older than the last accepted one
+	os.Args = []string{"mender-artifact", "validate",
+		"-k", filepath.Join(updateTestDir, "public.key"),
+		"--revocation-list", list,
+		"--revocation-key", filepath.Join(updateTestDir, "list-public.key"),
+		"--revocation-list-issued", rl.Issued.Add(time.Hour).Format(time.RFC3339), art}
+	err = run()
+	assert.Error(t, err)
+	assert.Equal(t, errArtifactInvalidParameters, lastExitCode)
+	assert.Contains(t, err.Error(), "older than the last accepted list")
+}
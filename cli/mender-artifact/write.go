@@ -17,8 +17,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
@@ -46,6 +49,7 @@ func validateInput(c *cli.Context) error {
 }
 
 func writeRootfs(c *cli.Context) error {
+	started := time.Now()
 	if err := validateInput(c); err != nil {
 		Log.Error(err.Error())
 		return err
@@ -63,9 +67,9 @@ func writeRootfs(c *cli.Context) error {
 	var h *handlers.Rootfs
 	switch version {
 	case 1:
-		h = handlers.NewRootfsV1(c.String("update"))
+		h = handlers.NewRootfsV1(c.String("update"), c.StringSlice("file")...)
 	case 2:
-		h = handlers.NewRootfsV2(c.String("update"))
+		h = handlers.NewRootfsV2(c.String("update"), c.StringSlice("file")...)
 	default:
 		return cli.NewExitError(
 			fmt.Sprintf("unsupported artifact version: %v", version),
@@ -73,6 +77,21 @@ func writeRootfs(c *cli.Context) error {
 		)
 	}
 
+	if c.Bool("dm-verity") {
+		if version == 1 {
+			return cli.NewExitError("can not use dm-verity with version 1",
+				errArtifactInvalidParameters)
+		}
+		dir, err := ioutil.TempDir("", "mender-verity")
+		if err != nil {
+			return cli.NewExitError("can not create dm-verity hash file", errArtifactCreate)
+		}
+		defer os.RemoveAll(dir)
+		if err = addVerity(h, c.String("update"), dir); err != nil {
+			return cli.NewExitError(err.Error(), errArtifactCreate)
+		}
+	}
+
 	upd := &awriter.Updates{
 		U: []handlers.Composer{h},
 	}
@@ -88,11 +107,16 @@ func writeRootfs(c *cli.Context) error {
 		os.Remove(name + ".tmp")
 	}()
 
-	aw, err := artifactWriter(f, c.String("key"), version)
+	aw, err := artifactWriter(f, c.String("key"), c.String("certificate"),
+		c.String("tsa-url"), version)
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
+	if err = setWriterOptions(c, aw, version); err != nil {
+		return err
+	}
+
 	scr, err := scripts(c.StringSlice("script"))
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -101,6 +125,17 @@ func writeRootfs(c *cli.Context) error {
 		return cli.NewExitError("can not use scripts artifact with version 1", 1)
 	}
 
+	prov, err := getProvenance(c, started)
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	if prov != nil {
+		if version == 1 {
+			return cli.NewExitError("can not use provenance with version 1", 1)
+		}
+		aw.SetProvenance(prov)
+	}
+
 	err = aw.WriteArtifact("mender", version,
 		c.StringSlice("device-type"), c.String("artifact-name"), upd, scr)
 	if err != nil {
@@ -115,18 +150,183 @@ func writeRootfs(c *cli.Context) error {
 	return nil
 }
 
-func artifactWriter(f *os.File, key string,
+// setWriterOptions sets the validity, the security version and the
+// encryption of the artifact requested by the flags shared by the write
+// subcommands.
+func setWriterOptions(c *cli.Context, aw *awriter.Writer, version int) error {
+	validity, err := getValidity(c.String("not-before"), c.String("not-after"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), errArtifactInvalidParameters)
+	}
+	aw.SetValidity(validity)
+	aw.SetSecurityVersion(c.Uint64("security-version"))
+
+	if c.String("encryption-key") != "" {
+		if version == 1 {
+			return cli.NewExitError("can not use encrypted artifact with version 1", 1)
+		}
+		enc, err := getEncrypter(c.String("encryption-key"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		aw.SetEncrypter(enc)
+	}
+	return nil
+}
+
+// addVerity generates the dm-verity hash tree of the image in dir and adds
+// it to the rootfs update.
+func addVerity(h *handlers.Rootfs, image, dir string) error {
+	hashFile := filepath.Join(dir, filepath.Base(image)+handlers.VeritySuffix)
+	v, err := handlers.GenerateVerity(image, hashFile)
+	if err != nil {
+		return err
+	}
+	return h.SetVerity(hashFile, v)
+}
+
+// getValidity parses the bounds of the artifact validity window; nil is
+// returned if none of those is provided.
+func getValidity(notBefore, notAfter string) (*artifact.Validity, error) {
+	if notBefore == "" && notAfter == "" {
+		return nil, nil
+	}
+	v := new(artifact.Validity)
+	for _, b := range []struct {
+		value string
+		t     **time.Time
+	}{
+		{notBefore, &v.NotBefore},
+		{notAfter, &v.NotAfter},
+	} {
+		if b.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, b.value)
+		if err != nil {
+			return nil, errors.New("invalid validity time: " + err.Error())
+		}
+		*b.t = &t
+	}
+	if v.Validate() != nil {
+		return nil, errors.New("artifact validity ends before it starts")
+	}
+	return v, nil
+}
+
+// getProvenance either reads the provenance provided by the build pipeline
+// or generates a new one recording the input files of the artifact; nil is
+// returned if the provenance is not requested.
+func getProvenance(c *cli.Context, started time.Time) (*artifact.Provenance, error) {
+	builder := c.String("builder-id")
+	source := c.String("source-uri")
+	commit := c.String("source-commit")
+
+	if path := c.String("provenance"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("can not read provenance: " + err.Error())
+		}
+		prov, err := artifact.ParseProvenance(data)
+		if err != nil {
+			return nil, err
+		}
+		if builder != "" {
+			prov.Predicate.Builder.ID = builder
+		}
+		return prov, nil
+	}
+	if builder == "" {
+		if source != "" || commit != "" {
+			return nil, errors.New("source of the artifact can be recorded " +
+				"only together with `builder-id`")
+		}
+		return nil, nil
+	}
+
+	prov := artifact.NewProvenance(builder, started)
+	if source != "" || commit != "" {
+		cs := &artifact.ConfigSource{URI: source}
+		if commit != "" {
+			cs.Digest = artifact.DigestSet{"sha1": commit}
+		}
+		prov.Predicate.Invocation = &artifact.Invocation{ConfigSource: cs}
+		prov.Predicate.Materials = append(prov.Predicate.Materials,
+			artifact.Material{URI: cs.URI, Digest: cs.Digest})
+	}
+	inputs := append([]string{c.String("update")}, c.StringSlice("script")...)
+	for _, in := range inputs {
+		if err := prov.AddMaterial("file:"+filepath.Base(in), in); err != nil {
+			return nil, err
+		}
+	}
+	finished := time.Now()
+	prov.Predicate.Metadata.BuildFinishedOn = &finished
+	return prov, nil
+}
+
+// writeUpdate writes the version 2 artifact holding the updates
+// to the output path.
+func writeUpdate(c *cli.Context, devices []string, artifactName string,
+	h ...handlers.Composer) error {
+	name := "artifact.mender"
+	if len(c.String("output-path")) > 0 {
+		name = c.String("output-path")
+	}
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return cli.NewExitError("can not create artifact file", errArtifactCreate)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(name + ".tmp")
+	}()
+
+	aw, err := artifactWriter(f, c.String("key"), c.String("certificate"),
+		c.String("tsa-url"), 2)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = setWriterOptions(c, aw, 2); err != nil {
+		return err
+	}
+	scr, err := scripts(c.StringSlice("script"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	upd := &awriter.Updates{
+		U: h,
+	}
+	if err = aw.WriteArtifact("mender", 2, devices, artifactName, upd, scr); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	f.Close()
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func artifactWriter(f *os.File, key, cert, tsa string,
 	ver int) (*awriter.Writer, error) {
 	if key != "" {
 		if ver == 0 {
 			// check if we are having correct version
 			return nil, errors.New("can not use signed artifact with version 0")
 		}
-		privateKey, err := getKey(key)
+		signer, err := getSigner(key, cert, tsa)
 		if err != nil {
 			return nil, err
 		}
-		return awriter.NewWriterSigned(f, artifact.NewSigner(privateKey)), nil
+		return awriter.NewWriterSigned(f, signer), nil
+	}
+	if cert != "" {
+		return nil, errors.New("can not use certificate without signing key")
+	}
+	if tsa != "" {
+		return nil, errors.New("can not use timestamp without signing key")
 	}
 	return awriter.NewWriter(f), nil
 }
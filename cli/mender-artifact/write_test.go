@@ -15,12 +15,26 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/mendersoftware/mender-artifact/areader"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestArtifactsWrite(t *testing.T) {
@@ -160,3 +174,824 @@ func TestWithScripts(t *testing.T) {
 	assert.Equal(t, "scripter: invalid script: InvalidScript\n",
 		fakeErrWriter.String())
 }
+
+func TestWriteEncrypted(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	priv, pub, err := generateKeys()
+	assert.NoError(t, err)
+	// the RSA test keys are too short for wrapping the data key
+	encPriv, encPub, err := generateECDSAKeys()
+	assert.NoError(t, err)
+	otherPriv, _, err := generateECDSAKeys()
+	assert.NoError(t, err)
+
+	err = MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "update.ext4", Content: []byte("my update")},
+			{Path: "private.key", Content: priv},
+			{Path: "public.key", Content: pub},
+			{Path: "encryption-private.key", Content: encPriv},
+			{Path: "encryption-public.key", Content: encPub},
+			{Path: "other-private.key", Content: otherPriv},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "art.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image", "-t", "my-device",
+		"-n", "mender-1.1", "-u", filepath.Join(updateTestDir, "update.ext4"),
+		"-k", filepath.Join(updateTestDir, "private.key"),
+		"--encryption-key", filepath.Join(updateTestDir, "encryption-public.key"),
+		"-o", art}
+	assert.NoError(t, run())
+
+	raw, err := ioutil.ReadFile(art)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "my update")
+
+	// the signature is verified without the decryption key
+	os.Args = []string{"mender-artifact", "validate",
+		"-k", filepath.Join(updateTestDir, "public.key"), art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "read",
+		"--decryption-key", filepath.Join(updateTestDir, "encryption-private.key"), art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "read",
+		"--decryption-key", filepath.Join(updateTestDir, "other-private.key"), art}
+	assert.Error(t, run())
+
+	// encrypted artifacts can not be modified
+	_, err = repack(art, bytes.NewReader(raw), ioutil.Discard, nil, "", "")
+	assert.Error(t, err)
+
+	os.Args = []string{"mender-artifact", "write", "rootfs-image", "-t", "my-device",
+		"-n", "mender-1.1", "-u", filepath.Join(updateTestDir, "update.ext4"),
+		"--encryption-key", filepath.Join(updateTestDir, "encryption-public.key"),
+		"-o", art, "-v", "1"}
+	assert.Error(t, run())
+}
+
+func TestWriteValidity(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{{Path: "update.ext4", Content: []byte("my update")}})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "art.mender")
+	write := func(validity ...string) error {
+		os.Args = append([]string{"mender-artifact", "write", "rootfs-image",
+			"-t", "my-device", "-n", "mender-1.1",
+			"-u", filepath.Join(updateTestDir, "update.ext4"), "-o", art},
+			validity...)
+		return run()
+	}
+	now := time.Now().UTC()
+
+	assert.NoError(t, write("--not-before", now.Add(-time.Hour).Format(time.RFC3339),
+		"--not-after", now.Add(time.Hour).Format(time.RFC3339)))
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// expired artifact
+	assert.NoError(t, write("--not-after", now.Add(-time.Hour).Format(time.RFC3339)))
+	os.Args = []string{"mender-artifact", "validate", art}
+	err = run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "artifact expired at")
+
+	assert.Error(t, write("--not-before", "yesterday"))
+	assert.Error(t, write("--not-before", now.Format(time.RFC3339),
+		"--not-after", now.Add(-time.Hour).Format(time.RFC3339)))
+}
+
+func TestWriteSecurityVersion(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{{Path: "update.ext4", Content: []byte("my update")}})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "art.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image",
+		"-t", "my-device", "-n", "mender-1.1", "--security-version", "5",
+		"-u", filepath.Join(updateTestDir, "update.ext4"), "-o", art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "validate",
+		"--min-security-version", "5", art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "validate",
+		"--min-security-version", "6", art}
+	err = run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "artifact security version 5 is lower "+
+		"than the minimum version 6")
+}
+
+func TestWriteProvenance(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "update.ext4", Content: []byte("my update")},
+			{Path: "ArtifactInstall_Enter_01", Content: []byte("script")},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "art.mender")
+	write := func(provenance ...string) error {
+		os.Args = append([]string{"mender-artifact", "write", "rootfs-image",
+			"-t", "my-device", "-n", "mender-1.1",
+			"-u", filepath.Join(updateTestDir, "update.ext4"),
+			"-s", filepath.Join(updateTestDir, "ArtifactInstall_Enter_01"),
+			"-o", art}, provenance...)
+		return run()
+	}
+	readProvenance := func() *artifact.Provenance {
+		f, err := os.Open(art)
+		require.NoError(t, err)
+		defer f.Close()
+		ar := areader.NewReader(f)
+		require.NoError(t, ar.ReadArtifact())
+		return ar.GetProvenance()
+	}
+
+	assert.NoError(t, write("--builder-id", "https://ci.example.com",
+		"--source-uri", "git+https://example.com/os.git", "--source-commit", "abcd"))
+	p := readProvenance()
+	require.NotNil(t, p)
+	assert.Equal(t, "https://ci.example.com", p.Predicate.Builder.ID)
+	assert.Equal(t, "git+https://example.com/os.git",
+		p.Predicate.Invocation.ConfigSource.URI)
+	require.Len(t, p.Predicate.Materials, 3)
+	assert.Equal(t, "abcd", p.Predicate.Materials[0].Digest["sha1"])
+	assert.Equal(t, "file:update.ext4", p.Predicate.Materials[1].URI)
+	assert.Equal(t, "file:ArtifactInstall_Enter_01", p.Predicate.Materials[2].URI)
+	require.Len(t, p.Subject, 1)
+	assert.Equal(t, "data/0000/update.ext4", p.Subject[0].Name)
+	assert.NotNil(t, p.Predicate.Metadata.BuildStartedOn)
+	assert.NotNil(t, p.Predicate.Metadata.BuildFinishedOn)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// provenance generated by the build pipeline
+	p.Subject = nil
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	stmt := filepath.Join(updateTestDir, "provenance.json")
+	require.NoError(t, ioutil.WriteFile(stmt, data, 0644))
+	assert.NoError(t, write("--provenance", stmt, "--builder-id", "other"))
+	p = readProvenance()
+	require.NotNil(t, p)
+	assert.Equal(t, "other", p.Predicate.Builder.ID)
+	assert.Len(t, p.Subject, 1)
+
+	require.NoError(t, ioutil.WriteFile(stmt, []byte("{}"), 0644))
+	assert.Error(t, write("--provenance", stmt))
+	assert.Error(t, write("--source-commit", "abcd"))
+
+	assert.NoError(t, write())
+	assert.Nil(t, readProvenance())
+}
+
+func TestWriteVerity(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	image := bytes.Repeat([]byte("block"), 4096)
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{{Path: "update.ext4", Content: image}})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "art.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image", "--dm-verity",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "update.ext4"), "-o", art}
+	assert.NoError(t, run())
+
+	readVerity := func(raw []byte) (*handlers.Verity, []byte) {
+		var tree []byte
+		rootfs := handlers.NewRootfsInstaller()
+		rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		}
+		rootfs.VerityInstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+			var err error
+			tree, err = ioutil.ReadAll(r)
+			return err
+		}
+		ar := areader.NewReader(bytes.NewReader(raw))
+		require.NoError(t, ar.RegisterHandler(rootfs))
+		require.NoError(t, ar.ReadArtifact())
+		return ar.GetHandlers()[0].(*handlers.Rootfs).GetVerity(), tree
+	}
+
+	raw, err := ioutil.ReadFile(art)
+	require.NoError(t, err)
+	v, tree := readVerity(raw)
+	require.NotNil(t, v)
+	assert.Equal(t, "update.ext4.verity", v.HashFile)
+	assert.Equal(t, uint64(5), v.DataBlocks)
+	assert.Len(t, tree, 2*handlers.VerityBlockSize)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// the hash tree is regenerated for the modified image
+	modified := filepath.Join(updateTestDir, "modified.ext4")
+	require.NoError(t, ioutil.WriteFile(modified, bytes.Repeat([]byte("kcolb"), 4096), 0644))
+	out := bytes.NewBuffer(nil)
+	_, err = repack(art, bytes.NewReader(raw), out, nil, "", modified)
+	require.NoError(t, err)
+	mv, _ := readVerity(out.Bytes())
+	require.NotNil(t, mv)
+	assert.Equal(t, "modified.ext4.verity", mv.HashFile)
+	assert.NotEqual(t, v.RootHash, mv.RootHash)
+
+	// the image must be aligned to the dm-verity block size
+	require.NoError(t, ioutil.WriteFile(modified, []byte("image"), 0644))
+	os.Args = []string{"mender-artifact", "write", "rootfs-image", "--dm-verity",
+		"-t", "my-device", "-n", "mender-1.1", "-u", modified, "-o", art}
+	assert.Error(t, run())
+
+	os.Args = []string{"mender-artifact", "write", "rootfs-image", "--dm-verity",
+		"-t", "my-device", "-n", "mender-1.1", "-v", "1",
+		"-u", filepath.Join(updateTestDir, "update.ext4"), "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteRootfsMultipleFiles(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "update.ext4", Content: []byte("rootfs")},
+			{Path: "zImage", Content: []byte("kernel")},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "art.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "update.ext4"),
+		"-f", filepath.Join(updateTestDir, "zImage"), "-o", art}
+	require.NoError(t, run())
+
+	readImages := func(raw []byte) map[string]string {
+		images := make(map[string]string)
+		rootfs := handlers.NewRootfsInstaller()
+		rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+			data, err := ioutil.ReadAll(r)
+			images[df.Name] = string(data)
+			return err
+		}
+		ar := areader.NewReader(bytes.NewReader(raw))
+		require.NoError(t, ar.RegisterHandler(rootfs))
+		require.NoError(t, ar.ReadArtifact())
+		return images
+	}
+
+	raw, err := ioutil.ReadFile(art)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"update.ext4": "rootfs", "zImage": "kernel"},
+		readImages(raw))
+
+	// the other images are kept when the rootfs image is replaced
+	modified := filepath.Join(updateTestDir, "modified.ext4")
+	require.NoError(t, ioutil.WriteFile(modified, []byte("modified"), 0644))
+	out := bytes.NewBuffer(nil)
+	_, err = repack(art, bytes.NewReader(raw), out, nil, "", modified)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"modified.ext4": "modified", "zImage": "kernel"},
+		readImages(out.Bytes()))
+}
+
+func TestWriteRootfsDelta(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	source := bytes.Repeat([]byte("source block"), 4096)
+	target := append([]byte("new header"), source[4096:]...)
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "source.ext4", Content: source},
+			{Path: "rootfs.ext4", Content: target},
+		})
+	assert.NoError(t, err)
+
+	// the target is provided as an artifact
+	targetArt := filepath.Join(updateTestDir, "target.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "rootfs.ext4"), "-o", targetArt}
+	require.NoError(t, run())
+
+	art := filepath.Join(updateTestDir, "delta.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image-delta",
+		"--source", filepath.Join(updateTestDir, "source.ext4"),
+		"--target", targetArt, "--security-version", "5", "-o", art}
+	require.NoError(t, run())
+
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var installed []byte
+	inst := handlers.NewRootfsDeltaInstaller()
+	inst.SourceHandler = func() (io.ReadCloser, error) {
+		return os.Open(filepath.Join(updateTestDir, "source.ext4"))
+	}
+	inst.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		assert.Equal(t, "rootfs.ext4", df.Name)
+		installed, err = ioutil.ReadAll(r)
+		return err
+	}
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(inst))
+	require.NoError(t, ar.ReadArtifact())
+	assert.Equal(t, "mender-1.1", ar.GetArtifactName())
+	assert.Equal(t, []string{"my-device"}, ar.GetCompatibleDevices())
+	assert.Equal(t, target, installed)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "validate",
+		"--min-security-version", "6", art}
+	err = run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "artifact security version 5 is lower "+
+		"than the minimum version 6")
+
+	// name and devices must be provided if the target is not an artifact
+	os.Args = []string{"mender-artifact", "write", "rootfs-image-delta",
+		"--source", filepath.Join(updateTestDir, "source.ext4"),
+		"--target", filepath.Join(updateTestDir, "rootfs.ext4"), "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteRootfsChunked(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	base := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(base)
+	image := append(append([]byte(nil), base...), []byte("new data")...)
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "base.ext4", Content: base},
+			{Path: "rootfs.ext4", Content: image},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "chunked.mender")
+	os.Args = []string{"mender-artifact", "write", "rootfs-image-chunked",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "rootfs.ext4"),
+		"--base", filepath.Join(updateTestDir, "base.ext4"), "-o", art}
+	require.NoError(t, run())
+
+	info, err := os.Stat(art)
+	require.NoError(t, err)
+	assert.True(t, info.Size() < int64(len(base)/2))
+
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var installed []byte
+	inst := handlers.NewRootfsChunkedInstaller()
+	inst.SourceHandler = func() (handlers.ChunkSource, error) {
+		return os.Open(filepath.Join(updateTestDir, "base.ext4"))
+	}
+	inst.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		installed, err = ioutil.ReadAll(r)
+		return err
+	}
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(inst))
+	require.NoError(t, ar.ReadArtifact())
+	assert.Equal(t, image, installed)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+}
+
+func TestWriteSingleFile(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{{Path: "app.conf", Content: []byte("new config")}})
+	assert.NoError(t, err)
+	require.NoError(t, os.Chmod(filepath.Join(updateTestDir, "app.conf"), 0640))
+
+	art := filepath.Join(updateTestDir, "single.mender")
+	os.Args = []string{"mender-artifact", "write", "single-file",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "app.conf"),
+		"--dest-path", "/etc/app/app.conf", "-o", art}
+	require.NoError(t, run())
+
+	root := filepath.Join(updateTestDir, "root")
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(handlers.NewSingleFileInstaller(root)))
+	require.NoError(t, ar.ReadArtifact())
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "etc", "app", "app.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, "new config", string(data))
+	info, err := os.Stat(filepath.Join(root, "etc", "app", "app.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// the destination must be absolute
+	os.Args = []string{"mender-artifact", "write", "single-file",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "app.conf"),
+		"--dest-path", "app.conf", "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteDirectory(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "app", IsDir: true},
+			{Path: "app/bin", IsDir: true},
+			{Path: "app/bin/app", Content: []byte("binary")},
+			{Path: "app/app.conf", Content: []byte("config")},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "directory.mender")
+	os.Args = []string{"mender-artifact", "write", "directory",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "app"),
+		"--dest-dir", "/opt/app", "--clean", "-o", art}
+	require.NoError(t, run())
+
+	root := filepath.Join(updateTestDir, "root")
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(handlers.NewDirectoryInstaller(root, "")))
+	require.NoError(t, ar.ReadArtifact())
+	assert.True(t, ar.GetHandlers()[0].(*handlers.Directory).GetMetaData().Clean)
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "opt", "app", "bin", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(data))
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// the update must be a directory
+	os.Args = []string{"mender-artifact", "write", "directory",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "app", "app.conf"),
+		"--dest-dir", "/opt/app", "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteDockerImage(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	// minimal OCI image layout with the single blob used as both config
+	// and layer
+	blob := []byte("{}")
+	sum := sha256.Sum256(blob)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	manifest := []byte(`{"schemaVersion":2,"config":{"mediaType":` +
+		`"application/vnd.oci.image.config.v1+json","digest":"` + digest +
+		`","size":2},"layers":[]}`)
+	msum := sha256.Sum256(manifest)
+	mdigest := "sha256:" + hex.EncodeToString(msum[:])
+	index := []byte(`{"schemaVersion":2,"manifests":[{"mediaType":` +
+		`"application/vnd.oci.image.manifest.v1+json","digest":"` + mdigest +
+		`","size":` + strconv.Itoa(len(manifest)) + `,"annotations":` +
+		`{"io.containerd.image.name":"docker.io/library/app:1.0"}}]}`)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "layout/blobs/sha256", IsDir: true},
+			{Path: "layout/oci-layout", Content: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+			{Path: "layout/index.json", Content: index},
+			{Path: "layout/blobs/sha256/" + digest[7:], Content: blob},
+			{Path: "layout/blobs/sha256/" + mdigest[7:], Content: manifest},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "docker.mender")
+	os.Args = []string{"mender-artifact", "write", "docker-image",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "layout"), "-o", art}
+	require.NoError(t, run())
+
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	var blobs []string
+	inst := handlers.NewDockerImageInstaller()
+	inst.BlobHandler = func(desc handlers.ImageDescriptor, r io.Reader) error {
+		blobs = append(blobs, desc.Digest)
+		return nil
+	}
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(inst))
+	require.NoError(t, ar.ReadArtifact())
+	assert.Equal(t, []string{mdigest, digest}, blobs)
+	images := ar.GetHandlers()[0].(*handlers.DockerImage).GetMetaData().Images
+	require.Len(t, images, 1)
+	assert.Equal(t, "docker.io/library/app:1.0", images[0].Ref)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+}
+
+// makeIpk creates the .ipk package in the tar.gz format holding only the
+// control file.
+func makeIpk(t *testing.T, path, control string) {
+	targz := func(name string, data []byte) []byte {
+		buf := bytes.NewBuffer(nil)
+		gz := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gz)
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: name, Mode: 0644, Size: int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+	pkg := targz("./control.tar.gz", targz("./control", []byte(control)))
+	require.NoError(t, ioutil.WriteFile(path, pkg, 0644))
+}
+
+func TestWritePackage(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	app := filepath.Join(updateTestDir, "app_1.0_armv7a.ipk")
+	makeIpk(t, app, "Package: app\nVersion: 1.0\nArchitecture: armv7a\n"+
+		"Depends: libapp (>= 1.0)\n")
+	lib := filepath.Join(updateTestDir, "libapp_1.0_armv7a.ipk")
+	makeIpk(t, lib, "Package: libapp\nVersion: 1.0\nArchitecture: armv7a\n")
+
+	art := filepath.Join(updateTestDir, "package.mender")
+	os.Args = []string{"mender-artifact", "write", "package",
+		"-t", "my-device", "-n", "mender-1.1", "-u", app, "-u", lib, "-o", art}
+	require.NoError(t, run())
+
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	var installed []string
+	inst := handlers.NewPackageInstaller()
+	inst.InstallHandler = func(r io.Reader, df *handlers.DataFile,
+		pkg *handlers.PackageInfo) error {
+		installed = append(installed, pkg.Name)
+		return nil
+	}
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(inst))
+	require.NoError(t, ar.ReadArtifact())
+	assert.Equal(t, []string{"libapp", "app"}, installed)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// at least one package must be given
+	os.Args = []string{"mender-artifact", "write", "package",
+		"-t", "my-device", "-n", "mender-1.1", "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteRawImage(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "spl.bin", Content: []byte("spl")},
+			{Path: "u-boot.bin", Content: []byte("u-boot")},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "raw.mender")
+	os.Args = []string{"mender-artifact", "write", "raw-image",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "spl.bin"),
+		"--target", "boot0", "--offset", "0x10", "--max-size", "16",
+		"-u", filepath.Join(updateTestDir, "u-boot.bin"),
+		"--target", "boot0", "--offset", "0x20", "--max-size", "16",
+		"--erase", "-o", art}
+	require.NoError(t, run())
+
+	target := filepath.Join(updateTestDir, "boot0")
+	require.NoError(t, ioutil.WriteFile(target, make([]byte, 48), 0644))
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	ar := areader.NewReader(f)
+	require.NoError(t, ar.RegisterHandler(
+		handlers.NewRawImageInstaller(map[string]string{"boot0": target})))
+	require.NoError(t, ar.ReadArtifact())
+
+	expected := make([]byte, 48)
+	copy(expected[16:], bytes.Repeat([]byte{0xff}, 32))
+	copy(expected[16:], "spl")
+	copy(expected[32:], "u-boot")
+	data, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// the offset of the second image is missing
+	os.Args = []string{"mender-artifact", "write", "raw-image",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "spl.bin"),
+		"--target", "boot0", "--offset", "0x10", "--max-size", "16",
+		"-u", filepath.Join(updateTestDir, "u-boot.bin"),
+		"--target", "boot0", "--max-size", "16", "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteModuleImage(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	// the module installs the streamed payloads next to its work directory
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "app.bin", Content: []byte("app")},
+			{Path: "meta-data.json", Content: []byte(`{"version":"1.0"}`)},
+			{Path: "modules", IsDir: true},
+			{Path: "modules/app-module", Content: []byte("#!/bin/sh\n" +
+				"case \"$1\" in\n" +
+				"Download) s=$(cat stream-next); cat \"$s\" > tmp/payload; " +
+				"cat stream-next;;\n" +
+				"Install) cat header/meta-data tmp/payload > ../installed;;\n" +
+				"esac\n")},
+		})
+	assert.NoError(t, err)
+	require.NoError(t, os.Chmod(filepath.Join(updateTestDir, "modules", "app-module"),
+		0755))
+
+	art := filepath.Join(updateTestDir, "module.mender")
+	os.Args = []string{"mender-artifact", "write", "module-image",
+		"-t", "my-device", "-n", "mender-1.1", "-T", "app-module",
+		"-u", filepath.Join(updateTestDir, "app.bin"),
+		"-m", filepath.Join(updateTestDir, "meta-data.json"), "-o", art}
+	require.NoError(t, run())
+
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	ar := areader.NewReader(f)
+	ar.ModuleHandler = handlers.ModuleInstallers(
+		filepath.Join(updateTestDir, "modules"), filepath.Join(updateTestDir, "work"))
+	require.NoError(t, ar.ReadArtifact())
+	assert.Equal(t, "app-module", ar.GetHandlers()[0].GetType())
+
+	data, err := ioutil.ReadFile(filepath.Join(updateTestDir, "work", "installed"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"version":"1.0"}app`, string(data))
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// the type is required
+	os.Args = []string{"mender-artifact", "write", "module-image",
+		"-t", "my-device", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "app.bin"), "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteMultiTarget(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	err := MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "gateway.ext4", Content: []byte("gateway")},
+			{Path: "sensor.ext4", Content: []byte("sensor")},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "multi.mender")
+	os.Args = []string{"mender-artifact", "write", "multi-target",
+		"-t", "gateway", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "gateway.ext4"),
+		"--target-device-type", "",
+		"-u", filepath.Join(updateTestDir, "sensor.ext4"),
+		"--target-device-type", "sensor-a, sensor-b", "-o", art}
+	require.NoError(t, run())
+
+	f, err := os.Open(art)
+	require.NoError(t, err)
+	defer f.Close()
+	var installed []string
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		data, err := ioutil.ReadAll(r)
+		installed = append(installed, string(data))
+		return err
+	}
+	ar := areader.NewReader(f)
+	ar.UpdateSelectCallback = areader.SelectDeviceType("sensor-b")
+	require.NoError(t, ar.RegisterHandler(rootfs))
+	require.NoError(t, ar.ReadArtifact())
+	assert.Equal(t, []string{"gateway"}, ar.GetCompatibleDevices())
+	assert.Nil(t, ar.GetUpdateDeviceTypes(0))
+	assert.Equal(t, []string{"sensor-a", "sensor-b"}, ar.GetUpdateDeviceTypes(1))
+	assert.Equal(t, []string{"gateway", "sensor"}, installed)
+
+	os.Args = []string{"mender-artifact", "read", art}
+	assert.NoError(t, run())
+
+	// each update needs its target devices
+	os.Args = []string{"mender-artifact", "write", "multi-target",
+		"-t", "gateway", "-n", "mender-1.1",
+		"-u", filepath.Join(updateTestDir, "gateway.ext4"),
+		"-u", filepath.Join(updateTestDir, "sensor.ext4"),
+		"--target-device-type", "sensor-a", "-o", art}
+	assert.Error(t, run())
+}
+
+func TestWriteUpdateOptions(t *testing.T) {
+	updateTestDir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(updateTestDir)
+
+	encPriv, encPub, err := generateECDSAKeys()
+	assert.NoError(t, err)
+	err = MakeFakeUpdateDir(updateTestDir,
+		[]TestDirEntry{
+			{Path: "app.conf", Content: []byte("new config")},
+			{Path: "encryption-private.key", Content: encPriv},
+			{Path: "encryption-public.key", Content: encPub},
+		})
+	assert.NoError(t, err)
+
+	art := filepath.Join(updateTestDir, "single.mender")
+	write := func(options ...string) error {
+		os.Args = append([]string{"mender-artifact", "write", "single-file",
+			"-t", "my-device", "-n", "mender-1.1",
+			"-u", filepath.Join(updateTestDir, "app.conf"),
+			"--dest-path", "/etc/app/app.conf", "-o", art}, options...)
+		return run()
+	}
+	now := time.Now().UTC()
+
+	require.NoError(t, write("--security-version", "5",
+		"--not-after", now.Add(time.Hour).Format(time.RFC3339),
+		"--encryption-key", filepath.Join(updateTestDir, "encryption-public.key")))
+
+	raw, err := ioutil.ReadFile(art)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "new config")
+
+	os.Args = []string{"mender-artifact", "read",
+		"--decryption-key", filepath.Join(updateTestDir, "encryption-private.key"), art}
+	assert.NoError(t, run())
+
+	os.Args = []string{"mender-artifact", "validate",
+		"--min-security-version", "6", art}
+	err = run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "artifact security version 5 is lower "+
+		"than the minimum version 6")
+
+	// expired artifact
+	require.NoError(t, write("--not-after", now.Add(-time.Hour).Format(time.RFC3339)))
+	os.Args = []string{"mender-artifact", "validate", art}
+	err = run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "artifact expired at")
+
+	assert.Error(t, write("--not-before", "yesterday"))
+}
@@ -0,0 +1,396 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package delta implements the binary delta of two images. The delta only
+// copies data from increasing offsets of the source image, so it can be
+// applied while reading the source as a stream; e.g. from the active
+// partition while the inactive one is being written.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBlockSize is the size of the matched blocks; it is the block
+	// size of ext4 file systems.
+	DefaultBlockSize = 4096
+
+	magic = "MDELTA01"
+
+	opCopy byte = 'C'
+	opData byte = 'D'
+	opEnd  byte = 'E'
+
+	// maxDataSize limits the size of the literal data of a single operation
+	maxDataSize = 1024 * 1024
+	// maxCopySize limits the size of the data copied by a single operation
+	maxCopySize = 1 << 31
+)
+
+// Header is stored at the beginning of the delta.
+type Header struct {
+	BlockSize  uint32
+	SourceSize uint64
+	TargetSize uint64
+}
+
+type strongHash [sha256.Size]byte
+
+// index maps the blocks of the source image to their offsets.
+type index struct {
+	weak   map[uint32]struct{}
+	strong map[strongHash][]uint64
+}
+
+// weakHash is the rolling checksum used by rsync.
+type weakHash struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakHash(block []byte) *weakHash {
+	h := &weakHash{n: uint32(len(block))}
+	for i, c := range block {
+		h.a += uint32(c)
+		h.b += uint32(len(block)-i) * uint32(c)
+	}
+	return h
+}
+
+func (h *weakHash) sum() uint32 {
+	return h.a&0xffff | h.b<<16
+}
+
+func (h *weakHash) roll(out, in byte) {
+	h.a += uint32(in) - uint32(out)
+	h.b += h.a - h.n*uint32(out)
+}
+
+func buildIndex(source io.Reader, blockSize int) (*index, uint64, error) {
+	idx := &index{
+		weak:   make(map[uint32]struct{}),
+		strong: make(map[strongHash][]uint64),
+	}
+	r := bufio.NewReader(source)
+	block := make([]byte, blockSize)
+	var size uint64
+	for {
+		n, err := io.ReadFull(r, block)
+		size += uint64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the unaligned tail can not be matched
+			return idx, size, nil
+		} else if err != nil {
+			return nil, 0, errors.Wrap(err, "delta: can not read source")
+		}
+		idx.weak[newWeakHash(block).sum()] = struct{}{}
+		sh := strongHash(sha256.Sum256(block))
+		idx.strong[sh] = append(idx.strong[sh], size-uint64(n))
+	}
+}
+
+// find returns the offset of the source block matching the given one at or
+// after the given source position.
+func (idx *index) find(weak uint32, block []byte, pos uint64) (uint64, bool) {
+	if _, ok := idx.weak[weak]; !ok {
+		return 0, false
+	}
+	offsets := idx.strong[strongHash(sha256.Sum256(block))]
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= pos })
+	if i == len(offsets) {
+		return 0, false
+	}
+	return offsets[i], true
+}
+
+// encoder writes the delta operations merging the adjacent copies.
+type encoder struct {
+	w       *bufio.Writer
+	data    []byte
+	copyOff uint64
+	copyLen uint64
+	written uint64
+}
+
+func (e *encoder) copy(off, size uint64) error {
+	if err := e.flushData(); err != nil {
+		return err
+	}
+	if e.copyLen > 0 && e.copyOff+e.copyLen == off && e.copyLen+size < maxCopySize {
+		e.copyLen += size
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyOff, e.copyLen = off, size
+	return nil
+}
+
+func (e *encoder) literal(c byte) error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.data = append(e.data, c)
+	if len(e.data) >= maxDataSize {
+		return e.flushData()
+	}
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyLen == 0 {
+		return nil
+	}
+	var op [13]byte
+	op[0] = opCopy
+	binary.BigEndian.PutUint64(op[1:], e.copyOff)
+	binary.BigEndian.PutUint32(op[9:], uint32(e.copyLen))
+	e.written += e.copyLen
+	e.copyLen = 0
+	_, err := e.w.Write(op[:])
+	return err
+}
+
+func (e *encoder) flushData() error {
+	if len(e.data) == 0 {
+		return nil
+	}
+	var op [5]byte
+	op[0] = opData
+	binary.BigEndian.PutUint32(op[1:], uint32(len(e.data)))
+	if _, err := e.w.Write(op[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.data)
+	e.written += uint64(len(e.data))
+	e.data = e.data[:0]
+	return err
+}
+
+// Diff calculates the delta transforming the source into the target image.
+func Diff(source io.Reader, target io.Reader, w io.Writer, blockSize int) error {
+	if blockSize <= 0 {
+		return errors.Errorf("delta: invalid block size: %d", blockSize)
+	}
+	idx, srcSize, err := buildIndex(source, blockSize)
+	if err != nil {
+		return err
+	}
+
+	// the size of the target is known only once the whole target is read
+	// so the operations are written to the temporary file first
+	tmp, err := ioutil.TempFile("", "delta")
+	if err != nil {
+		return errors.Wrap(err, "delta: can not create temporary file")
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	e := &encoder{w: bufio.NewWriter(tmp)}
+	if err = diff(idx, bufio.NewReader(target), e, blockSize); err != nil {
+		return err
+	}
+	if err = e.flushCopy(); err != nil {
+		return errors.Wrap(err, "delta: can not write delta")
+	}
+	if err = e.flushData(); err != nil {
+		return errors.Wrap(err, "delta: can not write delta")
+	}
+	if err = e.w.WriteByte(opEnd); err != nil {
+		return errors.Wrap(err, "delta: can not write delta")
+	}
+	if err = e.w.Flush(); err != nil {
+		return errors.Wrap(err, "delta: can not write delta")
+	}
+
+	hdr := Header{
+		BlockSize:  uint32(blockSize),
+		SourceSize: srcSize,
+		TargetSize: e.written,
+	}
+	if err = writeHeader(w, &hdr); err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "delta: can not read delta")
+	}
+	if _, err = io.Copy(w, tmp); err != nil {
+		return errors.Wrap(err, "delta: can not write delta")
+	}
+	return nil
+}
+
+func diff(idx *index, target *bufio.Reader, e *encoder, blockSize int) error {
+	// win holds the current block of the target at buf[start:]
+	buf := make([]byte, 0, 4*blockSize)
+	start := 0
+	var srcPos uint64
+
+	fill := func() error {
+		for len(buf)-start < blockSize {
+			c, err := target.ReadByte()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return errors.Wrap(err, "delta: can not read target")
+			}
+			buf = append(buf, c)
+		}
+		return nil
+	}
+	if err := fill(); err != nil {
+		return err
+	}
+
+	var h *weakHash
+	for len(buf)-start == blockSize {
+		win := buf[start:]
+		if h == nil {
+			h = newWeakHash(win)
+		}
+		if off, ok := idx.find(h.sum(), win, srcPos); ok {
+			if err := e.copy(off, uint64(blockSize)); err != nil {
+				return errors.Wrap(err, "delta: can not write delta")
+			}
+			srcPos = off + uint64(blockSize)
+			buf, start, h = buf[:0], 0, nil
+			if err := fill(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// no match; move the window by one byte
+		out := win[0]
+		if err := e.literal(out); err != nil {
+			return errors.Wrap(err, "delta: can not write delta")
+		}
+		start++
+		if start >= cap(buf)-blockSize {
+			buf = append(buf[:0], buf[start:]...)
+			start = 0
+		}
+		if err := fill(); err != nil {
+			return err
+		}
+		if len(buf)-start == blockSize {
+			h.roll(out, buf[len(buf)-1])
+		}
+	}
+
+	// the tail shorter than the block is stored as is
+	for _, c := range buf[start:] {
+		if err := e.literal(c); err != nil {
+			return errors.Wrap(err, "delta: can not write delta")
+		}
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, hdr *Header) error {
+	buf := make([]byte, len(magic)+4+8+8)
+	copy(buf, magic)
+	binary.BigEndian.PutUint32(buf[8:], hdr.BlockSize)
+	binary.BigEndian.PutUint64(buf[12:], hdr.SourceSize)
+	binary.BigEndian.PutUint64(buf[20:], hdr.TargetSize)
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "delta: can not write delta header")
+	}
+	return nil
+}
+
+// ReadHeader reads the header at the beginning of the delta.
+func ReadHeader(r io.Reader) (*Header, error) {
+	buf := make([]byte, len(magic)+4+8+8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "delta: can not read delta header")
+	}
+	if string(buf[:len(magic)]) != magic {
+		return nil, errors.New("delta: invalid delta format")
+	}
+	return &Header{
+		BlockSize:  binary.BigEndian.Uint32(buf[8:]),
+		SourceSize: binary.BigEndian.Uint64(buf[12:]),
+		TargetSize: binary.BigEndian.Uint64(buf[20:]),
+	}, nil
+}
+
+// Patch applies the delta to the source image read as a stream and writes
+// the target image to w. The source is read only up to the last copied
+// block.
+func Patch(source io.Reader, delta io.Reader, w io.Writer) error {
+	d := bufio.NewReader(delta)
+	hdr, err := ReadHeader(d)
+	if err != nil {
+		return err
+	}
+
+	var srcPos, written uint64
+	for {
+		op, err := d.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "delta: can not read delta")
+		}
+		switch op {
+		case opCopy:
+			var args [12]byte
+			if _, err = io.ReadFull(d, args[:]); err != nil {
+				return errors.Wrap(err, "delta: can not read delta")
+			}
+			off := binary.BigEndian.Uint64(args[:])
+			size := uint64(binary.BigEndian.Uint32(args[8:]))
+			if off < srcPos || off+size > hdr.SourceSize {
+				return errors.Errorf("delta: invalid source offset: %d", off)
+			}
+			if _, err = io.CopyN(ioutil.Discard, source, int64(off-srcPos)); err != nil {
+				return errors.Wrap(err, "delta: can not read source")
+			}
+			if _, err = io.CopyN(w, source, int64(size)); err != nil {
+				return errors.Wrap(err, "delta: can not copy source")
+			}
+			srcPos = off + size
+			written += size
+		case opData:
+			var args [4]byte
+			if _, err = io.ReadFull(d, args[:]); err != nil {
+				return errors.Wrap(err, "delta: can not read delta")
+			}
+			size := int64(binary.BigEndian.Uint32(args[:]))
+			if _, err = io.CopyN(w, d, size); err != nil {
+				return errors.Wrap(err, "delta: can not copy data")
+			}
+			written += uint64(size)
+		case opEnd:
+			if written != hdr.TargetSize {
+				return errors.Errorf("delta: invalid target size; expected: %d; "+
+					"actual: %d", hdr.TargetSize, written)
+			}
+			return nil
+		default:
+			return errors.Errorf("delta: invalid operation: %x", op)
+		}
+	}
+}
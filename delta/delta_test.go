@@ -0,0 +1,92 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(r *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	r.Read(data)
+	return data
+}
+
+func TestDiffPatch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	const bs = 512
+	source := randomData(r, 64*bs+100)
+
+	changed := append([]byte{}, source...)
+	copy(changed[10*bs:], randomData(r, bs))
+
+	inserted := append([]byte{}, source[:5*bs+7]...)
+	inserted = append(inserted, []byte("inserted data")...)
+	inserted = append(inserted, source[5*bs+7:]...)
+
+	zeros := make([]byte, 16*bs)
+
+	for name, target := range map[string][]byte{
+		"identical": source,
+		"changed":   changed,
+		"inserted":  inserted,
+		"truncated": source[:20*bs+3],
+		"appended":  append(append([]byte{}, source...), randomData(r, 3*bs)...),
+		"zeros":     zeros,
+		"empty":     {},
+		"unrelated": randomData(r, 8*bs),
+	} {
+		d := bytes.NewBuffer(nil)
+		require.NoError(t, Diff(bytes.NewReader(source), bytes.NewReader(target), d, bs), name)
+
+		hdr, err := ReadHeader(bytes.NewReader(d.Bytes()))
+		require.NoError(t, err, name)
+		assert.Equal(t, uint64(len(source)), hdr.SourceSize, name)
+		assert.Equal(t, uint64(len(target)), hdr.TargetSize, name)
+
+		// the source is read as a stream
+		out := bytes.NewBuffer(nil)
+		require.NoError(t, Patch(bytes.NewBuffer(source), bytes.NewReader(d.Bytes()), out),
+			name)
+		assert.Equal(t, string(target), out.String(), name)
+
+		switch name {
+		case "identical", "changed", "inserted", "truncated":
+			assert.True(t, d.Len() < 2*bs, "%s: %d", name, d.Len())
+		}
+	}
+
+	// repeated blocks are copied from increasing source offsets
+	d := bytes.NewBuffer(nil)
+	require.NoError(t, Diff(bytes.NewReader(zeros), bytes.NewReader(zeros), d, bs))
+	out := bytes.NewBuffer(nil)
+	require.NoError(t, Patch(bytes.NewReader(zeros), d, out))
+	assert.Equal(t, zeros, out.Bytes())
+
+	// source is too short
+	d = bytes.NewBuffer(nil)
+	require.NoError(t, Diff(bytes.NewReader(source), bytes.NewReader(source), d, bs))
+	assert.Error(t, Patch(bytes.NewReader(source[:bs]), d, bytes.NewBuffer(nil)))
+
+	assert.Error(t, Patch(bytes.NewReader(source), bytes.NewBufferString("invalid delta"),
+		bytes.NewBuffer(nil)))
+	assert.Error(t, Diff(bytes.NewReader(source), bytes.NewReader(source),
+		bytes.NewBuffer(nil), 0))
+}
@@ -16,8 +16,10 @@ package handlers
 
 import (
 	"archive/tar"
+	"compress/gzip"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
@@ -54,6 +56,28 @@ type Installer interface {
 	Copy() Installer
 }
 
+// Preparer is implemented by the installers which need to prepare for
+// installing the data file, like reserving space, before its data arrives.
+// The size and the checksum of the data file are already known.
+type Preparer interface {
+	Prepare(df *DataFile) error
+}
+
+// Finalizer is implemented by the installers which need to finalize the
+// data file once it is installed and its checksum is verified.
+type Finalizer interface {
+	Finalize(df *DataFile) error
+}
+
+// Aborter is implemented by the installers which need to clean up if
+// installing the data files fails once it has started; this includes
+// Prepare failing, the checksum verification failing after Install
+// consumed all the data and reading the following data files failing.
+// The data file is the one being installed last.
+type Aborter interface {
+	Abort(df *DataFile, cause error) error
+}
+
 func parseFiles(r io.Reader) (*artifact.Files, error) {
 	files := new(artifact.Files)
 	if _, err := io.Copy(files, r); err != nil {
@@ -87,9 +111,8 @@ func writeFiles(tw *tar.Writer, updFiles []string, dir string) error {
 	return nil
 }
 
-func writeTypeInfo(tw *tar.Writer, updateType string, dir string) error {
-	tInfo := artifact.TypeInfo{Type: updateType}
-	info, err := json.Marshal(&tInfo)
+func writeTypeInfo(tw *tar.Writer, tInfo *artifact.TypeInfo, dir string) error {
+	info, err := json.Marshal(tInfo)
 	if err != nil {
 		return errors.Wrapf(err, "update: can not create type-info")
 	}
@@ -111,3 +134,58 @@ func writeChecksums(tw *tar.Writer, files [](*DataFile), dir string) error {
 	}
 	return nil
 }
+
+// composeData stores all the data files of the update in a single
+// compressed tar archive.
+func composeData(tw *tar.Writer, files [](*DataFile), no int) error {
+	f, ferr := ioutil.TempFile("", "data")
+	if ferr != nil {
+		return errors.New("update: can not create temporary data file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err := func() error {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+
+		tarw := tar.NewWriter(gz)
+		defer tarw.Close()
+
+		for _, u := range files {
+			if err := writeDataFile(tarw, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Seek(0, 0); err != nil {
+		return errors.Wrapf(err, "update: can not read data file: %v", files)
+	}
+
+	dfw := artifact.NewTarWriterFile(tw)
+	if err = dfw.Write(f, artifact.UpdateDataPath(no)); err != nil {
+		return errors.Wrapf(err, "update: can not write tar data header: %v", files)
+	}
+	return nil
+}
+
+func writeDataFile(tw *tar.Writer, u *DataFile) error {
+	df, err := os.Open(u.Name)
+	if err != nil {
+		return errors.Wrapf(err, "update: can not open data file: %v", u)
+	}
+	defer df.Close()
+
+	fw := artifact.NewTarWriterFile(tw)
+	if err := fw.Write(df, filepath.Base(u.Name)); err != nil {
+		return errors.Wrapf(err,
+			"update: can not write tar temp data header: %v", u)
+	}
+	return nil
+}
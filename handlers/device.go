@@ -0,0 +1,222 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDeviceBufferSize is the size of the chunks written to the device.
+const DefaultDeviceBufferSize = 1024 * 1024
+
+// directAlignment is the alignment of the buffers, offsets and sizes
+// required by direct I/O; it is the logical block size of most devices.
+const directAlignment = 4096
+
+// ProgressFn is called after each chunk written to the device with the
+// number of bytes written so far and the size of the image.
+type ProgressFn func(written, total int64)
+
+// DeviceInstaller writes the rootfs image to a block device or an image
+// file. Its Install method can be used as InstallHandler of Rootfs. The
+// written data is synced, read back and verified against the checksum of
+// the data file.
+type DeviceInstaller struct {
+	// Path is either a block device or a regular file; the file is created
+	// if it does not exist.
+	Path string
+	// BufferSize is the size of the chunks written to the device; it is
+	// rounded up to the direct I/O alignment.
+	BufferSize int
+	Progress   ProgressFn
+}
+
+// NewDeviceInstaller creates the installer writing to the given path.
+func NewDeviceInstaller(path string) *DeviceInstaller {
+	return &DeviceInstaller{
+		Path:       path,
+		BufferSize: DefaultDeviceBufferSize,
+	}
+}
+
+// Install writes the data file to the device and verifies it.
+func (d *DeviceInstaller) Install(r io.Reader, df *DataFile) error {
+	if len(df.Checksum) == 0 {
+		return errors.Errorf("device: missing checksum of data file: %s", df.Name)
+	}
+	if err := d.checkSize(df.Size); err != nil {
+		return err
+	}
+	if err := d.write(r, df.Size); err != nil {
+		return err
+	}
+	return d.verify(df)
+}
+
+// checkSize makes sure the image fits the block device; regular files can
+// hold images of any size.
+func (d *DeviceInstaller) checkSize(size int64) error {
+	info, err := os.Stat(d.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "device: can not open: %s", d.Path)
+	}
+	if info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return errors.Wrapf(err, "device: can not open: %s", d.Path)
+	}
+	defer f.Close()
+	capacity, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrapf(err, "device: can not get size of: %s", d.Path)
+	}
+	if size > capacity {
+		return errors.Errorf("device: image of size %d does not fit %s of size %d",
+			size, d.Path, capacity)
+	}
+	return nil
+}
+
+func (d *DeviceInstaller) write(r io.Reader, size int64) error {
+	f, direct, err := openDevice(d.Path, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return errors.Wrapf(err, "device: can not open: %s", d.Path)
+	}
+	defer f.Close()
+
+	bufSize := d.BufferSize
+	if bufSize <= 0 {
+		bufSize = DefaultDeviceBufferSize
+	}
+	bufSize = (bufSize + directAlignment - 1) / directAlignment * directAlignment
+	buf := alignedBuffer(bufSize)
+
+	var written int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err = d.writeChunk(f, direct, buf[:n], written); err != nil {
+				return err
+			}
+			written += int64(n)
+			if d.Progress != nil {
+				d.Progress(written, size)
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return errors.Wrap(rerr, "device: can not read image")
+		}
+	}
+	if written != size {
+		return errors.Errorf("device: invalid image size; expected: %d; written: %d",
+			size, written)
+	}
+
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		if err = f.Truncate(written); err != nil {
+			return errors.Wrapf(err, "device: can not truncate: %s", d.Path)
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrapf(err, "device: can not sync: %s", d.Path)
+	}
+	return nil
+}
+
+// writeChunk writes the chunk at the given offset; the unaligned tail of
+// the image can not be written with direct I/O so it is written using
+// a regular file descriptor.
+func (d *DeviceInstaller) writeChunk(f *os.File, direct bool, chunk []byte,
+	off int64) error {
+	aligned := len(chunk)
+	if direct {
+		aligned = len(chunk) / directAlignment * directAlignment
+	}
+	if aligned > 0 {
+		if _, err := f.WriteAt(chunk[:aligned], off); err != nil {
+			return errors.Wrapf(err, "device: can not write: %s", d.Path)
+		}
+	}
+	if aligned == len(chunk) {
+		return nil
+	}
+
+	tail, err := os.OpenFile(d.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "device: can not open: %s", d.Path)
+	}
+	defer tail.Close()
+	if _, err = tail.WriteAt(chunk[aligned:], off+int64(aligned)); err != nil {
+		return errors.Wrapf(err, "device: can not write: %s", d.Path)
+	}
+	if err = tail.Sync(); err != nil {
+		return errors.Wrapf(err, "device: can not sync: %s", d.Path)
+	}
+	return nil
+}
+
+// verify reads the written image back and compares its checksum.
+func (d *DeviceInstaller) verify(df *DataFile) error {
+	f, _, err := openDevice(d.Path, os.O_RDONLY)
+	if err != nil {
+		return errors.Wrapf(err, "device: can not open: %s", d.Path)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := alignedBuffer(DefaultDeviceBufferSize)
+	for left := df.Size; left > 0; {
+		n, err := f.Read(buf)
+		if n == 0 && err != nil {
+			return errors.Wrapf(err, "device: can not read back: %s", d.Path)
+		}
+		if int64(n) > left {
+			n = int(left)
+		}
+		h.Write(buf[:n])
+		left -= int64(n)
+	}
+	sum := make([]byte, hex.EncodedLen(sha256.Size))
+	hex.Encode(sum, h.Sum(nil))
+	if !bytes.Equal(sum, df.Checksum) {
+		return errors.Errorf("device: invalid checksum of written image; "+
+			"expected: [%s]; actual: [%s]", df.Checksum, sum)
+	}
+	return nil
+}
+
+// alignedBuffer allocates the buffer usable for direct I/O.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlignment)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlignment - 1))
+	if off != 0 {
+		off = directAlignment - off
+	}
+	return buf[off : off+size]
+}
@@ -0,0 +1,35 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDevice opens the device bypassing the page cache if the file system
+// supports direct I/O; the second value reports if it does.
+func openDevice(path string, flag int) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, flag|syscall.O_DIRECT, 0644)
+	if err == nil {
+		return f, true, nil
+	}
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.EINVAL {
+		return nil, false, err
+	}
+	// tmpfs and some other file systems do not support direct I/O
+	f, err = os.OpenFile(path, flag, 0644)
+	return f, false, err
+}
@@ -0,0 +1,26 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build !linux
+
+package handlers
+
+import "os"
+
+// openDevice opens the device; direct I/O is supported on Linux only, so
+// the written data is only synced.
+func openDevice(path string, flag int) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, flag, 0644)
+	return f, false, err
+}
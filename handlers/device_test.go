@@ -0,0 +1,100 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func imageDataFile(image []byte) *DataFile {
+	sum := sha256.Sum256(image)
+	return &DataFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: []byte(hex.EncodeToString(sum[:])),
+	}
+}
+
+func TestDeviceInstaller(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "device")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "rootfs.img")
+	image := bytes.Repeat([]byte("0123456789"), 1000)
+
+	d := NewDeviceInstaller(target)
+	d.BufferSize = 1000
+	var progress []int64
+	d.Progress = func(written, total int64) {
+		assert.Equal(t, int64(len(image)), total)
+		progress = append(progress, written)
+	}
+	require.NoError(t, d.Install(bytes.NewReader(image), imageDataFile(image)))
+	// buffer size is rounded up to the direct I/O alignment
+	assert.Equal(t, []int64{4096, 8192, 10000}, progress)
+	data, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, image, data)
+
+	// the existing image file is truncated
+	small := []byte("small image")
+	require.NoError(t, NewDeviceInstaller(target).Install(bytes.NewReader(small),
+		imageDataFile(small)))
+	data, err = ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, small, data)
+
+	// checksum of the written data does not match
+	df := imageDataFile(image)
+	err = NewDeviceInstaller(target).Install(bytes.NewReader(small), &DataFile{
+		Name: df.Name, Size: int64(len(small)), Checksum: df.Checksum})
+	assert.Error(t, err)
+
+	// size of the image does not match
+	df.Size++
+	assert.Error(t, NewDeviceInstaller(target).Install(bytes.NewReader(image), df))
+
+	assert.Error(t, NewDeviceInstaller(target).Install(bytes.NewReader(image),
+		&DataFile{Name: "rootfs.ext4", Size: int64(len(image))}))
+	assert.Error(t, NewDeviceInstaller(filepath.Join(dir, "missing", "rootfs.img")).
+		Install(bytes.NewReader(image), imageDataFile(image)))
+
+	// the image does not fit the device
+	if _, err = os.Stat("/dev/null"); err == nil {
+		err = NewDeviceInstaller("/dev/null").Install(bytes.NewReader(image),
+			imageDataFile(image))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not fit")
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int{1, directAlignment, DefaultDeviceBufferSize} {
+		buf := alignedBuffer(size)
+		assert.Len(t, buf, size)
+		assert.Zero(t, uintptr(unsafe.Pointer(&buf[0]))%directAlignment)
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DirectoryType is the type of the updates installing a file tree.
+	DirectoryType = "directory"
+	// ManifestSuffix is appended to the name derived from the destination
+	// directory to get the name of the manifest of the installed files.
+	ManifestSuffix = ".manifest"
+)
+
+// DirectoryMetaData is the content of the meta-data file of the directory
+// update.
+type DirectoryMetaData struct {
+	// Path is the absolute path of the directory the tree is installed to.
+	Path string `json:"dest_dir"`
+	// Clean removes the existing content of the directory before the tree
+	// is installed; otherwise the tree is merged with the existing files.
+	Clean bool `json:"clean,omitempty"`
+}
+
+// Validate checks if the destination directory is valid.
+func (m *DirectoryMetaData) Validate() error {
+	if !filepath.IsAbs(m.Path) || filepath.Clean(m.Path) != m.Path ||
+		m.Path == "/" {
+		return errors.Errorf("update: invalid destination directory: %q", m.Path)
+	}
+	return nil
+}
+
+// DirectoryManifest lists the files installed by the directory update.
+type DirectoryManifest struct {
+	Path string `json:"dest_dir"`
+	// Files are relative to the destination directory in the order of
+	// installation; directories precede their content.
+	Files []string `json:"files"`
+}
+
+// Directory handles updates of type 'directory'. The update holds the tar
+// archive of the file tree. The installer extracts the tree next to the
+// destination and moves it in place once the checksum of the archive is
+// verified; see Finalize.
+type Directory struct {
+	update  *DataFile
+	meta    DirectoryMetaData
+	staging string
+	entries []*tar.Header
+
+	// Root is the directory the destination path is relative to. The
+	// archive is only consumed if not set.
+	Root string
+	// ManifestDir is the directory the manifests of the installed files are
+	// stored in; no manifest is stored if not set.
+	ManifestDir string
+}
+
+// ArchiveDirectory stores the file tree in the tar archive preserving the
+// modes, the modification times and the symbolic links.
+func ArchiveDirectory(dir, archive string) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create archive")
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return errors.Errorf("unsupported file type: %s", path)
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// the owners are not preserved
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		df, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer df.Close()
+		_, err = io.Copy(tw, df)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "update: can not archive directory: %s", dir)
+	}
+	if err = tw.Close(); err != nil {
+		return errors.Wrap(err, "update: can not write archive")
+	}
+	return nil
+}
+
+// NewDirectory creates the update installing the archived file tree to the
+// destination given by the meta-data.
+func NewDirectory(archive string, meta DirectoryMetaData) (*Directory, error) {
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+	return &Directory{
+		update: &DataFile{Name: archive},
+		meta:   meta,
+	}, nil
+}
+
+// NewDirectoryInstaller is used by the artifact reader to read and install
+// directory update type under the given root directory.
+func NewDirectoryInstaller(root, manifestDir string) *Directory {
+	return &Directory{
+		update:      new(DataFile),
+		Root:        root,
+		ManifestDir: manifestDir,
+	}
+}
+
+// Copy creates a new instance of Directory handler from the existing one.
+func (d *Directory) Copy() Installer {
+	return NewDirectoryInstaller(d.Root, d.ManifestDir)
+}
+
+// GetMetaData returns the destination of the file tree.
+func (d *Directory) GetMetaData() DirectoryMetaData {
+	return d.meta
+}
+
+func (d *Directory) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		if len(files.FileList) != 1 {
+			return errors.New("update: directory update must contain a single archive")
+		}
+		d.update.Name = files.FileList[0]
+	case filepath.Base(path) == "type-info":
+		// we don't need any information from type-info
+	case filepath.Base(path) == "meta-data":
+		if err := json.NewDecoder(r).Decode(&d.meta); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		return d.meta.Validate()
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+// Install extracts the archive to the temporary directory next to the
+// destination; the tree is moved in place by Finalize.
+func (d *Directory) Install(r io.Reader, info *os.FileInfo) error {
+	if d.Root == "" {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	if err := d.meta.Validate(); err != nil {
+		return err
+	}
+	dest := d.destination()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return errors.Wrap(err, "update: can not create destination directory")
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest))
+	if err != nil {
+		return errors.Wrap(err, "update: can not create temporary directory")
+	}
+	d.staging, d.entries = staging, nil
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "update: can not read archive")
+		}
+		if err = d.extract(tr, hdr); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// extract creates the archived file in the staging directory making sure
+// it can not be placed outside of it.
+func (d *Directory) extract(r io.Reader, hdr *tar.Header) error {
+	name, err := entryName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	if err = noSymlinks(d.staging, filepath.Dir(name)); err != nil {
+		return err
+	}
+	path := filepath.Join(d.staging, name)
+	hdr.Name = name
+	// the parent directories do not need to be archived
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "update: can not create directory: %s", name)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// the mode is set once the tree is in place so the content can be
+		// moved out of the read-only directories
+		if err = os.MkdirAll(path, 0700); err != nil {
+			return errors.Wrapf(err, "update: can not create directory: %s", name)
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			return errors.Wrapf(err, "update: can not create file: %s", name)
+		}
+		defer f.Close()
+		if _, err = io.Copy(f, r); err != nil {
+			return errors.Wrapf(err, "update: can not write file: %s", name)
+		}
+		// the mode is not subject to umask
+		if err = f.Chmod(hdr.FileInfo().Mode().Perm()); err != nil {
+			return errors.Wrapf(err, "update: can not set mode of: %s", name)
+		}
+		if err = f.Sync(); err != nil {
+			return errors.Wrapf(err, "update: can not sync file: %s", name)
+		}
+		if err = os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.Wrapf(err, "update: can not set time of: %s", name)
+		}
+	case tar.TypeSymlink:
+		if err = os.Symlink(hdr.Linkname, path); err != nil {
+			return errors.Wrapf(err, "update: can not create link: %s", name)
+		}
+	default:
+		return errors.Errorf("update: unsupported file type in archive: %s", name)
+	}
+	d.entries = append(d.entries, hdr)
+	return nil
+}
+
+// entryName returns the cleaned relative name of the archived file; the
+// names leaving the archive root are refused.
+func entryName(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("update: invalid file name in archive: %s", name)
+	}
+	return clean, nil
+}
+
+// noSymlinks makes sure none of the directories on the path is a symbolic
+// link, which could point outside of the base directory.
+func noSymlinks(base, dir string) error {
+	for ; dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(base, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "update: can not check directory: %s", dir)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("update: archived file is placed in "+
+				"symbolic link: %s", dir)
+		}
+	}
+	return nil
+}
+
+// Finalize implements Finalizer; it moves the extracted tree to the
+// destination and stores the manifest of the installed files.
+func (d *Directory) Finalize(df *DataFile) error {
+	if d.staging == "" {
+		return nil
+	}
+	dest := d.destination()
+	if d.meta.Clean {
+		if err := os.RemoveAll(dest); err != nil {
+			return errors.Wrapf(err, "update: can not clean: %s", dest)
+		}
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return errors.Wrapf(err, "update: can not create: %s", dest)
+	}
+
+	manifest := DirectoryManifest{Path: d.meta.Path}
+	for _, hdr := range d.entries {
+		if err := d.move(hdr, dest); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, filepath.ToSlash(hdr.Name))
+	}
+	// the directories are updated last as moving the content changes those
+	for i := len(d.entries) - 1; i >= 0; i-- {
+		hdr := d.entries[i]
+		if hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		path := filepath.Join(dest, hdr.Name)
+		if err := os.Chmod(path, hdr.FileInfo().Mode().Perm()); err != nil {
+			return errors.Wrapf(err, "update: can not set mode of: %s", path)
+		}
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return errors.Wrapf(err, "update: can not set time of: %s", path)
+		}
+	}
+
+	if err := os.RemoveAll(d.staging); err != nil {
+		return errors.Wrap(err, "update: can not remove temporary directory")
+	}
+	d.staging = ""
+	return d.writeManifest(&manifest)
+}
+
+func (d *Directory) move(hdr *tar.Header, dest string) error {
+	// the existing files are kept in the destination, so its directories
+	// could be symbolic links pointing outside of it
+	if err := noSymlinks(dest, filepath.Dir(hdr.Name)); err != nil {
+		return err
+	}
+	path := filepath.Join(dest, hdr.Name)
+	info, err := os.Lstat(path)
+	exists := err == nil
+
+	if hdr.Typeflag == tar.TypeDir {
+		if exists && info.IsDir() {
+			return nil
+		}
+		if exists {
+			if err = os.Remove(path); err != nil {
+				return errors.Wrapf(err, "update: can not replace: %s", path)
+			}
+		}
+		if err = os.Mkdir(path, 0700); err != nil {
+			return errors.Wrapf(err, "update: can not create directory: %s", path)
+		}
+		return nil
+	}
+
+	// the directory can not be replaced by the file using rename
+	if exists && info.IsDir() {
+		if err = os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "update: can not replace: %s", path)
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "update: can not create directory: %s", path)
+	}
+	if err = os.Rename(filepath.Join(d.staging, hdr.Name), path); err != nil {
+		return errors.Wrapf(err, "update: can not install: %s", path)
+	}
+	return nil
+}
+
+// Abort implements Aborter; it removes the extracted tree leaving the
+// destination untouched.
+func (d *Directory) Abort(df *DataFile, cause error) error {
+	if d.staging == "" {
+		return nil
+	}
+	err := os.RemoveAll(d.staging)
+	d.staging = ""
+	return err
+}
+
+func (d *Directory) destination() string {
+	return filepath.Join(d.Root, d.meta.Path)
+}
+
+// ManifestName returns the name of the manifest of the tree installed to
+// the given destination directory.
+func ManifestName(destDir string) string {
+	return strings.Replace(strings.Trim(destDir, "/"), "/", "_", -1) +
+		ManifestSuffix
+}
+
+func (d *Directory) writeManifest(m *DirectoryManifest) error {
+	if d.ManifestDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create manifest")
+	}
+	if err = os.MkdirAll(d.ManifestDir, 0755); err != nil {
+		return errors.Wrap(err, "update: can not create manifest directory")
+	}
+	path := filepath.Join(d.ManifestDir, ManifestName(m.Path))
+	if err = ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return errors.Wrap(err, "update: can not write manifest")
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return errors.Wrap(err, "update: can not write manifest")
+	}
+	return nil
+}
+
+// RemoveDirectory removes the files listed in the manifest of the tree
+// installed under the given root directory and the manifest itself. The
+// directories are only removed if they are left empty.
+func RemoveDirectory(root, manifest string) error {
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return errors.Wrap(err, "update: can not read manifest")
+	}
+	m := new(DirectoryManifest)
+	if err = json.Unmarshal(data, m); err != nil {
+		return errors.Wrap(err, "update: can not parse manifest")
+	}
+	if err = (&DirectoryMetaData{Path: m.Path}).Validate(); err != nil {
+		return err
+	}
+
+	dest := filepath.Join(root, m.Path)
+	files := append([]string{"."}, m.Files...)
+	for i := len(files) - 1; i >= 0; i-- {
+		name, err := entryName(files[i])
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dest, name)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "update: can not remove: %s", path)
+		}
+		if err = os.Remove(path); err != nil && !info.IsDir() {
+			return errors.Wrapf(err, "update: can not remove: %s", path)
+		}
+	}
+	return os.Remove(manifest)
+}
+
+func (d *Directory) GetUpdateFiles() [](*DataFile) {
+	return [](*DataFile){d.update}
+}
+
+func (d *Directory) GetType() string {
+	return DirectoryType
+}
+
+func (d *Directory) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	if err := writeFiles(tw, []string{filepath.Base(d.update.Name)},
+		path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: DirectoryType},
+		path); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(&d.meta)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create meta-data")
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (d *Directory) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, d.GetUpdateFiles(), no)
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	mtime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "data"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "bin", "app"),
+		[]byte("binary"), 0755))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "bin", "app"), mtime, mtime))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "app.conf"),
+		[]byte("config"), 0600))
+	require.NoError(t, os.Symlink("bin/app", filepath.Join(src, "link")))
+
+	archive := filepath.Join(dir, "app.tar")
+	require.NoError(t, ArchiveDirectory(src, archive))
+
+	d, err := NewDirectory(archive, DirectoryMetaData{Path: "/opt/app"})
+	require.NoError(t, err)
+	assert.Equal(t, DirectoryType, d.GetType())
+	_, err = NewDirectory(archive, DirectoryMetaData{Path: "/opt/../app"})
+	assert.Error(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, d.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	root := filepath.Join(dir, "root")
+	manifests := filepath.Join(root, "var", "lib", "manifests")
+	inst := NewDirectoryInstaller(root, manifests).Copy().(*Directory)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, DirectoryMetaData{Path: "/opt/app"}, inst.GetMetaData())
+
+	// the existing files are kept unless the directory is cleaned
+	dest := filepath.Join(root, "opt", "app")
+	require.NoError(t, os.MkdirAll(dest, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "old"), nil, 0644))
+
+	install := func(inst *Directory, archive string) error {
+		f, err := os.Open(archive)
+		require.NoError(t, err)
+		defer f.Close()
+		info, err := f.Stat()
+		require.NoError(t, err)
+		return inst.Install(f, &info)
+	}
+	require.NoError(t, install(inst, archive))
+	_, err = os.Stat(filepath.Join(dest, "app.conf"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, inst.Finalize(inst.update))
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(data))
+	link, err := os.Readlink(filepath.Join(dest, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "bin/app", link)
+	info, err := os.Stat(filepath.Join(dest, "bin", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+	assert.True(t, mtime.Equal(info.ModTime()))
+	info, err = os.Stat(filepath.Join(dest, "app.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+	info, err = os.Stat(filepath.Join(dest, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0750, info.Mode())
+	_, err = os.Stat(filepath.Join(dest, "old"))
+	assert.NoError(t, err)
+	files, err := ioutil.ReadDir(filepath.Join(root, "opt"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// the installed files are removed using the manifest
+	manifest := filepath.Join(manifests, "opt_app"+ManifestSuffix)
+	require.NoError(t, RemoveDirectory(root, manifest))
+	files, err = ioutil.ReadDir(dest)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "old", files[0].Name())
+	_, err = os.Stat(manifest)
+	assert.True(t, os.IsNotExist(err))
+
+	inst.meta.Clean = true
+	require.NoError(t, install(inst, archive))
+	require.NoError(t, inst.Finalize(inst.update))
+	_, err = os.Stat(filepath.Join(dest, "old"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDirectoryTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tc := map[string][]tar.Header{
+		"parent": {{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}},
+		"nested": {{Name: "dir/../../evil", Typeflag: tar.TypeReg, Mode: 0644}},
+		"link": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: dir},
+			{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"device": {{Name: "dev", Typeflag: tar.TypeChar, Mode: 0644}},
+	}
+	for name, headers := range tc {
+		archive := filepath.Join(dir, name+".tar")
+		f, err := os.Create(archive)
+		require.NoError(t, err)
+		tw := tar.NewWriter(f)
+		for i := range headers {
+			require.NoError(t, tw.WriteHeader(&headers[i]))
+		}
+		require.NoError(t, tw.Close())
+		f.Close()
+
+		root := filepath.Join(dir, "root")
+		inst := NewDirectoryInstaller(root, "")
+		inst.meta.Path = "/opt/app"
+
+		f, err = os.Open(archive)
+		require.NoError(t, err)
+		info, err := f.Stat()
+		require.NoError(t, err)
+		err = inst.Install(f, &info)
+		f.Close()
+		assert.Error(t, err, name)
+		require.NoError(t, inst.Abort(inst.update, errors.New("failed")))
+
+		_, err = os.Stat(filepath.Join(dir, "evil"))
+		assert.True(t, os.IsNotExist(err), name)
+		// the temporary directory is removed
+		files, err := ioutil.ReadDir(filepath.Join(root, "opt"))
+		require.NoError(t, err)
+		assert.Empty(t, files, name)
+	}
+}
+
+func TestDirectoryDestinationSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the archive does not hold the parent directory of the file
+	archive := filepath.Join(dir, "app.tar")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "app/passwd",
+		Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, err = tw.Write([]byte("evil"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	f.Close()
+
+	// the directory of the existing destination points outside of it
+	etc := filepath.Join(dir, "etc")
+	require.NoError(t, os.Mkdir(etc, 0755))
+	root := filepath.Join(dir, "root")
+	dest := filepath.Join(root, "opt")
+	require.NoError(t, os.MkdirAll(dest, 0755))
+	require.NoError(t, os.Symlink(etc, filepath.Join(dest, "app")))
+
+	inst := NewDirectoryInstaller(root, "")
+	inst.meta.Path = "/opt"
+	f, err = os.Open(archive)
+	require.NoError(t, err)
+	defer f.Close()
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.NoError(t, inst.Install(f, &info))
+	err = inst.Finalize(inst.update)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "symbolic link")
+
+	_, err = os.Stat(filepath.Join(etc, "passwd"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,356 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DockerImageType is the type of the container image updates.
+	DockerImageType = "docker-image"
+	// ImageLayoutSuffix is the suffix of the data file holding the OCI image
+	// layout archive.
+	ImageLayoutSuffix = ".oci.tar"
+
+	// maxManifestSize limits the size of the index and manifest blobs which
+	// are parsed by the installer
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+// ContainerImage is the image stored in the update.
+type ContainerImage struct {
+	// Ref is the reference of the image, like docker.io/library/app:1.0;
+	// it is empty for the untagged images.
+	Ref string `json:"ref,omitempty"`
+	// Digest is the digest of the image manifest or index.
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+}
+
+// DockerImageMetaData is the content of the meta-data file of the
+// docker-image update.
+type DockerImageMetaData struct {
+	Images []ContainerImage `json:"images"`
+}
+
+// Validate checks if the images are identified by the supported digests.
+func (m *DockerImageMetaData) Validate() error {
+	if len(m.Images) == 0 {
+		return errors.New("update: no container images")
+	}
+	for _, i := range m.Images {
+		if !digestRegexp.MatchString(i.Digest) {
+			return errors.Errorf("update: unsupported image digest: %s", i.Digest)
+		}
+	}
+	return nil
+}
+
+// DockerImage handles updates of type 'docker-image'. The update holds the
+// container images as the OCI image layout archive.
+type DockerImage struct {
+	layout *DataFile
+	meta   DockerImageMetaData
+
+	// LayoutHandler receives the OCI image layout archive; e.g. to load it
+	// using `skopeo copy oci-archive:...` or `docker load`.
+	LayoutHandler func(io.Reader, *DataFile) error
+	// BlobHandler is called for each blob of the layout if LayoutHandler is
+	// not set; the index and the manifests come before the blobs they
+	// reference. The digest of the blob is verified once it is read. The
+	// layout is only consumed if neither of the handlers is set.
+	BlobHandler func(ImageDescriptor, io.Reader) error
+}
+
+// GenerateDockerImage stores the container images from either the OCI image
+// layout directory or the docker-save archive in the OCI image layout
+// archive in dir.
+func GenerateDockerImage(src, dir string) (*DockerImage, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open image: %s", src)
+	}
+	layoutDir := src
+	if !info.IsDir() {
+		tmp, err := ioutil.TempDir(dir, "image")
+		if err != nil {
+			return nil, errors.Wrap(err, "update: can not create temporary directory")
+		}
+		defer os.RemoveAll(tmp)
+
+		// the archive of the recent docker versions is the OCI image layout
+		layoutDir = filepath.Join(tmp, "archive")
+		if err = extractArchive(src, layoutDir); err != nil {
+			return nil, err
+		}
+		if _, err = os.Stat(filepath.Join(layoutDir, ociLayoutFile)); err != nil {
+			archive := layoutDir
+			layoutDir = filepath.Join(tmp, "layout")
+			if err = convertDockerArchive(archive, layoutDir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	idx, err := readIndex(layoutDir)
+	if err != nil {
+		return nil, err
+	}
+	di := &DockerImage{
+		layout: &DataFile{
+			Name: filepath.Join(dir,
+				strings.TrimSuffix(filepath.Base(src), ".tar")+ImageLayoutSuffix),
+		},
+	}
+	for _, m := range idx.Manifests {
+		di.meta.Images = append(di.meta.Images, ContainerImage{
+			Ref:       imageRef(m),
+			Digest:    m.Digest,
+			MediaType: m.MediaType,
+		})
+	}
+	if err = di.meta.Validate(); err != nil {
+		return nil, err
+	}
+
+	out, err := os.Create(di.layout.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not create image layout")
+	}
+	defer out.Close()
+	if err = writeLayout(layoutDir, idx, out); err != nil {
+		return nil, err
+	}
+	return di, nil
+}
+
+// NewDockerImageInstaller is used by the artifact reader to read and install
+// docker-image update type.
+func NewDockerImageInstaller() *DockerImage {
+	return &DockerImage{
+		layout: new(DataFile),
+	}
+}
+
+// Copy creates a new instance of DockerImage handler from the existing one.
+func (di *DockerImage) Copy() Installer {
+	return &DockerImage{
+		layout:        new(DataFile),
+		LayoutHandler: di.LayoutHandler,
+		BlobHandler:   di.BlobHandler,
+	}
+}
+
+// GetMetaData returns the images stored in the update.
+func (di *DockerImage) GetMetaData() DockerImageMetaData {
+	return di.meta
+}
+
+func (di *DockerImage) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		if len(files.FileList) != 1 {
+			return errors.New("update: docker-image update must contain " +
+				"a single image layout")
+		}
+		di.layout.Name = files.FileList[0]
+	case filepath.Base(path) == "type-info":
+		// we don't need any information from type-info
+	case filepath.Base(path) == "meta-data":
+		if err := json.NewDecoder(r).Decode(&di.meta); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		return di.meta.Validate()
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+func (di *DockerImage) Install(r io.Reader, info *os.FileInfo) error {
+	var err error
+	switch {
+	case di.LayoutHandler != nil:
+		df := &DataFile{
+			Name:     di.layout.Name,
+			Size:     (*info).Size(),
+			Date:     (*info).ModTime(),
+			Checksum: di.layout.Checksum,
+		}
+		err = di.LayoutHandler(r, df)
+	case di.BlobHandler != nil:
+		err = di.readBlobs(r)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// readBlobs passes the blobs of the layout archive to the blob handler.
+func (di *DockerImage) readBlobs(r io.Reader) error {
+	// the media types are learned from the index and the manifests
+	mediaTypes := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "update: can not read image layout")
+		}
+
+		name := path.Clean(hdr.Name)
+		switch name {
+		case ociLayoutFile:
+			continue
+		case ociIndexFile:
+			if err = di.readIndex(tr, mediaTypes); err != nil {
+				return err
+			}
+			continue
+		}
+
+		digest := strings.Replace(strings.TrimPrefix(name, "blobs/"), "/", ":", 1)
+		if p, err := blobPath(digest); err != nil || p != name {
+			return errors.Errorf("update: unexpected file in image layout: %s", hdr.Name)
+		}
+		desc := ImageDescriptor{
+			MediaType: mediaTypes[digest],
+			Digest:    digest,
+			Size:      hdr.Size,
+		}
+		if err = di.readBlob(tr, desc, mediaTypes); err != nil {
+			return err
+		}
+	}
+}
+
+func (di *DockerImage) readIndex(r io.Reader, mediaTypes map[string]string) error {
+	idx := new(imageIndex)
+	if err := json.NewDecoder(io.LimitReader(r, maxManifestSize)).Decode(idx); err != nil {
+		return errors.Wrap(err, "update: can not parse image index")
+	}
+	for _, m := range idx.Manifests {
+		mediaTypes[m.Digest] = m.MediaType
+	}
+	// the signed meta-data must match the images of the layout
+	for _, i := range di.meta.Images {
+		if _, ok := mediaTypes[i.Digest]; !ok {
+			return errors.Errorf("update: image is missing in image layout: %s",
+				i.Digest)
+		}
+	}
+	return nil
+}
+
+func (di *DockerImage) readBlob(r io.Reader, desc ImageDescriptor,
+	mediaTypes map[string]string) error {
+	h := sha256.New()
+	verify := func() error {
+		if "sha256:"+hex.EncodeToString(h.Sum(nil)) != desc.Digest {
+			return errors.Errorf("update: invalid digest of image blob: %s",
+				desc.Digest)
+		}
+		return nil
+	}
+
+	if !isManifest(desc.MediaType) {
+		if err := di.BlobHandler(desc, io.TeeReader(r, h)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(h, r); err != nil {
+			return errors.Wrap(err, "update: can not read image blob")
+		}
+		return verify()
+	}
+
+	// the manifests are verified before those are parsed
+	if desc.Size > maxManifestSize {
+		return errors.Errorf("update: image manifest too big: %s", desc.Digest)
+	}
+	data, err := ioutil.ReadAll(io.TeeReader(r, h))
+	if err != nil {
+		return errors.Wrap(err, "update: can not read image blob")
+	}
+	if err = verify(); err != nil {
+		return err
+	}
+	c, err := children(desc.MediaType, data)
+	if err != nil {
+		return err
+	}
+	for _, d := range c {
+		mediaTypes[d.Digest] = d.MediaType
+	}
+	return di.BlobHandler(desc, bytes.NewReader(data))
+}
+
+func (di *DockerImage) GetUpdateFiles() [](*DataFile) {
+	return [](*DataFile){di.layout}
+}
+
+func (di *DockerImage) GetType() string {
+	return DockerImageType
+}
+
+func (di *DockerImage) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	if err := writeFiles(tw, []string{filepath.Base(di.layout.Name)},
+		path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: DockerImageType},
+		path); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(&di.meta)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create meta-data")
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (di *DockerImage) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, di.GetUpdateFiles(), no)
+}
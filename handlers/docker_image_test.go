@@ -0,0 +1,227 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDockerArchive creates the legacy docker-save archive holding the
+// image with two layers; the second layer links the first one.
+func writeDockerArchive(t *testing.T, path string) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	files := []struct {
+		name, content, link string
+	}{
+		{name: "config.json", content: `{"architecture":"arm"}`},
+		{name: "l1/layer.tar", content: "layer data"},
+		{name: "l2/layer.tar", link: "../l1/layer.tar"},
+		{name: "manifest.json", content: `[{"Config":"config.json",` +
+			`"RepoTags":["app:1.0"],"Layers":["l1/layer.tar","l2/layer.tar"]}]`},
+	}
+	for _, file := range files {
+		hdr := &tar.Header{Name: file.name, Mode: 0644,
+			Size: int64(len(file.content)), Typeflag: tar.TypeReg}
+		if file.link != "" {
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, file.link
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write([]byte(file.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+}
+
+func digest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestDockerImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "app.tar")
+	writeDockerArchive(t, archive)
+
+	di, err := GenerateDockerImage(archive, dir)
+	require.NoError(t, err)
+	assert.Equal(t, DockerImageType, di.GetType())
+	assert.Equal(t, filepath.Join(dir, "app"+ImageLayoutSuffix),
+		di.GetUpdateFiles()[0].Name)
+	images := di.GetMetaData().Images
+	require.Len(t, images, 1)
+	assert.Equal(t, "app:1.0", images[0].Ref)
+	assert.Equal(t, MediaTypeImageManifest, images[0].MediaType)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, di.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	inst := NewDockerImageInstaller()
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, di.GetMetaData(), inst.GetMetaData())
+
+	install := func(inst *DockerImage, layout string) error {
+		f, err := os.Open(layout)
+		require.NoError(t, err)
+		defer f.Close()
+		info, err := f.Stat()
+		require.NoError(t, err)
+		return inst.Install(f, &info)
+	}
+
+	// the blobs follow the blobs referencing them
+	var blobs []ImageDescriptor
+	blobInst := inst.Copy().(*DockerImage)
+	blobInst.meta = inst.meta
+	blobInst.BlobHandler = func(desc ImageDescriptor, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		assert.Equal(t, desc.Digest, digest(string(data)))
+		blobs = append(blobs, desc)
+		return err
+	}
+	layout := di.GetUpdateFiles()[0].Name
+	require.NoError(t, install(blobInst, layout))
+	require.Len(t, blobs, 3)
+	assert.Equal(t, images[0].Digest, blobs[0].Digest)
+	assert.Equal(t, MediaTypeImageManifest, blobs[0].MediaType)
+	assert.Equal(t, digest(`{"architecture":"arm"}`), blobs[1].Digest)
+	assert.Equal(t, MediaTypeImageConfig, blobs[1].MediaType)
+	assert.Equal(t, digest("layer data"), blobs[2].Digest)
+	assert.Equal(t, MediaTypeImageLayer, blobs[2].MediaType)
+
+	// the whole layout is passed to the layout handler
+	var files []string
+	inst.LayoutHandler = func(r io.Reader, df *DataFile) error {
+		assert.Equal(t, "app"+ImageLayoutSuffix, df.Name)
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			files = append(files, hdr.Name)
+		}
+	}
+	require.NoError(t, install(inst, layout))
+	assert.Equal(t, []string{ociLayoutFile, ociIndexFile}, files[:2])
+	assert.Len(t, files, 5)
+
+	// the OCI image layout directory is supported as well
+	layoutDir := filepath.Join(dir, "layout")
+	require.NoError(t, extractArchive(layout, layoutDir))
+	out := filepath.Join(dir, "out")
+	require.NoError(t, os.Mkdir(out, 0755))
+	oci, err := GenerateDockerImage(layoutDir, out)
+	require.NoError(t, err)
+	assert.Equal(t, di.GetMetaData(), oci.GetMetaData())
+
+	// the tampered blob is detected
+	layer, err := blobPath(digest("layer data"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layoutDir, layer),
+		[]byte("evil data!"), 0644))
+	_, err = GenerateDockerImage(layoutDir, out)
+	assert.Error(t, err)
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "evil.tar")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	// each of the links points inside the directory, but the chained
+	// ones point to its parent
+	for _, hdr := range []*tar.Header{
+		{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "d/x", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "d/x/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	out := filepath.Join(dir, "out")
+	err = extractArchive(archive, out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "symbolic link")
+	_, err = os.Lstat(filepath.Join(dir, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConvertDockerArchiveNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "secret")
+	require.NoError(t, ioutil.WriteFile(secret, []byte("secret"), 0600))
+	archive := filepath.Join(dir, "archive")
+	require.NoError(t, os.Mkdir(archive, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(archive, "config.json"),
+		[]byte(`{"architecture":"arm"}`), 0644))
+
+	for _, manifest := range []string{
+		`[{"Config": "../secret", "Layers": []}]`,
+		`[{"Config": "` + secret + `", "Layers": []}]`,
+		`[{"Config": "config.json", "Layers": ["../secret"]}]`,
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(archive, "manifest.json"),
+			[]byte(manifest), 0644))
+		out := filepath.Join(dir, "out")
+		require.NoError(t, os.RemoveAll(out))
+		require.NoError(t, os.Mkdir(out, 0755))
+		err = convertDockerArchive(archive, out)
+		require.Error(t, err, manifest)
+		assert.Contains(t, err.Error(), "invalid file name in archive", manifest)
+		_, err = os.Stat(filepath.Join(out, "blobs", "sha256",
+			strings.TrimPrefix(digest("secret"), "sha256:")))
+		assert.True(t, os.IsNotExist(err), manifest)
+	}
+}
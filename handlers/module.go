@@ -0,0 +1,526 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// The update module protocol lets external executables install the update
+// types with no handler compiled in. The executable named after the update
+// type is invoked with the phase and the working directory as arguments:
+//
+//	<module> Header <work dir>
+//	<module> Download <work dir>
+//	<module> Install <work dir>
+//	<module> Commit <work dir>
+//	<module> Rollback <work dir>
+//
+// The working directory holds the protocol version in the version file, the
+// files, type-info and meta-data of the update header in the header
+// directory, and the tmp directory the module can use freely. Header is
+// invoked once the whole header is read. While Download runs, the module
+// reads the path of the next payload stream from the stream-next FIFO and
+// the payload from the stream FIFO in the streams directory; the empty path
+// means there are no more payloads. If Download exits without opening
+// stream-next, the payloads are stored in the files directory instead.
+// Install is invoked once all the payloads are verified; Commit and
+// Rollback are invoked by the device once the update is accepted or has to
+// be reverted. Any exit code other than 0 fails the phase.
+const (
+	// ModuleProtocolVersion is the version of the update module protocol.
+	ModuleProtocolVersion = "1"
+
+	ModulePhaseHeader   = "Header"
+	ModulePhaseDownload = "Download"
+	ModulePhaseInstall  = "Install"
+	ModulePhaseCommit   = "Commit"
+	ModulePhaseRollback = "Rollback"
+)
+
+var errModuleExited = errors.New("update module: exited")
+
+// ModuleError is returned if the update module exits with a code other
+// than 0.
+type ModuleError struct {
+	Module   string
+	Phase    string
+	ExitCode int
+	// Output holds the standard error of the module.
+	Output string
+}
+
+func (e *ModuleError) Error() string {
+	msg := fmt.Sprintf("update module: %s %s exited with code %d",
+		e.Module, e.Phase, e.ExitCode)
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	return msg
+}
+
+// moduleProcess is the update module running the single phase.
+type moduleProcess struct {
+	cmd    *exec.Cmd
+	phase  string
+	stderr bytes.Buffer
+	done   chan struct{}
+	err    error
+}
+
+// ModuleImage handles the updates installed by the update modules. The
+// type of the update is the name of the module.
+type ModuleImage struct {
+	updateType string
+	files      []*DataFile
+	typeInfo   []byte
+	metaData   []byte
+
+	// ModulesDir holds the update module executables; the payloads are
+	// only consumed if not set.
+	ModulesDir string
+	// WorkDir is the directory the working directories of the update
+	// modules are created in.
+	WorkDir string
+
+	started    bool
+	download   *moduleProcess
+	streamed   bool
+	stored     bool
+	finalized  int
+	installing bool
+}
+
+func validModuleType(t string) error {
+	if t == "" || t == "." || t == ".." || filepath.Base(t) != t ||
+		strings.ContainsAny(t, " \t\n") {
+		return errors.Errorf("update module: invalid update type: %q", t)
+	}
+	return nil
+}
+
+// NewModuleImage creates the update installed by the update module of the
+// given type; the meta-data is passed to the module as is.
+func NewModuleImage(updateType string, files []string,
+	metaData map[string]interface{}) (*ModuleImage, error) {
+	if err := validModuleType(updateType); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("update module: no payload files")
+	}
+	m := &ModuleImage{updateType: updateType}
+	names := make(map[string]bool)
+	for _, f := range files {
+		if names[filepath.Base(f)] {
+			return nil, errors.Errorf("update module: duplicate payload file: %s", f)
+		}
+		names[filepath.Base(f)] = true
+		m.files = append(m.files, &DataFile{Name: f})
+	}
+	if metaData != nil {
+		md, err := json.Marshal(metaData)
+		if err != nil {
+			return nil, errors.Wrap(err, "update module: can not create meta-data")
+		}
+		m.metaData = md
+	}
+	return m, nil
+}
+
+// NewModuleImageInstaller is used by the artifact reader to install the
+// updates of the given type using the update module from modulesDir.
+func NewModuleImageInstaller(updateType, modulesDir, workDir string) *ModuleImage {
+	return &ModuleImage{
+		updateType: updateType,
+		ModulesDir: modulesDir,
+		WorkDir:    workDir,
+	}
+}
+
+// ModuleInstallers returns the function creating the installers of the
+// update types having the update module in modulesDir; it can be used as
+// ModuleHandler of the artifact reader.
+func ModuleInstallers(modulesDir, workDir string) func(string) Installer {
+	return func(updateType string) Installer {
+		if validModuleType(updateType) != nil {
+			return nil
+		}
+		info, err := os.Stat(filepath.Join(modulesDir, updateType))
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			return nil
+		}
+		return NewModuleImageInstaller(updateType, modulesDir, workDir)
+	}
+}
+
+// Copy creates a new instance of ModuleImage handler from the existing one.
+func (m *ModuleImage) Copy() Installer {
+	return NewModuleImageInstaller(m.updateType, m.ModulesDir, m.WorkDir)
+}
+
+// GetWorkDir returns the working directory of the update module.
+func (m *ModuleImage) GetWorkDir() string {
+	return filepath.Join(m.WorkDir, m.updateType)
+}
+
+func (m *ModuleImage) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		m.files = nil
+		for _, f := range files.FileList {
+			if filepath.Base(f) != f {
+				return errors.Errorf("update module: invalid payload file: %s", f)
+			}
+			m.files = append(m.files, &DataFile{Name: f})
+		}
+	case filepath.Base(path) == "type-info":
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrap(err, "update: can not read type-info")
+		}
+		m.typeInfo = data
+	case filepath.Base(path) == "meta-data":
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrap(err, "update: can not read meta-data")
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		var md map[string]interface{}
+		if err = json.Unmarshal(data, &md); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		m.metaData = data
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+// Prepare invokes the Header phase and starts the Download phase before the
+// first payload is read.
+func (m *ModuleImage) Prepare(df *DataFile) error {
+	if m.ModulesDir == "" || m.started {
+		return nil
+	}
+	m.started = true
+	if err := m.prepareWorkDir(); err != nil {
+		return err
+	}
+	if err := m.run(ModulePhaseHeader); err != nil {
+		return err
+	}
+	p, err := m.start(ModulePhaseDownload)
+	if err != nil {
+		return err
+	}
+	m.download = p
+	return nil
+}
+
+func (m *ModuleImage) prepareWorkDir() error {
+	dir := m.GetWorkDir()
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "update module: can not clean working directory")
+	}
+	for _, d := range []string{"header", "streams", "files", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return errors.Wrap(err, "update module: can not create working directory")
+		}
+	}
+
+	var names []string
+	for _, f := range m.files {
+		names = append(names, f.Name+"\n")
+	}
+	content := map[string][]byte{
+		"version":          []byte(ModuleProtocolVersion + "\n"),
+		"header/files":     []byte(strings.Join(names, "")),
+		"header/type-info": m.typeInfo,
+		"header/meta-data": m.metaData,
+	}
+	for name, data := range content {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return errors.Wrapf(err, "update module: can not write %s", name)
+		}
+	}
+
+	fifos := []string{"stream-next"}
+	for _, f := range m.files {
+		fifos = append(fifos, filepath.Join("streams", f.Name))
+	}
+	for _, f := range fifos {
+		if err := mkfifo(filepath.Join(dir, f)); err != nil {
+			return errors.Wrapf(err, "update module: can not create %s", f)
+		}
+	}
+	return nil
+}
+
+func (m *ModuleImage) start(phase string) (*moduleProcess, error) {
+	p := &moduleProcess{
+		phase: phase,
+		done:  make(chan struct{}),
+	}
+	p.cmd = exec.Command(filepath.Join(m.ModulesDir, m.updateType), phase,
+		m.GetWorkDir())
+	p.cmd.Dir = m.GetWorkDir()
+	p.cmd.Stderr = &p.stderr
+	if err := p.cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "update module: can not run %s %s",
+			m.updateType, phase)
+	}
+	go func() {
+		p.err = p.cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// wait returns the error of the finished phase; the exit codes other than
+// 0 are returned as ModuleError.
+func (m *ModuleImage) wait(p *moduleProcess) error {
+	<-p.done
+	if exit, ok := p.err.(*exec.ExitError); ok {
+		return &ModuleError{
+			Module:   m.updateType,
+			Phase:    p.phase,
+			ExitCode: exit.Sys().(syscall.WaitStatus).ExitStatus(),
+			Output:   strings.TrimSpace(p.stderr.String()),
+		}
+	} else if p.err != nil {
+		return errors.Wrapf(p.err, "update module: %s %s failed", m.updateType, p.phase)
+	}
+	return nil
+}
+
+func (m *ModuleImage) run(phase string) error {
+	p, err := m.start(phase)
+	if err != nil {
+		return err
+	}
+	return m.wait(p)
+}
+
+// openFifo opens the FIFO for writing unless the module exits before
+// opening it for reading.
+func openFifo(path string, p *moduleProcess) (*os.File, error) {
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		opened <- result{f, err}
+	}()
+	select {
+	case res := <-opened:
+		return res.f, res.err
+	case <-p.done:
+		releaseFifo(path)
+		if res := <-opened; res.f != nil {
+			res.f.Close()
+		}
+		return nil, errModuleExited
+	}
+}
+
+// exited returns the error of the Download phase which exited before
+// reading all the payloads.
+func (m *ModuleImage) exited() error {
+	if err := m.wait(m.download); err != nil {
+		return err
+	}
+	return errors.Errorf("update module: %s %s exited before reading all the "+
+		"payloads", m.updateType, ModulePhaseDownload)
+}
+
+func (m *ModuleImage) Install(r io.Reader, info *os.FileInfo) error {
+	if m.ModulesDir == "" {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	if m.download == nil {
+		return errors.New("update module: download not started")
+	}
+
+	name := (*info).Name()
+	if !m.stored {
+		err := m.stream(name, r)
+		if err != errModuleExited {
+			return err
+		}
+		// the module does not read the streams
+		if err = m.wait(m.download); err != nil {
+			return err
+		}
+		m.stored = true
+	}
+
+	f, err := os.OpenFile(filepath.Join(m.GetWorkDir(), "files", name),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "update module: can not store payload: %s", name)
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "update module: can not store payload: %s", name)
+	}
+	return nil
+}
+
+// stream passes the payload to the Download phase; errModuleExited is
+// returned if the module exits without reading any stream.
+func (m *ModuleImage) stream(name string, r io.Reader) error {
+	dir := m.GetWorkDir()
+	next, err := openFifo(filepath.Join(dir, "stream-next"), m.download)
+	if err == errModuleExited && !m.streamed {
+		return err
+	} else if err == errModuleExited {
+		return m.exited()
+	} else if err != nil {
+		return errors.Wrap(err, "update module: can not open stream-next")
+	}
+	m.streamed = true
+	_, err = fmt.Fprintf(next, "streams/%s\n", name)
+	next.Close()
+	if err != nil {
+		return errors.Wrap(err, "update module: can not write stream-next")
+	}
+
+	s, err := openFifo(filepath.Join(dir, "streams", name), m.download)
+	if err == errModuleExited {
+		return m.exited()
+	} else if err != nil {
+		return errors.Wrapf(err, "update module: can not open stream: %s", name)
+	}
+	defer s.Close()
+	if _, err = io.Copy(s, r); err != nil {
+		return errors.Wrapf(err, "update module: can not stream payload: %s", name)
+	}
+	return nil
+}
+
+// Finalize invokes the Install phase once all the payloads are verified.
+func (m *ModuleImage) Finalize(df *DataFile) error {
+	if m.ModulesDir == "" {
+		return nil
+	}
+	m.finalized++
+	if m.finalized < len(m.files) {
+		return nil
+	}
+
+	if !m.stored {
+		next, err := openFifo(filepath.Join(m.GetWorkDir(), "stream-next"),
+			m.download)
+		if err == nil {
+			_, err = next.Write([]byte("\n"))
+			next.Close()
+		}
+		if err != nil && err != errModuleExited {
+			return errors.Wrap(err, "update module: can not write stream-next")
+		}
+	}
+	if err := m.wait(m.download); err != nil {
+		return err
+	}
+	m.installing = true
+	return m.run(ModulePhaseInstall)
+}
+
+// Abort stops the Download phase; if the Install phase has already been
+// invoked, the Rollback phase is invoked as well.
+func (m *ModuleImage) Abort(df *DataFile, cause error) error {
+	if m.download != nil {
+		select {
+		case <-m.download.done:
+		default:
+			m.download.cmd.Process.Kill()
+			<-m.download.done
+		}
+	}
+	if m.installing {
+		return m.run(ModulePhaseRollback)
+	}
+	return nil
+}
+
+// Commit invokes the Commit phase once the installed update is accepted.
+func (m *ModuleImage) Commit() error {
+	return m.run(ModulePhaseCommit)
+}
+
+// Rollback invokes the Rollback phase reverting the installed update.
+func (m *ModuleImage) Rollback() error {
+	return m.run(ModulePhaseRollback)
+}
+
+func (m *ModuleImage) GetUpdateFiles() [](*DataFile) {
+	return m.files
+}
+
+func (m *ModuleImage) GetType() string {
+	return m.updateType
+}
+
+func (m *ModuleImage) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	var files []string
+	for _, f := range m.files {
+		files = append(files, filepath.Base(f.Name))
+	}
+	if err := writeFiles(tw, files, path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: m.updateType},
+		path); err != nil {
+		return err
+	}
+	// the file needs to be a part of artifact even if this one is empty
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(m.metaData, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (m *ModuleImage) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, m.GetUpdateFiles(), no)
+}
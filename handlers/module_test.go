@@ -0,0 +1,202 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamingModule copies the streamed payloads to the installed file; it
+// fails the phase having the fail-<phase> file in the parent directory.
+const streamingModule = `#!/bin/sh
+echo "$1" >> ../log
+if [ -e "../fail-$1" ]; then
+	echo "$1 failed" >&2
+	exit 3
+fi
+case "$1" in
+Download)
+	while true; do
+		stream=$(cat stream-next)
+		[ -z "$stream" ] && break
+		cat "$stream" > "tmp/$(basename "$stream")"
+	done
+	;;
+Install)
+	cat header/files > ../installed
+	cat tmp/* >> ../installed
+	;;
+esac
+`
+
+// storingModule does not read the streams, so the payloads are stored.
+const storingModule = `#!/bin/sh
+echo "$1" >> ../log
+case "$1" in
+Install)
+	cat header/meta-data > ../installed
+	cat files/* >> ../installed
+	;;
+esac
+`
+
+func installModule(t *testing.T, m *ModuleImage, payloads map[string][]byte) error {
+	for _, df := range m.GetUpdateFiles() {
+		name := df.Name
+		data := payloads[name]
+		*df = *imageDataFile(data)
+		df.Name = name
+		info := fakeFileInfo{name: df.Name, size: int64(len(data))}
+		var fi os.FileInfo = info
+		if err := m.Prepare(df); err != nil {
+			return err
+		}
+		err := m.Install(bytes.NewReader(data), &fi)
+		if err == nil {
+			err = m.Finalize(df)
+		}
+		if err != nil {
+			if aerr := m.Abort(df, err); aerr != nil {
+				return aerr
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+type fakeFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (f fakeFileInfo) Name() string { return f.name }
+func (f fakeFileInfo) Size() int64  { return f.size }
+
+func TestModuleImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	modules := filepath.Join(dir, "modules")
+	require.NoError(t, os.MkdirAll(modules, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(modules, "streaming"),
+		[]byte(streamingModule), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(modules, "storing"),
+		[]byte(storingModule), 0755))
+
+	payloads := map[string][]byte{"a.bin": []byte("first\n"), "b.bin": []byte("second\n")}
+	for name, data := range payloads {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+
+	_, err = NewModuleImage("../streaming", []string{filepath.Join(dir, "a.bin")}, nil)
+	assert.Error(t, err)
+	_, err = NewModuleImage("streaming", nil, nil)
+	assert.Error(t, err)
+
+	compose := func(updateType string, meta map[string]interface{}) *ModuleImage {
+		m, err := NewModuleImage(updateType, []string{
+			filepath.Join(dir, "a.bin"), filepath.Join(dir, "b.bin")}, meta)
+		require.NoError(t, err)
+		assert.Equal(t, updateType, m.GetType())
+
+		buf := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		require.NoError(t, m.ComposeHeader(tw, 0))
+		require.NoError(t, tw.Close())
+
+		create := ModuleInstallers(modules, filepath.Join(dir, "work"))
+		assert.Nil(t, create("missing"))
+		inst := create(updateType).Copy().(*ModuleImage)
+		tr := tar.NewReader(buf)
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+			names = append(names, filepath.Base(hdr.Name))
+		}
+		// meta-data is stored even if empty
+		assert.Contains(t, names, "meta-data")
+		return inst
+	}
+	reset := func() {
+		os.Remove(filepath.Join(dir, "work", "log"))
+		os.Remove(filepath.Join(dir, "work", "installed"))
+	}
+	log := func() string {
+		return string(readFile(t, filepath.Join(dir, "work", "log")))
+	}
+
+	// the payloads are streamed to the module
+	inst := compose("streaming", nil)
+	require.NoError(t, installModule(t, inst, payloads))
+	assert.Equal(t, "Header\nDownload\nInstall\n", log())
+	assert.Equal(t, "a.bin\nb.bin\nfirst\nsecond\n",
+		string(readFile(t, filepath.Join(dir, "work", "installed"))))
+	assert.Equal(t, ModuleProtocolVersion+"\n",
+		string(readFile(t, filepath.Join(inst.GetWorkDir(), "version"))))
+	require.NoError(t, inst.Commit())
+	assert.Equal(t, "Header\nDownload\nInstall\nCommit\n", log())
+
+	// the payloads are stored for the module not reading the streams
+	reset()
+	inst = compose("storing", map[string]interface{}{"key": "value"})
+	require.NoError(t, installModule(t, inst, payloads))
+	assert.Equal(t, "Header\nDownload\nInstall\n", log())
+	assert.Equal(t, `{"key":"value"}first`+"\nsecond\n",
+		string(readFile(t, filepath.Join(dir, "work", "installed"))))
+
+	// the exit code of the failed phase is returned
+	for _, phase := range []string{ModulePhaseHeader, ModulePhaseDownload,
+		ModulePhaseInstall} {
+		reset()
+		fail := filepath.Join(dir, "work", "fail-"+phase)
+		require.NoError(t, ioutil.WriteFile(fail, nil, 0644))
+		err = installModule(t, compose("streaming", nil), payloads)
+		require.Error(t, err, phase)
+		merr, ok := errors.Cause(err).(*ModuleError)
+		require.True(t, ok, phase)
+		assert.Equal(t, phase, merr.Phase)
+		assert.Equal(t, 3, merr.ExitCode)
+		assert.Equal(t, phase+" failed", merr.Output)
+		require.NoError(t, os.Remove(fail))
+	}
+	// the failed Install is rolled back
+	assert.Equal(t, "Header\nDownload\nInstall\nRollback\n", log())
+
+	// without the modules directory the payloads are only consumed
+	reset()
+	inst = compose("streaming", nil)
+	inst.ModulesDir = ""
+	require.NoError(t, installModule(t, inst, payloads))
+	_, err = os.Stat(filepath.Join(dir, "work", "log"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build windows
+
+package handlers
+
+import "github.com/pkg/errors"
+
+// update modules are not supported on Windows as the payloads are streamed
+// through FIFOs
+func mkfifo(path string) error {
+	return errors.New("update module: FIFOs are not supported")
+}
+
+func releaseFifo(path string) {}
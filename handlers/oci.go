@@ -0,0 +1,407 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Media types of the OCI image layout content.
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeImageLayer    = "application/vnd.oci.image.layer.v1.tar"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// annotations holding the image reference
+	annotationRefName   = "org.opencontainers.image.ref.name"
+	annotationImageName = "io.containerd.image.name"
+
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+)
+
+var digestRegexp = regexp.MustCompile("^sha256:[a-f0-9]{64}$")
+
+// ImageDescriptor describes the blob of the OCI image layout.
+type ImageDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// imageIndex is either the index.json of the layout or the image index
+// blob; imageManifest is the image manifest blob.
+type imageIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []ImageDescriptor `json:"manifests"`
+}
+
+type imageManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ImageDescriptor   `json:"config"`
+	Layers        []ImageDescriptor `json:"layers"`
+}
+
+func isManifest(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeImageIndex, mediaTypeDockerManifestList,
+		MediaTypeImageManifest, mediaTypeDockerManifest:
+		return true
+	}
+	return false
+}
+
+// children returns the descriptors referenced by the index or the manifest
+// blob; other blobs do not reference any.
+func children(mediaType string, data []byte) ([]ImageDescriptor, error) {
+	switch mediaType {
+	case MediaTypeImageIndex, mediaTypeDockerManifestList:
+		idx := new(imageIndex)
+		if err := json.Unmarshal(data, idx); err != nil {
+			return nil, errors.Wrap(err, "update: can not parse image index")
+		}
+		return idx.Manifests, nil
+	case MediaTypeImageManifest, mediaTypeDockerManifest:
+		m := new(imageManifest)
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, errors.Wrap(err, "update: can not parse image manifest")
+		}
+		return append([]ImageDescriptor{m.Config}, m.Layers...), nil
+	}
+	return nil, nil
+}
+
+func blobPath(digest string) (string, error) {
+	if !digestRegexp.MatchString(digest) {
+		return "", errors.Errorf("update: unsupported blob digest: %s", digest)
+	}
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1)), nil
+}
+
+// imageRef returns the reference of the image described in index.json.
+func imageRef(desc ImageDescriptor) string {
+	if ref := desc.Annotations[annotationImageName]; ref != "" {
+		return ref
+	}
+	return desc.Annotations[annotationRefName]
+}
+
+// readIndex parses index.json of the OCI image layout directory.
+func readIndex(dir string) (*imageIndex, error) {
+	if _, err := os.Stat(filepath.Join(dir, ociLayoutFile)); err != nil {
+		return nil, errors.Wrapf(err, "update: not an OCI image layout: %s", dir)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not read image index")
+	}
+	idx := new(imageIndex)
+	if err = json.Unmarshal(data, idx); err != nil {
+		return nil, errors.Wrap(err, "update: can not parse image index")
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, errors.New("update: image index is empty")
+	}
+	return idx, nil
+}
+
+// writeLayout stores the OCI image layout directory in the tar archive.
+// The index comes first and each blob follows the blob referencing it, so
+// the media types of all the blobs are known while the archive is read.
+// Only the referenced blobs are stored and their digests are verified.
+func writeLayout(dir string, idx *imageIndex, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, name := range []string{ociLayoutFile, ociIndexFile} {
+		if err := writeLayoutFile(tw, dir, name, ""); err != nil {
+			return err
+		}
+	}
+
+	written := make(map[string]bool)
+	queue := append([]ImageDescriptor(nil), idx.Manifests...)
+	for len(queue) > 0 {
+		desc := queue[0]
+		queue = queue[1:]
+		if written[desc.Digest] {
+			continue
+		}
+		name, err := blobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err = writeLayoutFile(tw, dir, name, desc.Digest); err != nil {
+			return err
+		}
+		written[desc.Digest] = true
+
+		if !isManifest(desc.MediaType) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return errors.Wrap(err, "update: can not read image blob")
+		}
+		c, err := children(desc.MediaType, data)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, c...)
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "update: can not write image layout")
+	}
+	return nil
+}
+
+func writeLayoutFile(tw *tar.Writer, dir, name, digest string) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return errors.Wrapf(err, "update: can not open image file: %s", name)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "update: can not open image file: %s", name)
+	}
+
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Typeflag: tar.TypeReg,
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "update: can not write image layout")
+	}
+	h := sha256.New()
+	if _, err = io.Copy(tw, io.TeeReader(f, h)); err != nil {
+		return errors.Wrap(err, "update: can not write image layout")
+	}
+	if digest != "" && "sha256:"+hex.EncodeToString(h.Sum(nil)) != digest {
+		return errors.Errorf("update: invalid digest of image blob: %s", digest)
+	}
+	return nil
+}
+
+// dockerArchiveManifest is the manifest.json of the legacy docker-save
+// archive.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// convertDockerArchive creates the OCI image layout in dir from the
+// extracted legacy docker-save archive.
+func convertDockerArchive(archive, dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(archive, "manifest.json"))
+	if err != nil {
+		return errors.Wrap(err, "update: not a docker archive")
+	}
+	var manifests []dockerArchiveManifest
+	if err = json.Unmarshal(data, &manifests); err != nil {
+		return errors.Wrap(err, "update: can not parse docker archive manifest")
+	}
+
+	idx := &imageIndex{SchemaVersion: 2}
+	for _, m := range manifests {
+		manifest := imageManifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeImageManifest,
+		}
+		config, err := archiveFile(archive, m.Config)
+		if err != nil {
+			return err
+		}
+		if manifest.Config, err = storeBlob(dir, config,
+			MediaTypeImageConfig); err != nil {
+			return err
+		}
+		for _, l := range m.Layers {
+			file, err := archiveFile(archive, l)
+			if err != nil {
+				return err
+			}
+			layer, err := storeBlob(dir, file, MediaTypeImageLayer)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+		}
+
+		data, err := json.Marshal(&manifest)
+		if err != nil {
+			return errors.Wrap(err, "update: can not create image manifest")
+		}
+		tmp := filepath.Join(dir, "manifest.tmp")
+		if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+			return errors.Wrap(err, "update: can not create image manifest")
+		}
+		desc, err := storeBlob(dir, tmp, MediaTypeImageManifest)
+		os.Remove(tmp)
+		if err != nil {
+			return err
+		}
+
+		if len(m.RepoTags) == 0 {
+			idx.Manifests = append(idx.Manifests, desc)
+		}
+		for _, tag := range m.RepoTags {
+			d := desc
+			d.Annotations = map[string]string{annotationImageName: tag}
+			if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+				d.Annotations[annotationRefName] = tag[i+1:]
+			}
+			idx.Manifests = append(idx.Manifests, d)
+		}
+	}
+
+	data, err = json.Marshal(idx)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create image index")
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, ociIndexFile), data, 0644); err != nil {
+		return errors.Wrap(err, "update: can not create image index")
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ociLayoutFile),
+		[]byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// archiveFile returns the path of the file the docker archive manifest
+// refers to; the names leaving the extracted archive are refused.
+func archiveFile(archive, name string) (string, error) {
+	clean, err := entryName(name)
+	if err != nil {
+		return "", err
+	}
+	if err = noSymlinks(archive, filepath.Dir(clean)); err != nil {
+		return "", err
+	}
+	return filepath.Join(archive, clean), nil
+}
+
+// storeBlob copies the file to the blobs of the image layout in dir.
+func storeBlob(dir, file, mediaType string) (ImageDescriptor, error) {
+	desc := ImageDescriptor{MediaType: mediaType}
+	in, err := os.Open(file)
+	if err != nil {
+		return desc, errors.Wrap(err, "update: can not open image file")
+	}
+	defer in.Close()
+
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	if err = os.MkdirAll(blobs, 0755); err != nil {
+		return desc, errors.Wrap(err, "update: can not create image blobs")
+	}
+	out, err := ioutil.TempFile(blobs, "blob")
+	if err != nil {
+		return desc, errors.Wrap(err, "update: can not create image blob")
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if desc.Size, err = io.Copy(io.MultiWriter(out, h), in); err != nil {
+		os.Remove(out.Name())
+		return desc, errors.Wrap(err, "update: can not write image blob")
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	desc.Digest = "sha256:" + sum
+	if err = os.Rename(out.Name(), filepath.Join(blobs, sum)); err != nil {
+		return desc, errors.Wrap(err, "update: can not write image blob")
+	}
+	return desc, nil
+}
+
+// extractArchive extracts the regular files and the directories of the tar
+// archive refusing the names leaving dir.
+func extractArchive(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return errors.Wrapf(err, "update: can not open: %s", archive)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "update: can not read archive: %s", archive)
+		}
+		name, err := entryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		// the links extracted so far could point outside of the directory
+		if err = noSymlinks(dir, filepath.Dir(name)); err != nil {
+			return err
+		}
+		path := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(tr, path)
+		case tar.TypeSymlink:
+			// the docker archive links the layers shared by the images
+			target := filepath.Join(filepath.Dir(name), hdr.Linkname)
+			if _, err = entryName(target); err != nil || filepath.IsAbs(hdr.Linkname) {
+				return errors.Errorf("update: invalid link in archive: %s", name)
+			}
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.Symlink(hdr.Linkname, path)
+			}
+		default:
+			// other files are not needed
+		}
+		if err != nil {
+			return errors.Wrapf(err, "update: can not extract: %s", name)
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
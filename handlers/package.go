@@ -0,0 +1,467 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// PackageType is the type of the updates installing a set of packages.
+const PackageType = "package"
+
+// PackageInfo holds the control metadata of the package.
+type PackageInfo struct {
+	// File is the name of the data file holding the package.
+	File         string `json:"file"`
+	Format       string `json:"format"`
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+	// Depends and PreDepends hold the dependency clauses as listed in the
+	// control file; e.g. "libc6 (>= 2.27) | musl".
+	Depends    []string `json:"depends,omitempty"`
+	PreDepends []string `json:"pre_depends,omitempty"`
+	Provides   []string `json:"provides,omitempty"`
+}
+
+// PackageMetaData is the content of the meta-data file of the package
+// update; the packages are listed in the installation order.
+type PackageMetaData struct {
+	Packages []PackageInfo `json:"packages"`
+}
+
+// Package handles updates of type 'package'. The update holds .deb or .ipk
+// packages ordered so that each package follows the packages it depends on.
+type Package struct {
+	files []*DataFile
+	meta  PackageMetaData
+
+	// InstallHandler is called for each package in the installation order.
+	// The packages are only consumed if not set.
+	InstallHandler func(io.Reader, *DataFile, *PackageInfo) error
+}
+
+// NewPackages creates the update holding the given .deb or .ipk packages;
+// the packages are ordered by their dependencies.
+func NewPackages(files []string) (*Package, error) {
+	if len(files) == 0 {
+		return nil, errors.New("update: no packages")
+	}
+	var pkgs []PackageInfo
+	names := make(map[string]bool)
+	for _, file := range files {
+		info, err := ReadPackageInfo(file)
+		if err != nil {
+			return nil, err
+		}
+		if names[info.File] {
+			return nil, errors.Errorf("update: duplicate package file: %s", info.File)
+		}
+		names[info.File] = true
+		pkgs = append(pkgs, *info)
+	}
+
+	order, err := orderPackages(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Package)
+	for _, i := range order {
+		p.meta.Packages = append(p.meta.Packages, pkgs[i])
+		p.files = append(p.files, &DataFile{Name: files[i]})
+	}
+	return p, nil
+}
+
+// ReadPackageInfo parses the control metadata of the .deb or .ipk package.
+func ReadPackageInfo(file string) (*PackageInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open package: %s", file)
+	}
+	defer f.Close()
+
+	format := strings.TrimPrefix(filepath.Ext(file), ".")
+	if format != "deb" && format != "ipk" {
+		return nil, errors.Errorf("update: unsupported package format: %s", file)
+	}
+	control, err := readControl(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: invalid package: %s", file)
+	}
+
+	info := &PackageInfo{
+		File:         filepath.Base(file),
+		Format:       format,
+		Name:         control["Package"],
+		Version:      control["Version"],
+		Architecture: control["Architecture"],
+		Depends:      splitList(control["Depends"]),
+		PreDepends:   splitList(control["Pre-Depends"]),
+		Provides:     splitList(control["Provides"]),
+	}
+	if info.Name == "" || info.Version == "" {
+		return nil, errors.Errorf("update: package name or version missing: %s", file)
+	}
+	return info, nil
+}
+
+const arMagic = "!<arch>\n"
+
+// readControl returns the fields of the control file of the package. Both
+// .deb and .ipk packages are either ar archives or, in case of older .ipk
+// packages, gzipped tar archives holding the control.tar archive.
+func readControl(r io.Reader) (map[string]string, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(arMagic))
+	if err != nil {
+		return nil, errors.Wrap(err, "can not read package")
+	}
+
+	var control io.Reader
+	var name string
+	if string(magic) == arMagic {
+		br.Discard(len(arMagic))
+		control, name, err = findArMember(br)
+	} else if magic[0] == 0x1f && magic[1] == 0x8b {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(br); err != nil {
+			return nil, errors.Wrap(err, "can not read package")
+		}
+		control, name, err = findTarMember(tar.NewReader(gz))
+	} else {
+		return nil, errors.New("unknown package format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "control.tar":
+	case "control.tar.gz":
+		if control, err = gzip.NewReader(control); err != nil {
+			return nil, errors.Wrap(err, "can not read control archive")
+		}
+	default:
+		return nil, errors.Errorf("unsupported compression of control archive: %s",
+			name)
+	}
+
+	tr := tar.NewReader(control)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("control file missing")
+		} else if err != nil {
+			return nil, errors.Wrap(err, "can not read control archive")
+		}
+		if filepath.Clean(hdr.Name) == "control" {
+			return parseControl(tr)
+		}
+	}
+}
+
+// findArMember returns the control archive stored in the ar archive.
+func findArMember(r io.Reader) (io.Reader, string, error) {
+	for {
+		var hdr [60]byte
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return nil, "", errors.New("control archive missing")
+		} else if err != nil {
+			return nil, "", errors.Wrap(err, "can not read package")
+		}
+		if string(hdr[58:]) != "`\n" {
+			return nil, "", errors.New("invalid ar archive")
+		}
+		// GNU ar terminates the names with a slash
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[:16])), "/")
+		var size int64
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(hdr[48:58])), "%d",
+			&size); err != nil || size < 0 {
+			return nil, "", errors.New("invalid ar archive")
+		}
+		if strings.HasPrefix(name, "control.tar") {
+			return io.LimitReader(r, size), name, nil
+		}
+		// the members are aligned to even offsets
+		if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+			return nil, "", errors.Wrap(err, "can not read package")
+		}
+	}
+}
+
+// findTarMember returns the control archive stored in the tar archive.
+func findTarMember(tr *tar.Reader) (io.Reader, string, error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, "", errors.New("control archive missing")
+		} else if err != nil {
+			return nil, "", errors.Wrap(err, "can not read package")
+		}
+		name := filepath.Clean(hdr.Name)
+		if strings.HasPrefix(name, "control.tar") {
+			return tr, name, nil
+		}
+	}
+}
+
+// parseControl parses the control file in the RFC 822 format; the values
+// of the multi-line fields are joined.
+func parseControl(r io.Reader) (map[string]string, error) {
+	fields := make(map[string]string)
+	var last string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			if last == "" {
+				return nil, errors.New("invalid control file")
+			}
+			fields[last] += "\n" + strings.TrimSpace(line)
+		default:
+			i := strings.Index(line, ":")
+			if i <= 0 {
+				return nil, errors.Errorf("invalid control file line: %s", line)
+			}
+			last = strings.TrimSpace(line[:i])
+			fields[last] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "can not read control file")
+	}
+	return fields, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// clauseNames returns the names of the alternative packages satisfying the
+// dependency clause.
+func clauseNames(clause string) []string {
+	var names []string
+	for _, alt := range strings.Split(clause, "|") {
+		// drop the version constraint and the architecture qualifier
+		name := strings.TrimSpace(alt)
+		if i := strings.IndexAny(name, " (:"); i >= 0 {
+			name = name[:i]
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// orderPackages returns the indexes of the packages sorted so that each
+// package follows the packages of the set it depends on; the packages not
+// depending on each other keep the given order. The dependencies on the
+// packages outside of the set are expected to be already installed.
+func orderPackages(pkgs []PackageInfo) ([]int, error) {
+	provided := make(map[string][]int)
+	for i, p := range pkgs {
+		provided[p.Name] = append(provided[p.Name], i)
+		for _, v := range p.Provides {
+			name := clauseNames(v)
+			if len(name) > 0 {
+				provided[name[0]] = append(provided[name[0]], i)
+			}
+		}
+	}
+
+	deps := make([]map[int]bool, len(pkgs))
+	for i, p := range pkgs {
+		deps[i] = make(map[int]bool)
+		for _, clause := range append(append([]string(nil), p.PreDepends...), p.Depends...) {
+			for _, name := range clauseNames(clause) {
+				for _, j := range provided[name] {
+					if j != i {
+						deps[i][j] = true
+					}
+				}
+			}
+		}
+	}
+
+	var order []int
+	done := make([]bool, len(pkgs))
+	for len(order) < len(pkgs) {
+		progress := false
+		for i := range pkgs {
+			if done[i] || !ready(deps[i], done) {
+				continue
+			}
+			order = append(order, i)
+			done[i] = true
+			progress = true
+			break
+		}
+		if !progress {
+			var cycle []string
+			for i, p := range pkgs {
+				if !done[i] {
+					cycle = append(cycle, p.Name)
+				}
+			}
+			return nil, errors.Errorf("update: dependency cycle between packages: %s",
+				strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+func ready(deps map[int]bool, done []bool) bool {
+	for j := range deps {
+		if !done[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewPackageInstaller is used by the artifact reader to read and install
+// package update type.
+func NewPackageInstaller() *Package {
+	return new(Package)
+}
+
+// Copy creates a new instance of Package handler from the existing one.
+func (p *Package) Copy() Installer {
+	return &Package{
+		InstallHandler: p.InstallHandler,
+	}
+}
+
+// GetMetaData returns the packages in the installation order.
+func (p *Package) GetMetaData() PackageMetaData {
+	return p.meta
+}
+
+func (p *Package) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		p.files = nil
+		for _, f := range files.FileList {
+			p.files = append(p.files, &DataFile{Name: f})
+		}
+	case filepath.Base(path) == "type-info":
+		// we don't need any information from type-info
+	case filepath.Base(path) == "meta-data":
+		if err := json.NewDecoder(r).Decode(&p.meta); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		if len(p.meta.Packages) != len(p.files) {
+			return errors.New("update: packages do not match the files")
+		}
+		for i, pkg := range p.meta.Packages {
+			if pkg.File != p.files[i].Name {
+				return errors.Errorf("update: package does not match the file: %s",
+					pkg.File)
+			}
+		}
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+func (p *Package) Install(r io.Reader, info *os.FileInfo) error {
+	if p.InstallHandler == nil {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	// the data files are stored in the installation order
+	name := (*info).Name()
+	for i, pkg := range p.meta.Packages {
+		if pkg.File != name {
+			continue
+		}
+		if err := p.InstallHandler(r, p.files[i], &p.meta.Packages[i]); err != nil {
+			return errors.Wrapf(err, "update: can not install package: %s", pkg.Name)
+		}
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	return errors.Errorf("update: unknown package file: %s", name)
+}
+
+func (p *Package) GetUpdateFiles() [](*DataFile) {
+	return p.files
+}
+
+func (p *Package) GetType() string {
+	return PackageType
+}
+
+func (p *Package) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	var files []string
+	for _, f := range p.files {
+		files = append(files, filepath.Base(f.Name))
+	}
+	if err := writeFiles(tw, files, path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: PackageType},
+		path); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(&p.meta)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create meta-data")
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (p *Package) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, p.GetUpdateFiles(), no)
+}
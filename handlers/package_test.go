@@ -0,0 +1,179 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: name, Mode: 0644, Size: int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// writeDeb creates the package in the ar format used by .deb packages.
+func writeDeb(t *testing.T, path, control string) {
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", tarGz(t, map[string][]byte{"./control": []byte(control)})},
+		{"data.tar.gz", tarGz(t, map[string][]byte{"./usr/bin/app": []byte("app")})},
+	}
+	buf := bytes.NewBufferString(arMagic)
+	for _, m := range members {
+		fmt.Fprintf(buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n",
+			m.name+"/", 0, 0, 0, "100644", len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+// writeIpk creates the package in the tar.gz format of the older .ipk
+// packages.
+func writeIpk(t *testing.T, path, control string) {
+	data := tarGz(t, map[string][]byte{
+		"./debian-binary":  []byte("2.0\n"),
+		"./control.tar.gz": tarGz(t, map[string][]byte{"control": []byte(control)}),
+		"./data.tar.gz":    tarGz(t, map[string][]byte{"./etc/base": []byte("base")}),
+	})
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "package")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	app := filepath.Join(dir, "app_1.2_armhf.deb")
+	writeDeb(t, app, "Package: app\nVersion: 1.2\nArchitecture: armhf\n"+
+		"Depends: libfoo (>= 1.0), libc6\nDescription: app\n multi-line description\n")
+	libfoo := filepath.Join(dir, "libfoo_1.0_armhf.deb")
+	writeDeb(t, libfoo, "Package: libfoo\nVersion: 1.0\nArchitecture: armhf\n"+
+		"Pre-Depends: base-files | busybox\n")
+	base := filepath.Join(dir, "base_3_all.ipk")
+	writeIpk(t, base, "Package: base\nVersion: 3\nArchitecture: all\n"+
+		"Provides: base-files\n")
+
+	p, err := NewPackages([]string{app, libfoo, base})
+	require.NoError(t, err)
+	assert.Equal(t, PackageType, p.GetType())
+	assert.Equal(t, []PackageInfo{
+		{
+			File: "base_3_all.ipk", Format: "ipk", Name: "base", Version: "3",
+			Architecture: "all", Provides: []string{"base-files"},
+		},
+		{
+			File: "libfoo_1.0_armhf.deb", Format: "deb", Name: "libfoo",
+			Version: "1.0", Architecture: "armhf",
+			PreDepends: []string{"base-files | busybox"},
+		},
+		{
+			File: "app_1.2_armhf.deb", Format: "deb", Name: "app", Version: "1.2",
+			Architecture: "armhf", Depends: []string{"libfoo (>= 1.0)", "libc6"},
+		},
+	}, p.GetMetaData().Packages)
+	files := p.GetUpdateFiles()
+	require.Len(t, files, 3)
+	assert.Equal(t, []string{base, libfoo, app},
+		[]string{files[0].Name, files[1].Name, files[2].Name})
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, p.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	var installed []string
+	inst := NewPackageInstaller()
+	inst.InstallHandler = func(r io.Reader, df *DataFile, pkg *PackageInfo) error {
+		assert.Equal(t, df.Name, pkg.File)
+		installed = append(installed, pkg.Name)
+		return nil
+	}
+	inst = inst.Copy().(*Package)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, p.GetMetaData(), inst.GetMetaData())
+
+	for _, f := range files {
+		df, err := os.Open(f.Name)
+		require.NoError(t, err)
+		info, err := df.Stat()
+		require.NoError(t, err)
+		require.NoError(t, inst.Install(df, &info))
+		df.Close()
+	}
+	assert.Equal(t, []string{"base", "libfoo", "app"}, installed)
+}
+
+func TestPackageErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "package")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.deb")
+	writeDeb(t, a, "Package: a\nVersion: 1\nDepends: b\n")
+	b := filepath.Join(dir, "b.ipk")
+	writeIpk(t, b, "Package: b\nVersion: 1\nDepends: a (= 1)\n")
+	_, err = NewPackages([]string{a, b})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dependency cycle between packages: a, b")
+
+	noVersion := filepath.Join(dir, "c.deb")
+	writeDeb(t, noVersion, "Package: c\n")
+	_, err = NewPackages([]string{noVersion})
+	assert.Error(t, err)
+
+	rpm := filepath.Join(dir, "c.rpm")
+	require.NoError(t, ioutil.WriteFile(rpm, []byte("rpm"), 0644))
+	_, err = NewPackages([]string{rpm})
+	assert.Error(t, err)
+
+	_, err = NewPackages(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,337 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// RawImageType is the type of the updates writing images to raw offsets of
+// devices or partitions; e.g. bootloaders or MCU firmware.
+const RawImageType = "raw-image"
+
+// RawPayload describes where the payload file is written.
+type RawPayload struct {
+	File string `json:"file"`
+	// Target is the name of the device or partition; the installer maps
+	// it to the actual path.
+	Target string `json:"target"`
+	Offset int64  `json:"offset"`
+	// MaxSize is the size of the region reserved for the payload.
+	MaxSize int64 `json:"max_size"`
+	// Erase requires the whole region to be filled with EraseValue before
+	// the payload is written.
+	Erase      bool  `json:"erase,omitempty"`
+	EraseValue uint8 `json:"erase_value,omitempty"`
+}
+
+// RawImageMetaData is the content of the meta-data file of the raw-image
+// update.
+type RawImageMetaData struct {
+	Payloads []RawPayload `json:"payloads"`
+}
+
+// Validate checks that the payloads are complete and the regions of the
+// payloads written to the same target do not overlap.
+func (m *RawImageMetaData) Validate() error {
+	if len(m.Payloads) == 0 {
+		return errors.New("update: no raw payloads")
+	}
+	files := make(map[string]bool)
+	regions := make(map[string][]RawPayload)
+	for _, p := range m.Payloads {
+		if p.File == "" || p.Target == "" {
+			return errors.New("update: raw payload file or target missing")
+		}
+		if files[p.File] {
+			return errors.Errorf("update: duplicate raw payload: %s", p.File)
+		}
+		files[p.File] = true
+		if p.Offset < 0 || p.MaxSize <= 0 {
+			return errors.Errorf("update: invalid region of raw payload: %s", p.File)
+		}
+		if p.Offset > math.MaxInt64-p.MaxSize {
+			return errors.Errorf("update: region of raw payload %s overflows", p.File)
+		}
+		regions[p.Target] = append(regions[p.Target], p)
+	}
+	for target, r := range regions {
+		sort.Slice(r, func(i, j int) bool { return r[i].Offset < r[j].Offset })
+		for i := 1; i < len(r); i++ {
+			if r[i-1].Offset+r[i-1].MaxSize > r[i].Offset {
+				return errors.Errorf("update: raw payloads %s and %s overlap on %s",
+					r[i-1].File, r[i].File, target)
+			}
+		}
+	}
+	return nil
+}
+
+// RawImage handles updates of type 'raw-image'. Each payload file is
+// written to the region of the target given by the meta-data.
+type RawImage struct {
+	files []*DataFile
+	meta  RawImageMetaData
+
+	// Targets maps the target names to the paths of the devices or
+	// partitions. The payloads are only consumed if not set.
+	Targets map[string]string
+}
+
+// NewRawImage creates the update writing the payloads; the File of each
+// payload is the path of the file to store in the artifact.
+func NewRawImage(payloads []RawPayload) (*RawImage, error) {
+	ri := new(RawImage)
+	for _, p := range payloads {
+		info, err := os.Stat(p.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "update: can not read raw payload: %s",
+				p.File)
+		}
+		if info.Size() > p.MaxSize {
+			return nil, errors.Errorf("update: raw payload %s of size %d exceeds "+
+				"max size %d", p.File, info.Size(), p.MaxSize)
+		}
+		ri.files = append(ri.files, &DataFile{Name: p.File})
+		p.File = filepath.Base(p.File)
+		ri.meta.Payloads = append(ri.meta.Payloads, p)
+	}
+	if err := ri.meta.Validate(); err != nil {
+		return nil, err
+	}
+	return ri, nil
+}
+
+// NewRawImageInstaller is used by the artifact reader to read and install
+// raw-image update type.
+func NewRawImageInstaller(targets map[string]string) *RawImage {
+	return &RawImage{
+		Targets: targets,
+	}
+}
+
+// Copy creates a new instance of RawImage handler from the existing one.
+func (ri *RawImage) Copy() Installer {
+	return &RawImage{
+		Targets: ri.Targets,
+	}
+}
+
+// GetMetaData returns the description of the payloads.
+func (ri *RawImage) GetMetaData() RawImageMetaData {
+	return ri.meta
+}
+
+func (ri *RawImage) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		ri.files = nil
+		for _, f := range files.FileList {
+			ri.files = append(ri.files, &DataFile{Name: f})
+		}
+	case filepath.Base(path) == "type-info":
+		// we don't need any information from type-info
+	case filepath.Base(path) == "meta-data":
+		if err := json.NewDecoder(r).Decode(&ri.meta); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		if err := ri.meta.Validate(); err != nil {
+			return err
+		}
+		if len(ri.meta.Payloads) != len(ri.files) {
+			return errors.New("update: raw payloads do not match the files")
+		}
+		for i, p := range ri.meta.Payloads {
+			if p.File != ri.files[i].Name {
+				return errors.Errorf("update: raw payload does not match the file: %s",
+					p.File)
+			}
+		}
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+func (ri *RawImage) Install(r io.Reader, info *os.FileInfo) error {
+	if ri.Targets == nil {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	name := (*info).Name()
+	for i, p := range ri.meta.Payloads {
+		if p.File == name {
+			return ri.write(r, ri.files[i], &p)
+		}
+	}
+	return errors.Errorf("update: unknown raw payload: %s", name)
+}
+
+// write stores the payload in its region of the target and verifies it.
+func (ri *RawImage) write(r io.Reader, df *DataFile, p *RawPayload) error {
+	path, ok := ri.Targets[p.Target]
+	if !ok {
+		return errors.Errorf("update: unknown raw target: %s", p.Target)
+	}
+	if len(df.Checksum) == 0 {
+		return errors.Errorf("update: missing checksum of raw payload: %s", p.File)
+	}
+	if df.Size > p.MaxSize {
+		return errors.Errorf("update: raw payload %s of size %d exceeds max size %d",
+			p.File, df.Size, p.MaxSize)
+	}
+
+	// raw targets are never created; those must be the existing devices
+	// or partitions large enough to hold the whole region
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrapf(err, "update: can not open raw target: %s", path)
+	}
+	defer f.Close()
+	capacity, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrapf(err, "update: can not get size of: %s", path)
+	}
+	// the end of the region is not computed so that it can not overflow
+	if p.Offset < 0 || p.MaxSize > capacity || p.Offset > capacity-p.MaxSize {
+		return errors.Errorf("update: region of raw payload %s exceeds %s of size %d",
+			p.File, path, capacity)
+	}
+
+	if p.Erase {
+		if err = erase(f, p.Offset, p.MaxSize, p.EraseValue); err != nil {
+			return errors.Wrapf(err, "update: can not erase: %s", path)
+		}
+	}
+	// the payload is not trusted to match the size from the header
+	n, err := writeAt(f, io.LimitReader(r, df.Size), p.Offset)
+	if err != nil {
+		return errors.Wrapf(err, "update: can not write: %s", path)
+	}
+	if n != df.Size {
+		return errors.Errorf("update: invalid size of raw payload %s; expected: %d; "+
+			"written: %d", p.File, df.Size, n)
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrapf(err, "update: can not sync: %s", path)
+	}
+
+	// read back the written payload
+	h := sha256.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, p.Offset, df.Size)); err != nil {
+		return errors.Wrapf(err, "update: can not read back: %s", path)
+	}
+	sum := make([]byte, hex.EncodedLen(sha256.Size))
+	hex.Encode(sum, h.Sum(nil))
+	if !bytes.Equal(sum, df.Checksum) {
+		return errors.Errorf("update: invalid checksum of written raw payload %s; "+
+			"expected: [%s]; actual: [%s]", p.File, df.Checksum, sum)
+	}
+	return nil
+}
+
+func writeAt(f *os.File, r io.Reader, off int64) (int64, error) {
+	buf := make([]byte, DefaultDeviceBufferSize)
+	var written int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, werr := f.WriteAt(buf[:n], off+written); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
+
+func erase(f *os.File, off, size int64, value uint8) error {
+	buf := bytes.Repeat([]byte{value}, DefaultDeviceBufferSize)
+	for size > 0 {
+		n := int64(len(buf))
+		if n > size {
+			n = size
+		}
+		if _, err := f.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+		size -= n
+	}
+	return nil
+}
+
+func (ri *RawImage) GetUpdateFiles() [](*DataFile) {
+	return ri.files
+}
+
+func (ri *RawImage) GetType() string {
+	return RawImageType
+}
+
+func (ri *RawImage) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	var files []string
+	for _, f := range ri.files {
+		files = append(files, filepath.Base(f.Name))
+	}
+	if err := writeFiles(tw, files, path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: RawImageType},
+		path); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(&ri.meta)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create meta-data")
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (ri *RawImage) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, ri.GetUpdateFiles(), no)
+}
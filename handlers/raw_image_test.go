@@ -0,0 +1,155 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawImageMetaData(t *testing.T) {
+	tc := []struct {
+		payloads []RawPayload
+		valid    bool
+	}{
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: 0, MaxSize: 1024},
+			{File: "u-boot", Target: "boot0", Offset: 1024, MaxSize: 1024}}, true},
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: 0, MaxSize: 1025},
+			{File: "u-boot", Target: "boot0", Offset: 1024, MaxSize: 1024}}, false},
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: 0, MaxSize: 1025},
+			{File: "u-boot", Target: "boot1", Offset: 1024, MaxSize: 1024}}, true},
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: 0, MaxSize: 1024},
+			{File: "spl", Target: "boot1", Offset: 0, MaxSize: 1024}}, false},
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: -1, MaxSize: 1024}}, false},
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: 0}}, false},
+		{[]RawPayload{{File: "spl", Target: "boot0", Offset: math.MaxInt64 - 512,
+			MaxSize: 1024}}, false},
+		{[]RawPayload{{File: "spl", Offset: 0, MaxSize: 1024}}, false},
+		{nil, false},
+	}
+	for i, test := range tc {
+		m := RawImageMetaData{Payloads: test.payloads}
+		err := m.Validate()
+		if test.valid {
+			assert.NoError(t, err, "test %d", i)
+		} else {
+			assert.Error(t, err, "test %d", i)
+		}
+	}
+}
+
+func TestRawImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raw-image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spl := filepath.Join(dir, "spl.bin")
+	require.NoError(t, ioutil.WriteFile(spl, []byte("spl"), 0644))
+	uboot := filepath.Join(dir, "u-boot.bin")
+	require.NoError(t, ioutil.WriteFile(uboot, []byte("u-boot"), 0644))
+
+	_, err = NewRawImage([]RawPayload{{File: uboot, Target: "boot0", MaxSize: 4}})
+	assert.Error(t, err)
+
+	ri, err := NewRawImage([]RawPayload{
+		{File: spl, Target: "boot0", Offset: 16, MaxSize: 16},
+		{File: uboot, Target: "boot0", Offset: 32, MaxSize: 16, Erase: true,
+			EraseValue: 0xff},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, RawImageType, ri.GetType())
+	assert.Equal(t, "spl.bin", ri.GetMetaData().Payloads[0].File)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, ri.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	target := filepath.Join(dir, "boot0")
+	require.NoError(t, ioutil.WriteFile(target, make([]byte, 48), 0644))
+	inst := NewRawImageInstaller(map[string]string{"boot0": target}).
+		Copy().(*RawImage)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, ri.GetMetaData(), inst.GetMetaData())
+
+	install := func(file string, df *DataFile) error {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		defer f.Close()
+		info, err := f.Stat()
+		require.NoError(t, err)
+		*df = *imageDataFile(readFile(t, file))
+		df.Name = filepath.Base(file)
+		return inst.Install(f, &info)
+	}
+	files := inst.GetUpdateFiles()
+	require.NoError(t, install(spl, files[0]))
+	require.NoError(t, install(uboot, files[1]))
+
+	expected := make([]byte, 48)
+	copy(expected[16:], "spl")
+	copy(expected[32:], bytes.Repeat([]byte{0xff}, 16))
+	copy(expected[32:], "u-boot")
+	assert.Equal(t, expected, readFile(t, target))
+
+	// the payload must match its size from the header
+	files[0].Size++
+	assert.Error(t, inst.write(bytes.NewReader([]byte("spl")), files[0],
+		&inst.meta.Payloads[0]))
+
+	// the region must fit the target
+	require.NoError(t, ioutil.WriteFile(target, make([]byte, 40), 0644))
+	err = install(uboot, files[1])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds")
+
+	// the end of the region must not overflow
+	err = inst.write(bytes.NewReader([]byte("spl")), files[0],
+		&RawPayload{File: "spl.bin", Target: "boot0", Offset: math.MaxInt64 - 8,
+			MaxSize: 16})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds")
+
+	// unknown target
+	inst.Targets = map[string]string{"boot1": target}
+	assert.Error(t, install(spl, files[0]))
+
+	// without targets the payloads are only consumed
+	inst.Targets = nil
+	assert.NoError(t, install(spl, files[0]))
+}
+
+func readFile(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,270 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/chunk"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RootfsChunkedType is the type of the rootfs updates split into
+	// content-defined chunks.
+	RootfsChunkedType = "rootfs-image-chunked"
+	// ChunkIndexSuffix is appended to the name of the image to get the name
+	// of the data file holding the chunk index.
+	ChunkIndexSuffix = ".caidx"
+	// ChunkStoreSuffix is appended to the name of the image to get the name
+	// of the data file holding the data of the chunks.
+	ChunkStoreSuffix = ".castr"
+)
+
+// ChunkSource is the installed image the chunks not included in the update
+// are read from.
+type ChunkSource interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// RootfsChunked handles updates of type 'rootfs-image-chunked'. The update
+// holds the index of the image chunks followed by the store with the data of
+// the chunks; the chunks available in the base image the update is built
+// against are left out of the store.
+type RootfsChunked struct {
+	index *DataFile
+	store *DataFile
+	idx   *chunk.Index
+
+	// SourceHandler opens the installed image providing the chunks left out
+	// of the store; e.g. the active partition. It is optional if the update
+	// is built without the base image.
+	SourceHandler func() (ChunkSource, error)
+	// InstallHandler installs the image assembled from the chunks; the data
+	// file describes the image. The chunks are only consumed if not set.
+	InstallHandler func(io.Reader, *DataFile) error
+}
+
+// GenerateRootfsChunked splits the image into chunks and stores the index
+// and the chunk store in dir. The chunks of the base image are left out of
+// the store; base can be empty to store all the chunks.
+func GenerateRootfsChunked(image, base, dir string) (*RootfsChunked, error) {
+	var local *chunk.Local
+	if base != "" {
+		b, err := os.Open(base)
+		if err != nil {
+			return nil, errors.Wrapf(err, "update: can not open image: %s", base)
+		}
+		defer b.Close()
+		if local, err = chunk.Scan(b, chunk.DefaultParams); err != nil {
+			return nil, err
+		}
+	}
+
+	img, err := os.Open(image)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open image: %s", image)
+	}
+	defer img.Close()
+
+	name := filepath.Join(dir, filepath.Base(image))
+	store, err := os.Create(name + ChunkStoreSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not create chunk store")
+	}
+	defer store.Close()
+	idx, err := chunk.Build(img, local, store, chunk.DefaultParams)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not create chunk index")
+	}
+	if err = ioutil.WriteFile(name+ChunkIndexSuffix, data, 0644); err != nil {
+		return nil, errors.Wrap(err, "update: can not write chunk index")
+	}
+	return &RootfsChunked{
+		index: &DataFile{Name: name + ChunkIndexSuffix},
+		store: &DataFile{Name: name + ChunkStoreSuffix},
+		idx:   idx,
+	}, nil
+}
+
+// NewRootfsChunkedInstaller is used by the artifact reader to read and
+// install rootfs-image-chunked update type.
+func NewRootfsChunkedInstaller() *RootfsChunked {
+	return &RootfsChunked{
+		index: new(DataFile),
+		store: new(DataFile),
+	}
+}
+
+// Copy creates a new instance of RootfsChunked handler from the existing
+// one.
+func (rc *RootfsChunked) Copy() Installer {
+	return &RootfsChunked{
+		index:          new(DataFile),
+		store:          new(DataFile),
+		SourceHandler:  rc.SourceHandler,
+		InstallHandler: rc.InstallHandler,
+	}
+}
+
+// GetIndex returns the chunk index; it is available once the index data
+// file is read.
+func (rc *RootfsChunked) GetIndex() *chunk.Index {
+	return rc.idx
+}
+
+func (rc *RootfsChunked) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		if len(files.FileList) != 2 ||
+			!strings.HasSuffix(files.FileList[0], ChunkIndexSuffix) ||
+			!strings.HasSuffix(files.FileList[1], ChunkStoreSuffix) {
+			return errors.New("update: chunked update must contain " +
+				"the chunk index and the chunk store")
+		}
+		rc.index.Name = files.FileList[0]
+		rc.store.Name = files.FileList[1]
+	case filepath.Base(path) == "type-info",
+		filepath.Base(path) == "meta-data":
+		// we don't need any information from type-info and meta-data
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+func (rc *RootfsChunked) Install(r io.Reader, info *os.FileInfo) error {
+	switch name := (*info).Name(); {
+	case strings.HasSuffix(name, ChunkIndexSuffix):
+		idx := new(chunk.Index)
+		if err := json.NewDecoder(r).Decode(idx); err != nil {
+			return errors.Wrap(err, "update: can not parse chunk index")
+		}
+		if err := idx.Validate(); err != nil {
+			return err
+		}
+		rc.idx = idx
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	case rc.idx == nil:
+		return errors.New("update: chunk store precedes the chunk index")
+	case rc.InstallHandler == nil:
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	var local *chunk.Local
+	if rc.SourceHandler != nil {
+		src, err := rc.SourceHandler()
+		if err != nil {
+			return errors.Wrap(err, "update: can not open chunk source")
+		}
+		defer src.Close()
+		if local, err = chunk.Scan(src, rc.idx.Params); err != nil {
+			return err
+		}
+	}
+
+	image := &DataFile{
+		Name:     strings.TrimSuffix(rc.store.Name, ChunkStoreSuffix),
+		Size:     rc.idx.Size,
+		Date:     (*info).ModTime(),
+		Checksum: []byte(rc.idx.Checksum),
+	}
+
+	// the image is passed to the install handler while being assembled
+	pr, pw := io.Pipe()
+	assembled := make(chan error, 1)
+	go func() {
+		err := chunk.Assemble(rc.idx, r, local, pw)
+		pw.CloseWithError(err)
+		assembled <- err
+	}()
+
+	var err error
+	herr := rc.InstallHandler(pr, image)
+	if herr == nil {
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(errors.New("update: installing chunked image failed"))
+	aerr := <-assembled
+	// assembling fails as well once the install handler stops reading, so
+	// the error of the handler is the cause
+	if herr != nil {
+		return errors.Wrap(herr, "update: can not install chunked image")
+	}
+	if aerr != nil {
+		return errors.Wrap(aerr, "update: can not assemble image")
+	}
+	if err != nil {
+		return errors.Wrap(err, "update: can not install chunked image")
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (rc *RootfsChunked) GetUpdateFiles() [](*DataFile) {
+	return [](*DataFile){rc.index, rc.store}
+}
+
+func (rc *RootfsChunked) GetType() string {
+	return RootfsChunkedType
+}
+
+func (rc *RootfsChunked) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	files := []string{
+		filepath.Base(rc.index.Name),
+		filepath.Base(rc.store.Name),
+	}
+	if err := writeFiles(tw, files, path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: RootfsChunkedType}, path); err != nil {
+		return err
+	}
+
+	// the file needs to be a part of artifact even if this one is empty
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(nil, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (rc *RootfsChunked) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, rc.GetUpdateFiles(), no)
+}
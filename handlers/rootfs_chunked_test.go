@@ -0,0 +1,128 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootfsChunked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunked")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(base)
+	image := append([]byte(nil), base[:1024*1024]...)
+	image = append(image, bytes.Repeat([]byte("new data"), 1024)...)
+	image = append(image, base[1024*1024:]...)
+
+	baseFile := filepath.Join(dir, "base.ext4")
+	imageFile := filepath.Join(dir, "rootfs.ext4")
+	require.NoError(t, ioutil.WriteFile(baseFile, base, 0644))
+	require.NoError(t, ioutil.WriteFile(imageFile, image, 0644))
+
+	out := filepath.Join(dir, "out")
+	require.NoError(t, os.Mkdir(out, 0755))
+	c, err := GenerateRootfsChunked(imageFile, baseFile, out)
+	require.NoError(t, err)
+	assert.Equal(t, RootfsChunkedType, c.GetType())
+	assert.Equal(t, int64(len(image)), c.GetIndex().Size)
+
+	// most of the chunks are left out of the store
+	storeFile := filepath.Join(out, "rootfs.ext4"+ChunkStoreSuffix)
+	store, err := os.Stat(storeFile)
+	require.NoError(t, err)
+	assert.True(t, store.Size() < int64(len(image)/4), "store size: %d", store.Size())
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, c.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	inst := NewRootfsChunkedInstaller()
+	tr := tar.NewReader(buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+		names = append(names, filepath.Base(hdr.Name))
+	}
+	assert.Equal(t, []string{"files", "type-info", "meta-data"}, names)
+	assert.Equal(t, "rootfs.ext4"+ChunkStoreSuffix, inst.GetUpdateFiles()[1].Name)
+
+	install := func(file string) error {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		defer f.Close()
+		info, err := f.Stat()
+		require.NoError(t, err)
+		return inst.Install(f, &info)
+	}
+
+	// the store can not be used without the index
+	assert.Error(t, install(storeFile))
+	require.NoError(t, install(filepath.Join(out, "rootfs.ext4"+ChunkIndexSuffix)))
+	assert.Equal(t, c.GetIndex(), inst.GetIndex())
+
+	// without the install handler the store is only consumed
+	assert.NoError(t, install(storeFile))
+
+	var installed []byte
+	var df *DataFile
+	inst.InstallHandler = func(r io.Reader, f *DataFile) error {
+		df = f
+		installed, err = ioutil.ReadAll(r)
+		return err
+	}
+	// the chunks of the base image are needed
+	assert.Error(t, install(storeFile))
+
+	inst.SourceHandler = func() (ChunkSource, error) {
+		return os.Open(baseFile)
+	}
+	require.NoError(t, install(storeFile))
+	assert.Equal(t, image, installed)
+
+	// the error of the install handler is not masked by the assembling
+	handler := inst.InstallHandler
+	inst.InstallHandler = func(r io.Reader, f *DataFile) error {
+		return errors.New("no space left")
+	}
+	err = install(storeFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "update: can not install chunked image: no space left")
+	inst.InstallHandler = handler
+
+	require.NoError(t, install(storeFile))
+	assert.Equal(t, image, installed)
+	assert.Equal(t, "rootfs.ext4", df.Name)
+	assert.Equal(t, int64(len(image)), df.Size)
+}
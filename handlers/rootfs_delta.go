@@ -0,0 +1,311 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/delta"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RootfsDeltaType is the type of the binary delta rootfs updates.
+	RootfsDeltaType = "rootfs-image-delta"
+	// RootfsImageChecksum is the key of the artifact dependency holding
+	// the checksum of the rootfs image the delta must be applied to.
+	RootfsImageChecksum = "rootfs_image_checksum"
+	// DeltaSuffix is appended to the name of the new image to get the name
+	// of the data file holding the delta.
+	DeltaSuffix = ".delta"
+)
+
+// RootfsDeltaMetaData is the content of the meta-data file of the
+// rootfs-image-delta update; it describes the image produced by applying
+// the delta.
+type RootfsDeltaMetaData struct {
+	TargetChecksum string `json:"target_checksum"`
+	TargetSize     int64  `json:"target_size"`
+}
+
+// RootfsDelta handles updates of type 'rootfs-image-delta'. The update
+// holds the binary delta transforming the installed rootfs image into the
+// new one.
+type RootfsDelta struct {
+	delta          *DataFile
+	sourceChecksum string
+	target         RootfsDeltaMetaData
+
+	// SourceHandler opens the installed rootfs image the delta is applied
+	// to; e.g. the active partition. The image is read as a stream.
+	SourceHandler func() (io.ReadCloser, error)
+	// InstallHandler installs the new rootfs image produced by applying the
+	// delta; the data file describes the new image. The delta is only
+	// verified if either of the handlers is not set.
+	InstallHandler func(io.Reader, *DataFile) error
+}
+
+// NewRootfsDelta creates the update holding the delta applicable to the
+// rootfs image with the given checksum.
+func NewRootfsDelta(deltaFile, sourceChecksum string,
+	target RootfsDeltaMetaData) *RootfsDelta {
+	return &RootfsDelta{
+		delta:          &DataFile{Name: deltaFile},
+		sourceChecksum: sourceChecksum,
+		target:         target,
+	}
+}
+
+// GenerateRootfsDelta stores the delta transforming the source image into
+// the target one in deltaFile and creates the update holding it. The name
+// of the delta file must be the name of the target image with DeltaSuffix
+// appended.
+func GenerateRootfsDelta(source, target, deltaFile string) (*RootfsDelta, error) {
+	srcSum, _, err := fileChecksum(source)
+	if err != nil {
+		return nil, err
+	}
+	targetSum, targetSize, err := fileChecksum(target)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open image: %s", source)
+	}
+	defer src.Close()
+	tgt, err := os.Open(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open image: %s", target)
+	}
+	defer tgt.Close()
+	out, err := os.Create(deltaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not create delta file")
+	}
+	defer out.Close()
+
+	if err = delta.Diff(src, tgt, out, delta.DefaultBlockSize); err != nil {
+		return nil, err
+	}
+	return NewRootfsDelta(deltaFile, srcSum, RootfsDeltaMetaData{
+		TargetChecksum: targetSum,
+		TargetSize:     targetSize,
+	}), nil
+}
+
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "update: can not open image: %s", path)
+	}
+	defer f.Close()
+	ch := artifact.NewWriterChecksum(ioutil.Discard)
+	size, err := io.Copy(ch, f)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "update: can not read image: %s", path)
+	}
+	return string(ch.Checksum()), size, nil
+}
+
+// NewRootfsDeltaInstaller is used by the artifact reader to read and
+// install rootfs-image-delta update type.
+func NewRootfsDeltaInstaller() *RootfsDelta {
+	return &RootfsDelta{
+		delta: new(DataFile),
+	}
+}
+
+// Copy creates a new instance of RootfsDelta handler from the existing one.
+func (rd *RootfsDelta) Copy() Installer {
+	return &RootfsDelta{
+		delta:          new(DataFile),
+		SourceHandler:  rd.SourceHandler,
+		InstallHandler: rd.InstallHandler,
+	}
+}
+
+// GetSourceChecksum returns the checksum of the rootfs image the delta
+// must be applied to.
+func (rd *RootfsDelta) GetSourceChecksum() string {
+	return rd.sourceChecksum
+}
+
+// GetTarget returns the description of the image produced by applying the
+// delta.
+func (rd *RootfsDelta) GetTarget() RootfsDeltaMetaData {
+	return rd.target
+}
+
+func (rd *RootfsDelta) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		if len(files.FileList) != 1 {
+			return errors.New("update: delta update must contain a single file")
+		}
+		rd.delta.Name = files.FileList[0]
+	case filepath.Base(path) == "type-info":
+		tInfo := new(artifact.TypeInfo)
+		if err := json.NewDecoder(r).Decode(tInfo); err != nil {
+			return errors.Wrap(err, "update: can not parse type-info")
+		}
+		sum, ok := tInfo.ArtifactDepends[RootfsImageChecksum].(string)
+		if !ok || sum == "" {
+			return errors.New("update: delta update must depend on " +
+				RootfsImageChecksum)
+		}
+		rd.sourceChecksum = sum
+	case filepath.Base(path) == "meta-data":
+		if err := json.NewDecoder(r).Decode(&rd.target); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		if rd.target.TargetChecksum == "" {
+			return errors.New("update: missing checksum of the delta target")
+		}
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+func (rd *RootfsDelta) Install(r io.Reader, info *os.FileInfo) error {
+	if rd.SourceHandler == nil || rd.InstallHandler == nil {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	src, err := rd.SourceHandler()
+	if err != nil {
+		return errors.Wrap(err, "update: can not open delta source")
+	}
+	defer src.Close()
+
+	// the source may be followed by unused space of the partition, so only
+	// the size of the source image stored in the delta header is verified
+	var hdrBuf bytes.Buffer
+	hdr, err := delta.ReadHeader(io.TeeReader(r, &hdrBuf))
+	if err != nil {
+		return err
+	}
+	if hdr.SourceSize > math.MaxInt64 {
+		return errors.Errorf("update: invalid delta source size: %d",
+			hdr.SourceSize)
+	}
+	srcCh := artifact.NewReaderChecksum(
+		io.LimitReader(src, int64(hdr.SourceSize)), []byte(rd.sourceChecksum))
+
+	target := &DataFile{
+		Name:     strings.TrimSuffix(rd.delta.Name, DeltaSuffix),
+		Size:     rd.target.TargetSize,
+		Date:     (*info).ModTime(),
+		Checksum: []byte(rd.target.TargetChecksum),
+	}
+
+	// the new image is passed to the install handler while being patched
+	pr, pw := io.Pipe()
+	patched := make(chan error, 1)
+	go func() {
+		err := delta.Patch(srcCh, io.MultiReader(&hdrBuf, r), pw)
+		pw.CloseWithError(err)
+		patched <- err
+	}()
+
+	ch := artifact.NewReaderChecksum(pr, target.Checksum)
+	herr := rd.InstallHandler(ch, target)
+	if herr == nil {
+		_, err = io.Copy(ioutil.Discard, ch)
+	}
+	pr.CloseWithError(errors.New("update: installing delta target failed"))
+	perr := <-patched
+	// patching fails as well once the install handler stops reading, so
+	// the error of the handler is the cause
+	if herr != nil {
+		return errors.Wrap(herr, "update: can not install delta target")
+	}
+	if perr != nil {
+		return errors.Wrap(perr, "update: can not apply delta")
+	}
+	if err != nil {
+		return errors.Wrap(err, "update: can not install delta target")
+	}
+	if err = ch.Verify(); err != nil {
+		return errors.Wrap(err, "update: invalid delta target")
+	}
+
+	// the rest of the source image is read to verify it is the expected one
+	if _, err = io.Copy(ioutil.Discard, srcCh); err != nil {
+		return errors.Wrap(err, "update: invalid delta source")
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (rd *RootfsDelta) GetUpdateFiles() [](*DataFile) {
+	return [](*DataFile){rd.delta}
+}
+
+func (rd *RootfsDelta) GetType() string {
+	return RootfsDeltaType
+}
+
+func (rd *RootfsDelta) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	if err := writeFiles(tw, []string{filepath.Base(rd.delta.Name)},
+		path); err != nil {
+		return err
+	}
+
+	tInfo := &artifact.TypeInfo{
+		Type: RootfsDeltaType,
+		ArtifactDepends: map[string]interface{}{
+			RootfsImageChecksum: rd.sourceChecksum,
+		},
+	}
+	if err := writeTypeInfo(tw, tInfo, path); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(&rd.target)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create meta-data")
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (rd *RootfsDelta) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, rd.GetUpdateFiles(), no)
+}
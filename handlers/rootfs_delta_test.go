@@ -0,0 +1,134 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootfsDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := make([]byte, 16*VerityBlockSize)
+	rand.New(rand.NewSource(1)).Read(source)
+	target := append([]byte(nil), source[:10*VerityBlockSize]...)
+	target = append(target, []byte("changed data")...)
+	target = append(target, source[11*VerityBlockSize:]...)
+
+	sourceFile := filepath.Join(dir, "source.ext4")
+	targetFile := filepath.Join(dir, "rootfs.ext4")
+	deltaFile := filepath.Join(dir, "rootfs.ext4"+DeltaSuffix)
+	require.NoError(t, ioutil.WriteFile(sourceFile, source, 0644))
+	require.NoError(t, ioutil.WriteFile(targetFile, target, 0644))
+
+	d, err := GenerateRootfsDelta(sourceFile, targetFile, deltaFile)
+	require.NoError(t, err)
+	assert.Equal(t, RootfsDeltaType, d.GetType())
+	assert.Equal(t, int64(len(target)), d.GetTarget().TargetSize)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, d.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	inst := NewRootfsDeltaInstaller().Copy().(*RootfsDelta)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, d.GetSourceChecksum(), inst.GetSourceChecksum())
+	assert.Equal(t, d.GetTarget(), inst.GetTarget())
+	assert.Equal(t, "rootfs.ext4"+DeltaSuffix, inst.GetUpdateFiles()[0].Name)
+
+	install := func(src string) ([]byte, *DataFile, error) {
+		f, err := os.Open(deltaFile)
+		require.NoError(t, err)
+		defer f.Close()
+		info, err := f.Stat()
+		require.NoError(t, err)
+
+		out := bytes.NewBuffer(nil)
+		var df *DataFile
+		inst.SourceHandler = func() (io.ReadCloser, error) {
+			return os.Open(src)
+		}
+		inst.InstallHandler = func(r io.Reader, f *DataFile) error {
+			df = f
+			_, err := io.Copy(out, r)
+			return err
+		}
+		err = inst.Install(f, &info)
+		return out.Bytes(), df, err
+	}
+
+	out, df, err := install(sourceFile)
+	assert.NoError(t, err)
+	assert.Equal(t, target, out)
+	assert.Equal(t, "rootfs.ext4", df.Name)
+	assert.Equal(t, int64(len(target)), df.Size)
+
+	// the partition holding the source can be larger than the image
+	partFile := filepath.Join(dir, "part.ext4")
+	part := append(append([]byte(nil), source...), make([]byte, 4*VerityBlockSize)...)
+	require.NoError(t, ioutil.WriteFile(partFile, part, 0644))
+	out, _, err = install(partFile)
+	assert.NoError(t, err)
+	assert.Equal(t, target, out)
+
+	// the error of the install handler is not masked by the patching
+	f, err := os.Open(deltaFile)
+	require.NoError(t, err)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	inst.SourceHandler = func() (io.ReadCloser, error) {
+		return os.Open(sourceFile)
+	}
+	inst.InstallHandler = func(r io.Reader, f *DataFile) error {
+		return errors.New("no space left")
+	}
+	err = inst.Install(f, &info)
+	f.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "update: can not install delta target: no space left")
+
+	// the delta can not be applied to other image
+	_, _, err = install(targetFile)
+	assert.Error(t, err)
+
+	// without handlers the delta is only consumed
+	inst.SourceHandler, inst.InstallHandler = nil, nil
+	f, err = os.Open(deltaFile)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, inst.Install(f, nil))
+}
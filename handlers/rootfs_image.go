@@ -17,7 +17,7 @@ package handlers
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
@@ -27,49 +27,95 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Rootfs handles updates of type 'rootfs-image'.
+// Rootfs handles updates of type 'rootfs-image'. The first data file is
+// the rootfs image; the update can hold further images, e.g. the kernel.
 type Rootfs struct {
 	version int
-	update  *DataFile
+	files   []*DataFile
+	// hashTree is the optional dm-verity hash tree of the update
+	hashTree *DataFile
+	verity   *Verity
 
+	// InstallHandler is called for each image with its data file.
 	InstallHandler func(io.Reader, *DataFile) error
+	// VerityInstallHandler installs the dm-verity hash tree; the hash tree
+	// is only verified and skipped if not set.
+	VerityInstallHandler func(io.Reader, *DataFile) error
+
+	// Optional hooks called for each data file; see Preparer, Finalizer
+	// and Aborter.
+	PrepareHandler  func(*DataFile) error
+	FinalizeHandler func(*DataFile) error
+	AbortHandler    func(*DataFile, error) error
 }
 
-func NewRootfsV1(updFile string) *Rootfs {
-	uf := &DataFile{
-		Name: updFile,
-	}
-	return &Rootfs{
-		update:  uf,
-		version: 1,
-	}
+// RootfsMetaData is the content of the meta-data file of the rootfs-image
+// update.
+type RootfsMetaData struct {
+	Verity *Verity `json:"dm_verity,omitempty"`
 }
 
-func NewRootfsV2(updFile string) *Rootfs {
-	uf := &DataFile{
-		Name: updFile,
+func newRootfs(version int, updFile string, files []string) *Rootfs {
+	rfs := &Rootfs{
+		files:   []*DataFile{{Name: updFile}},
+		version: version,
 	}
-	return &Rootfs{
-		update:  uf,
-		version: 2,
+	for _, f := range files {
+		rfs.files = append(rfs.files, &DataFile{Name: f})
 	}
+	return rfs
+}
+
+// NewRootfsV1 creates the update holding the rootfs image followed by the
+// optional further images.
+func NewRootfsV1(updFile string, files ...string) *Rootfs {
+	return newRootfs(1, updFile, files)
+}
+
+// NewRootfsV2 creates the update holding the rootfs image followed by the
+// optional further images.
+func NewRootfsV2(updFile string, files ...string) *Rootfs {
+	return newRootfs(2, updFile, files)
 }
 
 // NewRootfsInstaller is used by the artifact reader to read and install
 // rootfs-image update type.
 func NewRootfsInstaller() *Rootfs {
 	return &Rootfs{
-		update: new(DataFile),
+		files: []*DataFile{new(DataFile)},
 	}
 }
 
 // Copy creates a new instance of Rootfs handler from the existing one.
 func (rp *Rootfs) Copy() Installer {
 	return &Rootfs{
-		version:        rp.version,
-		update:         new(DataFile),
-		InstallHandler: rp.InstallHandler,
+		version:              rp.version,
+		files:                []*DataFile{new(DataFile)},
+		InstallHandler:       rp.InstallHandler,
+		VerityInstallHandler: rp.VerityInstallHandler,
+		PrepareHandler:       rp.PrepareHandler,
+		FinalizeHandler:      rp.FinalizeHandler,
+		AbortHandler:         rp.AbortHandler,
+	}
+}
+
+// SetVerity adds the dm-verity hash tree generated by GenerateVerity to the
+// update. The name of the hash file must be the name of the image with
+// VeritySuffix appended.
+func (rfs *Rootfs) SetVerity(hashFile string, v *Verity) error {
+	if filepath.Base(hashFile) != filepath.Base(rfs.files[0].Name)+VeritySuffix {
+		return errors.Errorf("update: invalid dm-verity hash file name: %s", hashFile)
 	}
+	v.HashFile = filepath.Base(hashFile)
+	rfs.hashTree = &DataFile{Name: hashFile}
+	rfs.verity = v
+	return nil
+}
+
+// GetVerity returns the parameters of the dm-verity hash tree of the update
+// or nil if there is none.
+func (rfs *Rootfs) GetVerity() *Verity {
+	return rfs.verity
 }
 
 func (rp *Rootfs) ReadHeader(r io.Reader, path string) error {
@@ -80,9 +126,15 @@ func (rp *Rootfs) ReadHeader(r io.Reader, path string) error {
 		if err != nil {
 			return err
 		}
-		rp.update.Name = files.FileList[0]
+		// the hash tree is told from the images once meta-data is read
+		rp.files = nil
+		rp.hashTree = nil
+		for _, f := range files.FileList {
+			rp.files = append(rp.files, &DataFile{Name: f})
+		}
+	case filepath.Base(path) == "meta-data":
+		return rp.readMetaData(r)
 	case filepath.Base(path) == "type-info",
-		filepath.Base(path) == "meta-data",
 		match(artifact.HeaderDirectory+"/*/signatures/*", path),
 		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
 		// TODO: implement when needed
@@ -91,24 +143,112 @@ func (rp *Rootfs) ReadHeader(r io.Reader, path string) error {
 		if _, err := io.Copy(buf, r); err != nil {
 			return errors.Wrap(err, "update: error reading checksum")
 		}
-		rp.update.Checksum = buf.Bytes()
+		df := rp.getFile(stripSum(path))
+		if df == nil {
+			return errors.Errorf("update: can not find data file: %v", stripSum(path))
+		}
+		df.Checksum = buf.Bytes()
 	default:
 		return errors.Errorf("update: unsupported file: %v", path)
 	}
 	return nil
 }
 
+func (rp *Rootfs) readMetaData(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "update: error reading meta-data")
+	}
+	md := new(RootfsMetaData)
+	if len(data) != 0 {
+		if err = json.Unmarshal(data, md); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+	}
+	if md.Verity == nil {
+		return nil
+	}
+	if err = md.Verity.Validate(); err != nil {
+		return err
+	}
+	// the hash tree is never the rootfs image itself
+	for i, f := range rp.files {
+		if i > 0 && f.Name == md.Verity.HashFile {
+			rp.hashTree = f
+			rp.files = append(rp.files[:i], rp.files[i+1:]...)
+			rp.verity = md.Verity
+			return nil
+		}
+	}
+	return errors.Errorf("update: missing dm-verity hash file: %s",
+		md.Verity.HashFile)
+}
+
+func (rfs *Rootfs) getFile(name string) *DataFile {
+	for _, f := range rfs.files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
 func (rfs *Rootfs) Install(r io.Reader, info *os.FileInfo) error {
-	if rfs.InstallHandler != nil {
-		if err := rfs.InstallHandler(r, rfs.update); err != nil {
-			return errors.Wrap(err, "update: can not install")
+	if rfs.hashTree != nil && (*info).Name() == rfs.hashTree.Name {
+		if rfs.VerityInstallHandler == nil {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
 		}
+		if err := rfs.VerityInstallHandler(r, rfs.hashTree); err != nil {
+			return errors.Wrap(err, "update: can not install dm-verity hash tree")
+		}
+		return nil
+	}
+	if rfs.InstallHandler == nil {
+		return nil
+	}
+	df := rfs.files[0]
+	if len(rfs.files) > 1 {
+		if df = rfs.getFile((*info).Name()); df == nil {
+			return errors.Errorf("update: unknown data file: %s", (*info).Name())
+		}
+	}
+	if err := rfs.InstallHandler(r, df); err != nil {
+		return errors.Wrap(err, "update: can not install")
+	}
+	return nil
+}
+
+// Prepare implements Preparer.
+func (rfs *Rootfs) Prepare(df *DataFile) error {
+	if rfs.PrepareHandler != nil {
+		return rfs.PrepareHandler(df)
+	}
+	return nil
+}
+
+// Finalize implements Finalizer.
+func (rfs *Rootfs) Finalize(df *DataFile) error {
+	if rfs.FinalizeHandler != nil {
+		return rfs.FinalizeHandler(df)
+	}
+	return nil
+}
+
+// Abort implements Aborter.
+func (rfs *Rootfs) Abort(df *DataFile, cause error) error {
+	if rfs.AbortHandler != nil {
+		return rfs.AbortHandler(df, cause)
 	}
 	return nil
 }
 
 func (rfs *Rootfs) GetUpdateFiles() [](*DataFile) {
-	return [](*DataFile){rfs.update}
+	files := append([](*DataFile){}, rfs.files...)
+	if rfs.hashTree != nil {
+		files = append(files, rfs.hashTree)
+	}
+	return files
 }
 
 func (rfs *Rootfs) GetType() string {
@@ -119,27 +259,47 @@ func (rfs *Rootfs) ComposeHeader(tw *tar.Writer, no int) error {
 
 	path := artifact.UpdateHeaderPath(no)
 
+	if rfs.version == 1 && rfs.hashTree != nil {
+		return errors.New("update: dm-verity is not supported by version 1 artifacts")
+	}
+
 	// first store files
-	if err := writeFiles(tw, []string{filepath.Base(rfs.update.Name)},
-		path); err != nil {
+	var names []string
+	stored := make(map[string]bool)
+	for _, f := range rfs.GetUpdateFiles() {
+		name := filepath.Base(f.Name)
+		if stored[name] {
+			return errors.Errorf("update: duplicate data file name: %s", name)
+		}
+		stored[name] = true
+		names = append(names, name)
+	}
+	if err := writeFiles(tw, names, path); err != nil {
 		return err
 	}
 
 	// store type-info
-	if err := writeTypeInfo(tw, "rootfs-image", path); err != nil {
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: "rootfs-image"}, path); err != nil {
 		return err
 	}
 
-	// store empty meta-data
+	// store meta-data
 	// the file needs to be a part of artifact even if this one is empty
+	var md []byte
+	if rfs.verity != nil {
+		var err error
+		if md, err = json.Marshal(&RootfsMetaData{Verity: rfs.verity}); err != nil {
+			return errors.Wrap(err, "update: can not create meta-data")
+		}
+	}
 	sw := artifact.NewTarWriterStream(tw)
-	if err := sw.Write(nil, filepath.Join(path, "meta-data")); err != nil {
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
 		return errors.Wrap(err, "update: can not store meta-data")
 	}
 
 	if rfs.version == 1 {
 		// store checksums
-		if err := writeChecksums(tw, [](*DataFile){rfs.update},
+		if err := writeChecksums(tw, rfs.files,
 			filepath.Join(path, "checksums")); err != nil {
 			return err
 		}
@@ -148,44 +308,5 @@ func (rfs *Rootfs) ComposeHeader(tw *tar.Writer, no int) error {
 }
 
 func (rfs *Rootfs) ComposeData(tw *tar.Writer, no int) error {
-	f, ferr := ioutil.TempFile("", "data")
-	if ferr != nil {
-		return errors.New("update: can not create temporary data file")
-	}
-	defer os.Remove(f.Name())
-
-	err := func() error {
-		gz := gzip.NewWriter(f)
-		defer gz.Close()
-
-		tarw := tar.NewWriter(gz)
-		defer tarw.Close()
-
-		df, err := os.Open(rfs.update.Name)
-		if err != nil {
-			return errors.Wrapf(err, "update: can not open data file: %v", rfs.update)
-		}
-		defer df.Close()
-
-		fw := artifact.NewTarWriterFile(tarw)
-		if err := fw.Write(df, filepath.Base(rfs.update.Name)); err != nil {
-			return errors.Wrapf(err,
-				"update: can not write tar temp data header: %v", rfs.update)
-		}
-		return nil
-	}()
-
-	if err != nil {
-		return err
-	}
-
-	if _, err = f.Seek(0, 0); err != nil {
-		return errors.Wrapf(err, "update: can not read data file: %v", rfs.update)
-	}
-
-	dfw := artifact.NewTarWriterFile(tw)
-	if err = dfw.Write(f, artifact.UpdateDataPath(no)); err != nil {
-		return errors.Wrapf(err, "update: can not write tar data header: %v", rfs.update)
-	}
-	return nil
+	return composeData(tw, rfs.GetUpdateFiles(), no)
 }
@@ -20,10 +20,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHandlerRootfs(t *testing.T) {
@@ -32,7 +34,7 @@ func TestHandlerRootfs(t *testing.T) {
 	assert.Equal(t, "rootfs-image", r.GetType())
 
 	// test get update files
-	r.update = &DataFile{Name: "update.ext4"}
+	r.files = []*DataFile{{Name: "update.ext4"}}
 	assert.Equal(t, "update.ext4", r.GetUpdateFiles()[0].Name)
 	assert.Equal(t, 1, r.version)
 
@@ -40,7 +42,7 @@ func TestHandlerRootfs(t *testing.T) {
 	assert.Equal(t, "rootfs-image", r.GetType())
 
 	// test get update files
-	r.update = &DataFile{Name: "update_next.ext4"}
+	r.files = []*DataFile{{Name: "update_next.ext4"}}
 	assert.Equal(t, "update_next.ext4", r.GetUpdateFiles()[0].Name)
 	assert.Equal(t, 2, r.version)
 
@@ -116,7 +118,7 @@ func TestRootfsReadHeader(t *testing.T) {
 		_, err = tr.Next()
 		assert.NoError(t, err)
 
-		err = r.ReadHeader(buf, test.name)
+		err = r.ReadHeader(tr, test.name)
 		if test.shouldErr {
 			assert.Error(t, err)
 			if test.errMsg != "" {
@@ -145,3 +147,79 @@ func TestRootfsReadData(t *testing.T) {
 	assert.Equal(t, "some data", data.String())
 
 }
+
+func TestRootfsMultipleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "rootfs.ext4")
+	require.NoError(t, ioutil.WriteFile(image, make([]byte, 2*VerityBlockSize), 0644))
+	kernel := filepath.Join(dir, "zImage")
+	require.NoError(t, ioutil.WriteFile(kernel, []byte("kernel"), 0644))
+	v, err := GenerateVerity(image, image+VeritySuffix)
+	require.NoError(t, err)
+
+	r := NewRootfsV2(image, kernel)
+	require.NoError(t, r.SetVerity(image+VeritySuffix, v))
+	files := r.GetUpdateFiles()
+	require.Len(t, files, 3)
+	assert.Equal(t, []string{image, kernel, image + VeritySuffix},
+		[]string{files[0].Name, files[1].Name, files[2].Name})
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, r.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	installed := make(map[string]string)
+	inst := NewRootfsInstaller()
+	inst.InstallHandler = func(r io.Reader, df *DataFile) error {
+		data, err := ioutil.ReadAll(r)
+		installed[df.Name] = string(data[:6])
+		return err
+	}
+	inst = inst.Copy().(*Rootfs)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, v, inst.GetVerity())
+	files = inst.GetUpdateFiles()
+	require.Len(t, files, 3)
+	assert.Equal(t, []string{"rootfs.ext4", "zImage", "rootfs.ext4.verity"},
+		[]string{files[0].Name, files[1].Name, files[2].Name})
+
+	for _, name := range []string{image, kernel, image + VeritySuffix} {
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		info, err := f.Stat()
+		require.NoError(t, err)
+		require.NoError(t, inst.Install(f, &info))
+		f.Close()
+	}
+	// the hash tree is not passed to the install handler
+	assert.Equal(t, map[string]string{
+		"rootfs.ext4": string(make([]byte, 6)),
+		"zImage":      "kernel",
+	}, installed)
+
+	// the images are not dropped without dm-verity
+	inst = NewRootfsInstaller()
+	require.NoError(t, inst.ReadHeader(
+		bytes.NewBufferString(`{"files": ["rootfs.ext4", "zImage"]}`),
+		"headers/0000/files"))
+	require.NoError(t, inst.ReadHeader(bytes.NewBufferString(""),
+		"headers/0000/meta-data"))
+	assert.Len(t, inst.GetUpdateFiles(), 2)
+	assert.Nil(t, inst.GetVerity())
+
+	// the data file names must be unique
+	r = NewRootfsV2(image, filepath.Join(dir, "other", "rootfs.ext4"))
+	assert.Error(t, r.ComposeHeader(tar.NewWriter(ioutil.Discard), 0))
+}
@@ -0,0 +1,323 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// SingleFileType is the type of the updates replacing a single file.
+const SingleFileType = "single-file"
+
+// SingleFileMetaData is the content of the meta-data file of the
+// single-file update.
+type SingleFileMetaData struct {
+	// Path is the absolute destination path of the file.
+	Path string `json:"dest_path"`
+	// Mode holds the octal permission bits; e.g. "0644".
+	Mode string `json:"mode"`
+	// Owner and Group are either names or numeric ids; the ownership is not
+	// changed if empty.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+	// PreviousChecksum is the checksum of the file the update replaces; the
+	// update is installed regardless of the existing file if empty.
+	PreviousChecksum string `json:"previous_checksum,omitempty"`
+}
+
+// Validate checks if the destination path and the mode are valid.
+func (m *SingleFileMetaData) Validate() error {
+	if !filepath.IsAbs(m.Path) || filepath.Clean(m.Path) != m.Path ||
+		m.Path == "/" {
+		return errors.Errorf("update: invalid destination path: %q", m.Path)
+	}
+	if _, err := m.fileMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *SingleFileMetaData) fileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(m.Mode, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, errors.Errorf("update: invalid file mode: %q", m.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// SingleFile handles updates of type 'single-file'. The installer writes the
+// file next to its destination and atomically replaces the destination once
+// the checksum of the file is verified; see Finalize.
+type SingleFile struct {
+	update *DataFile
+	meta   SingleFileMetaData
+	tmp    string
+
+	// Root is the directory the destination path is relative to. The file
+	// is only consumed if not set.
+	Root string
+}
+
+// NewSingleFile creates the update replacing the file at the destination
+// given by the meta-data.
+func NewSingleFile(file string, meta SingleFileMetaData) (*SingleFile, error) {
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+	return &SingleFile{
+		update: &DataFile{Name: file},
+		meta:   meta,
+	}, nil
+}
+
+// NewSingleFileInstaller is used by the artifact reader to read and install
+// single-file update type under the given root directory.
+func NewSingleFileInstaller(root string) *SingleFile {
+	return &SingleFile{
+		update: new(DataFile),
+		Root:   root,
+	}
+}
+
+// Copy creates a new instance of SingleFile handler from the existing one.
+func (sf *SingleFile) Copy() Installer {
+	return NewSingleFileInstaller(sf.Root)
+}
+
+// GetMetaData returns the destination of the file.
+func (sf *SingleFile) GetMetaData() SingleFileMetaData {
+	return sf.meta
+}
+
+func (sf *SingleFile) ReadHeader(r io.Reader, path string) error {
+	switch {
+	case filepath.Base(path) == "files":
+		files, err := parseFiles(r)
+		if err != nil {
+			return err
+		}
+		if len(files.FileList) != 1 {
+			return errors.New("update: single-file update must contain a single file")
+		}
+		sf.update.Name = files.FileList[0]
+	case filepath.Base(path) == "type-info":
+		// we don't need any information from type-info
+	case filepath.Base(path) == "meta-data":
+		if err := json.NewDecoder(r).Decode(&sf.meta); err != nil {
+			return errors.Wrap(err, "update: can not parse meta-data")
+		}
+		return sf.meta.Validate()
+	case match(artifact.HeaderDirectory+"/*/signatures/*", path),
+		match(artifact.HeaderDirectory+"/*/scripts/*/*", path):
+		// TODO: implement when needed
+	default:
+		return errors.Errorf("update: unsupported file: %v", path)
+	}
+	return nil
+}
+
+// Install writes the file to the temporary location next to the
+// destination; the destination is replaced by Finalize.
+func (sf *SingleFile) Install(r io.Reader, info *os.FileInfo) error {
+	if sf.Root == "" {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	if err := sf.meta.Validate(); err != nil {
+		return err
+	}
+	dest := sf.destination()
+	if err := sf.checkPrevious(dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return errors.Wrap(err, "update: can not create destination directory")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest))
+	if err != nil {
+		return errors.Wrap(err, "update: can not create temporary file")
+	}
+	sf.tmp = f.Name()
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "update: can not write: %s", sf.tmp)
+	}
+	mode, _ := sf.meta.fileMode()
+	if err = f.Chmod(mode); err != nil {
+		return errors.Wrapf(err, "update: can not set mode of: %s", dest)
+	}
+	if err = sf.chown(f); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrapf(err, "update: can not sync: %s", sf.tmp)
+	}
+	return nil
+}
+
+// Finalize implements Finalizer; it atomically replaces the destination
+// with the installed file.
+func (sf *SingleFile) Finalize(df *DataFile) error {
+	if sf.tmp == "" {
+		return nil
+	}
+	dest := sf.destination()
+	if err := os.Rename(sf.tmp, dest); err != nil {
+		return errors.Wrapf(err, "update: can not replace: %s", dest)
+	}
+	sf.tmp = ""
+
+	// sync the directory so the rename survives power loss
+	dir, err := os.Open(filepath.Dir(dest))
+	if err != nil {
+		return errors.Wrap(err, "update: can not sync destination directory")
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return errors.Wrap(err, "update: can not sync destination directory")
+	}
+	return nil
+}
+
+// Abort implements Aborter; it removes the temporary file leaving the
+// destination untouched.
+func (sf *SingleFile) Abort(df *DataFile, cause error) error {
+	if sf.tmp == "" {
+		return nil
+	}
+	err := os.Remove(sf.tmp)
+	sf.tmp = ""
+	return err
+}
+
+func (sf *SingleFile) destination() string {
+	return filepath.Join(sf.Root, sf.meta.Path)
+}
+
+func (sf *SingleFile) checkPrevious(dest string) error {
+	if sf.meta.PreviousChecksum == "" {
+		return nil
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		return errors.Wrapf(err, "update: can not open file to replace: %s", dest)
+	}
+	defer f.Close()
+	ch := artifact.NewWriterChecksum(ioutil.Discard)
+	if _, err = io.Copy(ch, f); err != nil {
+		return errors.Wrapf(err, "update: can not read file to replace: %s", dest)
+	}
+	if string(ch.Checksum()) != sf.meta.PreviousChecksum {
+		return errors.Errorf("update: file to replace has changed: %s", dest)
+	}
+	return nil
+}
+
+func (sf *SingleFile) chown(f *os.File) error {
+	if sf.meta.Owner == "" && sf.meta.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if sf.meta.Owner != "" {
+		id, err := lookupID(sf.meta.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "update: unknown owner: %s", sf.meta.Owner)
+		}
+		uid = id
+	}
+	if sf.meta.Group != "" {
+		id, err := lookupID(sf.meta.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "update: unknown group: %s", sf.meta.Group)
+		}
+		gid = id
+	}
+	if err := f.Chown(uid, gid); err != nil {
+		return errors.Wrapf(err, "update: can not change owner of: %s",
+			sf.destination())
+	}
+	return nil
+}
+
+// lookupID returns the numeric id either given as is or resolved by name.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func (sf *SingleFile) GetUpdateFiles() [](*DataFile) {
+	return [](*DataFile){sf.update}
+}
+
+func (sf *SingleFile) GetType() string {
+	return SingleFileType
+}
+
+func (sf *SingleFile) ComposeHeader(tw *tar.Writer, no int) error {
+	path := artifact.UpdateHeaderPath(no)
+
+	if err := writeFiles(tw, []string{filepath.Base(sf.update.Name)},
+		path); err != nil {
+		return err
+	}
+	if err := writeTypeInfo(tw, &artifact.TypeInfo{Type: SingleFileType},
+		path); err != nil {
+		return err
+	}
+
+	md, err := json.Marshal(&sf.meta)
+	if err != nil {
+		return errors.Wrap(err, "update: can not create meta-data")
+	}
+	sw := artifact.NewTarWriterStream(tw)
+	if err := sw.Write(md, filepath.Join(path, "meta-data")); err != nil {
+		return errors.Wrap(err, "update: can not store meta-data")
+	}
+	return nil
+}
+
+func (sf *SingleFile) ComposeData(tw *tar.Writer, no int) error {
+	return composeData(tw, sf.GetUpdateFiles(), no)
+}
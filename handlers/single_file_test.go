@@ -0,0 +1,147 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSingleFileMetaData(t *testing.T) {
+	tc := []struct {
+		meta  SingleFileMetaData
+		valid bool
+	}{
+		{SingleFileMetaData{Path: "/etc/app.conf", Mode: "0644"}, true},
+		{SingleFileMetaData{Path: "/etc/app.conf", Mode: "4755"}, false},
+		{SingleFileMetaData{Path: "/etc/app.conf", Mode: "rw"}, false},
+		{SingleFileMetaData{Path: "etc/app.conf", Mode: "0644"}, false},
+		{SingleFileMetaData{Path: "/etc/../app.conf", Mode: "0644"}, false},
+		{SingleFileMetaData{Path: "/", Mode: "0644"}, false},
+	}
+	for _, test := range tc {
+		err := test.meta.Validate()
+		if test.valid {
+			assert.NoError(t, err, test.meta.Path)
+		} else {
+			assert.Error(t, err, test.meta.Path)
+		}
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "single-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	update := filepath.Join(dir, "app.conf")
+	require.NoError(t, ioutil.WriteFile(update, []byte("new config"), 0600))
+	root := filepath.Join(dir, "root")
+	dest := filepath.Join(root, "etc", "app.conf")
+	require.NoError(t, os.MkdirAll(filepath.Dir(dest), 0755))
+	require.NoError(t, ioutil.WriteFile(dest, []byte("old config"), 0600))
+
+	u, err := user.Current()
+	require.NoError(t, err)
+	meta := SingleFileMetaData{
+		Path:  "/etc/app.conf",
+		Mode:  "0640",
+		Owner: u.Username,
+		Group: u.Gid,
+		// sha256 of "old config"
+		PreviousChecksum: "3f36baccc2b5ec3ebfa814f6844eb808f98427cc7297e58ecbe8df9e3c98d35a",
+	}
+	sf, err := NewSingleFile(update, meta)
+	require.NoError(t, err)
+	assert.Equal(t, SingleFileType, sf.GetType())
+
+	_, err = NewSingleFile(update, SingleFileMetaData{Path: "app.conf"})
+	assert.Error(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, sf.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	inst := NewSingleFileInstaller(root).Copy().(*SingleFile)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.ReadHeader(tr, hdr.Name))
+	}
+	assert.Equal(t, meta, inst.GetMetaData())
+	assert.Equal(t, "app.conf", inst.GetUpdateFiles()[0].Name)
+
+	install := func() error {
+		f, err := os.Open(update)
+		require.NoError(t, err)
+		defer f.Close()
+		info, err := f.Stat()
+		require.NoError(t, err)
+		return inst.Install(f, &info)
+	}
+
+	// the file to replace does not match the previous checksum
+	inst.meta.PreviousChecksum = "6e3d16ea9ec1a4d8e4eac4b2fa97c0ac48fd0c2d1e8a8d4a58cebf4f8b4e9b2c"
+	err = install()
+	require.Error(t, err)
+	assert.Contains(t, errors.Cause(err).Error(), "file to replace has changed")
+
+	inst.meta.PreviousChecksum = meta.PreviousChecksum
+	require.NoError(t, install())
+	// the destination is replaced only once the file is finalized
+	data, err := ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "old config", string(data))
+	require.NoError(t, inst.Finalize(inst.update))
+
+	data, err = ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "new config", string(data))
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+
+	// aborted file leaves the destination untouched
+	inst.meta.PreviousChecksum = ""
+	require.NoError(t, ioutil.WriteFile(update, []byte("broken"), 0600))
+	require.NoError(t, install())
+	require.NoError(t, inst.Abort(inst.update, errors.New("invalid checksum")))
+	data, err = ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "new config", string(data))
+	files, err := ioutil.ReadDir(filepath.Dir(dest))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// without root directory the file is only consumed
+	inst.Root = ""
+	require.NoError(t, install())
+	assert.NoError(t, inst.Finalize(inst.update))
+}
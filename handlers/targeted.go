@@ -0,0 +1,103 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// Targeted wraps the composer of the update installed only on the devices
+// of the given types; e.g. the sensors attached to the gateway the artifact
+// is deployed to. The device types are stored in the type-info of the
+// update as the artifact dependency.
+type Targeted struct {
+	Composer
+	DeviceTypes []string
+}
+
+// NewTargeted creates the update targeted at the given device types.
+func NewTargeted(c Composer, deviceTypes []string) *Targeted {
+	return &Targeted{
+		Composer:    c,
+		DeviceTypes: deviceTypes,
+	}
+}
+
+// ComposeHeader stores the header of the wrapped update adding the device
+// types to its type-info.
+func (t *Targeted) ComposeHeader(tw *tar.Writer, no int) error {
+	if len(t.DeviceTypes) == 0 {
+		return errors.New("update: no target device types")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	htw := tar.NewWriter(buf)
+	if err := t.Composer.ComposeHeader(htw, no); err != nil {
+		return err
+	}
+	if err := htw.Close(); err != nil {
+		return errors.Wrap(err, "update: can not compose header")
+	}
+
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "update: can not read composed header")
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return errors.Wrap(err, "update: can not read composed header")
+		}
+		if filepath.Base(hdr.Name) == "type-info" {
+			if data, err = t.addDeviceTypes(data); err != nil {
+				return err
+			}
+			hdr.Size = int64(len(data))
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "update: can not tar header")
+		}
+		if _, err = tw.Write(data); err != nil {
+			return errors.Wrap(err, "update: can not tar header")
+		}
+	}
+}
+
+func (t *Targeted) addDeviceTypes(data []byte) ([]byte, error) {
+	tInfo := new(artifact.TypeInfo)
+	if err := json.Unmarshal(data, tInfo); err != nil {
+		return nil, errors.Wrap(err, "update: can not parse type-info")
+	}
+	if tInfo.ArtifactDepends == nil {
+		tInfo.ArtifactDepends = make(map[string]interface{})
+	}
+	tInfo.ArtifactDepends[artifact.DeviceTypeDepends] = t.DeviceTypes
+	data, err := json.Marshal(tInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not create type-info")
+	}
+	return data, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargeted(t *testing.T) {
+	d := NewRootfsDelta("rootfs.ext4.delta", "abcd", RootfsDeltaMetaData{
+		TargetChecksum: "ef01", TargetSize: 1})
+	u := NewTargeted(d, []string{"sensor-a", "sensor-b"})
+	assert.Equal(t, RootfsDeltaType, u.GetType())
+	assert.Equal(t, d.GetUpdateFiles(), u.GetUpdateFiles())
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	require.NoError(t, u.ComposeHeader(tw, 0))
+	require.NoError(t, tw.Close())
+
+	var names []string
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, filepath.Base(hdr.Name))
+		if filepath.Base(hdr.Name) != "type-info" {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		tInfo := new(artifact.TypeInfo)
+		require.NoError(t, json.Unmarshal(data, tInfo))
+		// the existing dependencies are kept
+		assert.Equal(t, "abcd", tInfo.ArtifactDepends[RootfsImageChecksum])
+		assert.Equal(t, []string{"sensor-a", "sensor-b"}, tInfo.DeviceTypes())
+	}
+	assert.Equal(t, []string{"files", "type-info", "meta-data"}, names)
+
+	assert.Error(t, NewTargeted(d, nil).ComposeHeader(tar.NewWriter(ioutil.Discard), 0))
+}
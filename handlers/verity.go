@@ -0,0 +1,190 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// VeritySuffix is appended to the name of the image to get the name of
+	// the data file holding its hash tree.
+	VeritySuffix = ".verity"
+	// VerityBlockSize is the size of both data and hash blocks.
+	VerityBlockSize = 4096
+
+	verityVersion   = 1
+	verityAlgorithm = "sha256"
+	veritySaltSize  = 32
+)
+
+// Verity describes the dm-verity hash tree of the rootfs image. The hash
+// file uses the format of veritysetup, including the superblock, so the
+// device can be opened with `veritysetup open` using the root hash only.
+type Verity struct {
+	// HashFile is the name of the data file holding the hash tree.
+	HashFile      string `json:"hash_file"`
+	Version       int    `json:"version"`
+	Algorithm     string `json:"algorithm"`
+	DataBlockSize int    `json:"data_block_size"`
+	HashBlockSize int    `json:"hash_block_size"`
+	DataBlocks    uint64 `json:"data_blocks"`
+	// Salt and RootHash are hex encoded.
+	Salt     string `json:"salt"`
+	RootHash string `json:"root_hash"`
+}
+
+// Validate checks if the hash tree parameters are supported.
+func (v *Verity) Validate() error {
+	if v.HashFile == "" || v.Version != verityVersion ||
+		v.Algorithm != verityAlgorithm || v.DataBlocks == 0 ||
+		v.DataBlockSize != VerityBlockSize || v.HashBlockSize != VerityBlockSize {
+		return errors.New("update: unsupported dm-verity parameters")
+	}
+	if _, err := hex.DecodeString(v.Salt); err != nil {
+		return errors.Wrap(err, "update: invalid dm-verity salt")
+	}
+	if _, err := hex.DecodeString(v.RootHash); err != nil {
+		return errors.Wrap(err, "update: invalid dm-verity root hash")
+	}
+	return nil
+}
+
+// GenerateVerity calculates the dm-verity hash tree of the image using
+// random salt and stores it in hashFile.
+func GenerateVerity(image, hashFile string) (*Verity, error) {
+	salt := make([]byte, veritySaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errors.Wrap(err, "update: can not generate dm-verity salt")
+	}
+	return generateVerity(image, hashFile, salt)
+}
+
+func generateVerity(image, hashFile string, salt []byte) (*Verity, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open image: %s", image)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not open image: %s", image)
+	}
+	if info.Size() == 0 || info.Size()%VerityBlockSize != 0 {
+		return nil, errors.Errorf("update: size of the image is not a multiple "+
+			"of dm-verity block size: %d", info.Size())
+	}
+	dataBlocks := uint64(info.Size() / VerityBlockSize)
+
+	// the first level hashes the data blocks; each next level hashes the
+	// blocks of the previous one until a single block is left
+	hashes, err := hashBlocks(bufio.NewReader(f), dataBlocks, salt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update: can not read image: %s", image)
+	}
+	var levels [][]byte
+	for len(hashes) > sha256.Size {
+		level := packHashes(hashes)
+		levels = append(levels, level)
+		hashes, err = hashBlocks(bytes.NewReader(level),
+			uint64(len(level)/VerityBlockSize), salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v := &Verity{
+		Version:       verityVersion,
+		Algorithm:     verityAlgorithm,
+		DataBlockSize: VerityBlockSize,
+		HashBlockSize: VerityBlockSize,
+		DataBlocks:    dataBlocks,
+		Salt:          hex.EncodeToString(salt),
+		RootHash:      hex.EncodeToString(hashes),
+	}
+
+	out, err := os.Create(hashFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "update: can not create dm-verity hash file")
+	}
+	defer out.Close()
+
+	// the superblock comes first followed by the levels from the top one
+	w := bufio.NewWriter(out)
+	w.Write(v.superblock(salt))
+	for i := len(levels) - 1; i >= 0; i-- {
+		w.Write(levels[i])
+	}
+	if err = w.Flush(); err != nil {
+		return nil, errors.Wrap(err, "update: can not write dm-verity hash file")
+	}
+	return v, nil
+}
+
+// hashBlocks returns the concatenated salted hashes of all the blocks.
+func hashBlocks(r io.Reader, blocks uint64, salt []byte) ([]byte, error) {
+	hashes := make([]byte, 0, blocks*sha256.Size)
+	block := make([]byte, VerityBlockSize)
+	for i := uint64(0); i < blocks; i++ {
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		h.Write(salt)
+		h.Write(block)
+		hashes = h.Sum(hashes)
+	}
+	return hashes, nil
+}
+
+// packHashes stores the hashes in hash blocks padded with zeros.
+func packHashes(hashes []byte) []byte {
+	size := (len(hashes) + VerityBlockSize - 1) / VerityBlockSize * VerityBlockSize
+	level := make([]byte, size)
+	copy(level, hashes)
+	return level
+}
+
+// superblock encodes the veritysetup superblock padded to the hash block.
+func (v *Verity) superblock(salt []byte) []byte {
+	sb := make([]byte, VerityBlockSize)
+	copy(sb, "verity")
+	le := binary.LittleEndian
+	le.PutUint32(sb[8:], verityVersion)
+	// hash type 1 is the regular (not Chrome OS) format
+	le.PutUint32(sb[12:], 1)
+	// random UUID identifying the hash device
+	uuid := sb[16:32]
+	rand.Read(uuid)
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	copy(sb[32:64], v.Algorithm)
+	le.PutUint32(sb[64:], uint32(v.DataBlockSize))
+	le.PutUint32(sb[68:], uint32(v.HashBlockSize))
+	le.PutUint64(sb[72:], v.DataBlocks)
+	le.PutUint16(sb[80:], uint16(len(salt)))
+	copy(sb[88:], salt)
+	return sb
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func saltedHash(salt, block []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+func TestGenerateVerity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b0 := bytes.Repeat([]byte{'a'}, VerityBlockSize)
+	b1 := bytes.Repeat([]byte{'b'}, VerityBlockSize)
+	image := filepath.Join(dir, "rootfs.ext4")
+	require.NoError(t, ioutil.WriteFile(image, append(b0, b1...), 0644))
+	salt := bytes.Repeat([]byte{0x5a}, veritySaltSize)
+
+	hashFile := image + VeritySuffix
+	v, err := generateVerity(image, hashFile, salt)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), v.DataBlocks)
+	assert.Equal(t, hex.EncodeToString(salt), v.Salt)
+
+	level := make([]byte, VerityBlockSize)
+	copy(level, saltedHash(salt, b0))
+	copy(level[sha256.Size:], saltedHash(salt, b1))
+	assert.Equal(t, hex.EncodeToString(saltedHash(salt, level)), v.RootHash)
+
+	tree, err := ioutil.ReadFile(hashFile)
+	require.NoError(t, err)
+	require.Len(t, tree, 2*VerityBlockSize)
+	sb := tree[:VerityBlockSize]
+	assert.Equal(t, []byte("verity\x00\x00"), sb[:8])
+	assert.Equal(t, "sha256", string(bytes.TrimRight(sb[32:64], "\x00")))
+	assert.Equal(t, uint64(2), binary.LittleEndian.Uint64(sb[72:]))
+	assert.Equal(t, salt, sb[88:88+veritySaltSize])
+	assert.Equal(t, level, tree[VerityBlockSize:])
+
+	v.HashFile = filepath.Base(hashFile)
+	assert.NoError(t, v.Validate())
+
+	// single block has no hash levels
+	require.NoError(t, ioutil.WriteFile(image, b0, 0644))
+	v, err = generateVerity(image, hashFile, salt)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(saltedHash(salt, b0)), v.RootHash)
+
+	// image must be aligned to the block size
+	require.NoError(t, ioutil.WriteFile(image, []byte("image"), 0644))
+	_, err = GenerateVerity(image, hashFile)
+	assert.Error(t, err)
+	_, err = GenerateVerity(filepath.Join(dir, "missing"), hashFile)
+	assert.Error(t, err)
+}
+
+func TestRootfsVerity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verity")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "rootfs.ext4")
+	require.NoError(t, ioutil.WriteFile(image, make([]byte, 3*VerityBlockSize), 0644))
+	v, err := GenerateVerity(image, image+VeritySuffix)
+	require.NoError(t, err)
+
+	r := NewRootfsV2(image)
+	assert.Error(t, r.SetVerity(filepath.Join(dir, "other.verity"), v))
+	require.NoError(t, r.SetVerity(image+VeritySuffix, v))
+	require.Len(t, r.GetUpdateFiles(), 2)
+	assert.Equal(t, "rootfs.ext4.verity", r.GetVerity().HashFile)
+
+	// verity is not supported by version 1 artifacts
+	r1 := NewRootfsV1(image)
+	require.NoError(t, r1.SetVerity(image+VeritySuffix, v))
+	assert.Error(t, r1.ComposeHeader(nil, 0))
+
+	// reading the meta-data
+	inst := NewRootfsInstaller()
+	files := `{"files": ["rootfs.ext4", "rootfs.ext4.verity"]}`
+	require.NoError(t, inst.ReadHeader(bytes.NewBufferString(files), "headers/0000/files"))
+	assert.Error(t, inst.ReadHeader(bytes.NewBufferString("{"), "headers/0000/meta-data"))
+	md := `{"dm_verity": {"hash_file": "rootfs.ext4.verity", "version": 1, ` +
+		`"algorithm": "sha256", "data_block_size": 4096, "hash_block_size": 4096, ` +
+		`"data_blocks": 3, "salt": "` + v.Salt + `", "root_hash": "` + v.RootHash + `"}}`
+	require.NoError(t, inst.ReadHeader(bytes.NewBufferString(md), "headers/0000/meta-data"))
+	assert.Equal(t, v, inst.GetVerity())
+
+	inst = NewRootfsInstaller()
+	require.NoError(t, inst.ReadHeader(bytes.NewBufferString(`{"files": ["rootfs.ext4"]}`),
+		"headers/0000/files"))
+	assert.Error(t, inst.ReadHeader(bytes.NewBufferString(md), "headers/0000/meta-data"))
+}